@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --- Admin endpoints ---
+
+// adminTokenFromRequest extracts the token from "Authorization: Bearer <token>" or "X-Admin-Token"
+func adminTokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("X-Admin-Token")
+}
+
+// isAdminRequest reports whether the request carries the configured ADMIN_TOKEN
+func isAdminRequest(r *http.Request) bool {
+	token := getEnv("ADMIN_TOKEN", "")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(adminTokenFromRequest(r)), []byte(token)) == 1
+}
+
+// requireAdmin guards an endpoint with ADMIN_TOKEN. Admin endpoints are disabled while no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getEnv("ADMIN_TOKEN", "") == "" {
+			http.Error(w, "Admin API disabled (no ADMIN_TOKEN configured)", http.StatusForbidden)
+			return
+		}
+		if !isAdminRequest(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// adminSyncApplyHandler applies a SyncResponse body exactly as doSync would, for testing and air-gapped seeding
+func adminSyncApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var syncData SyncResponse
+	if err := json.NewDecoder(r.Body).Decode(&syncData); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if syncData.Action != "UPDATE_DELTA" && syncData.Action != "RESET_DB" {
+		http.Error(w, "Action must be 'UPDATE_DELTA' or 'RESET_DB'", http.StatusBadRequest)
+		return
+	}
+
+	if err := applySyncResponse(syncData); err != nil {
+		http.Error(w, "Redis error", http.StatusInternalServerError)
+		return
+	}
+
+	bands := 0
+	for _, op := range syncData.Ops {
+		bands += len(op.Bands)
+	}
+	log.Printf("[Mailuminati] Admin sync applied: %s (new_seq: %d, bands: %d)", syncData.Action, syncData.NewSeq, bands)
+
+	status := "applied"
+	if syncData.Action == "RESET_DB" {
+		status = "reset_started" // Runs in the background
+	}
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"status":  status,
+		"action":  syncData.Action,
+		"new_seq": syncData.NewSeq,
+		"bands":   bands,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
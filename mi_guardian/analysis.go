@@ -1,21 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
+	"log"
+	"math"
 	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/glaslos/tlsh"
+	"github.com/go-redis/redis/v8"
 	"github.com/jhillyerd/enmime"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // --- Internal TLSH logic ---
@@ -39,21 +43,16 @@ func extractDomain(email string) string {
 // isWhitelisted checks if sender domain or email is whitelisted
 func isWhitelisted(fromHeader string) (bool, string) {
 	domain := extractDomain(fromHeader)
-	email := strings.ToLower(fromHeader)
-
-	// Extract just the email if in "Name <email>" format
-	if idx := strings.Index(email, "<"); idx != -1 {
-		email = email[idx+1:]
-		if idx := strings.Index(email, ">"); idx != -1 {
-			email = email[:idx]
-		}
-	}
+	email := senderEmail(fromHeader)
 
 	// Check domain whitelist
 	if domain != "" {
 		if rdb.SIsMember(ctx, "mi:whitelist:domain", domain).Val() {
 			return true, "domain:" + domain
 		}
+		if isAutoWhitelisted(domain) {
+			return true, "auto_domain:" + domain
+		}
 	}
 
 	// Check email whitelist
@@ -66,6 +65,24 @@ func isWhitelisted(fromHeader string) (bool, string) {
 	return false, ""
 }
 
+// isRedundantRaw reports whether the raw signature is within REDUNDANT_RAW_DISTANCE of the normalized one
+func isRedundantRaw(normalizedSig, rawSig string) bool {
+	maxDist := atomic.LoadInt64(&redundantRawDistance)
+	if maxDist < 0 {
+		return false
+	}
+	dist, err := computeDistance(normalizedSig, rawSig, true, 0)
+	return err == nil && int64(dist) <= maxDist
+}
+
+// markRawRedundant tags the normalized signature as standing in for the skipped raw one
+func markRawRedundant(normalized *TypedSignature, dryRun bool) {
+	normalized.CoversRaw = true
+	if !dryRun {
+		promRedundantRawSkipped.Inc()
+	}
+}
+
 // getThresholdForType returns the distance threshold for a given signature type
 func getThresholdForType(sigType SignatureType) int {
 	switch sigType {
@@ -79,13 +96,164 @@ func getThresholdForType(sigType SignatureType) int {
 		return int(thresholdSubject)
 	case SigAttachment:
 		return int(thresholdAttachment)
+	case SigCombined:
+		return int(thresholdCombined)
+	case SigStructure:
+		return int(thresholdStructure)
 	default:
 		return 70
 	}
 }
 
+// getMinLengthForType returns the content length a signature of this type requires
+// (MIN_LENGTH_<TYPE>): shorter content is not hashed. For image attachments, see getMinVisualSize.
+func getMinLengthForType(sigType SignatureType) int {
+	switch sigType {
+	case SigNormalized:
+		return int(atomic.LoadInt64(&minLengthNormalized))
+	case SigRaw:
+		return int(atomic.LoadInt64(&minLengthRaw))
+	case SigURL:
+		return int(atomic.LoadInt64(&minLengthURL))
+	case SigSubject:
+		return int(atomic.LoadInt64(&minLengthSubject))
+	case SigAttachment:
+		return int(atomic.LoadInt64(&minLengthAttachment))
+	case SigCombined:
+		return int(atomic.LoadInt64(&minLengthCombined))
+	case SigStructure:
+		return int(atomic.LoadInt64(&minLengthStructure))
+	default:
+		return int(atomic.LoadInt64(&minLengthNormalized))
+	}
+}
+
+// getMinVisualSize returns the size an image attachment requires to be hashed (MIN_VISUAL_SIZE)
+func getMinVisualSize() int {
+	return int(atomic.LoadInt64(&minVisualSize))
+}
+
+// getQuorumForType returns how many LSH bands must match before a signature of this type is compared
+func getQuorumForType(sigType SignatureType) int {
+	var q int64
+	switch sigType {
+	case SigNormalized:
+		q = atomic.LoadInt64(&quorumNormalized)
+	case SigRaw:
+		q = atomic.LoadInt64(&quorumRaw)
+	case SigURL:
+		q = atomic.LoadInt64(&quorumURL)
+	case SigSubject:
+		q = atomic.LoadInt64(&quorumSubject)
+	case SigAttachment:
+		q = atomic.LoadInt64(&quorumAttachment)
+	case SigCombined:
+		q = atomic.LoadInt64(&quorumCombined)
+	case SigStructure:
+		q = atomic.LoadInt64(&quorumStructure)
+	}
+	if q <= 0 {
+		q = atomic.LoadInt64(&bandQuorum)
+	}
+	return int(q)
+}
+
+// getRetentionForType returns the local learning retention for a signature type
+// (RETENTION_DAYS_<TYPE>, falling back to LOCAL_RETENTION_DAYS)
+func getRetentionForType(sigType SignatureType) time.Duration {
+	var days int64
+	switch sigType {
+	case SigNormalized:
+		days = atomic.LoadInt64(&retentionDaysNormalized)
+	case SigRaw:
+		days = atomic.LoadInt64(&retentionDaysRaw)
+	case SigURL:
+		days = atomic.LoadInt64(&retentionDaysURL)
+	case SigSubject:
+		days = atomic.LoadInt64(&retentionDaysSubject)
+	case SigAttachment:
+		days = atomic.LoadInt64(&retentionDaysAttachment)
+	case SigCombined:
+		days = atomic.LoadInt64(&retentionDaysCombined)
+	case SigStructure:
+		days = atomic.LoadInt64(&retentionDaysStructure)
+	}
+	if days <= 0 {
+		return localRetentionDuration
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// thresholdProfile is the set of distance thresholds applied to one message
+type thresholdProfile struct {
+	Name      string
+	Bonus     int // Added to every per-type threshold (negative tightens them, down to 0)
+	SoftDelta int
+	Overrides map[SignatureType]int // Per-request thresholds, used as-is
+
+	SourceSoftDelta map[string]int // Soft delta per verdict source (SOFT_SPAM_DELTA_<SOURCE>), over SoftDelta
+}
+
+func (p thresholdProfile) threshold(sigType SignatureType) int {
+	if t, ok := p.Overrides[sigType]; ok {
+		return t
+	}
+	return max(getThresholdForType(sigType)+p.Bonus, 0)
+}
+
+// softThreshold returns the soft_spam distance of a signature type for a verdict source
+func (p thresholdProfile) softThreshold(sigType SignatureType, source string) int {
+	if delta, ok := p.SourceSoftDelta[source]; ok {
+		return p.threshold(sigType) + delta
+	}
+	return p.threshold(sigType) + p.SoftDelta
+}
+
+func defaultProfile() thresholdProfile {
+	return thresholdProfile{Name: "default", SoftDelta: int(softSpamDelta), SourceSoftDelta: sourceSoftDeltas()}
+}
+
+// deepScanProfile tightens every threshold by DEEP_SCAN_THRESHOLD_BONUS: only close variants
+// of known spam match, and a threshold never goes below 0 (identical signatures only)
+func deepScanProfile() thresholdProfile {
+	p := defaultProfile()
+	p.Name = "deep_scan"
+	p.Bonus = -int(atomic.LoadInt64(&deepScanBonus))
+	return p
+}
+
+// isDeepScanDomain checks the domain against DEEP_SCAN_DOMAINS.
+// Entries starting with "." are suffixes (".zip" covers every .zip domain), others match the domain and its subdomains.
+func isDeepScanDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	entries, _ := deepScanDomains.Load().([]string)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(domain, entry) {
+				return true
+			}
+		} else if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// profileForSender picks the threshold profile for a message based on its From header
+func profileForSender(fromHeader string) thresholdProfile {
+	if isDeepScanDomain(extractDomain(fromHeader)) {
+		return deepScanProfile()
+	}
+	return defaultProfile()
+}
+
 // getConfidenceForMatch calculates confidence based on distance and threshold
 func getConfidenceForMatch(distance int, threshold int) float64 {
+	if distance == 0 {
+		return 1.0 // Exact match, even under a threshold clamped to 0
+	}
 	if distance >= threshold {
 		return 0.0
 	}
@@ -106,6 +274,30 @@ func computeLocalTLSH(content string) (string, error) {
 	return "T1" + strings.ToUpper(goHashStruct.String()), nil
 }
 
+// exactBodySignature is the SHA-256 fallback signature for bodies TLSH cannot hash.
+// The "X1" prefix keeps it apart from TLSH signatures (it has no LSH bands).
+func exactBodySignature(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "X1" + strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// isTLSHSignature reports whether a stored signature is a TLSH hash (as opposed to an exact fallback)
+func isTLSHSignature(sig string) bool {
+	return strings.HasPrefix(sig, "T1")
+}
+
+// isValidTLSH reports whether sig is a well-formed TLSH digest
+func isValidTLSH(sig string) bool {
+	_, err := tlsh.ParseStringToTlsh(strings.TrimPrefix(sig, "T1"))
+	return isTLSHSignature(sig) && err == nil
+}
+
+// getBodyHashFailureAction returns BODY_HASH_FAILURE_ACTION: ignore, soft_spam or exact
+func getBodyHashFailureAction() string {
+	action, _ := bodyHashFailureAction.Load().(string)
+	return action
+}
+
 // computeDistance computes the distance between two hashes locally
 func computeDistance(d1, d2 string, includeLen bool, threshold int) (int, error) {
 	// Strip T1 prefix if present, as ParseStringToTlsh expects raw hex
@@ -116,18 +308,29 @@ func computeDistance(d1, d2 string, includeLen bool, threshold int) (int, error)
 	if err != nil {
 		return 0, err
 	}
+	if !includeLen {
+		d2 = withTLSHLength(d2, d1)
+	}
 	t2, err := tlsh.ParseStringToTlsh(d2)
 	if err != nil {
 		return 0, err
 	}
 
-	// Note: glaslos/tlsh Diff includes length.
-	// We ignore includeLen parameter as the library doesn't support excluding it easily without forking.
 	dist := t1.Diff(t2)
 
 	return dist, nil
 }
 
+// withTLSHLength returns digest with the length byte of ref. glaslos/tlsh Diff always
+// counts the length difference; diffing against a digest carrying the same length
+// byte leaves it out. Both digests are raw hex (without the T1 prefix).
+func withTLSHLength(digest, ref string) string {
+	if len(digest) < 4 || len(ref) < 4 {
+		return digest
+	}
+	return digest[:2] + ref[2:4] + digest[4:]
+}
+
 // computeDistanceBatch computes distances in batch (Batch)
 func computeDistanceBatch(ref string, digests []string, ids []string, includeLen bool) (map[string]int, error) {
 	if len(digests) != len(ids) {
@@ -143,6 +346,9 @@ func computeDistanceBatch(ref string, digests []string, ids []string, includeLen
 	results := make(map[string]int)
 	for i, digest := range digests {
 		d := strings.TrimPrefix(digest, "T1")
+		if !includeLen {
+			d = withTLSHLength(d, ref)
+		}
 		t, err := tlsh.ParseStringToTlsh(d)
 		if err != nil {
 			continue // Skip invalid hashes
@@ -186,26 +392,9 @@ func normalizeEmailBody(text, html string) string {
 	body := text + "\n\n" + html
 	body = strings.TrimSpace(body)
 
-	reImgSrc := regexp.MustCompile(`(?i)<img([^>]*?)src="[^"]*"([^>]*?)>`)
-	body = reImgSrc.ReplaceAllString(body, `<img${1}src="imgurl"${2}>`)
-
-	reHex8 := regexp.MustCompile(`[0-9a-fA-F]{8,}`)
-	body = reHex8.ReplaceAllString(body, "****")
-
-	reDigit6 := regexp.MustCompile(`\d{6,}`)
-	body = reDigit6.ReplaceAllString(body, "****")
-
-	reStyleAttr := regexp.MustCompile(`(?i)\s*style\s*=\s*"[^"]*"`)
-	body = reStyleAttr.ReplaceAllString(body, "")
-
-	reTrackers := regexp.MustCompile(`(?i)([?&])(utm_[^=&]+|gclid|fbclid|mc_eid|mc_cid)=[^&\s"'>]+`)
-	body = reTrackers.ReplaceAllString(body, "$1")
-
-	body = strings.ToLower(body)
-	reSpaces := regexp.MustCompile(`[ \t]+`)
-	body = reSpaces.ReplaceAllString(body, " ")
-	reNewlines := regexp.MustCompile(`\r?\n{2,}`)
-	body = reNewlines.ReplaceAllString(body, "\n\n")
+	for _, step := range currentNormalizeSteps() {
+		body = step.Apply(body)
+	}
 
 	return body
 }
@@ -231,7 +420,10 @@ func extractBands_6_3(sig string) []string {
 	return bands
 }
 
-func storeScanResult(env *enmime.Envelope, hashes []string) {
+// ScanRetention is how long scan results are stored, for /report and /signal
+const ScanRetention = 7 * 24 * time.Hour
+
+func storeScanResult(env *enmime.Envelope, hashes []string, types map[string]string, fingerprint, forwarded string) {
 	msgID := env.GetHeader("Message-ID")
 	if msgID == "" {
 		return
@@ -241,7 +433,8 @@ func storeScanResult(env *enmime.Envelope, hashes []string) {
 	hasher.Write([]byte(msgID))
 	sha1Hash := hex.EncodeToString(hasher.Sum(nil))
 
-	result := ScanResult{Hashes: hashes, Timestamp: time.Now().Unix()}
+	result := ScanResult{Hashes: hashes, Types: types, Timestamp: time.Now().Unix(), FromDomain: extractDomain(env.GetHeader("From")),
+		FromEmail: senderEmail(env.GetHeader("From")), Fingerprint: fingerprint, SchemaVersion: currentVerdictSchemaVersion(), Forwarded: forwarded}
 	resultBytes, _ := json.Marshal(result)
 
 	key := "mi:msgid:" + sha1Hash
@@ -251,68 +444,1073 @@ func storeScanResult(env *enmime.Envelope, hashes []string) {
 	opCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rdb.Set(opCtx, key, resultBytes, 7*24*time.Hour)
+	rdb.Set(opCtx, key, resultBytes, ScanRetention)
+}
+
+// storeUnscannedResult stores the scan of a message judged before its signature lookups,
+// with its normalized body signature, so that it can still be reported and learned
+func storeUnscannedResult(env *enmime.Envelope) {
+	body := analyzeBody(env.Text, env.HTML)
+	var hashes []string
+	types := map[string]string{}
+	fingerprint := ""
+	if len(body.Normalized) > getMinLengthForType(SigNormalized) {
+		fingerprint = body.Fingerprint
+		if body.SignatureErr == nil && body.Signature != "" {
+			hashes = append(hashes, body.Signature)
+			types[body.Signature] = SigNormalized.String()
+		}
+	}
+	storeScanResult(env, hashes, types, fingerprint, forwardedBlockSignature(env.Text, env.HTML))
+}
+
+// applyPartialMatch turns an oracle partial match (band quorum reached, oracle not confirming)
+// into soft_spam when PARTIAL_MATCH_ACTION=soft_spam. Confidence is the band-match ratio.
+func applyPartialMatch(res *AnalysisResult, matchCount, totalBands int, sigType SignatureType) {
+	if !partialMatchSoftSpam.Load() || totalBands == 0 || res.Action == "spam" {
+		return
+	}
+	confidence := float64(matchCount) / float64(totalBands)
+	if confidence > 1.0 {
+		confidence = 1.0
+	}
+	if res.Action == "soft_spam" && res.Confidence >= confidence {
+		return
+	}
+	*res = AnalysisResult{Action: "soft_spam", Label: "oracle_partial", ProximityMatch: true, Confidence: confidence, MatchType: sigType.String(),
+		ConfidenceBreakdown: &ConfidenceBreakdown{BandRatio: subSignal(confidence)}}
+}
+
+// oracleCachedAt returns when the oracle verdict for sig was cached (0 if unknown)
+func oracleCachedAt(sig string) int64 {
+	res, _ := cachedOracleVerdict("mi:oracle_cache:" + sig)
+	return res.CachedAt
+}
+
+// localLearnedAt returns when hash was first learned locally (0 if unknown)
+func localLearnedAt(hash string) int64 {
+	learnedAt, _ := rdb.Get(ctx, LocalLearnedPrefix+hash).Int64()
+	return learnedAt
+}
+
+// getSpamWeightForType returns the score added by a spam report on a signature of this type
+func getSpamWeightForType(sigType SignatureType) int64 {
+	if weights, ok := typeSpamWeights.Load().(map[SignatureType]int64); ok {
+		if w, ok := weights[sigType]; ok {
+			return w
+		}
+	}
+	return atomic.LoadInt64(&spamWeight)
+}
+
+// getHamWeightForType returns the score removed by a ham report on a signature of this type
+func getHamWeightForType(sigType SignatureType) int64 {
+	if weights, ok := typeHamWeights.Load().(map[SignatureType]int64); ok {
+		if w, ok := weights[sigType]; ok {
+			return w
+		}
+	}
+	return atomic.LoadInt64(&hamWeight)
+}
+
+// learnSpamHash adds weight to a hash's local spam score and (re)indexes its bands.
+// The first type a hash is learned as is kept and drives its retention.
+func learnSpamHash(targetHash string, weight int64, sigType SignatureType) int64 {
+	scoreKey := LocalScorePrefix + targetHash
+	newScore, _ := rdb.IncrBy(ctx, scoreKey, weight).Result()
+
+	typeKey := LocalTypePrefix + targetHash
+	if sigType != SigUnknown {
+		rdb.SetNX(ctx, typeKey, sigType.String(), 0)
+	}
+	retention := learnedRetention(targetHash)
+
+	// Refresh/Add bands
+	pipe := rdb.Pipeline()
+	var bandKeys []string
+	for _, band := range signatureBands(targetHash) {
+		key := LocalFragPrefix + band
+		pipe.SAdd(ctx, key, targetHash)
+		bandKeys = append(bandKeys, key)
+	}
+	pipe.Expire(ctx, scoreKey, retention)
+	pipe.SetNX(ctx, LocalLearnedPrefix+targetHash, time.Now().Unix(), retention)
+	pipe.Expire(ctx, LocalLearnedPrefix+targetHash, retention)
+	pipe.Expire(ctx, typeKey, retention)
+	pipe.Expire(ctx, LocalCampaignPrefix+targetHash, retention)
+	pipe.Expire(ctx, LocalSourcesPrefix+targetHash, retention)
+	recordReport(pipe, targetHash, weight, retention)
+	pipe.Exec(ctx)
+	extendBandTTLs(bandKeys, retention)
+	return newScore
+}
+
+// extendBandTTLs sets the TTL of band keys to ttl, unless they already live longer: bands are
+// shared by hashes of every type, so a refresh for one must not cut another's band short
+func extendBandTTLs(keys []string, ttl time.Duration) {
+	pipe := rdb.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.TTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return
+	}
+	pipe = rdb.Pipeline()
+	for i, key := range keys {
+		if ttls[i].Val() < ttl {
+			pipe.Expire(ctx, key, ttl)
+		}
+	}
+	pipe.Exec(ctx)
+}
+
+// learnedRetention returns the retention of a learned hash, based on its stored type and
+// capped by MAX_HASH_LIFETIME since it was first learned
+func learnedRetention(hash string) time.Duration {
+	name, _ := rdb.Get(ctx, LocalTypePrefix+hash).Result()
+	return capHashLifetime(getRetentionForType(parseSignatureType(name)), localLearnedAt(hash), time.Now())
+}
+
+// capHashLifetime caps a TTL refresh so that a hash expires at most MAX_HASH_LIFETIME after
+// it was first learned (learnedAt 0: learned now), however often it is refreshed
+func capHashLifetime(retention time.Duration, learnedAt int64, now time.Time) time.Duration {
+	maxLifetime := time.Duration(atomic.LoadInt64(&maxHashLifetime))
+	if maxLifetime <= 0 {
+		return retention
+	}
+	start := now
+	if learnedAt > 0 {
+		start = time.Unix(learnedAt, 0)
+	}
+	remaining := start.Add(maxLifetime).Sub(now)
+	if remaining < time.Second {
+		remaining = time.Second // Lifetime over: expire now (a 0 TTL would mean none for SETNX)
+	}
+	if remaining < retention {
+		return remaining
+	}
+	return retention
+}
+
+// meetsOracleCacheMinConfidence reports whether an oracle-cache proximity match is confident
+// enough for a spam verdict (ORACLE_CACHE_MIN_CONFIDENCE); weaker matches become soft_spam
+func meetsOracleCacheMinConfidence(confidence float64) bool {
+	return confidence >= float64(atomic.LoadInt64(&oracleCacheMinConfidence))/100
+}
+
+// shouldPromoteOracleCacheMatch decides whether an oracle-cache proximity match is strong enough to learn locally
+func shouldPromoteOracleCacheMatch(confidence float64) bool {
+	return promoteOracleCache.Load() && confidence >= float64(atomic.LoadInt64(&promoteMinConfidence))/100
+}
+
+// promoteOracleCacheMatch learns sig locally with a modest score, so the variant keeps matching
+// once the short-lived oracle cache entry has expired. Hashes already known locally are left alone.
+func promoteOracleCacheMatch(sig string, sigType SignatureType) {
+	if n, err := rdb.Exists(ctx, LocalScorePrefix+sig).Result(); err != nil || n > 0 {
+		return
+	}
+	score := learnSpamHash(sig, atomic.LoadInt64(&promoteScore), sigType)
+	recordReportSources([]string{sig}, ReportSourceSystem)
+	promOracleCachePromotions.Inc()
+	log.Printf("[Mailuminati] Promoted oracle cache match to local learning: %s (Score: %d)", sig, score)
+}
+
+// oracleSoftVerdict fills in what an oracle soft_spam verdict may leave out
+func oracleSoftVerdict(res AnalysisResult, sigType SignatureType) AnalysisResult {
+	res.ProximityMatch = true
+	if res.Label == "" {
+		res.Label = "oracle_soft"
+	}
+	if res.Confidence <= 0 {
+		res.Confidence = heuristicSoftConfidence
+	}
+	if res.MatchType == "" {
+		res.MatchType = sigType.String()
+	}
+	return res
 }
 
-func callOracleDecision(sig string) AnalysisResult {
+// oracleDecisionForContent reads the oracle verdict through a cache keyed by content
+// fingerprint, so the other signatures of the same content (and later copies of it)
+// reuse the first spam verdict instead of calling the oracle again. Other verdicts are
+// not shared: a signature type the oracle doesn't flag says nothing of the other types.
+func oracleDecisionForContent(reqCtx context.Context, fingerprint, sig string) AnalysisResult {
+	if fingerprint == "" {
+		return callOracleDecision(reqCtx, sig)
+	}
+	fpKey := OracleFingerprintPrefix + fingerprint
+	if res, ok := cachedOracleVerdict(fpKey); ok && res.Action == "spam" {
+		if !isDryRun(reqCtx) {
+			promOracleFingerprintHits.Inc()
+		}
+		return res
+	}
+
+	res := callOracleDecision(reqCtx, sig)
+	if res.Action != "spam" || isDryRun(reqCtx) {
+		return res
+	}
+
+	// Mirror the exact-signature cache entry, which only exists for real oracle answers
+	pipe := rdb.Pipeline()
+	get := pipe.Get(ctx, "mi:oracle_cache:"+sig)
+	ttl := pipe.PTTL(ctx, "mi:oracle_cache:"+sig)
+	pipe.Exec(ctx)
+	if get.Err() == nil && ttl.Val() > 0 {
+		rdb.Set(ctx, fpKey, get.Val(), ttl.Val())
+	}
+	return res
+}
+
+func callOracleDecision(reqCtx context.Context, sig string) AnalysisResult {
+	reqCtx, span := tracer.Start(reqCtx, "oracle", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	dryRun := isDryRun(reqCtx)
 	cacheKey := "mi:oracle_cache:" + sig
-	if cached, err := rdb.Get(ctx, cacheKey).Result(); err == nil {
-		var res AnalysisResult
-		if json.Unmarshal([]byte(cached), &res) == nil {
-			if res.Action == "spam" {
-				atomic.AddInt64(&cachedPositiveCount, 1)
-				promCacheHits.WithLabelValues("positive").Inc()
-			} else {
-				atomic.AddInt64(&cachedNegativeCount, 1)
-				promCacheHits.WithLabelValues("negative").Inc()
-			}
+	if res, ok := cachedOracleVerdict(cacheKey); ok {
+		span.SetAttributes(attribute.Bool("mailuminati.cached", true))
+		if dryRun {
 			return res
 		}
+		if res.Action == "spam" {
+			atomic.AddInt64(&cachedPositiveCount, 1)
+			promCacheHits.WithLabelValues("positive").Inc()
+		} else {
+			atomic.AddInt64(&cachedNegativeCount, 1)
+			promCacheHits.WithLabelValues("negative").Inc()
+		}
+		return res
 	}
 
-	payload, _ := json.Marshal(map[string]string{
-		"node_id":         nodeID,
-		"email_body_hash": sig,
-	})
-
-	client := &http.Client{Timeout: 4 * time.Second}
-	resp, err := client.Post(oracleURL+"/analyze", "application/json", bytes.NewBuffer(payload))
-	if err != nil {
+	// Known oracle downtime: rely on local learning instead of waiting for a timeout
+	if skipOracleCall("analyze") {
+		span.SetAttributes(attribute.Bool("mailuminati.maintenance", true))
 		return AnalysisResult{Action: "allow", ProximityMatch: true}
 	}
-	defer resp.Body.Close()
 
-	var res struct {
-		Result AnalysisResult `json:"result"`
+	var result AnalysisResult
+	for attempt := int64(0); ; attempt++ {
+		var malformed string
+		var err error
+		result, malformed, err = queryOracle(reqCtx, sig)
+		if err != nil {
+			span.RecordError(err)
+			return AnalysisResult{Action: "allow", ProximityMatch: true}
+		}
+		if malformed == "" {
+			break
+		}
+		if !dryRun {
+			promOracleMalformed.WithLabelValues(malformed).Inc()
+		}
+		span.SetAttributes(attribute.String("mailuminati.malformed", malformed))
+		log.Printf("[Mailuminati] Malformed oracle response (%s) for signature: %s (attempt %d)", malformed, sig, attempt+1)
+		if attempt >= atomic.LoadInt64(&oracleMalformedRetries) || reqCtx.Err() != nil {
+			return malformedOracleVerdict(sig) // Out of retries, or past the request deadline
+		}
 	}
-	json.NewDecoder(resp.Body).Decode(&res)
 
-	if res.Result.Action != "" {
+	if result.Action != "" && dryRun {
+		return result // Not cached: a dry run leaves no trace
+	}
+	if result.Action != "" {
 		cacheDuration := 5 * time.Minute
-		if res.Result.Action == "spam" {
+		// Stamp the cached copy so later hits can report how old the verdict is
+		cachedResult := result
+		cachedResult.CachedAt = time.Now().Unix()
+		cachedResult.SchemaVersion = currentVerdictSchemaVersion()
+		if result.Action == "spam" {
 			// For SPAM: Store exactly like local learns (LSH bands) + Exact Cache
-			cacheDuration = 1 * time.Hour
-
-			// 1. Exact Cache (Fast path)
-			data, _ := json.Marshal(res.Result)
+			cacheOracleSpam(sig, cachedResult, oracleSpamCacheDuration)
+		} else {
+			// For HAM/Others (soft_spam included): Store only exact cache, short TTL
+			data, _ := json.Marshal(cachedResult)
 			rdb.Set(ctx, cacheKey, data, cacheDuration)
+		}
+		rememberOracleVerdict(sig, cachedResult)
+		return result
+	}
 
-			// 2. LSH Bands (Proximity path)
-			bands := extractBands_6_3(sig)
-			pipe := rdb.Pipeline()
-			for _, band := range bands {
-				key := OracleCacheFragPrefix + band
-				pipe.SAdd(ctx, key, sig)
-				pipe.Expire(ctx, key, cacheDuration)
+	return AnalysisResult{Action: "allow", ProximityMatch: true}
+}
+
+// cacheOracleSpam caches an oracle spam verdict for sig: the exact entry (fast path) and
+// the signature's bands in oc_f: (proximity path), both for ttl
+func cacheOracleSpam(sig string, res AnalysisResult, ttl time.Duration) {
+	data, _ := json.Marshal(res)
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, "mi:oracle_cache:"+sig, data, ttl)
+	for _, band := range signatureBands(sig) {
+		key := OracleCacheFragPrefix + band
+		pipe.SAdd(ctx, key, sig)
+		pipe.Expire(ctx, key, ttl)
+	}
+	pipe.Exec(ctx)
+}
+
+type dryRunKey struct{}
+
+// withDryRun marks a scan as a dry run (/explain): the verdict is computed as /analyze would,
+// but the scan is not stored, counted, learned from nor tracked
+func withDryRun(reqCtx context.Context) context.Context {
+	return context.WithValue(reqCtx, dryRunKey{}, true)
+}
+
+// isDryRun reports whether the scan of this request must have no side effects
+func isDryRun(reqCtx context.Context) bool {
+	dryRun, _ := reqCtx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// analyzeEnvelope runs the full scan pipeline (whitelist, signatures, lookups) on a parsed message
+func analyzeEnvelope(reqCtx context.Context, env *enmime.Envelope) scanOutcome {
+	mode := currentMode()
+	if mode == ModeAllowAll {
+		return scanOutcome{Result: AnalysisResult{Action: "allow", Label: ModeAllowAll, ReasonCode: ReasonModeAllowAll, SchemaVersion: currentVerdictSchemaVersion()}}
+	}
+	outcome := scanEnvelope(reqCtx, env)
+	applySpamMinConfidence(&outcome.Result, env.GetHeader("Message-ID"))
+	applySpamminessScore(&outcome, extractDomain(env.GetHeader("From")), env.GetHeader("Message-ID"))
+	if mode == ModeScanOnly && !outcome.Whitelisted {
+		applyScanOnly(&outcome.Result, env.GetHeader("Message-ID"))
+	}
+	outcome.Result.ReasonCode = reasonCodeFor(outcome.Result)
+	outcome.Result.UserMessage = userMessageFor(outcome.Result)
+	outcome.Result.SchemaVersion = currentVerdictSchemaVersion()
+	if isDryRun(reqCtx) {
+		return outcome
+	}
+	if outcome.Result.Action == "spam" {
+		recordSpamDomain(extractDomain(env.GetHeader("From")))
+	}
+	sampleHam(outcome)
+	return outcome
+}
+
+// attachmentOracleCapped reports (and counts) an attachment signature denied an oracle call
+// because the message already used its MAX_ATTACHMENT_ORACLE_CALLS; otherwise the call is counted
+func (s *signatureScan) attachmentOracleCapped(sigType SignatureType) bool {
+	if sigType != SigAttachment {
+		return false
+	}
+	limit := int(atomic.LoadInt64(&maxAttachmentOracleCalls))
+	if limit > 0 && s.AttachmentOracleCalls >= limit {
+		if !s.DryRun {
+			promAttachmentOracleCapped.Inc()
+		}
+		return true
+	}
+	s.AttachmentOracleCalls++
+	return false
+}
+
+// oracleLocalOnly reports whether signatures of this type are judged on local learning only
+// (ORACLE_LOCAL_ONLY_TYPES): the oracle is not consulted on their band matches
+func oracleLocalOnly(sigType SignatureType) bool {
+	types, _ := oracleLocalOnlyTypes.Load().(map[SignatureType]bool)
+	return types[sigType]
+}
+
+// softLabels names the soft counterpart of spam labels demoted by SPAM_MIN_CONFIDENCE
+var softLabels = map[string]string{
+	"local_spam":         "local_soft",
+	"oracle_cache_match": "oracle_cache_soft",
+}
+
+// applySpamMinConfidence demotes spam verdicts whose confidence is below SPAM_MIN_CONFIDENCE
+// to soft_spam, whatever the distance. Verdicts without a confidence (e.g. an oracle spam
+// that didn't report one) are left alone.
+func applySpamMinConfidence(res *AnalysisResult, messageID string) {
+	minConfidence := float64(atomic.LoadInt64(&spamMinConfidence)) / 100
+	if res.Action != "spam" || res.Confidence <= 0 || res.Confidence >= minConfidence {
+		return
+	}
+	log.Printf("[Mailuminati] Spam verdict demoted to soft_spam (confidence %.2f < %.2f) | Message-ID: %s", res.Confidence, minConfidence, messageID)
+	res.Action = "soft_spam"
+	if soft, ok := softLabels[res.Label]; ok {
+		res.Label = soft
+	}
+}
+
+// scanEnvelope computes the verdict; analyzeEnvelope adds the reason code
+func scanEnvelope(reqCtx context.Context, env *enmime.Envelope) scanOutcome {
+	typedSignatures := []TypedSignature{}
+	signatures := []string{} // Keep for backward compatibility
+
+	// get the message-id and subject for logging
+	messageID := env.GetHeader("Message-ID")
+	subject := env.GetHeader("Subject")
+	fromHeader := env.GetHeader("From")
+	dryRun := isDryRun(reqCtx)
+	facts := messageFacts{FromDomain: extractDomain(fromHeader)}
+	if dryRun {
+		facts.DomainFirstSeen = domainFirstSeen(facts.FromDomain)
+	} else {
+		facts.DomainFirstSeen = touchDomainFirstSeen(facts.FromDomain)
+	}
+	facts.AltPartDistance = -1
+
+	// Check sender lists first; a sender on both is settled by LIST_CONFLICT_POLICY
+	whitelisted, reason := isWhitelisted(fromHeader)
+	if blacklisted, blReason := isBlacklisted(fromHeader); blacklisted && (!whitelisted || blacklistWins(fromHeader, blReason)) {
+		log.Printf("[Mailuminati] Blacklisted sender: %s | Reason: %s | Message-ID: %s", fromHeader, blReason, messageID)
+		return scanOutcome{
+			Result:          AnalysisResult{Action: "spam", Label: "blacklisted", Confidence: 1.0},
+			BlacklistReason: blReason,
+		}
+	}
+	if whitelisted {
+		log.Printf("[Mailuminati] Whitelisted sender: %s | Reason: %s | Message-ID: %s", fromHeader, reason, messageID)
+		return scanOutcome{
+			Result:          AnalysisResult{Action: "allow", Label: "whitelisted"},
+			Whitelisted:     true,
+			WhitelistReason: reason,
+		}
+	}
+
+	// Spam traps are scanned and stored for learning, but never blocked nor confirmed by the oracle
+	trap, isTrap := spamTrapRecipient(env)
+
+	// Messages missing required headers can be judged without scanning
+	if action := getMissingHeadersAction(); action != "scan" && !isTrap {
+		if missing := missingHeaders(env); len(missing) > 0 {
+			sig := heuristicSignal{Label: "missing_headers", Detail: strings.Join(missing, ", ")}
+			log.Printf("[Mailuminati] Missing required headers (%s) | Message-ID: %s", sig.Detail, messageID)
+			confidence := math.Min(1.0, heuristicSoftConfidence*heuristicWeight("missing_headers"))
+			if action == "spam" {
+				confidence = 1.0
+			}
+			if !dryRun {
+				go storeUnscannedResult(env)
+			}
+			return scanOutcome{
+				Result:     AnalysisResult{Action: action, Label: "missing_headers", Confidence: confidence},
+				Heuristics: []heuristicSignal{sig},
+			}
+		}
+	}
+
+	// Exact known-bad attachments need no similarity search
+	if badAttachmentCheck.Load() && !isTrap {
+		if name, hash, found := knownBadAttachment(env); found {
+			log.Printf("[Mailuminati] Known bad attachment '%s' (sha256 %s) | Message-ID: %s", name, hash, messageID)
+			if !dryRun {
+				promBadAttachmentHits.Inc()
+				go storeUnscannedResult(env)
+			}
+			return scanOutcome{Result: AnalysisResult{Action: "spam", Label: "known_bad_attachment", Confidence: 1.0, MatchType: SigAttachment.String()}}
+		}
+	}
+
+	// Executables and scripts are dangerous whatever their content: spam needs no scan, soft_spam is a heuristic
+	if !isTrap {
+		if sig, found := scanDangerousAttachment(env, messageID); found {
+			if getDangerousAttachmentAction() == "spam" {
+				if !dryRun {
+					go storeUnscannedResult(env)
+				}
+				return scanOutcome{
+					Result:     AnalysisResult{Action: "spam", Label: "dangerous_attachment", Confidence: 1.0, MatchType: SigAttachment.String()},
+					Heuristics: []heuristicSignal{sig},
+				}
+			}
+			facts.DangerousAttachment = &sig
+		}
+	}
+
+	// Senders on the deep-scan list get the strict profile
+	profile := applyThresholdOverrides(reqCtx, profileForSender(fromHeader))
+
+	minLen := getMinLengthForType(SigNormalized)
+
+	_, normalizeSpan := tracer.Start(reqCtx, "normalize")
+	failed := make(map[string]int) // Signatures that could not be computed, by type
+
+	// 1. Analyze text body (Standard strategy) - Normalized
+	body := analyzeBody(env.Text, env.HTML)
+	combinedBody := body.Normalized
+	if heuristicEnabled("altpart_mismatch") {
+		facts.AltPartDistance = altPartDistance(env)
+	}
+	if heuristicEnabled("date_anomaly") {
+		facts.Date = inspectDateHeader(env, time.Now(), time.Duration(atomic.LoadInt64(&dateMaxFutureSkew)), time.Duration(atomic.LoadInt64(&dateMaxAge)))
+	}
+	fingerprint := body.Fingerprint
+	// Oracle verdicts are shared by fingerprint only for bodies long enough to identify the content
+	oracleFingerprint := ""
+	if len(combinedBody) > minLen {
+		oracleFingerprint = fingerprint
+	}
+	var bodyHashErr error
+	var exactSig string
+	if len(combinedBody) > minLen {
+		if sig, err := body.Signature, body.SignatureErr; err == nil {
+			typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigNormalized})
+			signatures = append(signatures, sig)
+		} else {
+			log.Printf("[Mailuminati] Failed to compute TLSH for body: %v", err)
+			failed[SigNormalized.String()]++
+			bodyHashErr = err
+			if !dryRun {
+				promBodyHashFailures.Inc()
+			}
+			if getBodyHashFailureAction() == "exact" {
+				// Unhashable bodies fall back to exact matching, learnable through /report like any signature
+				exactSig = exactBodySignature(combinedBody)
+				signatures = append(signatures, exactSig)
+			}
+		}
+	}
+
+	// 2. Extra Hash: Raw Body (HTML + Text concatenated, no normalization)
+	// Skipped when its TLSH is within REDUNDANT_RAW_DISTANCE of the normalized one (plaintext-only
+	// mail), and for HTML mail with SKIP_RAW_FOR_HTML (markup changes make it noisy)
+	rawBody := env.Text + env.HTML
+	if len(rawBody) > getMinLengthForType(SigRaw) && !(skipRawForHTML.Load() && env.HTML != "") {
+		if sig, err := body.RawSignature(); err == nil {
+			if len(typedSignatures) > 0 && isRedundantRaw(typedSignatures[0].Hash, sig) {
+				markRawRedundant(&typedSignatures[0], dryRun)
+			} else {
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigRaw})
+				signatures = append(signatures, sig)
 			}
-			pipe.Exec(ctx)
 		} else {
-			// For HAM/Others: Store only exact cache
-			data, _ := json.Marshal(res.Result)
-			rdb.Set(ctx, cacheKey, data, cacheDuration)
+			failed[SigRaw.String()]++
 		}
-		return res.Result
 	}
 
-	return AnalysisResult{Action: "allow", ProximityMatch: true}
+	// 3. URL-Based Hash (for phishing detection)
+	urls := extractURLs(env.Text + env.HTML)
+	if len(urls) >= 2 {
+		urlContent := strings.Join(urls, "\n")
+		if len(urlContent) > getMinLengthForType(SigURL) {
+			if getDistanceMetricForType(SigURL) == "jaccard" {
+				// URL-set signature compared by Jaccard distance (local only, the oracle indexes TLSH)
+				sig := urlSetSignature(urls)
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigURL})
+				signatures = append(signatures, sig)
+			} else if sig, err := computeLocalTLSH(urlContent); err == nil {
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigURL})
+				signatures = append(signatures, sig)
+			} else {
+				failed[SigURL.String()]++
+			}
+		}
+	}
+
+	// 3.5 Subject-Based Hash (spam campaigns often reuse subjects)
+	if len(subject) > getMinLengthForType(SigSubject) {
+		if sig, err := computeLocalTLSH(subjectHashContent(subject)); err == nil {
+			typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigSubject})
+			signatures = append(signatures, sig)
+		} else {
+			failed[SigSubject.String()]++
+		}
+	}
+
+	// 3.6 Combined Subject + Body Hash (campaigns varying each part independently)
+	if combinedSignature.Load() {
+		combinedContent := normalizeSubject(subject) + "\n" + combinedBody
+		if len(combinedContent) > getMinLengthForType(SigCombined) {
+			if sig, err := computeLocalTLSH(combinedContent); err == nil {
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigCombined})
+				signatures = append(signatures, sig)
+			} else {
+				failed[SigCombined.String()]++
+			}
+		}
+	}
+
+	// 3.7 HTML Structure Hash (template reuse with varied text)
+	if structureSignature.Load() && env.HTML != "" {
+		if skeleton := htmlSkeleton(env.HTML); len(skeleton) > getMinLengthForType(SigStructure) {
+			if sig, err := computeLocalTLSH(skeleton); err == nil {
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigStructure})
+				signatures = append(signatures, sig)
+			} else {
+				failed[SigStructure.String()]++
+			}
+		}
+	}
+
+	// 4. Analyze significant attachments
+	minVisual, minAttachment := getMinVisualSize(), getMinLengthForType(SigAttachment)
+	for _, att := range env.Attachments {
+		isImg := strings.HasPrefix(att.ContentType, "image/")
+		if isImg && len(att.Content) > minVisual {
+			// Huge images: perceptual hash or nothing (MAX_VISUAL_SIZE)
+			switch visualHashMode(len(att.Content)) {
+			case VisualSkip:
+				if !dryRun {
+					promLargeImagesSkipped.Inc()
+				}
+				continue
+			case VisualHashPerceptual:
+				if sig, err := perceptualHash(att.Content); err == nil {
+					typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigAttachment})
+					signatures = append(signatures, sig)
+				} else {
+					log.Printf("[Mailuminati] Failed to compute perceptual hash for attachment '%s': %v", att.FileName, err)
+					failed[SigAttachment.String()]++
+				}
+				continue
+			}
+		}
+		if (isImg && len(att.Content) > minVisual) || (!isImg && len(att.Content) > minAttachment) {
+			if sig, err := computeLocalTLSH(string(att.Content)); err == nil {
+				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigAttachment})
+				signatures = append(signatures, sig)
+			} else {
+				log.Printf("[Mailuminati] Failed to compute TLSH for attachment '%s': %v", att.FileName, err)
+				failed[SigAttachment.String()]++
+			}
+		}
+	}
+
+	normalizeSpan.SetAttributes(attribute.Int("mailuminati.signatures", len(signatures)))
+	normalizeSpan.End()
+
+	sigTypes := make(map[string]string, len(signatures))
+	for _, ts := range typedSignatures {
+		sigTypes[ts.Hash] = ts.Type.String()
+	}
+	if exactSig != "" {
+		sigTypes[exactSig] = SigNormalized.String()
+	}
+	if !dryRun {
+		go storeScanResult(env, signatures, sigTypes, oracleFingerprint, forwardedBlockSignature(env.Text, env.HTML))
+	}
+
+	var finalResult AnalysisResult = AnalysisResult{Action: "allow", ProximityMatch: false}
+	var lookupSpan trace.Span // One span per signature's band lookups
+	combiner := getVerdictCombiner()
+	scan := &signatureScan{MessageID: messageID, Subject: subject, Profile: profile, IsTrap: isTrap, DryRun: dryRun,
+		OracleFingerprint: oracleFingerprint, NearMisses: make(map[string]NearMiss)}
+	nearMisses := scan.NearMisses
+	var typeVerdicts []typeVerdict
+
+	if exactSig != "" {
+		score, _ := rdb.Get(ctx, LocalScorePrefix+exactSig).Int64()
+		trusted := localScoreTrusted(exactSig, score)
+		if trusted && !localHashConfirmed(exactSig) {
+			log.Printf("[Mailuminati] Local exact match awaiting confirmation. Message-ID: %s | Signature: %s | Sources: %d", messageID, exactSig, localSourceCount(exactSig))
+			held := AnalysisResult{Action: "soft_spam", Label: "local_unconfirmed", Confidence: 1.0, MatchType: SigNormalized.String(), LearnedAt: localLearnedAt(exactSig)}
+			held.ConfidenceBreakdown = newBreakdown(1.0, 0, 0).withScore(score).withRecency(held.LearnedAt, getRetentionForType(SigNormalized))
+			typeVerdicts = addTypeVerdict(typeVerdicts, SigNormalized, held)
+		} else if trusted {
+			log.Printf("[Mailuminati] Local exact spam detected! Message-ID: %s | Subject: %s | Signature: %s | Score: %d", messageID, subject, exactSig, score)
+			exact := AnalysisResult{Action: "spam", Label: "local_exact", Confidence: 1.0, MatchType: SigNormalized.String(), LearnedAt: localLearnedAt(exactSig)}
+			exact.ConfidenceBreakdown = newBreakdown(1.0, 0, 0).withScore(score).withRecency(exact.LearnedAt, getRetentionForType(SigNormalized))
+			if !dryRun {
+				atomic.AddInt64(&localSpamCount, 1)
+				promLocalMatch.Inc()
+			}
+			typeVerdicts = addTypeVerdict(typeVerdicts, SigNormalized, exact)
+			if combiner == CombinerFirstSpam {
+				finalResult = exact
+				goto endAnalysis
+			}
+		}
+	}
+
+	// 3. Collision search with type-specific thresholds: one verdict per signature, combined by VERDICT_COMBINER
+	for _, typedSig := range typedSignatures {
+		if lookupSpan != nil {
+			lookupSpan.End()
+		}
+		lookupCtx, span := tracer.Start(reqCtx, "band_lookup", trace.WithAttributes(attribute.String("mailuminati.signature_type", typedSig.Type.String())))
+		lookupSpan = span
+		verdict := scan.evaluate(lookupCtx, typedSig)
+		typeVerdicts = addTypeVerdict(typeVerdicts, typedSig.Type, verdict)
+		if combiner == CombinerFirstSpam {
+			mergeFirstSpam(&finalResult, verdict)
+			if finalResult.Action == "spam" {
+				break // Final verdict; stop everything
+			}
+		}
+	}
+	if combiner != CombinerFirstSpam {
+		finalResult = combineTypeVerdicts(combiner, typeVerdicts)
+	}
+
+endAnalysis:
+	if lookupSpan != nil {
+		lookupSpan.End()
+	}
+	heuristics := evaluateHeuristics(env, facts)
+	if bodyHashErr != nil && getBodyHashFailureAction() == "soft_spam" {
+		heuristics = append(heuristics, heuristicSignal{Label: "unhashable_body", Detail: bodyHashErr.Error()})
+	}
+	for _, h := range heuristics {
+		log.Printf("[Mailuminati] Heuristic %s (%s) | Message-ID: %s", h.Label, h.Detail, messageID)
+		applyHeuristic(&finalResult, h)
+	}
+	if heuristicEnabled("list_unsubscribe") {
+		recipients := len(addressDomains(env.GetHeader("To"))) + len(addressDomains(env.GetHeader("Cc")))
+		if sig, delta, ok := checkListUnsubscribe(env.GetHeader("List-Unsubscribe"), recipients); ok {
+			applyListUnsubscribe(&finalResult, delta*heuristicWeight(sig.Label))
+			heuristics = append(heuristics, sig)
+		}
+	}
+
+	if combinedBody != "" {
+		if sig, ok := checkMassCampaign(fingerprint, dryRun); ok {
+			log.Printf("[Mailuminati] Heuristic %s (%s) | Message-ID: %s", sig.Label, sig.Detail, messageID)
+			applyMassCampaign(&finalResult, sig)
+			heuristics = append(heuristics, sig)
+		}
+	}
+	if isTrap {
+		log.Printf("[Mailuminati] Spam-trap delivery to %s, forcing allow (was %s/%s) | Message-ID: %s", trap, finalResult.Action, finalResult.Label, messageID)
+		finalResult.Action = "allow"
+		finalResult.Label = "spam_trap"
+		finalResult.Confidence = 0
+		if spamTrapAutoLearn.Load() && !dryRun {
+			go learnTrapHit(trap, ScanResult{Hashes: signatures, Types: sigTypes}.typedHashes()) // Off the request path
+		}
+	}
+	if finalResult.Action != "spam" {
+		finalResult.NearMiss = closestNearMiss(nearMisses)
+	}
+	if finalResult.Action == "soft_spam" && len(combinedBody) > minLen { // Same content identity as oracleFingerprint
+		if after := softSpamEscalationFor(finalResult.Label); after > 0 {
+			if sig, ok := escalateSoftSpam(&finalResult, fingerprint, after, dryRun); ok {
+				log.Printf("[Mailuminati] Heuristic %s (%s) | Message-ID: %s", sig.Label, sig.Detail, messageID)
+				heuristics = append(heuristics, sig)
+			}
+		} else if softSpamTracking.Load() && !dryRun {
+			go recordSoftSpam(fingerprint, finalResult)
+		}
+	}
+
+	outcome := scanOutcome{
+		Result:       finalResult,
+		Profile:      profile,
+		Fingerprint:  fingerprint,
+		Signatures:   typedSignatures,
+		Hashes:       signatures,
+		Heuristics:   heuristics,
+		NearMisses:   nearMisses,
+		TypeVerdicts: typeVerdicts,
+		Failed:       failed,
+	}
+	if facts.AltPartDistance >= 0 {
+		outcome.AltPartDistance = &facts.AltPartDistance
+	}
+	outcome.Date = facts.Date
+	return outcome
+}
+
+// signatureScan is the per-message context of the signature lookups
+type signatureScan struct {
+	MessageID             string
+	Subject               string
+	Profile               thresholdProfile
+	IsTrap                bool
+	DryRun                bool // /explain: no counters, learning nor TTL refresh
+	OracleFingerprint     string
+	NearMisses            map[string]NearMiss // Signature hash -> its closest non-matching local candidate
+	AttachmentOracleCalls int                 // Attachment signatures that went to the oracle (MAX_ATTACHMENT_ORACLE_CALLS)
+}
+
+// countCacheHit counts a positive oracle cache hit, outside dry runs
+func (s *signatureScan) countCacheHit() {
+	if s.DryRun {
+		return
+	}
+	atomic.AddInt64(&cachedPositiveCount, 1)
+	promCacheHits.WithLabelValues("positive").Inc()
+}
+
+// evaluate looks a signature up (oracle cache, local learning, oracle bands) and returns its own verdict
+func (s *signatureScan) evaluate(lookupCtx context.Context, typedSig TypedSignature) AnalysisResult {
+	verdict := AnalysisResult{Action: "allow", ProximityMatch: false}
+	sig := typedSig.Hash
+	sigType := typedSig.Type
+	threshold := s.Profile.threshold(sigType)
+	softThreshold := s.Profile.softThreshold(sigType, SoftSourceOracleCache)
+	quorum := getQuorumForType(sigType)
+	// Step 1: Check oracle decision cache
+	cacheKey := "mi:oracle_cache:" + sig
+	if res, ok := cachedOracleVerdict(cacheKey); ok && res.Action == "spam" {
+		verdict = res
+		verdict.ConfidenceBreakdown = newBreakdown(1.0, 1, 1).withRecency(res.CachedAt, oracleSpamCacheDuration)
+		s.countCacheHit()
+		return verdict // Spam verdict; no need to look further
+	}
+
+	bands := lookupBands(sig)
+	if len(bands) == 0 {
+		return verdict
+	}
+	// URL sets and band subsets can have fewer bands than the quorum
+	if quorum > len(bands) {
+		quorum = len(bands)
+	}
+	if isPerceptualSignature(sig) {
+		quorum = 1 // See perceptualBands
+	}
+	distancer := distancerForType(sig, sigType)
+	var pipe redis.Pipeliner
+
+	// Step 1.5: Oracle Cache Proximity Lookup (Spam variations from recent queries)
+	oracleCacheBandsKeys := []string{}
+	pipe = rdb.Pipeline()
+	ocCmds := make(map[string]*redis.IntCmd)
+	for _, b := range bands {
+		key := OracleCacheFragPrefix + b
+		ocCmds[key] = pipe.Exists(ctx, key)
+	}
+	pipe.Exec(ctx)
+
+	for key, cmd := range ocCmds {
+		if cmd.Val() > 0 {
+			oracleCacheBandsKeys = append(oracleCacheBandsKeys, key)
+		}
+	}
+
+	if len(oracleCacheBandsKeys) >= quorum {
+		var ocHashes []string
+		pipe = rdb.Pipeline()
+		hashCmds := make(map[string]*redis.StringSliceCmd)
+		for _, key := range oracleCacheBandsKeys {
+			hashCmds[key] = pipe.SMembers(ctx, key)
+		}
+		pipe.Exec(ctx)
+
+		seenHashes := make(map[string]struct{})
+		for _, cmd := range hashCmds {
+			for _, hash := range cmd.Val() {
+				if _, seen := seenHashes[hash]; !seen {
+					ocHashes = append(ocHashes, hash)
+					seenHashes[hash] = struct{}{}
+				}
+			}
+		}
+
+		if len(ocHashes) > 0 {
+			distances, err := distancer.Distances(sig, ocHashes)
+			if err == nil {
+				for hash, dist := range distances {
+					if dist <= softThreshold {
+						if _, current := cachedOracleVerdict("mi:oracle_cache:" + hash); !current {
+							continue // Expired, or cached under another verdict schema
+						}
+					}
+					if dist <= threshold && !meetsOracleCacheMinConfidence(getConfidenceForMatch(dist, threshold)) {
+						// Loose proximity to a cached spam: not certain enough to block
+						confidence := getConfidenceForMatch(dist, threshold)
+						log.Printf("[Mailuminati] Oracle Cache Proximity Match below minimum confidence. Message-ID: %s | Subject: %s | Distance: %d | Confidence: %.2f | Type: %s", s.MessageID, s.Subject, dist, confidence, sigType.String())
+						if verdict.Action != "spam" && (verdict.Action != "soft_spam" || confidence > verdict.Confidence) {
+							verdict = AnalysisResult{Action: "soft_spam", Label: "oracle_cache_soft", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String(), CachedAt: oracleCachedAt(hash)}
+							verdict.ConfidenceBreakdown = newBreakdown(confidence, len(oracleCacheBandsKeys), len(bands)).withRecency(verdict.CachedAt, oracleSpamCacheDuration)
+						}
+					} else if dist <= threshold {
+						confidence := getConfidenceForMatch(dist, threshold)
+						log.Printf("[Mailuminati] Oracle Cache Proximity Match! Message-ID: %s | Subject: %s | Signature: %s | Match: %s | Distance: %d | Type: %s", s.MessageID, s.Subject, sig, hash, dist, sigType.String())
+						verdict = AnalysisResult{Action: "spam", Label: "oracle_cache_match", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String(), CachedAt: oracleCachedAt(hash)}
+						verdict.ConfidenceBreakdown = newBreakdown(confidence, len(oracleCacheBandsKeys), len(bands)).withRecency(verdict.CachedAt, oracleSpamCacheDuration)
+						s.countCacheHit()
+						if shouldPromoteOracleCacheMatch(confidence) && !s.DryRun {
+							go promoteOracleCacheMatch(sig, sigType)
+						}
+						return verdict
+					} else if dist <= softThreshold {
+						// Soft spam - close but not certain
+						confidence := getConfidenceForMatch(dist, softThreshold)
+						log.Printf("[Mailuminati] Oracle Cache Soft Match. Message-ID: %s | Subject: %s | Distance: %d | Type: %s", s.MessageID, s.Subject, dist, sigType.String())
+						if verdict.Action != "spam" {
+							verdict = AnalysisResult{Action: "soft_spam", Label: "oracle_cache_soft", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String(), CachedAt: oracleCachedAt(hash)}
+							verdict.ConfidenceBreakdown = newBreakdown(confidence, len(oracleCacheBandsKeys), len(bands)).withRecency(verdict.CachedAt, oracleSpamCacheDuration)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Step 2: Local learning lookup
+	localSoftThreshold := s.Profile.softThreshold(sigType, SoftSourceLocal)
+	localMatchBandsKeys := []string{}
+	pipe = rdb.Pipeline()
+	localCmds := make(map[string]*redis.IntCmd)
+	for _, b := range bands {
+		key := LocalFragPrefix + b
+		localCmds[key] = pipe.Exists(ctx, key)
+	}
+	pipe.Exec(ctx)
+
+	for key, cmd := range localCmds {
+		if cmd.Val() > 0 {
+			localMatchBandsKeys = append(localMatchBandsKeys, key)
+		}
+	}
+
+	if len(localMatchBandsKeys) >= quorum {
+		if !s.DryRun {
+			// Bands are shared by several hashes: the refresh is only bounded by MAX_HASH_LIFETIME,
+			// each hash's own keys age out on their first-learned time
+			extendBandTTLs(localMatchBandsKeys, capHashLifetime(getRetentionForType(sigType), 0, time.Now()))
+		}
+
+		var localHashes []string
+		pipe = rdb.Pipeline()
+		hashCmds := make(map[string]*redis.StringSliceCmd)
+		for _, key := range localMatchBandsKeys {
+			hashCmds[key] = pipe.SMembers(ctx, key)
+		}
+		pipe.Exec(ctx)
+
+		seenHashes := make(map[string]struct{})
+		for _, cmd := range hashCmds {
+			for _, hash := range cmd.Val() {
+				if _, seen := seenHashes[hash]; !seen {
+					localHashes = append(localHashes, hash)
+					seenHashes[hash] = struct{}{}
+				}
+			}
+		}
+
+		if len(localHashes) > 0 {
+			distances, err := distancer.Distances(sig, localHashes)
+			if err == nil {
+				var candidates, softCandidates []localCandidate
+				for hash, dist := range distances {
+					if nm, seen := s.NearMisses[sig]; dist > threshold && (!seen || dist < nm.Distance) {
+						s.NearMisses[sig] = NearMiss{Hash: hash, Distance: dist, Threshold: threshold, MatchType: sigType.String()}
+					}
+					if dist <= localSoftThreshold {
+						// Check score
+						scoreVal, _ := rdb.Get(ctx, LocalScorePrefix+hash).Int64()
+						if dist <= threshold {
+							candidates = append(candidates, localCandidate{Hash: hash, Distance: dist, Score: scoreVal})
+						} else {
+							// Soft spam - close but not certain
+							softCandidates = append(softCandidates, localCandidate{Hash: hash, Distance: dist, Score: scoreVal})
+						}
+					}
+				}
+
+				trusted := func(c localCandidate) bool { return localScoreTrusted(c.Hash, c.Score) }
+				match, isLocalSpam, overridden := resolveLocalCandidates(candidates, trusted)
+				if isLocalSpam && !localHashConfirmed(match.Hash) {
+					// Held as soft_spam until LEARNING_MIN_SOURCES distinct sources reported it
+					confidence := getConfidenceForMatch(match.Distance, threshold)
+					log.Printf("[Mailuminati] Local match awaiting confirmation. Message-ID: %s | Match: %s | Sources: %d | Type: %s", s.MessageID, match.Hash, localSourceCount(match.Hash), sigType.String())
+					verdict = AnalysisResult{Action: "soft_spam", Label: "local_unconfirmed", ProximityMatch: true, Distance: match.Distance, Confidence: confidence, MatchType: sigType.String(), LearnedAt: localLearnedAt(match.Hash), CampaignID: localCampaignID(match.Hash)}
+					verdict.ConfidenceBreakdown = newBreakdown(confidence, len(localMatchBandsKeys), len(bands)).withScore(match.Score).withRecency(verdict.LearnedAt, getRetentionForType(sigType))
+					return verdict
+				}
+				if isLocalSpam {
+					dist, hash, scoreVal := match.Distance, match.Hash, match.Score
+					confidence := getConfidenceForMatch(dist, threshold)
+					log.Printf("[Mailuminati] Local spam detected! Message-ID: %s | Subject: %s | Signature: %s | Match: %s | Score: %d | Type: %s", s.MessageID, s.Subject, sig, hash, scoreVal, sigType.String())
+					verdict = AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String(), LearnedAt: localLearnedAt(hash), CampaignID: localCampaignID(hash)}
+					verdict.ConfidenceBreakdown = newBreakdown(confidence, len(localMatchBandsKeys), len(bands)).withScore(scoreVal).withRecency(verdict.LearnedAt, getRetentionForType(sigType))
+					if !s.DryRun {
+						atomic.AddInt64(&localSpamCount, 1)
+						promLocalMatch.Inc()
+					}
+					return verdict // Local spam verdict; move to next signature
+				}
+				if overridden {
+					// Ham candidates won the conflict: no soft verdict from this signature either
+					log.Printf("[Mailuminati] Local spam match overridden by ham candidates (%s). Message-ID: %s | Type: %s", getLocalConflictPolicy(), s.MessageID, sigType.String())
+					softCandidates = nil
+				}
+				var softMatch *localCandidate
+				for i, c := range softCandidates {
+					if trusted(c) && (softMatch == nil || c.Distance < softMatch.Distance) {
+						softMatch = &softCandidates[i]
+					}
+				}
+				if c := softMatch; c != nil && verdict.Action != "spam" {
+					confidence := getConfidenceForMatch(c.Distance, localSoftThreshold)
+					log.Printf("[Mailuminati] Local soft match. Message-ID: %s | Subject: %s | Distance: %d | Type: %s", s.MessageID, s.Subject, c.Distance, sigType.String())
+					verdict = AnalysisResult{Action: "soft_spam", Label: "local_soft", ProximityMatch: true, Distance: c.Distance, Confidence: confidence, MatchType: sigType.String(), LearnedAt: localLearnedAt(c.Hash), CampaignID: localCampaignID(c.Hash)}
+					verdict.ConfidenceBreakdown = newBreakdown(confidence, len(localMatchBandsKeys), len(bands)).withScore(c.Score).withRecency(verdict.LearnedAt, getRetentionForType(sigType))
+				}
+			}
+		}
+		// If we reach here, distances were > threshold
+		verdict.ProximityMatch = true
+		return verdict // Stop here for this signature, as requested
+	}
+
+	// Step 3: Band-based collision search (Oracle LSH)
+	matchCount := 0
+	pipe = rdb.Pipeline()
+	oracleCmds := make([]*redis.IntCmd, len(bands))
+	for i, b := range bands {
+		oracleCmds[i] = pipe.Exists(ctx, FragKeyPrefix+b)
+	}
+	pipe.Exec(ctx)
+
+	for _, cmd := range oracleCmds {
+		if cmd.Val() > 0 {
+			matchCount++
+		}
+	}
+
+	if matchCount >= quorum && (s.IsTrap || oracleLocalOnly(sigType) || s.attachmentOracleCapped(sigType)) {
+		verdict.ProximityMatch = true
+	} else if matchCount >= quorum {
+		oracleVerdict := oracleDecisionForContent(lookupCtx, s.OracleFingerprint, sig) // Call the oracle only here
+		if oracleVerdict.Action == "spam" {
+			log.Printf("[Mailuminati] Oracle spam detected! Message-ID: %s | Subject: %s | Signature: %s", s.MessageID, s.Subject, sig)
+			verdict = oracleVerdict
+			verdict.ConfidenceBreakdown = &ConfidenceBreakdown{BandRatio: subSignal(float64(matchCount) / float64(len(bands)))}
+			if !s.DryRun {
+				atomic.AddInt64(&spamConfirmedCount, 1)
+				promOracleMatch.WithLabelValues("complete").Inc()
+			}
+			return verdict // Spam verdict; no need to look further
+		} else if oracleVerdict.Action == "soft_spam" {
+			soft := oracleSoftVerdict(oracleVerdict, sigType)
+			log.Printf("[Mailuminati] Oracle soft spam. Message-ID: %s | Subject: %s | Signature: %s", s.MessageID, s.Subject, sig)
+			if !s.DryRun {
+				promOracleMatch.WithLabelValues("soft").Inc()
+			}
+			if verdict.Action == "allow" || (verdict.Action == "soft_spam" && soft.Confidence > verdict.Confidence) {
+				verdict = soft
+				verdict.ConfidenceBreakdown = &ConfidenceBreakdown{BandRatio: subSignal(float64(matchCount) / float64(len(bands)))}
+			}
+		} else {
+			log.Printf("[Mailuminati] Oracle partial match. Message-ID: %s | Subject: %s | Signature: %s", s.MessageID, s.Subject, sig)
+			verdict.ProximityMatch = true
+			if !s.DryRun {
+				atomic.AddInt64(&partialMatchCount, 1)
+				promOracleMatch.WithLabelValues("partial").Inc()
+			}
+			applyPartialMatch(&verdict, matchCount, len(bands), sigType)
+		}
+	}
+	return verdict
+}
+
+// signatureCoverage counts the computed signatures by type. A normalized signature
+// standing in for a redundant raw one counts for both.
+func (o scanOutcome) signatureCoverage() map[string]int {
+	computed := make(map[string]int)
+	for _, ts := range o.Signatures {
+		computed[ts.Type.String()]++
+		if ts.CoversRaw {
+			computed[SigRaw.String()]++
+		}
+	}
+	return computed
+}
+
+// closestNearMiss returns the near miss with the smallest margin over its threshold
+func closestNearMiss(nearMisses map[string]NearMiss) *NearMiss {
+	var closest *NearMiss
+	for _, nm := range nearMisses {
+		if closest == nil || nm.Distance-nm.Threshold < closest.Distance-closest.Threshold {
+			nm := nm
+			closest = &nm
+		}
+	}
+	return closest
 }
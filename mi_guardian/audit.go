@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Verdict audit log ---
+
+// With AUDIT_LOG_PATH set, every verdict is appended to that file as a JSON line, for
+// compliance records. The file is rotated when it would grow beyond AUDIT_LOG_MAX_SIZE or
+// when an AUDIT_LOG_ROTATE_INTERVAL boundary is crossed (UTC): it is renamed with the time
+// of the rotation as suffix, and rotated files older than AUDIT_LOG_RETENTION are deleted.
+// AUDIT_LOG_FIELDS selects the fields written, and AUDIT_LOG_REDACT how the ones that may
+// identify a correspondent (from_domain, message_id) are written: as is, hashed or omitted.
+
+const (
+	AuditRedactNone = "none"
+	AuditRedactHash = "hash"
+	AuditRedactOmit = "omit"
+
+	auditRotatedTimeFormat = "20060102T150405.000000000Z"
+)
+
+// auditFields are the fields an audit line may hold
+var auditFields = map[string]bool{
+	"timestamp": true, "fingerprint": true, "action": true, "reason_code": true, "label": true,
+	"match_type": true, "confidence": true, "from_domain": true, "message_id": true,
+}
+
+// auditPersonalFields are the fields redacted by AUDIT_LOG_REDACT
+var auditPersonalFields = map[string]bool{"from_domain": true, "message_id": true}
+
+const defaultAuditFields = "timestamp,fingerprint,action,reason_code,match_type,from_domain"
+
+// auditConfig holds the parsed AUDIT_LOG_* settings
+type auditConfig struct {
+	Path           string
+	MaxSize        int64         // Bytes, 0 = no size rotation
+	RotateInterval time.Duration // 0 = no time rotation
+	Retention      time.Duration // 0 = rotated files are kept
+	Fields         []string
+	Redact         string
+}
+
+// loadAuditConfig reads AUDIT_LOG_*, dropping unknown fields and redaction modes
+func loadAuditConfig() auditConfig {
+	cfg := auditConfig{
+		Path:           strings.TrimSpace(getEnv("AUDIT_LOG_PATH", "")),
+		MaxSize:        getEnvInt64("AUDIT_LOG_MAX_SIZE", 100*1024*1024),
+		RotateInterval: getEnvDuration("AUDIT_LOG_ROTATE_INTERVAL", 24*time.Hour),
+		Retention:      getEnvDuration("AUDIT_LOG_RETENTION", 90*24*time.Hour),
+		Redact:         strings.ToLower(getEnv("AUDIT_LOG_REDACT", AuditRedactNone)),
+	}
+	fields := getEnvList("AUDIT_LOG_FIELDS")
+	if len(fields) == 0 {
+		fields = strings.Split(defaultAuditFields, ",")
+	}
+	for _, f := range fields {
+		if !auditFields[f] {
+			log.Printf("[Mailuminati] Unknown AUDIT_LOG_FIELDS field %q, ignored", f)
+			continue
+		}
+		cfg.Fields = append(cfg.Fields, f)
+	}
+	switch cfg.Redact {
+	case "":
+		cfg.Redact = AuditRedactNone
+	case AuditRedactNone, AuditRedactHash, AuditRedactOmit:
+	default:
+		log.Printf("[Mailuminati] Invalid AUDIT_LOG_REDACT %q, using %s", cfg.Redact, AuditRedactHash)
+		cfg.Redact = AuditRedactHash
+	}
+	return cfg
+}
+
+// auditLogger appends lines to a file, rotating it by size and time
+type auditLogger struct {
+	mu     sync.Mutex
+	cfg    auditConfig
+	file   *os.File
+	size   int64
+	period time.Time // Rotation period the open file belongs to
+	now    func() time.Time
+}
+
+var (
+	auditLogMutex sync.Mutex
+	auditLog      *auditLogger // nil = disabled
+)
+
+// configureAuditLog (re)starts the audit log when its settings changed
+func configureAuditLog(cfg auditConfig) {
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	if auditLog != nil && auditConfigEqual(auditLog.cfg, cfg) {
+		return
+	}
+	if auditLog != nil {
+		auditLog.close()
+		auditLog = nil
+	}
+	if cfg.Path != "" {
+		auditLog = &auditLogger{cfg: cfg, now: time.Now}
+	}
+}
+
+func auditConfigEqual(a, b auditConfig) bool {
+	return a.Path == b.Path && a.MaxSize == b.MaxSize && a.RotateInterval == b.RotateInterval &&
+		a.Retention == b.Retention && a.Redact == b.Redact && strings.Join(a.Fields, ",") == strings.Join(b.Fields, ",")
+}
+
+func currentAuditLog() *auditLogger {
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	return auditLog
+}
+
+// rotationPeriod returns the start of the AUDIT_LOG_ROTATE_INTERVAL period t falls in
+func (l *auditLogger) rotationPeriod(t time.Time) time.Time {
+	if l.cfg.RotateInterval <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(l.cfg.RotateInterval)
+}
+
+// open opens the log file for appending. An existing file belongs to the period of its
+// last write, so that time rotation carries over restarts.
+func (l *auditLogger) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.cfg.Path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	l.period = l.rotationPeriod(l.now())
+	if l.size > 0 {
+		l.period = l.rotationPeriod(info.ModTime())
+	}
+	return nil
+}
+
+// needsRotation reports whether writing n more bytes at now must go to a new file
+func (l *auditLogger) needsRotation(n int64, now time.Time) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.cfg.MaxSize > 0 && l.size+n > l.cfg.MaxSize {
+		return true
+	}
+	return l.cfg.RotateInterval > 0 && !l.rotationPeriod(now).Equal(l.period)
+}
+
+// rotate renames the current file with the rotation time as suffix and opens a new one
+func (l *auditLogger) rotate(now time.Time) error {
+	l.file.Close()
+	l.file = nil
+	var target string
+	for stamp := now; ; stamp = stamp.Add(time.Nanosecond) {
+		// Never overwrite a rotated file (clock stepped back, or two rotations at once)
+		target = l.cfg.Path + "." + stamp.UTC().Format(auditRotatedTimeFormat)
+		if _, err := os.Stat(target); err != nil {
+			break
+		}
+	}
+	if err := os.Rename(l.cfg.Path, target); err != nil {
+		return err
+	}
+	promAuditLog.WithLabelValues("rotated").Inc()
+	l.prune(now)
+	return l.open()
+}
+
+// prune deletes the rotated files older than AUDIT_LOG_RETENTION
+func (l *auditLogger) prune(now time.Time) {
+	if l.cfg.Retention <= 0 {
+		return
+	}
+	rotated, _ := filepath.Glob(l.cfg.Path + ".*")
+	for _, name := range rotated {
+		at, err := time.Parse(auditRotatedTimeFormat, strings.TrimPrefix(name, l.cfg.Path+"."))
+		if err != nil {
+			continue // Not one of ours
+		}
+		if now.Sub(at) > l.cfg.Retention {
+			os.Remove(name)
+		}
+	}
+}
+
+// write appends one line, rotating the file first when needed
+func (l *auditLogger) write(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.needsRotation(int64(len(line)), now) {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// redactAuditValue writes a personal field as configured ("" when omitted)
+func redactAuditValue(mode, value string) string {
+	switch {
+	case value == "" || mode == AuditRedactOmit:
+		return ""
+	case mode == AuditRedactHash:
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:8])
+	}
+	return value
+}
+
+// auditRecord builds the audit line of a verdict with the configured fields
+func auditRecord(cfg auditConfig, outcome scanOutcome, fromHeader, messageID string, at time.Time) map[string]interface{} {
+	res := outcome.Result
+	values := map[string]interface{}{
+		"timestamp":   at.UTC().Format(time.RFC3339Nano),
+		"fingerprint": outcome.Fingerprint,
+		"action":      res.Action,
+		"reason_code": string(res.ReasonCode),
+		"label":       res.Label,
+		"match_type":  res.MatchType,
+		"confidence":  res.Confidence,
+		"from_domain": extractDomain(fromHeader),
+		"message_id":  strings.Trim(strings.TrimSpace(messageID), "<>"),
+	}
+	record := make(map[string]interface{}, len(cfg.Fields))
+	for _, f := range cfg.Fields {
+		v := values[f]
+		if auditPersonalFields[f] {
+			v = redactAuditValue(cfg.Redact, v.(string))
+		}
+		if s, ok := v.(string); ok && s == "" {
+			continue
+		}
+		record[f] = v
+	}
+	return record
+}
+
+// auditVerdict appends a verdict to the audit log, when AUDIT_LOG_PATH is set
+func auditVerdict(outcome scanOutcome, fromHeader, messageID string) {
+	l := currentAuditLog()
+	if l == nil {
+		return
+	}
+	line, _ := json.Marshal(auditRecord(l.cfg, outcome, fromHeader, messageID, l.now()))
+	if err := l.write(append(line, '\n')); err != nil {
+		promAuditLog.WithLabelValues("error").Inc()
+		log.Printf("[Mailuminati] Audit log write failed: %v", err)
+		return
+	}
+	promAuditLog.WithLabelValues("written").Inc()
+}
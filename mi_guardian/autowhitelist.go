@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- Automatic whitelisting of frequently-hammed sender domains (opt-in) ---
+
+const (
+	HamCountPrefix      = "mi:hamcount:"       // Ham reports per From domain within the window
+	AutoWhitelistPrefix = "mi:whitelist:auto:" // One key per auto-whitelisted domain (value: added-at timestamp)
+)
+
+// recordHamForSender counts a ham report against the sender domain and whitelists it once
+// AUTO_WHITELIST_HAM_REPORTS reports were received within AUTO_WHITELIST_WINDOW
+func recordHamForSender(domain string) bool {
+	if !autoWhitelist.Load() || domain == "" {
+		return false
+	}
+
+	key := HamCountPrefix + domain
+	count, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return false
+	}
+	if count == 1 {
+		rdb.Expire(ctx, key, time.Duration(atomic.LoadInt64(&autoWhitelistWindow)))
+	}
+	if count < atomic.LoadInt64(&autoWhitelistHamReports) {
+		return false
+	}
+
+	// TTL 0 keeps the entry until it is removed through DELETE /whitelist
+	ttl := time.Duration(atomic.LoadInt64(&autoWhitelistTTL))
+	added, err := rdb.SetNX(ctx, AutoWhitelistPrefix+domain, time.Now().Unix(), ttl).Result()
+	if err != nil || !added {
+		return false
+	}
+	rdb.Del(ctx, key)
+	promAutoWhitelisted.Inc()
+	log.Printf("[Mailuminati] Auto-whitelisted domain %s after %d ham reports", domain, count)
+	return true
+}
+
+// isAutoWhitelisted checks the auto-whitelist entries. Entries left from before
+// AUTO_WHITELIST was turned off don't apply.
+func isAutoWhitelisted(domain string) bool {
+	if !autoWhitelist.Load() || domain == "" {
+		return false
+	}
+	n, _ := rdb.Exists(ctx, AutoWhitelistPrefix+domain).Result()
+	return n > 0
+}
+
+// listAutoWhitelist returns auto-whitelisted domains with the time they were added, for review
+func listAutoWhitelist() map[string]int64 {
+	entries := make(map[string]int64)
+	iter := rdb.Scan(ctx, 0, AutoWhitelistPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		addedAt, _ := strconv.ParseInt(rdb.Get(ctx, iter.Val()).Val(), 10, 64)
+		entries[strings.TrimPrefix(iter.Val(), AutoWhitelistPrefix)] = addedAt
+	}
+	return entries
+}
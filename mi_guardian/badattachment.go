@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Known-bad attachment hashes ---
+
+// Exact SHA-256 hashes of known-bad attachments. Entries added through the admin API live
+// in the BAD_ATTACHMENT_SET set; entries from BAD_ATTACHMENT_FEED_URL are kept apart
+// (<set>:feed) so a feed refresh never drops manual entries.
+
+var reSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// badAttachmentKeys returns the manual set and the feed set
+func badAttachmentKeys() (manual, feed string) {
+	manual = getEnv("BAD_ATTACHMENT_SET", "mi:badhash:attachment")
+	return manual, manual + ":feed"
+}
+
+// knownBadAttachment returns the name and SHA-256 of the first attachment found in a bad hash set
+func knownBadAttachment(env *enmime.Envelope) (name, hash string, found bool) {
+	if len(env.Attachments) == 0 {
+		return "", "", false
+	}
+	manual, feed := badAttachmentKeys()
+	hashes := make([]string, len(env.Attachments))
+	pipe := rdb.Pipeline()
+	for i, att := range env.Attachments {
+		sum := sha256.Sum256(att.Content)
+		hashes[i] = hex.EncodeToString(sum[:])
+		pipe.SIsMember(ctx, manual, hashes[i])
+		pipe.SIsMember(ctx, feed, hashes[i])
+	}
+	cmds, _ := pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		if cmd.(*redis.BoolCmd).Val() {
+			return env.Attachments[i/2].FileName, hashes[i/2], true
+		}
+	}
+	return "", "", false
+}
+
+// parseBadHashFeed reads one SHA-256 per line. Comments (#) and blank lines are skipped, and
+// "sha256sum" style lines keep only the hash.
+func parseBadHashFeed(body string) []string {
+	var hashes []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if h := strings.ToLower(strings.Fields(line)[0]); reSHA256.MatchString(h) {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// refreshBadAttachmentFeed downloads the feed and atomically replaces the feed set
+func refreshBadAttachmentFeed(url string) (int, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("feed returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024*1024))
+	if err != nil {
+		return 0, err
+	}
+	hashes := parseBadHashFeed(string(body))
+
+	_, feed := badAttachmentKeys()
+	if len(hashes) == 0 {
+		return 0, rdb.Del(ctx, feed).Err()
+	}
+	tmp := feed + ":tmp"
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, tmp)
+	for start := 0; start < len(hashes); start += 1000 {
+		end := start + 1000
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		members := make([]interface{}, 0, end-start)
+		for _, h := range hashes[start:end] {
+			members = append(members, h)
+		}
+		pipe.SAdd(ctx, tmp, members...)
+	}
+	pipe.Rename(ctx, tmp, feed)
+	_, err = pipe.Exec(ctx)
+	return len(hashes), err
+}
+
+// badAttachmentFeedWorker refreshes the feed set every BAD_ATTACHMENT_FEED_INTERVAL
+func badAttachmentFeedWorker() {
+	for {
+		if url := getEnv("BAD_ATTACHMENT_FEED_URL", ""); url != "" {
+			if n, err := refreshBadAttachmentFeed(url); err != nil {
+				log.Printf("[Mailuminati] Bad attachment feed refresh failed: %v", err)
+			} else {
+				log.Printf("[Mailuminati] Bad attachment feed refreshed: %d hashes", n)
+			}
+		}
+		time.Sleep(time.Duration(atomic.LoadInt64(&badAttachmentFeedInterval)))
+	}
+}
+
+// adminBadAttachmentHandler lists (GET), adds (POST) or removes (DELETE) manual bad attachment
+// hashes. POST and DELETE take {"hashes": ["<sha256>", ...]}.
+func adminBadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	manual, feed := badAttachmentKeys()
+	switch r.Method {
+	case http.MethodGet:
+		hashes, err := rdb.SMembers(ctx, manual).Result()
+		if err != nil {
+			http.Error(w, "Redis error", http.StatusInternalServerError)
+			return
+		}
+		feedCount, _ := rdb.SCard(ctx, feed).Result()
+		respBytes, _ := json.Marshal(map[string]interface{}{"hashes": hashes, "feed_count": feedCount})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+		return
+
+	case http.MethodPost, http.MethodDelete:
+		var reqBody struct {
+			Hashes []string `json:"hashes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || len(reqBody.Hashes) == 0 {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		members := make([]interface{}, 0, len(reqBody.Hashes))
+		for _, h := range reqBody.Hashes {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if !reSHA256.MatchString(h) {
+				http.Error(w, "Invalid SHA-256: "+h, http.StatusBadRequest)
+				return
+			}
+			members = append(members, h)
+		}
+		var changed int64
+		var err error
+		if r.Method == http.MethodPost {
+			changed, err = rdb.SAdd(ctx, manual, members...).Result()
+		} else {
+			changed, err = rdb.SRem(ctx, manual, members...).Result()
+		}
+		if err != nil {
+			http.Error(w, "Redis error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[Mailuminati] Bad attachment hashes %s: %d changed", strings.ToLower(r.Method), changed)
+		respBytes, _ := json.Marshal(map[string]interface{}{"status": "ok", "changed": changed})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	default:
+		http.Error(w, "GET, POST or DELETE required", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --- Sender blacklist ---
+
+// Blacklisted senders get a spam verdict without scanning. When a sender is on both
+// lists, LIST_CONFLICT_POLICY decides:
+//   - blacklist_wins: the blacklist entry always applies
+//   - whitelist_wins: the whitelist entry always applies
+//   - most_specific_wins (default): an email entry beats a domain entry; on a tie the
+//     blacklist applies
+
+const (
+	ListConflictBlacklistWins = "blacklist_wins"
+	ListConflictWhitelistWins = "whitelist_wins"
+	ListConflictMostSpecific  = "most_specific_wins"
+)
+
+// senderEmail extracts the lowercased address from a From header ("Name <email>" or "email")
+func senderEmail(fromHeader string) string {
+	email := strings.ToLower(strings.TrimSpace(fromHeader))
+	if idx := strings.Index(email, "<"); idx != -1 {
+		email = email[idx+1:]
+		if idx := strings.Index(email, ">"); idx != -1 {
+			email = email[:idx]
+		}
+	}
+	return email
+}
+
+// isBlacklisted checks if sender email or domain is blacklisted. The email entry is
+// reported first, as the more specific one.
+func isBlacklisted(fromHeader string) (bool, string) {
+	if email := senderEmail(fromHeader); email != "" {
+		if rdb.SIsMember(ctx, "mi:blacklist:email", email).Val() {
+			return true, "email:" + email
+		}
+	}
+	if domain := extractDomain(fromHeader); domain != "" {
+		if rdb.SIsMember(ctx, "mi:blacklist:domain", domain).Val() {
+			return true, "domain:" + domain
+		}
+	}
+	return false, ""
+}
+
+// getListConflictPolicy returns the configured LIST_CONFLICT_POLICY
+func getListConflictPolicy() string {
+	if policy, ok := listConflictPolicy.Load().(string); ok {
+		return policy
+	}
+	return ListConflictMostSpecific
+}
+
+// blacklistWins decides a sender found on both lists
+func blacklistWins(fromHeader, blacklistReason string) bool {
+	switch getListConflictPolicy() {
+	case ListConflictBlacklistWins:
+		return true
+	case ListConflictWhitelistWins:
+		return false
+	}
+	// Only an email whitelist entry outranks a domain blacklist entry
+	if strings.HasPrefix(blacklistReason, "email:") {
+		return true
+	}
+	email := senderEmail(fromHeader)
+	return email == "" || !rdb.SIsMember(ctx, "mi:whitelist:email", email).Val()
+}
+
+func blacklistHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		domains, _ := rdb.SMembers(ctx, "mi:blacklist:domain").Result()
+		emails, _ := rdb.SMembers(ctx, "mi:blacklist:email").Result()
+		respBytes, _ := json.Marshal(map[string]interface{}{
+			"domains":         domains,
+			"emails":          emails,
+			"conflict_policy": getListConflictPolicy(),
+		})
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	case http.MethodPost, http.MethodDelete:
+		var reqBody struct {
+			Type  string `json:"type"`  // "domain" or "email"
+			Value string `json:"value"` // domain or email address
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		reqBody.Value = strings.ToLower(strings.TrimSpace(reqBody.Value))
+		if reqBody.Value == "" {
+			http.Error(w, "Value cannot be empty", http.StatusBadRequest)
+			return
+		}
+		var key string
+		switch reqBody.Type {
+		case "domain":
+			key = "mi:blacklist:domain"
+		case "email":
+			key = "mi:blacklist:email"
+		default:
+			http.Error(w, "Type must be 'domain' or 'email'", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			rdb.SAdd(ctx, key, reqBody.Value)
+			log.Printf("[Mailuminati] Added to blacklist: %s=%s", reqBody.Type, reqBody.Value)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"added"}`))
+		} else {
+			rdb.SRem(ctx, key, reqBody.Value)
+			log.Printf("[Mailuminati] Removed from blacklist: %s=%s", reqBody.Type, reqBody.Value)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"removed"}`))
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Normalized body cache ---
+
+// The same content is often analyzed several times in a row: greylisting retries, one
+// analysis per recipient, re-analysis through /explain. With NORMALIZED_BODY_CACHE_SIZE
+// set, the normalized body and the body signatures (normalized and raw TLSH) are kept in
+// memory, keyed by a hash of the raw text and HTML parts, for the most recent bodies.
+// Entries computed under another verdict schema (normalization or signature settings
+// changed) or another normalized body minimum length are recomputed.
+
+// maxCachedBodySize keeps large bodies out of the cache, so that it stays small however it is sized
+const maxCachedBodySize = 256 * 1024
+
+// bodyEntry is what the body of a message yields before lookups. Entries are shared
+// between analyses and never modified once built, but for the raw body signature which
+// is only computed when a scan asks for it.
+type bodyEntry struct {
+	Normalized    string
+	Fingerprint   string // contentFingerprint of Normalized
+	Signature     string // TLSH of Normalized ("" when too short or unhashable)
+	SignatureErr  error
+	SchemaVersion string // bodyEntrySchema the entry was computed under
+
+	rawBody string // Text and HTML parts concatenated, without normalization
+	rawOnce sync.Once
+	rawSig  string
+	rawErr  error
+}
+
+// RawSignature returns the TLSH of the raw body, computed on first use: most early
+// verdicts and skipped raw signatures never need it
+func (e *bodyEntry) RawSignature() (string, error) {
+	e.rawOnce.Do(func() {
+		if e.rawBody == e.Normalized && e.Signature != "" {
+			e.rawSig = e.Signature
+		} else {
+			e.rawSig, e.rawErr = computeLocalTLSH(e.rawBody)
+		}
+	})
+	return e.rawSig, e.rawErr
+}
+
+// bodyCache is a bounded LRU of body entries
+type bodyCache struct {
+	mu    sync.Mutex
+	order *list.List // Most recent first; values are *bodyCacheItem
+	items map[string]*list.Element
+}
+
+type bodyCacheItem struct {
+	key   string
+	entry *bodyEntry
+}
+
+var normalizedBodies = &bodyCache{order: list.New(), items: make(map[string]*list.Element)}
+
+// get returns the entry cached for key, marking it as the most recent
+func (c *bodyCache) get(key string) (*bodyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*bodyCacheItem).entry, true
+}
+
+// put caches an entry, evicting the least recent ones beyond size
+func (c *bodyCache) put(key string, entry *bodyEntry, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*bodyCacheItem).entry = entry
+		c.order.MoveToFront(el)
+	} else {
+		c.items[key] = c.order.PushFront(&bodyCacheItem{key: key, entry: entry})
+	}
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*bodyCacheItem).key)
+	}
+}
+
+// len returns the number of cached entries
+func (c *bodyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// bodyCacheKey identifies a body by its text and HTML parts
+func bodyCacheKey(text, html string) string {
+	h := sha256.New()
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(text)))
+	h.Write(n[:])
+	h.Write([]byte(text))
+	h.Write([]byte(html))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bodyEntrySchema identifies the settings a body entry depends on: the verdict schema and
+// the normalized body minimum length, which decides whether its signature is computed at all
+func bodyEntrySchema() string {
+	return currentVerdictSchemaVersion() + "/" + strconv.Itoa(getMinLengthForType(SigNormalized))
+}
+
+// computeBodyEntry normalizes a body and computes its normalized signature
+func computeBodyEntry(text, html string) *bodyEntry {
+	e := &bodyEntry{
+		Normalized:    normalizeEmailBody(text, html),
+		SchemaVersion: bodyEntrySchema(),
+		rawBody:       text + html,
+	}
+	e.Fingerprint = contentFingerprint(e.Normalized)
+	if len(e.Normalized) > getMinLengthForType(SigNormalized) {
+		e.Signature, e.SignatureErr = computeLocalTLSH(e.Normalized)
+	}
+	return e
+}
+
+// analyzeBody returns the normalized body and body signatures of a message, from the
+// cache when NORMALIZED_BODY_CACHE_SIZE is set
+func analyzeBody(text, html string) *bodyEntry {
+	size := atomic.LoadInt64(&normalizedBodyCacheSize)
+	if size <= 0 || len(text)+len(html) > maxCachedBodySize {
+		return computeBodyEntry(text, html)
+	}
+	key := bodyCacheKey(text, html)
+	if e, ok := normalizedBodies.get(key); ok && e.SchemaVersion == bodyEntrySchema() {
+		promBodyCache.WithLabelValues("hit").Inc()
+		return e
+	}
+	promBodyCache.WithLabelValues("miss").Inc()
+	e := computeBodyEntry(text, html)
+	normalizedBodies.put(key, e, int(size))
+	return e
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// --- Request body buffers ---
+
+// enmime needs the whole message before hashing starts (parts are decoded and kept in
+// the envelope), so the body cannot be streamed through. What can be saved is the
+// ReadAll buffer itself: grown by doubling up to MaxProcessSize, it was allocated anew
+// for every request. Body buffers are now taken from a pool, pre-sized from
+// Content-Length, and returned once enmime has parsed them.
+
+// maxPooledBodySize keeps huge buffers out of the pool, so that a burst of large
+// messages does not pin their memory once it is over
+const maxPooledBodySize = 4 * 1024 * 1024
+
+var bodyBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// readMessageBody reads at most MaxProcessSize bytes of body into a pooled buffer, to be
+// handed back with releaseMessageBody once parsed. sizeHint is the Content-Length, if known.
+func readMessageBody(body io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	buf := bodyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if sizeHint > 0 {
+		// ReadFrom wants room for one more read after the last byte, to see EOF
+		buf.Grow(int(min(sizeHint, MaxProcessSize)) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(io.LimitReader(body, MaxProcessSize)); err != nil {
+		releaseMessageBody(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// releaseMessageBody returns a body buffer to the pool. Nothing may hold on to its bytes.
+func releaseMessageBody(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBodySize {
+		return
+	}
+	buf.Reset()
+	bodyBufferPool.Put(buf)
+}
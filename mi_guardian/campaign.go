@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// --- Mass campaign detection ---
+
+const MassCampaignPrefix = "mi:burst:" // Short-lived counter per content fingerprint
+
+// countCampaignCopy records one more analysis of a content fingerprint and returns
+// how many copies were seen within the current MASS_CAMPAIGN_WINDOW
+func countCampaignCopy(fingerprint string) (int64, error) {
+	key := MassCampaignPrefix + fingerprint
+	count, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		// The window starts with the first copy; later copies don't extend it
+		rdb.Expire(ctx, key, time.Duration(atomic.LoadInt64(&massCampaignWindow)))
+	}
+	return count, nil
+}
+
+// checkMassCampaign flags content analyzed for many recipients within the burst window.
+// A dry run reads the counter as if this copy had been counted.
+func checkMassCampaign(fingerprint string, dryRun bool) (heuristicSignal, bool) {
+	threshold := atomic.LoadInt64(&massCampaignThreshold)
+	if threshold <= 0 || !heuristicEnabled("mass_campaign") {
+		return heuristicSignal{}, false
+	}
+	var count int64
+	var err error
+	if dryRun {
+		count, _ = rdb.Get(ctx, MassCampaignPrefix+fingerprint).Int64()
+		count++
+	} else {
+		count, err = countCampaignCopy(fingerprint)
+	}
+	if err != nil || count < threshold {
+		return heuristicSignal{}, false
+	}
+	window := time.Duration(atomic.LoadInt64(&massCampaignWindow))
+	return heuristicSignal{Label: "mass_campaign", Detail: fmt.Sprintf("%d copies within %s", count, window)}, true
+}
+
+// applyMassCampaign escalates the verdict to MASS_CAMPAIGN_ACTION (soft_spam or spam)
+func applyMassCampaign(res *AnalysisResult, sig heuristicSignal) {
+	if !massCampaignSpam.Load() || res.Action == "spam" {
+		applyHeuristic(res, sig)
+		return
+	}
+	res.Action = "spam"
+	res.Label = sig.Label
+	if floor := math.Min(1.0, heuristicSoftConfidence*heuristicWeight(sig.Label)); res.Confidence < floor {
+		res.Confidence = floor
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/jhillyerd/enmime/mediatype"
+)
+
+// --- Charset sniffing ---
+
+// Some spam declares charset=us-ascii but carries UTF-8 bytes. enmime only trusts its own
+// detection on parts of 100 characters or more, so shorter parts are decoded as the declared
+// charset (Windows-1252 for us-ascii) and normalize to mojibake that hashes far from the
+// correctly labeled message. With CHARSET_SNIFFING on, a message whose us-ascii text parts
+// hold 8-bit bytes (invalid in US-ASCII) is parsed again with those parts read as UTF-8, and
+// the new parse is kept when they are valid UTF-8. Parts declaring a single-byte charset
+// such as ISO-8859-1, where every byte is valid, are left as declared.
+
+// asciiCharsets are the names of US-ASCII in Content-Type charset parameters
+var asciiCharsets = map[string]bool{
+	"us-ascii": true, "ascii": true, "us": true, "iso646-us": true, "ansi_x3.4-1968": true, "csascii": true,
+}
+
+// utf8ForASCIIParser parses messages reading text parts declared us-ascii as UTF-8
+var utf8ForASCIIParser = enmime.NewParser(enmime.SetCustomParseMediaType(asciiAsUTF8))
+
+// asciiAsUTF8 parses a media type like enmime does, declaring UTF-8 in place of US-ASCII
+func asciiAsUTF8(ctype string) (string, map[string]string, []string, error) {
+	mtype, params, invalid, err := mediatype.Parse(ctype)
+	if cs, ok := params["charset"]; ok && asciiCharsets[strings.ToLower(strings.TrimSpace(cs))] {
+		params["charset"] = "utf-8"
+	}
+	return mtype, params, invalid, err
+}
+
+// isTextPart reports whether a part is body text (not an attachment)
+func isTextPart(p *enmime.Part) bool {
+	return strings.HasPrefix(p.ContentType, "text/") && p.Disposition != "attachment"
+}
+
+// mislabeledASCIIParts returns the IDs of the text parts decoded as us-ascii although they
+// hold 8-bit bytes (parts enmime detected a charset for are trusted)
+func mislabeledASCIIParts(env *enmime.Envelope) map[string]bool {
+	ids := make(map[string]bool)
+	if env.Root == nil {
+		return ids
+	}
+	for _, p := range env.Root.DepthMatchAll(isTextPart) {
+		if p.OrigCharset == "" && asciiCharsets[strings.ToLower(p.Charset)] && !isASCII(p.Content) {
+			ids[p.PartID] = true
+		}
+	}
+	return ids
+}
+
+// isASCII reports whether b only holds 7-bit bytes
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// parseEnvelope parses a raw message. With CHARSET_SNIFFING, text parts mislabeled us-ascii
+// are re-decoded as UTF-8 when their bytes are valid UTF-8.
+func parseEnvelope(raw []byte) (*enmime.Envelope, error) {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil || !charsetSniffing.Load() {
+		return env, err
+	}
+	ids := mislabeledASCIIParts(env)
+	if len(ids) == 0 {
+		return env, nil
+	}
+	redecoded, err := utf8ForASCIIParser.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil || redecoded.Root == nil {
+		return env, nil
+	}
+	for _, p := range redecoded.Root.DepthMatchAll(isTextPart) {
+		if ids[p.PartID] && !utf8.Valid(p.Content) {
+			promCharsetRedecoded.WithLabelValues("invalid").Inc()
+			return env, nil
+		}
+	}
+	promCharsetRedecoded.WithLabelValues("utf8").Inc()
+	return redecoded, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Verdict combiners ---
+
+// Every signature of a message gets its own verdict; VERDICT_COMBINER decides how they make
+// the message's verdict:
+//   - first_spam (default): signatures are looked up in order and the first spam verdict
+//     stops the scan; otherwise the most confident soft_spam wins
+//   - strongest: every signature is looked up and the most confident verdict wins
+//   - weighted_vote: every signature is looked up and each signature type votes with its
+//     VERDICT_WEIGHT_<TYPE>; the weighted mean of the votes (a spam counts its confidence,
+//     a soft_spam half of it, an allow nothing) is compared to VERDICT_VOTE_SPAM and
+//     VERDICT_VOTE_SOFT (percents)
+//
+// strongest and weighted_vote cost more lookups (and oracle calls) per message.
+
+const (
+	CombinerFirstSpam    = "first_spam"
+	CombinerStrongest    = "strongest"
+	CombinerWeightedVote = "weighted_vote"
+)
+
+// typeVerdict is the verdict of a signature type: the strongest of its signatures
+type typeVerdict struct {
+	Type   SignatureType
+	Result AnalysisResult
+}
+
+// getVerdictCombiner returns VERDICT_COMBINER
+func getVerdictCombiner() string {
+	if combiner, ok := verdictCombiner.Load().(string); ok && combiner != "" {
+		return combiner
+	}
+	return CombinerFirstSpam
+}
+
+// loadVerdictCombiner reads VERDICT_COMBINER, VERDICT_WEIGHT_<TYPE>, VERDICT_VOTE_SPAM and VERDICT_VOTE_SOFT
+func loadVerdictCombiner() {
+	switch combiner := strings.ToLower(getEnv("VERDICT_COMBINER", CombinerFirstSpam)); combiner {
+	case CombinerFirstSpam, CombinerStrongest, CombinerWeightedVote:
+		verdictCombiner.Store(combiner)
+	default:
+		log.Printf("[Mailuminati] Invalid VERDICT_COMBINER %q, using %s", combiner, CombinerFirstSpam)
+		verdictCombiner.Store(CombinerFirstSpam)
+	}
+	weights := make(map[SignatureType]int64)
+	for _, t := range allSignatureTypes {
+		if w := getEnvInt64("VERDICT_WEIGHT_"+strings.ToUpper(t.String()), 1); w >= 0 {
+			weights[t] = w
+		}
+	}
+	verdictWeights.Store(weights)
+	atomic.StoreInt64(&verdictVoteSpam, getEnvInt64("VERDICT_VOTE_SPAM", 50))
+	atomic.StoreInt64(&verdictVoteSoft, getEnvInt64("VERDICT_VOTE_SOFT", 25))
+}
+
+// getVerdictWeightForType returns the vote weight of a signature type (weighted_vote)
+func getVerdictWeightForType(sigType SignatureType) int64 {
+	if weights, ok := verdictWeights.Load().(map[SignatureType]int64); ok {
+		if w, ok := weights[sigType]; ok {
+			return w
+		}
+	}
+	return 1
+}
+
+// actionRank orders verdict actions by severity
+func actionRank(action string) int {
+	switch action {
+	case "spam":
+		return 2
+	case "soft_spam":
+		return 1
+	}
+	return 0
+}
+
+// effectiveConfidence is the confidence of a verdict, for verdicts that don't carry one
+// (an oracle spam without confidence is certain)
+func effectiveConfidence(res AnalysisResult) float64 {
+	if res.Confidence > 0 || res.Action == "allow" {
+		return res.Confidence
+	}
+	if res.Action == "spam" {
+		return 1.0
+	}
+	return heuristicSoftConfidence
+}
+
+// strongerVerdict reports whether b beats a: the more severe action, then the higher confidence
+func strongerVerdict(a, b AnalysisResult) bool {
+	if ra, rb := actionRank(a.Action), actionRank(b.Action); ra != rb {
+		return rb > ra
+	}
+	return effectiveConfidence(b) > effectiveConfidence(a)
+}
+
+// addTypeVerdict folds a signature verdict into the verdict of its type
+func addTypeVerdict(verdicts []typeVerdict, sigType SignatureType, res AnalysisResult) []typeVerdict {
+	for i := range verdicts {
+		if verdicts[i].Type == sigType {
+			proximity := verdicts[i].Result.ProximityMatch || res.ProximityMatch
+			if strongerVerdict(verdicts[i].Result, res) {
+				verdicts[i].Result = res
+			}
+			verdicts[i].Result.ProximityMatch = proximity
+			return verdicts
+		}
+	}
+	return append(verdicts, typeVerdict{Type: sigType, Result: res})
+}
+
+// mergeFirstSpam folds a signature verdict into the running verdict (first_spam): a spam
+// is final, a soft_spam replaces a less confident one
+func mergeFirstSpam(final *AnalysisResult, res AnalysisResult) {
+	switch {
+	case res.Action == "spam":
+		*final = res
+	case res.Action == "soft_spam" && (final.Action == "allow" || res.Confidence > final.Confidence):
+		*final = res
+	case res.ProximityMatch:
+		final.ProximityMatch = true
+	}
+}
+
+// combineTypeVerdicts makes the message verdict out of the type verdicts (strongest, weighted_vote)
+func combineTypeVerdicts(combiner string, verdicts []typeVerdict) AnalysisResult {
+	final := AnalysisResult{Action: "allow"}
+	for _, v := range verdicts {
+		final.ProximityMatch = final.ProximityMatch || v.Result.ProximityMatch
+	}
+
+	var strongest *AnalysisResult
+	for i := range verdicts {
+		res := &verdicts[i].Result
+		if res.Action == "allow" {
+			continue
+		}
+		if strongest == nil || effectiveConfidence(*res) > effectiveConfidence(*strongest) ||
+			(effectiveConfidence(*res) == effectiveConfidence(*strongest) && actionRank(res.Action) > actionRank(strongest.Action)) {
+			strongest = res
+		}
+	}
+	if strongest == nil {
+		return final
+	}
+	if combiner == CombinerStrongest {
+		return *strongest
+	}
+	return weightedVote(verdicts, final)
+}
+
+// weightedVote applies the weighted_vote combiner. The verdict is built on the strongest
+// spam vote (or soft_spam vote, without one), with the vote score as confidence; a spam
+// needs at least one spam vote.
+func weightedVote(verdicts []typeVerdict, allow AnalysisResult) AnalysisResult {
+	var total, score float64
+	var base *AnalysisResult
+	for i := range verdicts {
+		w := float64(getVerdictWeightForType(verdicts[i].Type))
+		res := &verdicts[i].Result
+		total += w
+		switch res.Action {
+		case "spam":
+			score += w * effectiveConfidence(*res)
+		case "soft_spam":
+			score += w * effectiveConfidence(*res) / 2
+		default:
+			continue
+		}
+		if w > 0 && (base == nil || strongerVerdict(*base, *res)) {
+			base = res
+		}
+	}
+	if total == 0 || base == nil {
+		return allow
+	}
+	score /= total
+
+	res := *base
+	res.Confidence = score
+	switch {
+	case score >= float64(atomic.LoadInt64(&verdictVoteSpam))/100 && base.Action == "spam":
+		// A spam it stays
+	case score >= float64(atomic.LoadInt64(&verdictVoteSoft))/100:
+		res.Action = "soft_spam"
+		if soft, ok := softLabels[res.Label]; ok {
+			res.Label = soft
+		}
+	default:
+		return allow
+	}
+	return res
+}
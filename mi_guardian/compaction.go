@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Local learning compaction ---
+
+// compactionWorker periodically merges near-duplicate learned hashes (COMPACTION_ENABLED)
+func compactionWorker() {
+	for {
+		time.Sleep(time.Duration(atomic.LoadInt64(&compactionInterval)))
+		if !compactionEnabled.Load() {
+			continue
+		}
+		start := time.Now()
+		merged := compactLearnedHashes(int(atomic.LoadInt64(&compactionDistance)))
+		log.Printf("[Mailuminati] Compaction merged %d learned hashes in %s", merged, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// compactLearnedHashes clusters learned hashes within maxDist of each other and merges each cluster
+// into one representative (the highest score): scores are summed, the oldest learned_at is kept, the
+// cluster gets a campaign ID and the other hashes are pruned along with their band memberships.
+// Returns the number of hashes merged away.
+func compactLearnedHashes(maxDist int) int {
+	var hashes []string
+	iter := rdb.Scan(ctx, 0, LocalScorePrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		hashes = append(hashes, strings.TrimPrefix(iter.Val(), LocalScorePrefix))
+	}
+	if iter.Err() != nil || len(hashes) < 2 {
+		promCompactionLastRun.Set(0)
+		return 0
+	}
+
+	scores := make(map[string]int64, len(hashes))
+	learnedAt := make(map[string]int64, len(hashes))
+	campaigns := make(map[string]string)
+	pipe := rdb.Pipeline()
+	scoreCmds := make(map[string]*redis.StringCmd, len(hashes))
+	learnedCmds := make(map[string]*redis.StringCmd, len(hashes))
+	campaignCmds := make(map[string]*redis.StringCmd, len(hashes))
+	for _, h := range hashes {
+		scoreCmds[h] = pipe.Get(ctx, LocalScorePrefix+h)
+		learnedCmds[h] = pipe.Get(ctx, LocalLearnedPrefix+h)
+		campaignCmds[h] = pipe.Get(ctx, LocalCampaignPrefix+h)
+	}
+	pipe.Exec(ctx)
+	for _, h := range hashes {
+		scores[h], _ = scoreCmds[h].Int64()
+		learnedAt[h], _ = learnedCmds[h].Int64()
+		if id := campaignCmds[h].Val(); id != "" {
+			campaigns[h] = id
+		}
+	}
+
+	// Strongest hashes become representatives
+	sort.Slice(hashes, func(i, j int) bool {
+		if scores[hashes[i]] != scores[hashes[j]] {
+			return scores[hashes[i]] > scores[hashes[j]]
+		}
+		return hashes[i] < hashes[j]
+	})
+
+	merged := 0
+	assigned := make(map[string]bool, len(hashes))
+	for _, rep := range hashes {
+		if assigned[rep] {
+			continue
+		}
+		assigned[rep] = true
+		cluster := nearLearnedHashes(rep, maxDist, scores, assigned)
+		if len(cluster) == 0 {
+			continue
+		}
+		mergeLearnedHashes(rep, cluster, scores, learnedAt, campaigns)
+		merged += len(cluster)
+	}
+
+	promCompactionMerged.Add(float64(merged))
+	promCompactionLastRun.Set(float64(merged))
+	return merged
+}
+
+// nearLearnedHashes finds unassigned learned hashes within maxDist of rep through the band index, and marks them assigned
+func nearLearnedHashes(rep string, maxDist int, scores map[string]int64, assigned map[string]bool) []string {
+	pipe := rdb.Pipeline()
+	var cmds []*redis.StringSliceCmd
+	for _, band := range signatureBands(rep) {
+		cmds = append(cmds, pipe.SMembers(ctx, LocalFragPrefix+band))
+	}
+	pipe.Exec(ctx)
+
+	seen := make(map[string]struct{})
+	var candidates []string
+	for _, cmd := range cmds {
+		for _, h := range cmd.Val() {
+			if _, known := scores[h]; !known || assigned[h] {
+				continue
+			}
+			if _, ok := seen[h]; !ok {
+				seen[h] = struct{}{}
+				candidates = append(candidates, h)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	distances, err := distancerForSignature(rep).Distances(rep, candidates)
+	if err != nil {
+		return nil
+	}
+	var cluster []string
+	for _, h := range candidates {
+		if dist, ok := distances[h]; ok && dist <= maxDist {
+			assigned[h] = true
+			cluster = append(cluster, h)
+		}
+	}
+	sort.Strings(cluster)
+	return cluster
+}
+
+// maxMergeAttempts bounds the retries of a merge whose members changed while it was prepared
+const maxMergeAttempts = 3
+
+// mergeLearnedHashes folds the cluster members into rep and prunes them. The members are
+// re-read and pruned in one transaction, so a report landing on a member during
+// compaction is carried over rather than deleted with it.
+func mergeLearnedHashes(rep string, members []string, scores, learnedAt map[string]int64, campaigns map[string]string) {
+	watched := make([]string, 0, 2*len(members))
+	for _, h := range members {
+		watched = append(watched, LocalScorePrefix+h, LocalLearnedPrefix+h)
+	}
+
+	merge := func(tx *redis.Tx) error {
+		scoreCmds := make([]*redis.StringCmd, len(members))
+		learnedCmds := make([]*redis.StringCmd, len(members))
+		tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, h := range members {
+				scoreCmds[i] = pipe.Get(ctx, LocalScorePrefix+h)
+				learnedCmds[i] = pipe.Get(ctx, LocalLearnedPrefix+h)
+			}
+			return nil
+		})
+		var total int64
+		oldest := learnedAt[rep]
+		for i, h := range members {
+			scores[h], _ = scoreCmds[i].Int64()
+			learnedAt[h], _ = learnedCmds[i].Int64()
+			total += scores[h]
+			if learnedAt[h] > 0 && (oldest == 0 || learnedAt[h] < oldest) {
+				oldest = learnedAt[h]
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.IncrBy(ctx, LocalScorePrefix+rep, total)
+			if len(members) > 0 {
+				// Keep the members' report history so the merged score decays the same way
+				keys := []string{LocalReportsPrefix + rep}
+				for _, h := range members {
+					keys = append(keys, LocalReportsPrefix+h)
+				}
+				pipe.ZUnionStore(ctx, LocalReportsPrefix+rep, &redis.ZStore{Keys: keys, Aggregate: "MAX"})
+				pipe.Expire(ctx, LocalReportsPrefix+rep, learnedRetention(rep))
+				// And the sources that reported them, so the merge doesn't cost the cluster its confirmation
+				sourceKeys := []string{LocalSourcesPrefix + rep}
+				for _, h := range members {
+					sourceKeys = append(sourceKeys, LocalSourcesPrefix+h)
+				}
+				pipe.SUnionStore(ctx, LocalSourcesPrefix+rep, sourceKeys...)
+				pipe.Expire(ctx, LocalSourcesPrefix+rep, learnedRetention(rep))
+			}
+			if oldest > 0 && oldest != learnedAt[rep] {
+				pipe.Set(ctx, LocalLearnedPrefix+rep, oldest, redis.KeepTTL)
+			}
+			pipe.Set(ctx, LocalCampaignPrefix+rep, clusterCampaignID(rep, members, scores, campaigns), learnedRetention(rep))
+			for _, h := range members {
+				for _, band := range signatureBands(h) {
+					pipe.SRem(ctx, LocalFragPrefix+band, h)
+				}
+				pipe.Del(ctx, LocalScorePrefix+h, LocalLearnedPrefix+h, LocalTypePrefix+h, LocalReportsPrefix+h, LocalCampaignPrefix+h, LocalSourcesPrefix+h)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < maxMergeAttempts; attempt++ {
+		err := rdb.Watch(ctx, merge, watched...)
+		if err != redis.TxFailedErr {
+			if err != nil {
+				log.Printf("[Mailuminati] Compaction merge into %s failed: %v", rep, err)
+			}
+			return
+		}
+	}
+	log.Printf("[Mailuminati] Compaction merge into %s skipped: members kept changing", rep)
+}
+
+// --- Campaign IDs ---
+
+// A cluster of learned hashes merged by compaction is a campaign. Its ID is assigned at the
+// first merge and carried by the representative, so verdicts matching it return the same
+// campaign_id however the campaign's variants are later merged: a cluster keeps the ID of
+// its representative, or else of its strongest member that had one.
+
+// clusterCampaignID returns the campaign ID of a cluster being merged into rep
+func clusterCampaignID(rep string, members []string, scores map[string]int64, campaigns map[string]string) string {
+	if id, ok := campaigns[rep]; ok {
+		return id
+	}
+	var best string
+	for _, h := range members {
+		if _, ok := campaigns[h]; ok && (best == "" || scores[h] > scores[best]) {
+			best = h
+		}
+	}
+	if best != "" {
+		return campaigns[best]
+	}
+	return newCampaignID(rep)
+}
+
+// newCampaignID derives the ID of a new campaign from its first representative
+func newCampaignID(rep string) string {
+	sum := sha256.Sum256([]byte(rep))
+	return "cmp_" + hex.EncodeToString(sum[:6])
+}
+
+// localCampaignID returns the campaign of a learned hash ("" if it never absorbed variants)
+func localCampaignID(hash string) string {
+	id, _ := rdb.Get(ctx, LocalCampaignPrefix+hash).Result()
+	return id
+}
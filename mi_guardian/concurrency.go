@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Analyze concurrency limit ---
+
+// MAX_CONCURRENT_ANALYZE caps how many /analyze requests are processed at once, to
+// protect Redis and CPU under bursts. A request arriving when the limit is reached
+// waits up to ANALYZE_QUEUE_TIMEOUT for a slot, then gets a 503 (0 = reject at once).
+
+// analyzeSlots is the semaphore of the current limit. A new semaphore is created when
+// the limit changes; requests release the slot they acquired, in their semaphore.
+type analyzeSlots struct {
+	limit int64
+	slots chan struct{}
+}
+
+var (
+	analyzeSlotsMutex   sync.Mutex
+	currentAnalyzeSlots *analyzeSlots // nil = no limit
+)
+
+// setAnalyzeConcurrency applies the MAX_CONCURRENT_ANALYZE setting (0 = no limit)
+func setAnalyzeConcurrency(limit int64) {
+	analyzeSlotsMutex.Lock()
+	defer analyzeSlotsMutex.Unlock()
+	if limit <= 0 {
+		currentAnalyzeSlots = nil
+		return
+	}
+	if currentAnalyzeSlots == nil || currentAnalyzeSlots.limit != limit {
+		currentAnalyzeSlots = &analyzeSlots{limit: limit, slots: make(chan struct{}, limit)}
+	}
+}
+
+// acquireAnalyzeSlot waits up to timeout for a slot. It returns the release function,
+// or false when no slot freed up in time.
+func acquireAnalyzeSlot(timeout time.Duration, done <-chan struct{}) (func(), bool) {
+	analyzeSlotsMutex.Lock()
+	s := currentAnalyzeSlots
+	analyzeSlotsMutex.Unlock()
+
+	if s == nil {
+		promAnalyzeInFlight.Inc()
+		return promAnalyzeInFlight.Dec, true
+	}
+	release := func() {
+		<-s.slots
+		promAnalyzeInFlight.Dec()
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		promAnalyzeInFlight.Inc()
+		return release, true
+	default:
+	}
+	if timeout <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		promAnalyzeInFlight.Inc()
+		return release, true
+	case <-timer.C:
+	case <-done:
+	}
+	return nil, false
+}
+
+// limitAnalyzeConcurrency wraps the analyze handler with the MAX_CONCURRENT_ANALYZE limit
+func limitAnalyzeConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := acquireAnalyzeSlot(time.Duration(atomic.LoadInt64(&analyzeQueueTimeout)), r.Context().Done())
+		if !ok {
+			promAnalyzeRejected.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent analyze requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	}
+}
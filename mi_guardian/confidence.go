@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// --- Confidence breakdown ---
+
+const (
+	scoreSaturation         = 5         // Local spam score at which the score signal reaches 1.0
+	oracleSpamCacheDuration = time.Hour // Lifetime of cached oracle spam verdicts
+)
+
+// ConfidenceBreakdown explains a verdict's confidence with its sub-signals, each in [0, 1].
+// Signals that don't apply to the match (e.g. no score for oracle verdicts) are omitted.
+type ConfidenceBreakdown struct {
+	Distance       *float64 `json:"distance,omitempty"`        // Closeness of the matched hash (1.0 = identical)
+	BandRatio      *float64 `json:"band_ratio,omitempty"`      // Share of the signature's bands found in the index
+	ScoreMagnitude *float64 `json:"score_magnitude,omitempty"` // Local spam score relative to scoreSaturation
+	Recency        *float64 `json:"recency,omitempty"`         // Freshness of the knowledge (1.0 = just learned/cached)
+}
+
+func subSignal(v float64) *float64 {
+	v = math.Max(0, math.Min(1, v))
+	return &v
+}
+
+// newBreakdown starts a breakdown from the distance confidence and the band match ratio
+func newBreakdown(distanceConfidence float64, matchedBands, totalBands int) *ConfidenceBreakdown {
+	b := &ConfidenceBreakdown{Distance: subSignal(distanceConfidence)}
+	if totalBands > 0 {
+		b.BandRatio = subSignal(float64(matchedBands) / float64(totalBands))
+	}
+	return b
+}
+
+// withScore adds the local spam score signal
+func (b *ConfidenceBreakdown) withScore(score int64) *ConfidenceBreakdown {
+	b.ScoreMagnitude = subSignal(float64(score) / scoreSaturation)
+	return b
+}
+
+// withRecency adds how fresh knowledge stamped at knownAt is over its lifetime (unknown stamps are skipped)
+func (b *ConfidenceBreakdown) withRecency(knownAt int64, lifetime time.Duration) *ConfidenceBreakdown {
+	if knownAt > 0 && lifetime > 0 {
+		age := time.Since(time.Unix(knownAt, 0))
+		b.Recency = subSignal(1 - float64(age)/float64(lifetime))
+	}
+	return b
+}
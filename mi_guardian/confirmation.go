@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Learning confirmation by distinct sources ---
+
+// With LEARNING_MIN_SOURCES above 1, a hash learned from spam reports only blocks once that
+// many distinct sources reported it: until then its matches are held as soft_spam
+// (local_unconfirmed). A report's source is the client IP, or the optional "source" field
+// of /report (a node, mailbox or plugin name) when the caller holds the ADMIN_TOKEN: an
+// unauthenticated client could otherwise claim as many sources as needed. Hashes learned by Guardian itself
+// (spam traps, oracle cache promotion) are confirmed outright, as are hashes learned
+// before sources were tracked.
+
+// ReportSourceSystem marks hashes learned by Guardian itself; it can't be sent by a client
+const ReportSourceSystem = "@system"
+
+const maxReportSourceLen = 128
+
+// reportSource returns the source of a report: the one declared by an admin caller, or
+// else the client IP
+func reportSource(declared string, r *http.Request) string {
+	source := strings.TrimLeft(strings.ToLower(strings.TrimSpace(declared)), "@")
+	if len(source) > maxReportSourceLen {
+		source = source[:maxReportSourceLen]
+	}
+	if source != "" && isAdminRequest(r) {
+		return source
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// learningConfirmationEnabled reports whether hashes need several distinct sources to block
+func learningConfirmationEnabled() bool {
+	return atomic.LoadInt64(&learningMinSources) > 1
+}
+
+// recordReportSources adds source to the report sources of the learned hashes
+func recordReportSources(hashes []string, source string) {
+	if !learningConfirmationEnabled() || source == "" {
+		return
+	}
+	pipe := rdb.Pipeline()
+	for _, hash := range hashes {
+		pipe.SAdd(ctx, LocalSourcesPrefix+hash, source)
+		pipe.Expire(ctx, LocalSourcesPrefix+hash, learnedRetention(hash))
+	}
+	pipe.Exec(ctx)
+}
+
+// localHashConfirmed reports whether a learned hash was reported by enough distinct sources
+// to block. Hashes without tracked sources, or learned by Guardian itself, are confirmed.
+func localHashConfirmed(hash string) bool {
+	if !learningConfirmationEnabled() {
+		return true
+	}
+	key := LocalSourcesPrefix + hash
+	pipe := rdb.Pipeline()
+	count := pipe.SCard(ctx, key)
+	system := pipe.SIsMember(ctx, key, ReportSourceSystem)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return true // Fail open, as before confirmation existed
+	}
+	return count.Val() == 0 || system.Val() || count.Val() >= atomic.LoadInt64(&learningMinSources)
+}
+
+// localSourceCount returns the number of distinct sources that reported a learned hash
+func localSourceCount(hash string) int64 {
+	n, _ := rdb.SCard(ctx, LocalSourcesPrefix+hash).Result()
+	return n
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+)
+
+// --- Conflicting local candidates ---
+
+// A signature can be within threshold of several learned hashes, some reported as spam,
+// some driven negative by ham reports. LOCAL_CONFLICT_POLICY decides the verdict:
+//   - any_spam (default): any trusted spam candidate matches
+//   - highest_score: the candidate with the highest score decides
+//   - nearest: the nearest candidate decides
+//   - net_score: the scores of all candidates are summed; a positive sum matches
+//
+// With the last three, a heavily hammed neighbor can override a weakly spammy one.
+
+const (
+	LocalConflictAnySpam      = "any_spam"
+	LocalConflictHighestScore = "highest_score"
+	LocalConflictNearest      = "nearest"
+	LocalConflictNetScore     = "net_score"
+)
+
+// localCandidate is a learned hash within threshold of a signature
+type localCandidate struct {
+	Hash     string
+	Distance int
+	Score    int64
+}
+
+// getLocalConflictPolicy returns the configured LOCAL_CONFLICT_POLICY
+func getLocalConflictPolicy() string {
+	if policy, ok := localConflictPolicy.Load().(string); ok {
+		return policy
+	}
+	return LocalConflictAnySpam
+}
+
+// resolveLocalCandidates picks the candidate a spam verdict is based on. It returns false
+// when no candidate is a trusted spam hash, or when the policy lets ham candidates win
+// (overridden is then true).
+func resolveLocalCandidates(candidates []localCandidate, trusted func(localCandidate) bool) (match localCandidate, ok, overridden bool) {
+	if len(candidates) == 0 {
+		return localCandidate{}, false, false
+	}
+	// Nearest first; on equal distance, highest score first
+	sorted := append([]localCandidate(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Distance != sorted[j].Distance {
+			return sorted[i].Distance < sorted[j].Distance
+		}
+		return sorted[i].Score > sorted[j].Score
+	})
+	nearestTrusted := func() (localCandidate, bool) {
+		for _, c := range sorted {
+			if trusted(c) {
+				return c, true
+			}
+		}
+		return localCandidate{}, false
+	}
+
+	var decider localCandidate
+	switch getLocalConflictPolicy() {
+	case LocalConflictNearest:
+		decider = sorted[0]
+	case LocalConflictHighestScore:
+		decider = sorted[0]
+		for _, c := range sorted[1:] {
+			if c.Score > decider.Score {
+				decider = c
+			}
+		}
+	case LocalConflictNetScore:
+		var net int64
+		for _, c := range sorted {
+			net += c.Score
+		}
+		if net <= 0 {
+			_, anySpam := nearestTrusted()
+			return localCandidate{}, false, anySpam
+		}
+		match, ok = nearestTrusted()
+		return match, ok, false
+	default:
+		match, ok = nearestTrusted()
+		return match, ok, false
+	}
+
+	if trusted(decider) {
+		return decider, true, false
+	}
+	_, anySpam := nearestTrusted()
+	return localCandidate{}, false, anySpam
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Dangerous attachment extensions ---
+
+// Some attachment types have no business in mail whatever their content: executables,
+// scripts, shortcuts and disk images. With DANGEROUS_ATTACHMENT_ACTION set, an attachment
+// whose (decoded) file name ends in one of the DANGEROUS_EXTENSIONS makes the message
+// soft_spam (a heuristic) or spam (an immediate verdict), with label dangerous_attachment.
+// Names hiding the extension behind a document one ("invoice.pdf.exe"), a right-to-left
+// override or trailing dots are reported as such.
+
+// defaultDangerousExtensions are the extensions checked when DANGEROUS_EXTENSIONS is unset
+var defaultDangerousExtensions = []string{
+	"exe", "scr", "com", "pif", "cpl", "msi", "msp", "dll",
+	"bat", "cmd", "ps1", "vbs", "vbe", "js", "jse", "wsf", "wsh", "hta", "jar",
+	"lnk", "reg", "scf", "iso", "img", "vhd", "vhdx",
+}
+
+// bidiControls are the Unicode direction controls used to reverse a file name's display
+var bidiControls = strings.NewReplacer(
+	"\u200e", "", "\u200f", "", "\u202a", "", "\u202b", "", "\u202c", "", "\u202d", "", "\u202e", "",
+	"\u2066", "", "\u2067", "", "\u2068", "", "\u2069", "",
+)
+
+// reDocumentExtension matches what a reader takes for a file type ("pdf", "docx", "jpg")
+var reDocumentExtension = regexp.MustCompile(`^[a-z][a-z0-9]{1,4}$`)
+
+// getDangerousAttachmentAction returns DANGEROUS_ATTACHMENT_ACTION: off, soft_spam or spam
+func getDangerousAttachmentAction() string {
+	if action, ok := dangerousAttachmentAction.Load().(string); ok && action != "" {
+		return action
+	}
+	return "off"
+}
+
+// loadDangerousExtensions reads DANGEROUS_EXTENSIONS ("exe,.scr,...") as a set
+func loadDangerousExtensions() map[string]bool {
+	list := getEnvList("DANGEROUS_EXTENSIONS")
+	if len(list) == 0 {
+		list = defaultDangerousExtensions
+	}
+	exts := make(map[string]bool, len(list))
+	for _, ext := range list {
+		if ext = strings.TrimPrefix(ext, "."); ext != "" {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
+
+// attachmentFileName returns the file name of a part as a mail client would show it:
+// encoded words decoded (enmime leaves some malformed ones), path and direction controls removed
+func attachmentFileName(p *enmime.Part) string {
+	name := p.FileName
+	if strings.Contains(name, "=?") {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+	name = bidiControls.Replace(name)
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// fileExtensions returns the extension of a file name and the one before it ("" if none).
+// Trailing dots and spaces, dropped by Windows, are ignored.
+func fileExtensions(name string) (ext, inner string) {
+	name = strings.ToLower(strings.TrimRight(name, ". "))
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", ""
+	}
+	ext = strings.TrimSpace(name[i+1:])
+	stem := strings.TrimRight(name[:i], ". ")
+	if j := strings.LastIndex(stem, "."); j >= 0 {
+		inner = strings.TrimSpace(stem[j+1:])
+	}
+	return ext, inner
+}
+
+// checkDangerousAttachment flags the first attachment with a dangerous extension
+func checkDangerousAttachment(env *enmime.Envelope, exts map[string]bool) (heuristicSignal, bool) {
+	parts := append(append([]*enmime.Part{}, env.Attachments...), env.Inlines...)
+	for _, p := range parts {
+		name := attachmentFileName(p)
+		if name == "" {
+			continue
+		}
+		ext, inner := fileExtensions(name)
+		if !exts[ext] {
+			continue
+		}
+		detail := name
+		switch {
+		case reDocumentExtension.MatchString(inner) && !exts[inner]:
+			detail += " (double extension)"
+		case bidiControls.Replace(p.FileName) != p.FileName || strings.TrimRight(name, ". ") != name:
+			detail += " (disguised name)"
+		}
+		return heuristicSignal{Label: "dangerous_attachment", Detail: detail}, true
+	}
+	return heuristicSignal{}, false
+}
+
+// scanDangerousAttachment runs the dangerous attachment check when DANGEROUS_ATTACHMENT_ACTION is set
+func scanDangerousAttachment(env *enmime.Envelope, messageID string) (heuristicSignal, bool) {
+	if getDangerousAttachmentAction() == "off" {
+		return heuristicSignal{}, false
+	}
+	exts, _ := dangerousExtensions.Load().(map[string]bool)
+	sig, ok := checkDangerousAttachment(env, exts)
+	if ok {
+		log.Printf("[Mailuminati] Dangerous attachment %s | Message-ID: %s", sig.Detail, messageID)
+	}
+	return sig, ok
+}
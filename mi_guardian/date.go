@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Date header anomalies ---
+
+// Legitimate mail is dated by the sending MTA or client, a few seconds or minutes before
+// it reaches us. Spam tools often leave the Date header out, date it days ahead so it
+// sorts on top of the inbox, or replay a template with its original date. With
+// DATE_ANOMALY_CHECK on, a Date header missing, unparsable, more than DATE_MAX_FUTURE_SKEW
+// ahead or more than DATE_MAX_AGE old raises the date_anomaly heuristic.
+
+const (
+	DateAnomalyMissing    = "missing"
+	DateAnomalyUnparsable = "unparsable"
+	DateAnomalyFuture     = "future"
+	DateAnomalyPast       = "past"
+)
+
+// dateFallbackLayouts are the non-RFC 5322 formats met in the wild, tried after mail.ParseDate
+var dateFallbackLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	time.ANSIC,
+	time.UnixDate,
+	time.RubyDate,
+	time.RFC850,
+	"Monday, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 -0700 MST",
+	"Mon, 2 Jan 2006 15:04:05 MST -0700",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"2 January 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15.04.05 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05",
+}
+
+var (
+	reDateComment = regexp.MustCompile(`\([^)]*\)`)
+	reDateGMT     = regexp.MustCompile(`(?i)\b(?:GMT|UTC)([+-]\d{4})\b`)
+)
+
+// messageDate is the outcome of the Date header check, as reported by /explain
+type messageDate struct {
+	Header  string `json:"header,omitempty"`
+	Parsed  string `json:"parsed,omitempty"` // RFC 3339, UTC
+	Anomaly string `json:"anomaly,omitempty"`
+	Offset  string `json:"offset,omitempty"` // Date minus analysis time, for future and past anomalies
+}
+
+// parseDateHeader parses a Date header, RFC 5322 first (obsolete forms included), then
+// the common non-conforming formats
+func parseDateHeader(value string) (time.Time, bool) {
+	value = strings.Join(strings.Fields(reDateComment.ReplaceAllString(value, " ")), " ")
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := mail.ParseDate(value); err == nil {
+		return t, true
+	}
+	value = reDateGMT.ReplaceAllString(value, "$1") // "GMT+0200"
+	value = strings.TrimSuffix(strings.TrimSpace(value), ",")
+	if t, err := mail.ParseDate(value); err == nil {
+		return t, true
+	}
+	for _, layout := range dateFallbackLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// inspectDateHeader checks the Date header of a message against now
+func inspectDateHeader(env *enmime.Envelope, now time.Time, maxFutureSkew, maxAge time.Duration) *messageDate {
+	if env.Root == nil {
+		return nil
+	}
+	values := env.Root.Header[textproto.CanonicalMIMEHeaderKey("Date")]
+	if len(values) == 0 || strings.TrimSpace(values[0]) == "" {
+		return &messageDate{Anomaly: DateAnomalyMissing}
+	}
+	d := &messageDate{Header: strings.TrimSpace(values[0])}
+	t, ok := parseDateHeader(d.Header)
+	if !ok {
+		d.Anomaly = DateAnomalyUnparsable
+		return d
+	}
+	d.Parsed = t.UTC().Format(time.RFC3339)
+	offset := t.Sub(now)
+	switch {
+	case maxFutureSkew > 0 && offset > maxFutureSkew:
+		d.Anomaly = DateAnomalyFuture
+	case maxAge > 0 && -offset > maxAge:
+		d.Anomaly = DateAnomalyPast
+	}
+	if d.Anomaly != "" {
+		d.Offset = offset.Round(time.Second).String()
+	}
+	return d
+}
+
+// checkDateAnomaly flags a message whose Date header is missing, unparsable or out of range
+func checkDateAnomaly(d *messageDate) (heuristicSignal, bool) {
+	if d == nil || d.Anomaly == "" {
+		return heuristicSignal{}, false
+	}
+	detail := d.Anomaly
+	if d.Offset != "" {
+		detail += " (" + d.Offset + ")"
+	}
+	return heuristicSignal{Label: "date_anomaly", Detail: detail}, true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// --- Signature debugging ---
+
+// debugHashContent prepares content the way scanEnvelope does for a signature type. For
+// combined signatures, subject is prepended to the normalized body.
+func debugHashContent(sigType SignatureType, content, subject string) (string, bool) {
+	switch sigType {
+	case SigNormalized:
+		return normalizeEmailBody(content, ""), true
+	case SigRaw, SigAttachment:
+		return content, true
+	case SigURL:
+		return strings.Join(extractURLs(content), "\n"), true
+	case SigSubject:
+		return subjectHashContent(content), true
+	case SigCombined:
+		return normalizeSubject(subject) + "\n" + normalizeEmailBody(content, ""), true
+	case SigStructure:
+		return htmlSkeleton(content), true
+	}
+	return "", false
+}
+
+// debugHashHandler recomputes a signature and its LSH bands from supplied content
+// (POST /debug/hash), so clients can check whether two messages should match.
+// Body: {"type": "normalized", "content": "...", "subject": "...", "base64": false}.
+// Read-only: nothing is stored or looked up.
+func debugHashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		Type    string `json:"type"`
+		Content string `json:"content"`
+		Subject string `json:"subject"` // Combined signatures only
+		Base64  bool   `json:"base64"`  // Content is base64 (binary attachments)
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxProcessSize)).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(reqBody.Content)
+		if err != nil {
+			http.Error(w, "Invalid base64 content", http.StatusBadRequest)
+			return
+		}
+		reqBody.Content = string(decoded)
+	}
+
+	sigType := parseSignatureType(strings.ToLower(strings.TrimSpace(reqBody.Type)))
+	if reqBody.Type == "" {
+		sigType = SigNormalized
+	}
+	hashed, ok := debugHashContent(sigType, reqBody.Content, reqBody.Subject)
+	if !ok {
+		http.Error(w, "Unknown signature type: "+reqBody.Type, http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"type":          sigType.String(),
+		"hashed_length": len(hashed),
+	}
+	status := http.StatusOK
+	if sigType == SigURL && getDistanceMetricForType(SigURL) == "jaccard" {
+		sig := urlSetSignature(extractURLs(reqBody.Content))
+		resp["signature"] = sig
+		resp["bands"] = signatureBands(sig)
+	} else if sig, err := computeLocalTLSH(hashed); err != nil {
+		resp["error"] = err.Error()
+		status = http.StatusUnprocessableEntity
+	} else {
+		resp["signature"] = sig
+		resp["bands"] = signatureBands(sig)
+	}
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(respBytes)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// --- Forwarded/quoted message stripping ---
+
+var (
+	reQuotePrefix = regexp.MustCompile(`^[ \t]*(>[ \t]?)+`)
+	// Reply attribution ("On Mon, 1 Jan 2026, Bob <bob@example.com> wrote:"), possibly wrapped by the MUA
+	reAttribution = regexp.MustCompile(`(?i)^on\s.+\swrote:\s*$`)
+	// Separators MUAs put before a forwarded or quoted original
+	reForwardSeparator = regexp.MustCompile(`(?i)^[ \t]*(-{2,}\s*(forwarded message|original message|message d'origine|weitergeleitete nachricht|message transféré)\s*-{2,}|begin forwarded message:)\s*$`)
+	// Header lines MUAs repeat right after a forward separator
+	reForwardHeader = regexp.MustCompile(`(?i)^[ \t]*(from|sent|date|to|cc|subject|de|envoyé|à|objet|von|gesendet|an|betreff)\s*:`)
+	reBlockquoteTag = regexp.MustCompile(`(?i)</?blockquote[^>]*>`)
+)
+
+// dequoteText strips quote markers, reply attributions and forward separators (with the
+// header block that follows them), so a forwarded spam normalizes like the original
+func dequoteText(text string) string {
+	lines := strings.Split(text, "\n")
+	out := make([]string, 0, len(lines))
+	inForwardHeaders := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		line = reQuotePrefix.ReplaceAllString(line, "")
+
+		if reForwardSeparator.MatchString(line) {
+			inForwardHeaders = true
+			continue
+		}
+		if inForwardHeaders {
+			if reForwardHeader.MatchString(line) {
+				continue
+			}
+			inForwardHeaders = false
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+		}
+		if reAttribution.MatchString(line) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// dequoteHTML unwraps <blockquote> elements used by webmails to quote the original
+func dequoteHTML(html string) string {
+	return reBlockquoteTag.ReplaceAllString(html, "")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// --- Display-name spoofing ---
+
+// Spammers put a trusted brand or person in the From display name while the address is
+// unrelated ("PayPal Support <x@random.ru>"). PROTECTED_DISPLAY_NAMES lists the names to
+// protect, each with the domains allowed to use it:
+//
+//	PROTECTED_DISPLAY_NAMES=paypal=paypal.com|paypal.fr,john smith=example.com,amazon
+//
+// A name without domains is allowed from any domain with the name as a label (amazon.de,
+// mail.amazon.com). A display name claiming a protected name from another domain raises
+// the display_name_spoof heuristic.
+
+// maxDisplayNameWords bounds the word runs compared to the protected names
+const maxDisplayNameWords = 24
+
+// protectedDisplayName is a PROTECTED_DISPLAY_NAMES entry
+type protectedDisplayName struct {
+	Name    string   // As configured
+	Key     string   // Folded, without spaces
+	Domains []string // Authorized sender domains (subdomains included)
+}
+
+// parseProtectedDisplayNames parses the PROTECTED_DISPLAY_NAMES entries ("name=domain|domain")
+func parseProtectedDisplayNames(entries []string) []protectedDisplayName {
+	var names []protectedDisplayName
+	for _, entry := range entries {
+		name, domains, _ := strings.Cut(entry, "=")
+		key := strings.Join(displayNameWords(name), "")
+		if key == "" {
+			continue
+		}
+		p := protectedDisplayName{Name: strings.TrimSpace(name), Key: key}
+		for _, d := range strings.Split(domains, "|") {
+			if d = strings.TrimPrefix(strings.TrimSpace(d), "@"); d != "" {
+				p.Domains = append(p.Domains, d)
+			}
+		}
+		names = append(names, p)
+	}
+	return names
+}
+
+// authorizes reports whether domain may use the protected name
+func (p protectedDisplayName) authorizes(domain string) bool {
+	if len(p.Domains) == 0 {
+		for _, label := range strings.Split(domain, ".") {
+			if label == p.Key {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range p.Domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// displayNameConfusables folds look-alike characters to the Latin letter they imitate
+var displayNameConfusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'һ': 'h', 'ԁ': 'd', // Cyrillic
+	'α': 'a', 'ο': 'o', 'ρ': 'p', 'ν': 'v', 'ι': 'i', 'κ': 'k', 'τ': 't', // Greek
+	'0': 'o', '1': 'l',
+}
+
+// displayNameWords folds a display name (case, look-alikes, full-width forms) and splits it
+// into words. Punctuation, symbols and invisible characters separate words.
+func displayNameWords(name string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 0xFF01 && r <= 0xFF5E { // Full-width ASCII
+			r = unicode.ToLower(r - 0xFEE0)
+		}
+		if c, ok := displayNameConfusables[r]; ok {
+			r = c
+		}
+		switch {
+		case unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Mn, r):
+			// Zero-width and combining characters are dropped, joining what they split
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte(' ')
+		}
+	}
+	words := strings.Fields(b.String())
+	if len(words) > maxDisplayNameWords {
+		words = words[:maxDisplayNameWords]
+	}
+	return words
+}
+
+// parseFromHeader splits a From header into display name and address. Malformed
+// headers fall back to "name <address>" splitting, or a bare address.
+func parseFromHeader(fromHeader string) (name, address string) {
+	if addr, err := mail.ParseAddress(fromHeader); err == nil {
+		return addr.Name, addr.Address
+	}
+	if idx := strings.LastIndex(fromHeader, "<"); idx != -1 {
+		name = strings.Trim(strings.TrimSpace(fromHeader[:idx]), `"'`)
+		address = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(fromHeader[idx+1:]), ">"))
+		return name, address
+	}
+	return "", strings.TrimSpace(fromHeader)
+}
+
+// claimedName returns the protected name a display name claims, matching whole words
+// (so "Pay Pal" and "PAYPAL-Billing" claim paypal, "Pineapple" doesn't claim apple)
+func claimedName(words []string, protected []protectedDisplayName) (protectedDisplayName, bool) {
+	for _, p := range protected {
+		for i := range words {
+			run := ""
+			for j := i; j < len(words) && len(run) < len(p.Key); j++ {
+				run += words[j]
+			}
+			if run == p.Key {
+				return p, true
+			}
+		}
+	}
+	return protectedDisplayName{}, false
+}
+
+// checkDisplayNameSpoof flags a From display name claiming a protected name from a
+// domain not authorized for it. An address in the display name counts as a claim too.
+func checkDisplayNameSpoof(fromHeader string, protected []protectedDisplayName) (heuristicSignal, bool) {
+	if len(protected) == 0 {
+		return heuristicSignal{}, false
+	}
+	name, address := parseFromHeader(fromHeader)
+	domain := extractDomain(address)
+	if strings.TrimSpace(name) == "" || domain == "" {
+		return heuristicSignal{}, false
+	}
+	p, ok := claimedName(displayNameWords(name), protected)
+	if !ok || p.authorizes(domain) {
+		return heuristicSignal{}, false
+	}
+	return heuristicSignal{Label: "display_name_spoof", Detail: fmt.Sprintf("%q from %s", p.Name, domain)}, true
+}
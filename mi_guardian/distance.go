@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Distance metrics ---
+
+// URLSetPrefix marks URL-set signatures (one short SHA-1 token per normalized URL)
+const URLSetPrefix = "U1:"
+
+// Distancer measures how far apart signatures are: 0 means identical, larger means less similar
+type Distancer interface {
+	Name() string
+	Distances(ref string, candidates []string) (map[string]int, error)
+}
+
+// tlshDistancer is the default metric: TLSH Diff, with or without the length difference
+type tlshDistancer struct {
+	ignoreLength bool
+}
+
+func (tlshDistancer) Name() string { return "tlsh" }
+
+func (d tlshDistancer) Distances(ref string, candidates []string) (map[string]int, error) {
+	return computeDistanceBatch(ref, candidates, candidates, !d.ignoreLength)
+}
+
+// urlJaccardDistancer compares URL-set signatures: (1 - |A∩B| / |A∪B|) scaled to 0-100
+type urlJaccardDistancer struct{}
+
+func (urlJaccardDistancer) Name() string { return "jaccard" }
+
+func (urlJaccardDistancer) Distances(ref string, candidates []string) (map[string]int, error) {
+	refSet, ok := parseURLSetSignature(ref)
+	if !ok {
+		return nil, errors.New("not a URL-set signature")
+	}
+	results := make(map[string]int)
+	for _, c := range candidates {
+		set, ok := parseURLSetSignature(c)
+		if !ok {
+			continue // Skip signatures of another metric
+		}
+		results[c] = jaccardDistance(refSet, set)
+	}
+	return results, nil
+}
+
+// jaccardDistance returns the Jaccard distance of two sets scaled to 0-100
+func jaccardDistance(a, b map[string]struct{}) int {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	inter := 0
+	for k := range a {
+		if _, ok := b[k]; ok {
+			inter++
+		}
+	}
+	union := len(a) + len(b) - inter
+	return int(math.Round((1 - float64(inter)/float64(union)) * 100))
+}
+
+// urlSetSignature encodes a set of URLs as sorted short tokens, independent of their order in the message
+func urlSetSignature(urls []string) string {
+	seen := make(map[string]struct{})
+	tokens := []string{}
+	for _, u := range urls {
+		sum := sha1.Sum([]byte(u))
+		token := strings.ToUpper(hex.EncodeToString(sum[:4]))
+		if _, ok := seen[token]; !ok {
+			seen[token] = struct{}{}
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens)
+	return URLSetPrefix + strings.Join(tokens, ":")
+}
+
+func parseURLSetSignature(sig string) (map[string]struct{}, bool) {
+	if !strings.HasPrefix(sig, URLSetPrefix) {
+		return nil, false
+	}
+	set := make(map[string]struct{})
+	for _, token := range strings.Split(strings.TrimPrefix(sig, URLSetPrefix), ":") {
+		if token != "" {
+			set[token] = struct{}{}
+		}
+	}
+	return set, true
+}
+
+// distancerForSignature picks the metric matching how a signature was built
+func distancerForSignature(sig string) Distancer {
+	if strings.HasPrefix(sig, URLSetPrefix) {
+		return urlJaccardDistancer{}
+	}
+	if isPerceptualSignature(sig) {
+		return perceptualDistancer{}
+	}
+	return tlshDistancer{}
+}
+
+// distancerForType is distancerForSignature with the TLSH length setting of the signature type
+func distancerForType(sig string, sigType SignatureType) Distancer {
+	d := distancerForSignature(sig)
+	if _, ok := d.(tlshDistancer); ok {
+		return tlshDistancer{ignoreLength: !getLengthInclusionForType(sigType)}
+	}
+	return d
+}
+
+// getLengthInclusionForType reports whether TLSH distances of a signature type count the
+// length difference. Variable-length content (bodies, subjects) may leave it out with
+// TLSH_IGNORE_LENGTH_TYPES, so a short variant of a learned message still matches.
+func getLengthInclusionForType(sigType SignatureType) bool {
+	types, _ := tlshIgnoreLengthTypes.Load().(map[SignatureType]bool)
+	return !types[sigType]
+}
+
+// signatureBands returns the LSH index keys of a signature: TLSH bands, one band per URL
+// token, or the perceptual hash bands
+func signatureBands(sig string) []string {
+	if hash, ok := parsePerceptualSignature(sig); ok {
+		return perceptualBands(hash)
+	}
+	if set, ok := parseURLSetSignature(sig); ok {
+		bands := make([]string, 0, len(set))
+		for token := range set {
+			bands = append(bands, "u:"+token)
+		}
+		sort.Strings(bands)
+		return bands
+	}
+	return extractBands_6_3(sig)
+}
+
+// lookupBands returns the bands checked against the LSH indexes for the quorum: the TLSH
+// bands thinned by BAND_SUBSET_STRIDE / BAND_SUBSET_MAX. Learning always indexes every
+// band, so analyze and report lookups agree whatever subset is configured.
+func lookupBands(sig string) []string {
+	bands := signatureBands(sig)
+	if !isTLSHSignature(sig) {
+		return bands // URL-set tokens and perceptual bands are all needed
+	}
+	return bandSubset(bands, int(atomic.LoadInt64(&bandSubsetStride)), int(atomic.LoadInt64(&bandSubsetMax)))
+}
+
+// bandSubset keeps every stride-th band, then at most max of them (0 = no limit)
+func bandSubset(bands []string, stride, max int) []string {
+	if stride <= 1 && (max <= 0 || max >= len(bands)) {
+		return bands
+	}
+	if stride < 1 {
+		stride = 1
+	}
+	subset := make([]string, 0, len(bands)/stride+1)
+	for i := 0; i < len(bands); i += stride {
+		if max > 0 && len(subset) == max {
+			break
+		}
+		subset = append(subset, bands[i])
+	}
+	return subset
+}
+
+// getDistanceMetricForType returns the configured metric for a signature type (only SigURL supports jaccard)
+func getDistanceMetricForType(sigType SignatureType) string {
+	if sigType == SigURL && urlDistanceJaccard.Load() {
+		return "jaccard"
+	}
+	return "tlsh"
+}
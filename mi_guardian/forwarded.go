@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Forwarded spam reports ---
+
+// Users often report spam by forwarding it with a word of their own ("FYI, more of
+// these"). Normalizing the whole forward shifts the hash away from the original, even
+// with DEQUOTE_FORWARDS. With FORWARDED_BLOCK_MIN_SIZE set, the dominant forwarded block
+// of a message (the largest run of quoted lines, or everything after a forward separator)
+// gets its own normalized signature, stored with the scan: a report on the message learns
+// that signature in place of the whole-message one. Verdicts are not affected.
+
+var (
+	reBlockquoteOpen  = regexp.MustCompile(`(?i)<blockquote[^>]*>`)
+	reBlockquoteClose = regexp.MustCompile(`(?i)</blockquote\s*>`)
+)
+
+// dominantForwardedBlock returns the largest forwarded block of a plain text body,
+// dequoted, when it holds at least minSize characters
+func dominantForwardedBlock(text string, minSize int) (string, bool) {
+	lines := strings.Split(text, "\n")
+	var blocks [][]string
+	for i := 0; i < len(lines); i++ {
+		if reForwardSeparator.MatchString(strings.TrimRight(reQuotePrefix.ReplaceAllString(lines[i], ""), "\r")) {
+			// The forwarded original runs to the end; the separator stays for dequoteText
+			blocks = append(blocks, lines[i:])
+			break
+		}
+		if !reQuotePrefix.MatchString(lines[i]) {
+			continue
+		}
+		// A run of quoted lines, blank lines included while more quoted lines follow
+		start, end := i, i+1
+		for j := i + 1; j < len(lines); j++ {
+			if reQuotePrefix.MatchString(lines[j]) {
+				end = j + 1
+			} else if strings.TrimSpace(lines[j]) != "" {
+				break
+			}
+		}
+		blocks = append(blocks, lines[start:end])
+		i = end - 1
+	}
+
+	best := ""
+	for _, b := range blocks {
+		block := dequoteText(strings.Join(b, "\n"))
+		if strings.Contains(text, "\r\n") {
+			// dequoteText drops the CRs: restore them, the original is hashed with its line endings
+			block = strings.ReplaceAll(block, "\n", "\r\n")
+		}
+		if block = strings.TrimSpace(block); len(block) > len(best) {
+			best = block
+		}
+	}
+	if best == "" || len(best) < minSize {
+		return "", false
+	}
+	return best, true
+}
+
+// forwardedHTMLBlock returns the content of the outermost <blockquote> of an HTML body,
+// where webmails put the quoted or forwarded original
+func forwardedHTMLBlock(html string) (string, bool) {
+	open := reBlockquoteOpen.FindStringIndex(html)
+	if open == nil {
+		return "", false
+	}
+	closes := reBlockquoteClose.FindAllStringIndex(html[open[1]:], -1)
+	if len(closes) == 0 {
+		return "", false
+	}
+	return html[open[1] : open[1]+closes[len(closes)-1][0]], true
+}
+
+// forwardedBlockSignature computes the normalized signature of the dominant forwarded block
+// of a message ("" when disabled, when there is none, or when an HTML body has no
+// identifiable original)
+func forwardedBlockSignature(text, html string) string {
+	minSize := int(atomic.LoadInt64(&forwardedBlockMinSize))
+	if minSize <= 0 {
+		return ""
+	}
+	textBlock, ok := dominantForwardedBlock(text, minSize)
+	if !ok {
+		return ""
+	}
+	htmlBlock := ""
+	if strings.TrimSpace(html) != "" {
+		if htmlBlock, ok = forwardedHTMLBlock(html); !ok {
+			return ""
+		}
+	}
+	body := normalizeEmailBody(textBlock, htmlBlock)
+	if len(body) <= getMinLengthForType(SigNormalized) {
+		return ""
+	}
+	sig, err := computeLocalTLSH(body)
+	if err != nil {
+		return ""
+	}
+	return sig
+}
+
+// withForwardedBlock returns the scan with its normalized signature replaced by the one of
+// the dominant forwarded block, when one was recorded
+func (s ScanResult) withForwardedBlock() ScanResult {
+	if s.Forwarded == "" {
+		return s
+	}
+	scoped := s
+	scoped.Hashes = []string{s.Forwarded}
+	scoped.Types = map[string]string{s.Forwarded: SigNormalized.String()}
+	for _, h := range s.Hashes {
+		if parseSignatureType(s.Types[h]) == SigNormalized || h == s.Forwarded {
+			continue
+		}
+		scoped.Hashes = append(scoped.Hashes, h)
+		scoped.Types[h] = s.Types[h]
+	}
+	return scoped
+}
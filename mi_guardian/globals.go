@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -11,17 +12,25 @@ import (
 
 // --- Mailuminati engine configuration ---
 const (
-	EngineVersion         = "0.5.1"
-	FragKeyPrefix         = "mi_f:"
-	LocalFragPrefix       = "lg_f:"
-	OracleCacheFragPrefix = "oc_f:"
-	LocalScorePrefix      = "lg_s:"
-	MetaNodeID            = "mi_meta:id"
-	MetaVer               = "mi_meta:v"
-	DefaultOracle         = "https://oracle.mailuminati.com"
-	MaxProcessSize        = 15 * 1024 * 1024 // 15 MB max
-	MinVisualSize         = 50 * 1024        // Ignore small logos/trackers
-	DefaultLocalRetention = 15               // Days to keep local learning data
+	EngineVersion           = "0.5.1"
+	FragKeyPrefix           = "mi_f:"
+	LocalFragPrefix         = "lg_f:"
+	OracleCacheFragPrefix   = "oc_f:"
+	LocalScorePrefix        = "lg_s:"
+	LocalLearnedPrefix      = "lg_t:"         // First-learned unix timestamp per local hash
+	LocalTypePrefix         = "lg_y:"         // Signature type a local hash was learned as
+	LocalReportsPrefix      = "lg_r:"         // Report log (timestamped weights) per local hash
+	LocalCampaignPrefix     = "lg_c:"         // Campaign ID of a local hash that absorbed variants (compaction)
+	LocalSourcesPrefix      = "lg_src:"       // Distinct sources that reported a local hash (LEARNING_MIN_SOURCES)
+	OracleFingerprintPrefix = "mi:oracle_fp:" // Oracle spam verdict per content fingerprint
+	DomainFirstSeenPrefix   = "mi:domain_first_seen:"
+	MetaNodeID              = "mi_meta:id"
+	MetaVer                 = "mi_meta:v"
+	DefaultOracle           = "https://oracle.mailuminati.com"
+	MaxProcessSize          = 15 * 1024 * 1024 // 15 MB max
+	MinVisualSize           = 50 * 1024        // Ignore small logos/trackers
+	DefaultLocalRetention   = 15               // Days to keep local learning data
+	MinSubjectLength        = 30               // Subjects up to this length get no subject signature
 )
 
 var (
@@ -37,6 +46,8 @@ var (
 	localSpamCount         int64
 	spamWeight             int64
 	hamWeight              int64
+	typeSpamWeights        atomic.Value // map[SignatureType]int64, overrides spamWeight per type
+	typeHamWeights         atomic.Value // map[SignatureType]int64, overrides hamWeight per type
 	localRetentionDuration time.Duration
 
 	// Distance thresholds per signature type (lower = stricter)
@@ -45,12 +56,263 @@ var (
 	thresholdURL        int64 = 50 // URL-based - strict (phishing)
 	thresholdSubject    int64 = 55 // Subject-based - medium-strict
 	thresholdAttachment int64 = 45 // Attachment - strictest
+	thresholdCombined   int64 = 60 // Subject + body - medium
+	thresholdStructure  int64 = 40 // HTML skeleton - strict (shared ESP templates)
+
+	// LSH band quorum: minimum matching bands before computing distances.
+	// Per-type values of 0 fall back to bandQuorum.
+	bandQuorum       int64 = 4
+	quorumNormalized int64
+	quorumRaw        int64
+	quorumURL        int64
+	quorumSubject    int64
+	quorumAttachment int64
+	quorumCombined   int64
+	quorumStructure  int64
+
+	// Per-type local learning retention in days (0 = LOCAL_RETENTION_DAYS)
+	retentionDaysNormalized int64
+	retentionDaysRaw        int64
+	retentionDaysURL        int64
+	retentionDaysSubject    int64
+	retentionDaysAttachment int64
+	retentionDaysCombined   int64
+	retentionDaysStructure  int64
+
+	// Maximum lifetime of a learned hash since first learned, whatever the refreshes (0 = none)
+	maxHashLifetime int64
 
 	// Soft spam threshold (between soft and hard = review)
 	softSpamDelta int64 = 20 // If distance is threshold+delta, mark as soft_spam
 
-	// Minimum body length for reliable TLSH
-	minBodyLength int64 = 200
+	// Per-source soft deltas (-1 = softSpamDelta) and soft_spam escalation counts (0 = never)
+	softSpamDeltaLocal          int64 = -1
+	softSpamDeltaOracleCache    int64 = -1
+	softSpamEscalateLocal       int64
+	softSpamEscalateOracleCache int64
+
+	// Per-type minimum content length: shorter content gets no signature (TLSH is unreliable
+	// on little data). Image attachments have their own gate, to ignore logos and trackers.
+	minLengthNormalized int64 = 200
+	minLengthRaw        int64 = 200
+	minLengthURL        int64 = 100
+	minLengthSubject    int64 = MinSubjectLength
+	minLengthAttachment int64 = 128
+	minLengthCombined   int64 = 200
+	minLengthStructure  int64 = 200
+	minVisualSize       int64 = MinVisualSize
+
+	// Subset of TLSH bands checked for the quorum (stride 1 and max 0 = all bands)
+	bandSubsetStride int64 = 1
+	bandSubsetMax    int64
+
+	// Raw signatures within this distance of the normalized one are skipped (-1 = never skip)
+	redundantRawDistance int64
+
+	// Strip forward/reply quoting before normalization (DEQUOTE_FORWARDS)
+	dequoteForwards atomic.Bool
+
+	// Minimum size of the forwarded block learned from reports in place of the whole message (0 = disabled)
+	forwardedBlockMinSize int64
+
+	// Recency weighting of local scores (REPORT_HALF_LIFE, 0 = disabled)
+	reportHalfLife         int64
+	reportMinWeightedScore int64 = 50 // Percent of one score point
+
+	// Distinct report sources a learned hash needs to block (LEARNING_MIN_SOURCES, <= 1 = disabled)
+	learningMinSources int64
+
+	// Age window of stored scans accepted by /report (REPORT_MAX_SCAN_AGE, 0 = disabled)
+	reportMaxScanAge   int64
+	reportMaxClockSkew int64 = int64(5 * time.Minute) // Tolerance for scans stamped in the future
+
+	// Oracle report dedup by content fingerprint, on top of the per-Message-ID dedup (0 = disabled)
+	reportContentDedupWindow int64
+
+	// Attachment signatures per message allowed to call the oracle (0 = no limit)
+	maxAttachmentOracleCalls int64
+
+	// Signature types never sent to the oracle from analyze (ORACLE_LOCAL_ONLY_TYPES)
+	oracleLocalOnlyTypes atomic.Value // map[SignatureType]bool
+
+	// Ham weight of each user behavior signal (SIGNAL_WEIGHT_<SIGNAL>)
+	signalWeights atomic.Value // map[string]int64
+
+	// Signature types whose TLSH distance leaves out the length difference (TLSH_IGNORE_LENGTH_TYPES)
+	tlshIgnoreLengthTypes atomic.Value // map[SignatureType]bool
+
+	// Redis Streams consumer (QUEUE_MODE): entries per read, output stream cap
+	queueBatchSize    int64 = 10
+	queueOutputMaxLen int64 = 100000
+
+	// Exact SHA-256 check of attachments against the known-bad sets (BAD_ATTACHMENT_CHECK)
+	badAttachmentCheck        atomic.Bool
+	badAttachmentFeedInterval int64 = int64(time.Hour)
+
+	// Scheduled oracle downtime (ORACLE_MAINTENANCE_WINDOWS)
+	maintenanceWindows atomic.Value // []maintenanceWindow
+
+	// Ordered body normalization steps (NORMALIZE_STEPS)
+	normalizeSteps atomic.Value // []normalizeStep
+
+	// Decode base64 blobs embedded in visible text before normalization (BASE64_DECODE)
+	base64Decode     atomic.Bool
+	base64MinRun     int64 = 80
+	base64MaxDecoded int64 = 64 * 1024
+
+	// Collapse emoji/symbol runs into a placeholder before hashing (EMOJI_NORMALIZE)
+	emojiNormalize atomic.Bool
+
+	// Re-decode text parts mislabeled us-ascii as UTF-8 (CHARSET_SNIFFING)
+	charsetSniffing atomic.Bool
+
+	// RESET_DB throttling: keys unlinked per batch and pause between batches
+	resetBatchSize  int64 = 500
+	resetBatchDelay int64 = int64(50 * time.Millisecond)
+
+	// Optional subject + body signature (COMBINED_SIGNATURE)
+	combinedSignature atomic.Bool
+
+	// Image attachments over this size (bytes, 0 = no cap) are skipped, or get a
+	// perceptual hash instead of TLSH with LARGE_IMAGE_PERCEPTUAL
+	maxVisualSize        int64
+	largeImagePerceptual atomic.Bool
+
+	// Optional HTML structure signature (STRUCTURE_SIGNATURE)
+	structureSignature atomic.Bool
+
+	// No raw body signature for messages with an HTML part (SKIP_RAW_FOR_HTML)
+	skipRawForHTML atomic.Bool
+
+	// Deep-scan senders: domains/TLDs that always get the strict threshold profile
+	deepScanDomains atomic.Value      // []string
+	deepScanBonus   int64        = 15 // Subtracted from every threshold for deep-scan senders
+
+	// Spam verdicts below this confidence are soft_spam, whatever the type (SPAM_MIN_CONFIDENCE)
+	spamMinConfidence int64 // Percent, 0 = disabled
+
+	// Oracle-cache proximity matches below this confidence are soft_spam, not spam
+	oracleCacheMinConfidence int64 // Percent, 0 = any match within threshold
+
+	// Promotion of strong oracle-cache proximity matches into local learning
+	promoteOracleCache   atomic.Bool
+	promoteMinConfidence int64 = 90 // Percent
+	promoteScore         int64 = 1
+
+	// Oracle cache filled from an oracle snapshot on startup (ORACLE_CACHE_WARM_START)
+	oracleCacheWarmStart      atomic.Bool
+	oracleCacheWarmStartLimit int64 = 10000
+
+	// Clean messages sampled for the oracle as ham observations (HAM_SAMPLE_RATE)
+	hamSampleSettings atomic.Value // hamSampleConfig
+
+	// Signatures returned in /analyze responses (RESPONSE_INCLUDE_HASHES); admin callers always get them
+	responseIncludeHashes atomic.Bool
+
+	// Spamminess score and score-derived actions (SPAMMINESS_SCORE, SCORE_*)
+	scoreSettings atomic.Value // scoreConfig
+
+	// In-memory cache of normalized bodies and body signatures, in entries (NORMALIZED_BODY_CACHE_SIZE, 0 = off)
+	normalizedBodyCacheSize int64
+
+	// Malformed oracle responses: retries, then allow, soft_spam or last_known (ORACLE_MALFORMED_ACTION)
+	oracleMalformedRetries int64
+	oracleMalformedAction  atomic.Value // string
+	oracleLastKnownTTL     int64        = int64(24 * time.Hour)
+
+	// What to do when the normalized body cannot be hashed: ignore, soft_spam or exact
+	bodyHashFailureAction atomic.Value // string
+
+	// Anti-reconnaissance delay before spam verdicts (nanoseconds, 0 = disabled)
+	spamResponseDelay int64
+
+	// Verdict log line per analyzed message, for SIEM ingestion: "cef", "leef" or "" (off)
+	verdictLogFormat atomic.Value // string
+
+	// Top spam sender domains tracked in memory (TOP_DOMAINS_SIZE, 0 = disabled)
+	topDomainsSize int64
+
+	// How long an analyze request waits for a slot under MAX_CONCURRENT_ANALYZE (0 = reject at once)
+	analyzeQueueTimeout int64
+
+	// soft_spam trend tracking per content fingerprint
+	softSpamTracking    atomic.Bool
+	softSpamTrackingTTL int64 = int64(24 * time.Hour)
+
+	// Distance metric for URL signatures: TLSH (default) or Jaccard over the URL set
+	urlDistanceJaccard atomic.Bool
+
+	// Automatic whitelisting of frequently-hammed sender domains (opt-in)
+	autoWhitelist           atomic.Bool
+	autoWhitelistHamReports int64 = 5
+	autoWhitelistWindow     int64 = int64(7 * 24 * time.Hour)
+	autoWhitelistTTL        int64 = int64(30 * 24 * time.Hour)
+
+	// PARTIAL_MATCH_ACTION: ignore (default) or soft_spam
+	partialMatchSoftSpam atomic.Bool
+
+	// Periodic compaction of near-duplicate learned hashes
+	compactionEnabled  atomic.Bool
+	compactionInterval int64 = int64(6 * time.Hour)
+	compactionDistance int64 = 10
+
+	// Mass campaign detection: copies of the same content within a short window (0 = disabled)
+	massCampaignThreshold int64
+	massCampaignWindow    int64       = int64(10 * time.Minute)
+	massCampaignSpam      atomic.Bool // MASS_CAMPAIGN_ACTION=spam (default soft_spam)
+
+	// Spam-trap recipient addresses: scanned and stored, verdict forced to allow, no oracle calls
+	spamTrapRecipients atomic.Value // []string
+	spamTrapAutoLearn  atomic.Bool  // Learn trap deliveries as spam without a report
+
+	// Precedence when a sender is both whitelisted and blacklisted (LIST_CONFLICT_POLICY)
+	listConflictPolicy atomic.Value // string
+
+	// Verdict when a signature matches learned hashes of conflicting scores (LOCAL_CONFLICT_POLICY)
+	localConflictPolicy atomic.Value // string
+
+	// How the per-signature verdicts make the message verdict (VERDICT_COMBINER)
+	verdictCombiner atomic.Value      // string
+	verdictWeights  atomic.Value      // map[SignatureType]int64, weighted_vote
+	verdictVoteSpam int64        = 50 // Percent
+	verdictVoteSoft int64        = 25 // Percent
+
+	// End-user messages for spam/soft_spam verdicts (USER_MESSAGE_*)
+	userMessages  atomic.Value // map[string]string, keyed by USER_MESSAGE_ suffix
+	smtpResponses atomic.Value // smtpResponseConfig (SMTP_RESPONSE_*)
+
+	// Required headers and what to do when one is missing (scan, soft_spam or spam)
+	requiredHeaders      atomic.Value // []string
+	missingHeadersAction atomic.Value // string
+
+	// Attachments with a dangerous extension: off, soft_spam or spam (DANGEROUS_ATTACHMENT_ACTION)
+	dangerousAttachmentAction atomic.Value // string
+	dangerousExtensions       atomic.Value // map[string]bool
+
+	// Optional heuristics and signal weights (HEURISTIC_*, off by default)
+	heuristicSettings atomic.Value // heuristicConfig
+
+	// Domains first seen within this window are new senders (new_sender heuristic)
+	newSenderWindow int64 = int64(72 * time.Hour)
+
+	// Protected From display names and their authorized domains (PROTECTED_DISPLAY_NAMES)
+	protectedDisplayNames atomic.Value // []protectedDisplayName
+
+	// Message-ID domains never flagged by msgid_domain_mismatch (MSGID_DOMAIN_IGNORE)
+	msgidDomainIgnore atomic.Value // []string
+
+	// Text vs HTML alternative divergence (altpart_mismatch heuristic)
+	altPartMismatchDistance int64 = 150
+
+	// Date header anomalies (date_anomaly heuristic)
+	dateMaxFutureSkew int64 = int64(24 * time.Hour)
+	dateMaxAge        int64 = int64(30 * 24 * time.Hour)
+
+	// How long a sending domain is remembered after its last message
+	domainFirstSeenRetention int64 = int64(90 * 24 * time.Hour)
+
+	// Verdict schema version of the current config, stamped into cached verdicts and stored scans
+	verdictSchemaVersion atomic.Value // string
 
 	// Config
 	configMap   map[string]string = make(map[string]string)
@@ -74,4 +336,112 @@ var (
 		Name: "mailuminati_guardian_cache_hits_total",
 		Help: "Total number of cache hits",
 	}, []string{"result"})
+	promBodyHashFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_body_hash_failures_total",
+		Help: "Total number of messages whose normalized body could not be hashed",
+	})
+	promAutoWhitelisted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_auto_whitelisted_total",
+		Help: "Total number of sender domains automatically whitelisted after repeated ham reports",
+	})
+	promCompactionMerged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_compaction_merged_total",
+		Help: "Total number of learned hashes merged into a near-duplicate by compaction",
+	})
+	promCompactionLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_compaction_merged_last_run",
+		Help: "Number of learned hashes merged by the last compaction run",
+	})
+	promTrapAutoLearned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_trap_auto_learned_total",
+		Help: "Total number of spam-trap deliveries automatically learned as spam",
+	})
+	promRedundantRawSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_redundant_raw_skipped_total",
+		Help: "Total number of raw body signatures skipped as redundant with the normalized signature",
+	})
+	promOracleFingerprintHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_fingerprint_hits_total",
+		Help: "Total number of oracle calls avoided by the content-fingerprint verdict cache",
+	})
+	promResetInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_reset_in_progress",
+		Help: "1 while an oracle band reset (RESET_DB) is running",
+	})
+	promResetDeleted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_reset_deleted_keys",
+		Help: "Oracle band keys deleted so far by the current or last reset",
+	})
+	promMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_mode",
+		Help: "Current operating mode (1 for the active mode)",
+	}, []string{"mode"})
+	promModeChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_mode_changes_total",
+		Help: "Total number of operating mode changes made through this node, by new mode",
+	}, []string{"mode"})
+	promOracleSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_calls_skipped_total",
+		Help: "Total number of oracle calls skipped during a maintenance window, by call",
+	}, []string{"call"})
+	promBadAttachmentHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_bad_attachment_hits_total",
+		Help: "Total number of messages carrying a known-bad attachment (exact SHA-256)",
+	})
+	promReportsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_reports_rejected_total",
+		Help: "Total number of reports rejected because the stored scan timestamp is outside the accepted window, by reason",
+	}, []string{"reason"})
+	promAttachmentOracleCapped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_attachment_oracle_capped_total",
+		Help: "Total number of attachment signatures not sent to the oracle because the per-message cap was reached",
+	})
+	promAnalyzeInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_analyze_in_flight",
+		Help: "Number of analyze requests currently being processed",
+	})
+	promAnalyzeRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_analyze_rejected_total",
+		Help: "Total number of analyze requests rejected with 503 because MAX_CONCURRENT_ANALYZE was reached",
+	})
+	promLargeImagesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_large_images_skipped_total",
+		Help: "Total number of image attachments not hashed because they exceed MAX_VISUAL_SIZE",
+	})
+	promReportsSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_reports_suppressed_total",
+		Help: "Total number of spam reports not learned because the sender is whitelisted",
+	})
+	promUserSignals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_user_signals_total",
+		Help: "Total number of user behavior signals received on /signal, by signal",
+	}, []string{"signal"})
+	promOracleCacheWarmed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_cache_warmed_total",
+		Help: "Total number of oracle spam signatures cached from an oracle snapshot on startup",
+	})
+	promHamSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_ham_samples_total",
+		Help: "Total number of clean message signatures sampled for the oracle, by outcome (contributed, dropped)",
+	}, []string{"outcome"})
+	promBodyCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_body_cache_total",
+		Help: "Total number of normalized body cache lookups, by result (hit, miss)",
+	}, []string{"result"})
+	promCharsetRedecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_charset_redecoded_total",
+		Help: "Total number of messages with text parts mislabeled us-ascii, by outcome (utf8: re-decoded as UTF-8, invalid: kept as declared)",
+	}, []string{"outcome"})
+	promAuditLog = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_audit_log_total",
+		Help: "Total number of verdict audit log events, by event (written, rotated, error)",
+	}, []string{"event"})
+	promOracleMalformed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_malformed_responses_total",
+		Help: "Total number of oracle responses that were not a usable verdict, by reason (decode, action)",
+	}, []string{"reason"})
+	promOracleCachePromotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_cache_promotions_total",
+		Help: "Total number of oracle cache proximity matches promoted to local learning",
+	})
 )
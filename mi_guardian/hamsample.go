@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Ham sampling ---
+
+// The oracle only hears about the messages users report, so its models see far more
+// spam than ham. With HAM_SAMPLE_RATE set, a fraction of the clean (allowed, no signal)
+// messages have their signatures sent to the oracle as ham observations. Only TLSH
+// signatures of the HAM_SAMPLE_TYPES are sent (never ORACLE_LOCAL_ONLY_TYPES), never for
+// whitelisted senders nor spam-trap deliveries, and in batches every HAM_SAMPLE_INTERVAL.
+// Off unless HAM_SAMPLE_RATE > 0; GET /config discloses the setting.
+
+const (
+	maxHamSampleBuffer   = 1000 // Signatures waiting for the next batch; more are dropped
+	hamObservationReport = "ham_observation"
+)
+
+// hamSampleConfig holds the parsed HAM_SAMPLE_* settings
+type hamSampleConfig struct {
+	Rate     float64
+	Types    map[SignatureType]bool
+	Interval time.Duration
+}
+
+var (
+	hamSampleMu     sync.Mutex
+	hamSampleBuffer []string
+)
+
+// loadHamSampleConfig reads HAM_SAMPLE_RATE (0 to 1), HAM_SAMPLE_TYPES and HAM_SAMPLE_INTERVAL
+func loadHamSampleConfig() hamSampleConfig {
+	cfg := hamSampleConfig{Interval: getEnvDuration("HAM_SAMPLE_INTERVAL", time.Minute)}
+	if raw := strings.TrimSpace(getEnv("HAM_SAMPLE_RATE", "")); raw != "" {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Printf("[Mailuminati] Invalid HAM_SAMPLE_RATE %q (expected 0 to 1), ham sampling disabled", raw)
+		} else {
+			cfg.Rate = rate
+		}
+	}
+	cfg.Types = getEnvSignatureTypes("HAM_SAMPLE_TYPES")
+	if len(cfg.Types) == 0 {
+		cfg.Types = map[SignatureType]bool{SigNormalized: true}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	return cfg
+}
+
+// currentHamSampleConfig returns the active ham sampling settings
+func currentHamSampleConfig() hamSampleConfig {
+	cfg, _ := hamSampleSettings.Load().(hamSampleConfig)
+	return cfg
+}
+
+// typeNames lists the sampled signature types, for /config
+func (cfg hamSampleConfig) typeNames() []string {
+	names := []string{}
+	for t := range cfg.Types {
+		if !oracleLocalOnly(t) {
+			names = append(names, t.String())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hamSampleSignatures returns the signatures of a message that may be contributed
+func hamSampleSignatures(cfg hamSampleConfig, sigs []TypedSignature) []string {
+	var hashes []string
+	for _, ts := range sigs {
+		if isTLSHSignature(ts.Hash) && cfg.Types[ts.Type] && !oracleLocalOnly(ts.Type) {
+			hashes = append(hashes, ts.Hash)
+		}
+	}
+	return hashes
+}
+
+// sampleHam queues the signatures of a clean message for the next ham batch, at the
+// configured rate
+func sampleHam(outcome scanOutcome) {
+	cfg := currentHamSampleConfig()
+	if cfg.Rate <= 0 || outcome.Whitelisted || outcome.Result.Action != "allow" || outcome.Result.ReasonCode != ReasonClean {
+		return
+	}
+	if cfg.Rate < 1 && rand.Float64() >= cfg.Rate {
+		return
+	}
+	hashes := hamSampleSignatures(cfg, outcome.Signatures)
+	if len(hashes) == 0 {
+		return
+	}
+
+	hamSampleMu.Lock()
+	defer hamSampleMu.Unlock()
+	room := maxHamSampleBuffer - len(hamSampleBuffer)
+	if room < len(hashes) {
+		promHamSamples.WithLabelValues("dropped").Add(float64(len(hashes) - max(room, 0)))
+		hashes = hashes[:max(room, 0)]
+	}
+	hamSampleBuffer = append(hamSampleBuffer, hashes...)
+}
+
+// flushHamSamples sends the queued signatures to the oracle as ham observations.
+// It returns the number of signatures contributed.
+func flushHamSamples() (int, error) {
+	hamSampleMu.Lock()
+	hashes := hamSampleBuffer
+	hamSampleBuffer = nil
+	hamSampleMu.Unlock()
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	if skipOracleCall("ham_sample") {
+		promHamSamples.WithLabelValues("dropped").Add(float64(len(hashes)))
+		return 0, nil
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"node_id":     nodeID,
+		"signatures":  hashes,
+		"report_type": hamObservationReport,
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(oracleURL+"/report", "application/json", bytes.NewBuffer(payload))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("oracle returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		promHamSamples.WithLabelValues("dropped").Add(float64(len(hashes)))
+		return 0, err
+	}
+	promHamSamples.WithLabelValues("contributed").Add(float64(len(hashes)))
+	return len(hashes), nil
+}
+
+// hamSampleWorker flushes the ham samples every HAM_SAMPLE_INTERVAL, while sampling is on
+func hamSampleWorker() {
+	for {
+		time.Sleep(currentHamSampleConfig().Interval)
+		if currentHamSampleConfig().Rate <= 0 {
+			// Sampling turned off since: what was buffered is not sent
+			hamSampleMu.Lock()
+			dropped := len(hamSampleBuffer)
+			hamSampleBuffer = nil
+			hamSampleMu.Unlock()
+			promHamSamples.WithLabelValues("dropped").Add(float64(dropped))
+			continue
+		}
+		if n, err := flushHamSamples(); err != nil {
+			log.Printf("[Mailuminati] Ham sample contribution failed: %v", err)
+		} else if n > 0 {
+			log.Printf("[Mailuminati] Contributed %d ham sample signatures to the Oracle", n)
+		}
+	}
+}
@@ -2,18 +2,18 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/jhillyerd/enmime"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // --- Handlers ---
@@ -21,342 +21,282 @@ import (
 func analyzeHandler(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&scanCount, 1)
 	promScanned.Inc()
+	reqCtx, span := startRequestSpan(r, "analyze")
+	defer span.End()
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
 
-	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, MaxProcessSize))
+	body, err := readMessageBody(r.Body, r.ContentLength)
 	if err != nil {
 		http.Error(w, "Error reading body", http.StatusInternalServerError)
 		return
 	}
 
-	env, err := enmime.ReadEnvelope(bytes.NewReader(bodyBytes))
+	env, err := parseEnvelope(body.Bytes())
+	releaseMessageBody(body)
 	if err != nil {
 		http.Error(w, "Invalid MIME", http.StatusBadRequest)
 		return
 	}
 
-	typedSignatures := []TypedSignature{}
-	signatures := []string{} // Keep for backward compatibility
+	reqCtx, err = withRequestOverrides(reqCtx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	outcome := analyzeEnvelope(reqCtx, env)
+	span.SetAttributes(
+		attribute.String("mailuminati.action", outcome.Result.Action),
+		attribute.String("mailuminati.reason_code", string(outcome.Result.ReasonCode)),
+	)
+	if outcome.Result.Action == "spam" {
+		tarpit(reqCtx, time.Duration(atomic.LoadInt64(&spamResponseDelay)))
+	}
+	event := newSIEMEvent(outcome, env.GetHeader("From"), env.GetHeader("Message-ID"))
+	logVerdictSIEM(event)
+	auditVerdict(outcome, env.GetHeader("From"), env.GetHeader("Message-ID"))
+	if format := negotiateSIEMFormat(r.Header.Get("Accept")); format != "" {
+		writeSIEMResponse(w, format, event)
+		return
+	}
+	if !responseIncludeHashes.Load() && !isAdminRequest(r) {
+		outcome = outcome.withoutHashes()
+	}
+	writeAnalyzeResponse(w, outcome)
+}
 
-	// get the message-id and subject for logging
-	messageID := env.GetHeader("Message-ID")
-	subject := env.GetHeader("Subject")
-	fromHeader := env.GetHeader("From")
+// tarpit delays a spam verdict to slow down filter probing, giving up as soon as the request is done
+func tarpit(reqCtx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-reqCtx.Done():
+	}
+}
 
-	// Check whitelist first
-	if whitelisted, reason := isWhitelisted(fromHeader); whitelisted {
-		log.Printf("[Mailuminati] Whitelisted sender: %s | Reason: %s | Message-ID: %s", fromHeader, reason, messageID)
-		w.Header().Set("Content-Type", "application/json")
+// writeAnalyzeResponse serializes a scan outcome in the /analyze response format
+func writeAnalyzeResponse(w http.ResponseWriter, outcome scanOutcome) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(analyzeResponseBody(outcome))
+}
+
+// analyzeResponseBody is the JSON verdict returned by /analyze (and written by the queue consumer)
+func analyzeResponseBody(outcome scanOutcome) []byte {
+	if outcome.Whitelisted {
 		response := struct {
-			Action     string `json:"action"`
-			Label      string `json:"label,omitempty"`
-			Whitelisted bool   `json:"whitelisted"`
-			Reason     string `json:"reason,omitempty"`
+			Action      string        `json:"action"`
+			Label       string        `json:"label,omitempty"`
+			ReasonCode  ReasonCode    `json:"reason_code"`
+			Score       *int          `json:"score,omitempty"`
+			Whitelisted bool          `json:"whitelisted"`
+			Reason      string        `json:"reason,omitempty"`
+			SMTP        *SMTPResponse `json:"smtp_response,omitempty"`
+			Version     string        `json:"verdict_schema_version"`
 		}{
-			Action:     "allow",
-			Label:      "whitelisted",
+			Action:      outcome.Result.Action,
+			Label:       outcome.Result.Label,
+			ReasonCode:  outcome.Result.ReasonCode,
+			Score:       outcome.Result.Score,
 			Whitelisted: true,
-			Reason:     reason,
+			Reason:      outcome.WhitelistReason,
+			SMTP:        smtpResponseFor(outcome.Result),
+			Version:     outcome.Result.SchemaVersion,
 		}
 		respBytes, _ := json.Marshal(response)
-		w.WriteHeader(http.StatusOK)
-		w.Write(respBytes)
-		return
+		return respBytes
 	}
 
-	// Get minimum body length (configurable)
-	minLen := int(minBodyLength)
-
-	// 1. Analyze text body (Standard strategy) - Normalized
-	combinedBody := normalizeEmailBody(env.Text, env.HTML)
-	if len(combinedBody) > minLen {
-		if sig, err := computeLocalTLSH(combinedBody); err == nil {
-			typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigNormalized})
-			signatures = append(signatures, sig)
-		} else {
-			log.Printf("[Mailuminati] Failed to compute TLSH for body: %v", err)
-		}
+	finalResult := outcome.Result
+	response := struct {
+		Action              string               `json:"action"`
+		Label               string               `json:"label,omitempty"`
+		ReasonCode          ReasonCode           `json:"reason_code"`
+		ProximityMatch      bool                 `json:"proximity_match"`
+		Distance            int                  `json:"distance,omitempty"`
+		Confidence          float64              `json:"confidence,omitempty"`
+		Score               *int                 `json:"score,omitempty"`
+		MatchType           string               `json:"match_type,omitempty"`
+		Brand               string               `json:"brand,omitempty"`
+		UserMessage         string               `json:"user_message,omitempty"`
+		SMTPResponse        *SMTPResponse        `json:"smtp_response,omitempty"`
+		LearnedAt           int64                `json:"learned_at,omitempty"`
+		CampaignID          string               `json:"campaign_id,omitempty"`
+		CachedAt            int64                `json:"cached_at,omitempty"`
+		NearMiss            *NearMiss            `json:"near_miss,omitempty"`
+		ConfidenceBreakdown *ConfidenceBreakdown `json:"confidence_breakdown,omitempty"`
+		Hashes              []string             `json:"hashes,omitempty"`
+		SignaturesComputed  map[string]int       `json:"signatures_computed"` // null when not scanned
+		SignaturesFailed    map[string]int       `json:"signatures_failed"`
+		SchemaVersion       string               `json:"verdict_schema_version"`
+	}{
+		Action:              finalResult.Action,
+		Label:               finalResult.Label,
+		ReasonCode:          finalResult.ReasonCode,
+		ProximityMatch:      finalResult.ProximityMatch,
+		Distance:            finalResult.Distance,
+		Confidence:          finalResult.Confidence,
+		Score:               finalResult.Score,
+		MatchType:           finalResult.MatchType,
+		Brand:               finalResult.Brand,
+		UserMessage:         finalResult.UserMessage,
+		SMTPResponse:        smtpResponseFor(finalResult),
+		LearnedAt:           finalResult.LearnedAt,
+		CampaignID:          finalResult.CampaignID,
+		CachedAt:            finalResult.CachedAt,
+		NearMiss:            finalResult.NearMiss,
+		ConfidenceBreakdown: finalResult.ConfidenceBreakdown,
+		Hashes:              outcome.Hashes,
+		SchemaVersion:       finalResult.SchemaVersion,
 	}
-
-	// 2. Extra Hash: Raw Body (HTML + Text concatenated, no normalization)
-	rawBody := env.Text + env.HTML
-	if len(rawBody) > minLen {
-		if sig, err := computeLocalTLSH(rawBody); err == nil {
-			typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigRaw})
-			signatures = append(signatures, sig)
-		}
+	if outcome.Failed != nil {
+		response.SignaturesComputed = outcome.signatureCoverage()
+		response.SignaturesFailed = outcome.Failed
 	}
 
-	// 3. URL-Based Hash (for phishing detection)
-	urls := extractURLs(env.Text + env.HTML)
-	if len(urls) >= 2 {
-		urlContent := strings.Join(urls, "\n")
-		if len(urlContent) > 100 {
-			if sig, err := computeLocalTLSH(urlContent); err == nil {
-				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigURL})
-				signatures = append(signatures, sig)
-			}
-		}
-	}
+	respBytes, _ := json.Marshal(response)
+	return respBytes
+}
 
-	// 3.5 Subject-Based Hash (spam campaigns often reuse subjects)
-	if len(subject) > 30 {
-		normalizedSubject := strings.ToLower(strings.TrimSpace(subject))
-		// Repeat subject to meet TLSH minimum length requirement
-		subjectContent := strings.Repeat(normalizedSubject+" ", 5)
-		if sig, err := computeLocalTLSH(subjectContent); err == nil {
-			typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigSubject})
-			signatures = append(signatures, sig)
-		}
+// explainHandler runs the analyze pipeline and returns the verdict along with how it was reached
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// 4. Analyze significant attachments
-	for _, att := range env.Attachments {
-		isImg := strings.HasPrefix(att.ContentType, "image/")
-		if (isImg && len(att.Content) > MinVisualSize) || (!isImg && len(att.Content) > 128) {
-			if sig, err := computeLocalTLSH(string(att.Content)); err == nil {
-				typedSignatures = append(typedSignatures, TypedSignature{Hash: sig, Type: SigAttachment})
-				signatures = append(signatures, sig)
-			} else {
-				log.Printf("[Mailuminati] Failed to compute TLSH for attachment '%s': %v", att.FileName, err)
-			}
-		}
+	body, err := readMessageBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusInternalServerError)
+		return
 	}
 
-	go storeScanResult(env, signatures)
-
-	var finalResult AnalysisResult = AnalysisResult{Action: "allow", ProximityMatch: false}
-
-	// 3. Collision search with type-specific thresholds
-	for _, typedSig := range typedSignatures {
-		sig := typedSig.Hash
-		sigType := typedSig.Type
-		threshold := getThresholdForType(sigType)
-		softThreshold := threshold + int(softSpamDelta)
-		// Step 1: Check oracle decision cache
-		cacheKey := "mi:oracle_cache:" + sig
-		if cached, err := rdb.Get(ctx, cacheKey).Result(); err == nil {
-			var res AnalysisResult
-			if json.Unmarshal([]byte(cached), &res) == nil && res.Action == "spam" {
-				finalResult = res
-				atomic.AddInt64(&cachedPositiveCount, 1)
-				promCacheHits.WithLabelValues("positive").Inc()
-				goto endAnalysis // Final verdict; stop everything
-			}
-		}
-
-		bands := extractBands_6_3(sig)
-		var pipe redis.Pipeliner
-
-		// Declare here to avoid "goto jumps over declaration"
-		var matchCount int
-		var oracleCmds []*redis.IntCmd
-
-		// Step 1.5: Oracle Cache Proximity Lookup (Spam variations from recent queries)
-		oracleCacheBandsKeys := []string{}
-		pipe = rdb.Pipeline()
-		ocCmds := make(map[string]*redis.IntCmd)
-		for _, b := range bands {
-			key := OracleCacheFragPrefix + b
-			ocCmds[key] = pipe.Exists(ctx, key)
-		}
-		pipe.Exec(ctx)
-
-		for key, cmd := range ocCmds {
-			if cmd.Val() > 0 {
-				oracleCacheBandsKeys = append(oracleCacheBandsKeys, key)
-			}
-		}
+	env, err := parseEnvelope(body.Bytes())
+	releaseMessageBody(body)
+	if err != nil {
+		http.Error(w, "Invalid MIME", http.StatusBadRequest)
+		return
+	}
 
-		if len(oracleCacheBandsKeys) >= 4 {
-			var ocHashes []string
-			pipe = rdb.Pipeline()
-			hashCmds := make(map[string]*redis.StringSliceCmd)
-			for _, key := range oracleCacheBandsKeys {
-				hashCmds[key] = pipe.SMembers(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			seenHashes := make(map[string]struct{})
-			for _, cmd := range hashCmds {
-				for _, hash := range cmd.Val() {
-					if _, seen := seenHashes[hash]; !seen {
-						ocHashes = append(ocHashes, hash)
-						seenHashes[hash] = struct{}{}
-					}
-				}
-			}
+	reqCtx, err := withRequestOverrides(r.Context(), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			if len(ocHashes) > 0 {
-				distances, err := computeDistanceBatch(sig, ocHashes, ocHashes, false)
-				if err == nil {
-					for hash, dist := range distances {
-						if dist <= threshold {
-							confidence := getConfidenceForMatch(dist, threshold)
-							log.Printf("[Mailuminati] Oracle Cache Proximity Match! Message-ID: %s | Subject: %s | Signature: %s | Match: %s | Distance: %d | Type: %s", messageID, subject, sig, hash, dist, sigType.String())
-							finalResult = AnalysisResult{Action: "spam", Label: "oracle_cache_match", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String()}
-							atomic.AddInt64(&cachedPositiveCount, 1)
-							promCacheHits.WithLabelValues("positive").Inc()
-							goto endAnalysis
-						} else if dist <= softThreshold {
-							// Soft spam - close but not certain
-							confidence := getConfidenceForMatch(dist, softThreshold)
-							log.Printf("[Mailuminati] Oracle Cache Soft Match. Message-ID: %s | Subject: %s | Distance: %d | Type: %s", messageID, subject, dist, sigType.String())
-							if finalResult.Action != "spam" {
-								finalResult = AnalysisResult{Action: "soft_spam", Label: "oracle_cache_soft", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String()}
-							}
-						}
-					}
-				}
-			}
-		}
+	// Explaining a message must not change how the next copy is judged
+	outcome := analyzeEnvelope(withDryRun(reqCtx), env)
+	redact := !responseIncludeHashes.Load() && !isAdminRequest(r)
+	if redact {
+		outcome = outcome.withoutHashes()
+	}
 
-		// Step 2: Local learning lookup
-		localMatchBandsKeys := []string{}
-		pipe = rdb.Pipeline()
-		localCmds := make(map[string]*redis.IntCmd)
-		for _, b := range bands {
-			key := LocalFragPrefix + b
-			localCmds[key] = pipe.Exists(ctx, key)
+	sigs := make([]map[string]interface{}, 0, len(outcome.Signatures))
+	for _, s := range outcome.Signatures {
+		sig := map[string]interface{}{"type": s.Type.String()}
+		if !redact {
+			sig["hash"] = s.Hash
 		}
-		pipe.Exec(ctx)
-
-		for key, cmd := range localCmds {
-			if cmd.Val() > 0 {
-				localMatchBandsKeys = append(localMatchBandsKeys, key)
-			}
+		if s.CoversRaw {
+			sig["covers"] = SigRaw.String()
 		}
-
-		if len(localMatchBandsKeys) >= 4 {
-			pipe = rdb.Pipeline()
-			for _, key := range localMatchBandsKeys {
-				pipe.Expire(ctx, key, localRetentionDuration)
-			}
-			pipe.Exec(ctx)
-
-			var localHashes []string
-			pipe = rdb.Pipeline()
-			hashCmds := make(map[string]*redis.StringSliceCmd)
-			for _, key := range localMatchBandsKeys {
-				hashCmds[key] = pipe.SMembers(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			seenHashes := make(map[string]struct{})
-			for _, cmd := range hashCmds {
-				for _, hash := range cmd.Val() {
-					if _, seen := seenHashes[hash]; !seen {
-						localHashes = append(localHashes, hash)
-						seenHashes[hash] = struct{}{}
-					}
-				}
-			}
-
-			if len(localHashes) > 0 {
-				distances, err := computeDistanceBatch(sig, localHashes, localHashes, false)
-				if err == nil {
-					isLocalSpam := false
-					for hash, dist := range distances {
-						if dist <= threshold {
-							// Check score
-							scoreKey := LocalScorePrefix + hash
-							scoreVal, _ := rdb.Get(ctx, scoreKey).Int64()
-
-							if scoreVal > 0 {
-								confidence := getConfidenceForMatch(dist, threshold)
-								log.Printf("[Mailuminati] Local spam detected! Message-ID: %s | Subject: %s | Signature: %s | Match: %s | Score: %d | Type: %s", messageID, subject, sig, hash, scoreVal, sigType.String())
-								finalResult = AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String()}
-								atomic.AddInt64(&localSpamCount, 1)
-								promLocalMatch.Inc()
-								isLocalSpam = true
-								break // A single match is enough
-							}
-						} else if dist <= softThreshold {
-							// Soft spam - close but not certain
-							scoreKey := LocalScorePrefix + hash
-							scoreVal, _ := rdb.Get(ctx, scoreKey).Int64()
-							if scoreVal > 0 && finalResult.Action != "spam" {
-								confidence := getConfidenceForMatch(dist, softThreshold)
-								log.Printf("[Mailuminati] Local soft match. Message-ID: %s | Subject: %s | Distance: %d | Type: %s", messageID, subject, dist, sigType.String())
-								finalResult = AnalysisResult{Action: "soft_spam", Label: "local_soft", ProximityMatch: true, Distance: dist, Confidence: confidence, MatchType: sigType.String()}
-							}
-						}
-					}
-					if isLocalSpam {
-						goto nextSignature // Local spam verdict; move to next signature
-					}
-				}
+		if nm, ok := outcome.NearMisses[s.Hash]; ok {
+			if redact {
+				nm.Hash = ""
 			}
-			// If we reach here, distances were > threshold
-			finalResult.ProximityMatch = true
-			goto nextSignature // Stop here for this signature, as requested
+			sig["near_miss"] = nm
 		}
+		sigs = append(sigs, sig)
+	}
 
-		// Step 3: Band-based collision search (Oracle LSH)
-		matchCount = 0
-		pipe = rdb.Pipeline()
-		oracleCmds = make([]*redis.IntCmd, len(bands))
-		for i, b := range bands {
-			oracleCmds[i] = pipe.Exists(ctx, FragKeyPrefix+b)
+	resp := map[string]interface{}{
+		"verdict":     outcome.Result,
+		"whitelisted": outcome.Whitelisted,
+		"profile":     outcome.Profile.Name,
+		"signatures":  sigs,
+		"heuristics":  outcome.Heuristics,
+	}
+	if outcome.Whitelisted {
+		resp["whitelist_reason"] = outcome.WhitelistReason
+	}
+	if outcome.Failed != nil {
+		resp["signatures_failed"] = outcome.Failed
+	}
+	if outcome.BlacklistReason != "" {
+		resp["blacklist_reason"] = outcome.BlacklistReason
+	}
+	if outcome.AltPartDistance != nil {
+		resp["altpart_distance"] = *outcome.AltPartDistance
+	}
+	if outcome.Date != nil {
+		resp["date"] = outcome.Date
+	}
+	if len(outcome.TypeVerdicts) > 0 {
+		resp["combiner"] = getVerdictCombiner()
+		verdicts := make([]map[string]interface{}, 0, len(outcome.TypeVerdicts))
+		for _, v := range outcome.TypeVerdicts {
+			verdicts = append(verdicts, map[string]interface{}{"type": v.Type.String(), "verdict": v.Result})
 		}
-		pipe.Exec(ctx)
+		resp["type_verdicts"] = verdicts
+	}
 
-		for _, cmd := range oracleCmds {
-			if cmd.Val() > 0 {
-				matchCount++
-			}
-		}
+	// Provenance: how old the knowledge behind the verdict is
+	now := time.Now().Unix()
+	if outcome.Result.LearnedAt > 0 {
+		resp["learned_age_seconds"] = now - outcome.Result.LearnedAt
+	}
+	if outcome.Result.CachedAt > 0 {
+		resp["cached_age_seconds"] = now - outcome.Result.CachedAt
+	}
 
-		if matchCount >= 4 {
-			oracleVerdict := callOracleDecision(sig) // Call the oracle only here
-			if oracleVerdict.Action == "spam" {
-				log.Printf("[Mailuminati] Oracle spam detected! Message-ID: %s | Subject: %s | Signature: %s", messageID, subject, sig)
-				finalResult = oracleVerdict
-				atomic.AddInt64(&spamConfirmedCount, 1)
-				promOracleMatch.WithLabelValues("complete").Inc()
-				break // Final verdict; stop everything
-			} else {
-				log.Printf("[Mailuminati] Oracle partial match. Message-ID: %s | Subject: %s | Signature: %s", messageID, subject, sig)
-				finalResult.ProximityMatch = true
-				atomic.AddInt64(&partialMatchCount, 1)
-				promOracleMatch.WithLabelValues("partial").Inc()
-			}
-		}
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
 
-	nextSignature:
-		// If we have a spam verdict (local or oracle), we can stop
-		if finalResult.Action == "spam" {
-			break
+// contentReportKey is the oracle report dedup key of a content fingerprint (REPORT_CONTENT_DEDUP_WINDOW).
+// Scoped reports send other signatures, so the scope is part of the key. Returns "" when
+// disabled or for scans without a fingerprint.
+func contentReportKey(fingerprint, reportType string, scope []SignatureType) string {
+	if fingerprint == "" || atomic.LoadInt64(&reportContentDedupWindow) <= 0 {
+		return ""
+	}
+	key := ContentReportDedupPrefix + fingerprint + ":" + reportType
+	if len(scope) > 0 {
+		names := make([]string, 0, len(scope))
+		for _, t := range scope {
+			names = append(names, t.String())
 		}
+		sort.Strings(names)
+		key += ":" + strings.Join(names, ",")
 	}
+	return key
+}
 
-endAnalysis:
-	w.Header().Set("Content-Type", "application/json")
-	response := struct {
-		Action         string   `json:"action"`
-		Label          string   `json:"label,omitempty"`
-		ProximityMatch bool     `json:"proximity_match"`
-		Distance       int      `json:"distance,omitempty"`
-		Confidence     float64  `json:"confidence,omitempty"`
-		MatchType      string   `json:"match_type,omitempty"`
-		Hashes         []string `json:"hashes,omitempty"`
-	}{
-		Action:         finalResult.Action,
-		Label:          finalResult.Label,
-		ProximityMatch: finalResult.ProximityMatch,
-		Distance:       finalResult.Distance,
-		Confidence:     finalResult.Confidence,
-		MatchType:      finalResult.MatchType,
-		Hashes:         signatures,
+// scanAgeRejection checks a stored scan timestamp against REPORT_MAX_SCAN_AGE and
+// REPORT_MAX_CLOCK_SKEW, returning why a report on it must be rejected ("" if accepted)
+func scanAgeRejection(scannedAt int64, now time.Time) string {
+	maxAge := time.Duration(atomic.LoadInt64(&reportMaxScanAge))
+	if maxAge <= 0 {
+		return ""
 	}
-
-	respBytes, _ := json.Marshal(response)
-	w.WriteHeader(http.StatusOK)
-	w.Write(respBytes)
+	at := time.Unix(scannedAt, 0)
+	if at.After(now.Add(time.Duration(atomic.LoadInt64(&reportMaxClockSkew)))) {
+		return "scan_in_future"
+	}
+	if now.Sub(at) > maxAge {
+		return "scan_too_old"
+	}
+	return ""
 }
 
 func reportHandler(w http.ResponseWriter, r *http.Request) {
@@ -366,8 +306,13 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var reqBody struct {
-		MessageID  string `json:"message-id"`
-		ReportType string `json:"report_type"`
+		MessageID  string   `json:"message-id"`
+		ReportType string   `json:"report_type"`
+		Scope      []string `json:"scope"` // Signature types to learn from and report (default: all)
+		// Learn a spam report on a whitelisted sender anyway (admin token required)
+		OverrideWhitelist bool `json:"override_whitelist"`
+		// Reporting node or mailbox, counted by LEARNING_MIN_SOURCES (admin token required; default: the client IP)
+		Source string `json:"source"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
@@ -375,12 +320,20 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hasher := sha1.New()
-	hasher.Write([]byte(reqBody.MessageID))
-	sha1Hash := hex.EncodeToString(hasher.Sum(nil))
+	var scope []SignatureType
+	for _, name := range reqBody.Scope {
+		sigType := parseSignatureType(strings.ToLower(strings.TrimSpace(name)))
+		if sigType == SigUnknown {
+			http.Error(w, "Unknown signature type in scope: "+name, http.StatusBadRequest)
+			return
+		}
+		scope = append(scope, sigType)
+	}
+
+	sha1Hash := messageIDHash(reqBody.MessageID)
 
 	// Prevent duplicate reports for the same type
-	reportKey := "mi:rpt:" + sha1Hash + ":" + reqBody.ReportType
+	reportKey := ReportDedupPrefix + sha1Hash + ":" + reqBody.ReportType
 	if added, err := rdb.SetNX(ctx, reportKey, "1", 24*time.Hour).Result(); err != nil {
 		http.Error(w, "Redis error", http.StatusInternalServerError)
 		return
@@ -402,6 +355,46 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 
 	var scanData ScanResult
 	json.Unmarshal([]byte(val), &scanData)
+	if scanData.SchemaVersion != "" && scanData.SchemaVersion != currentVerdictSchemaVersion() {
+		// Hashed under another config: learning from them could teach signatures no scan produces anymore
+		log.Printf("[Mailuminati] Stale scan data for Message-ID: %s (schema %s, current %s)", reqBody.MessageID, scanData.SchemaVersion, currentVerdictSchemaVersion())
+		rdb.Del(ctx, reportKey) // Nothing was reported: the message may be reported again once rescanned
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"status":"stale","reason":"verdict_schema_changed"}`))
+		return
+	}
+	if reason := scanAgeRejection(scanData.Timestamp, time.Now()); reason != "" {
+		log.Printf("[Mailuminati] Rejected %s report for Message-ID: %s (%s, scanned at %d)", reqBody.ReportType, reqBody.MessageID, reason, scanData.Timestamp)
+		promReportsRejected.WithLabelValues(reason).Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"status":"rejected","reason":"` + reason + `"}`))
+		return
+	}
+	if reqBody.ReportType == "spam" {
+		if whitelisted, reason := scanData.senderWhitelisted(); whitelisted {
+			if !reqBody.OverrideWhitelist || !isAdminRequest(r) {
+				// A trusted sender's mail (possibly a compromised account) must not be learned
+				// on a user's word alone: it would block the sender's legitimate mail
+				log.Printf("[Mailuminati] Suppressed spam report for whitelisted sender (%s), Message-ID: %s", reason, reqBody.MessageID)
+				promReportsSuppressed.Inc()
+				rdb.Del(ctx, reportKey) // Let an admin override through
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"status":"suppressed","reason":"whitelisted_sender"}`))
+				return
+			}
+			log.Printf("[Mailuminati] Admin override: learning spam report for whitelisted sender (%s), Message-ID: %s", reason, reqBody.MessageID)
+		}
+	}
+	if scanData.Forwarded != "" {
+		log.Printf("[Mailuminati] Learning the forwarded block of Message-ID: %s", reqBody.MessageID)
+		scanData = scanData.withForwardedBlock()
+	}
+	if len(scope) > 0 {
+		scanData = scanData.inScope(scope)
+	}
 
 	// Check if we have hashes to report, else return error
 	if len(scanData.Hashes) == 0 {
@@ -411,112 +404,14 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 
 	// --- Local learning ---
 	skipOracleReport := false
-
 	if reqBody.ReportType == "spam" || reqBody.ReportType == "ham" {
 		log.Printf("[Mailuminati] Processing %s report for Message-ID: %s", reqBody.ReportType, reqBody.MessageID)
+		skipOracleReport = learnFromReport(scanData.typedHashes(), reqBody.ReportType, reportSource(reqBody.Source, r))
+	}
 
-		for _, hash := range scanData.Hashes {
-			bands := extractBands_6_3(hash)
-
-			// 1. Identify candidates using LSH
-			pipe := rdb.Pipeline()
-			localCmds := make(map[string]*redis.IntCmd)
-			for _, b := range bands {
-				key := LocalFragPrefix + b
-				localCmds[key] = pipe.Exists(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			matchingBandsKeys := []string{}
-			for key, cmd := range localCmds {
-				if cmd.Val() > 0 {
-					matchingBandsKeys = append(matchingBandsKeys, key)
-				}
-			}
-
-			var bestMatchHash string
-			var bestMatchDist int = 9999
-
-			if len(matchingBandsKeys) >= 4 {
-				// Get candidates
-				pipe = rdb.Pipeline()
-				hashCmds := make(map[string]*redis.StringSliceCmd)
-				for _, key := range matchingBandsKeys {
-					hashCmds[key] = pipe.SMembers(ctx, key)
-				}
-				pipe.Exec(ctx)
-
-				candidates := make(map[string]struct{})
-				for _, cmd := range hashCmds {
-					for _, h := range cmd.Val() {
-						candidates[h] = struct{}{}
-					}
-				}
-
-				candidateList := []string{}
-				for h := range candidates {
-					candidateList = append(candidateList, h)
-				}
-
-				if len(candidateList) > 0 {
-					// Compute distances
-					distances, err := computeDistanceBatch(hash, candidateList, candidateList, false)
-					if err == nil {
-						for h, dist := range distances {
-							if dist < bestMatchDist {
-								bestMatchDist = dist
-								bestMatchHash = h
-							}
-						}
-					}
-				}
-			}
-
-			// Decision Logic
-			targetHash := hash // Default: the reported hash itself
-			if bestMatchDist <= 70 {
-				targetHash = bestMatchHash
-			}
-
-			scoreKey := LocalScorePrefix + targetHash
-
-			if reqBody.ReportType == "spam" {
-				if bestMatchDist <= 70 {
-					// Already known locally
-					skipOracleReport = true
-				}
-
-				// Increment score
-				// Use atomic load for safe concurrent access during reload
-				currentSpamWeight := atomic.LoadInt64(&spamWeight)
-				newScore, _ := rdb.IncrBy(ctx, scoreKey, currentSpamWeight).Result()
-
-				// Refresh/Add bands
-				pipe := rdb.Pipeline()
-				targetBands := extractBands_6_3(targetHash)
-				for _, band := range targetBands {
-					key := LocalFragPrefix + band
-					pipe.SAdd(ctx, key, targetHash)
-					pipe.Expire(ctx, key, localRetentionDuration)
-				}
-				pipe.Expire(ctx, scoreKey, localRetentionDuration)
-				pipe.Exec(ctx)
-				log.Printf("[Mailuminati] Learned spam hash: %s (Score: %d)", targetHash, newScore)
-
-			} else if reqBody.ReportType == "ham" {
-				if bestMatchDist <= 70 {
-					// Found a corresponding spam entry to punish
-					currentHamWeight := atomic.LoadInt64(&hamWeight)
-					newScore, _ := rdb.DecrBy(ctx, scoreKey, currentHamWeight).Result()
-					log.Printf("[Mailuminati] Ham report for hash: %s (Score: %d)", targetHash, newScore)
-
-					// Refresh TTL (keep it alive even if negative)
-					rdb.Expire(ctx, scoreKey, localRetentionDuration)
-				}
-			}
-		}
+	if reqBody.ReportType == "ham" {
+		recordHamForSender(scanData.FromDomain)
 	}
-	// --- End local learning ---
 
 	if reqBody.ReportType == "spam" && skipOracleReport {
 		log.Printf("[Mailuminati] Skip Oracle report for Message-ID: %s (Already known)", reqBody.MessageID)
@@ -526,19 +421,52 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Non-TLSH signatures (exact fallback, URL sets, perceptual hashes) are local-only
+	oracleSigs := []string{}
+	for _, hash := range scanData.Hashes {
+		if isTLSHSignature(hash) {
+			oracleSigs = append(oracleSigs, hash)
+		}
+	}
+	if len(oracleSigs) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"skipped_oracle","reason":"local_only"}`))
+		return
+	}
+
+	// The same content arriving under other Message-IDs is reported to the oracle once per window
+	contentKey := contentReportKey(scanData.Fingerprint, reqBody.ReportType, scope)
+	if contentKey != "" {
+		window := time.Duration(atomic.LoadInt64(&reportContentDedupWindow))
+		if added, err := rdb.SetNX(ctx, contentKey, reqBody.MessageID, window).Result(); err == nil && !added {
+			log.Printf("[Mailuminati] Skip Oracle report for Message-ID: %s (content already reported)", reqBody.MessageID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"skipped_oracle","reason":"duplicate_content"}`))
+			return
+		}
+	}
+
 	payload, _ := json.Marshal(map[string]interface{}{
 		"node_id":     nodeID,
-		"signatures":  scanData.Hashes,
+		"signatures":  oracleSigs,
 		"report_type": reqBody.ReportType,
 	})
 
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Post(oracleURL+"/report", "application/json", bytes.NewBuffer(payload))
 	if err != nil {
+		if contentKey != "" {
+			rdb.Del(ctx, contentKey) // Not reported: let a later report through
+		}
 		http.Error(w, "Oracle unreachable", http.StatusServiceUnavailable)
 		return
 	}
 	defer resp.Body.Close()
+	if contentKey != "" && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		rdb.Del(ctx, contentKey) // Refused: let a later report through
+	}
 
 	body, _ := io.ReadAll(resp.Body)
 	w.Header().Set("Content-Type", "application/json")
@@ -565,6 +493,7 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		"node_id":     nodeID,
 		"current_seq": currentSeq,
 		"version":     EngineVersion,
+		"mode":        currentMode(),
 	}
 	respBytes, _ := json.Marshal(resp)
 
@@ -583,8 +512,9 @@ func whitelistHandler(w http.ResponseWriter, r *http.Request) {
 		domains, _ := rdb.SMembers(ctx, "mi:whitelist:domain").Result()
 		emails, _ := rdb.SMembers(ctx, "mi:whitelist:email").Result()
 		response := map[string]interface{}{
-			"domains": domains,
-			"emails":  emails,
+			"domains":      domains,
+			"emails":       emails,
+			"auto_domains": listAutoWhitelist(),
 		}
 		respBytes, _ := json.Marshal(response)
 		w.WriteHeader(http.StatusOK)
@@ -647,6 +577,9 @@ func whitelistHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		rdb.SRem(ctx, key, reqBody.Value)
+		if reqBody.Type == "domain" {
+			rdb.Del(ctx, AutoWhitelistPrefix+reqBody.Value)
+		}
 		log.Printf("[Mailuminati] Removed from whitelist: %s=%s", reqBody.Type, reqBody.Value)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"removed"}`))
@@ -662,3 +595,123 @@ func logRequestHandler(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// matchLearnedHash finds the learned hash a reported signature stands for: the nearest
+// learned hash within distance 70 (known), else the signature itself
+func matchLearnedHash(ts TypedSignature) (targetHash string, known bool) {
+	hash := ts.Hash
+	bands := lookupBands(hash)
+
+	// 1. Identify candidates using LSH
+	pipe := rdb.Pipeline()
+	localCmds := make(map[string]*redis.IntCmd)
+	for _, b := range bands {
+		key := LocalFragPrefix + b
+		localCmds[key] = pipe.Exists(ctx, key)
+	}
+	pipe.Exec(ctx)
+
+	matchingBandsKeys := []string{}
+	for key, cmd := range localCmds {
+		if cmd.Val() > 0 {
+			matchingBandsKeys = append(matchingBandsKeys, key)
+		}
+	}
+
+	var bestMatchHash string
+	var bestMatchDist int = 9999
+
+	quorum := int(atomic.LoadInt64(&bandQuorum))
+	if quorum > len(bands) {
+		quorum = len(bands)
+	}
+	if isPerceptualSignature(hash) {
+		quorum = 1 // See perceptualBands
+	}
+	if len(bands) > 0 && len(matchingBandsKeys) >= quorum {
+		// Get candidates
+		pipe = rdb.Pipeline()
+		hashCmds := make(map[string]*redis.StringSliceCmd)
+		for _, key := range matchingBandsKeys {
+			hashCmds[key] = pipe.SMembers(ctx, key)
+		}
+		pipe.Exec(ctx)
+
+		candidates := make(map[string]struct{})
+		for _, cmd := range hashCmds {
+			for _, h := range cmd.Val() {
+				candidates[h] = struct{}{}
+			}
+		}
+
+		candidateList := []string{}
+		for h := range candidates {
+			candidateList = append(candidateList, h)
+		}
+
+		if len(candidateList) > 0 {
+			// Compute distances
+			distances, err := distancerForType(hash, ts.Type).Distances(hash, candidateList)
+			if err == nil {
+				for h, dist := range distances {
+					if dist < bestMatchDist {
+						bestMatchDist = dist
+						bestMatchHash = h
+					}
+				}
+			}
+		}
+	}
+
+	if bestMatchDist <= 70 {
+		return bestMatchHash, true
+	}
+	return hash, false
+}
+
+// learnFromReport applies a spam or ham report to local learning. It returns true
+// when a spam report matched an already-learned hash (no need to tell the oracle).
+// The source of a spam report is recorded for LEARNING_MIN_SOURCES ("" records none).
+func learnFromReport(sigs []TypedSignature, reportType, source string) (knownLocally bool) {
+	var learned []string
+	for _, ts := range sigs {
+		hash := ts.Hash
+		targetHash, known := matchLearnedHash(ts)
+		scoreKey := LocalScorePrefix + targetHash
+
+		if reportType == "spam" {
+			if known {
+				// Already known locally
+				knownLocally = true
+			}
+
+			// Increment score
+			// Use atomic load for safe concurrent access during reload
+			newScore := learnSpamHash(targetHash, getSpamWeightForType(ts.Type), ts.Type)
+			learned = append(learned, targetHash)
+			log.Printf("[Mailuminati] Learned spam hash: %s (Score: %d)", targetHash, newScore)
+
+		} else if reportType == "ham" {
+			// Exact fallback signatures have no bands: they are their own entry
+			if known || !isTLSHSignature(hash) {
+				// Found a corresponding spam entry to punish
+				currentHamWeight := getHamWeightForType(ts.Type)
+				newScore, _ := rdb.DecrBy(ctx, scoreKey, currentHamWeight).Result()
+				log.Printf("[Mailuminati] Ham report for hash: %s (Score: %d)", targetHash, newScore)
+
+				// Refresh TTL (keep it alive even if negative)
+				retention := learnedRetention(targetHash)
+				rdb.Expire(ctx, scoreKey, retention)
+				rdb.Expire(ctx, LocalLearnedPrefix+targetHash, retention)
+				rdb.Expire(ctx, LocalTypePrefix+targetHash, retention)
+				rdb.Expire(ctx, LocalCampaignPrefix+targetHash, retention)
+				rdb.Expire(ctx, LocalSourcesPrefix+targetHash, retention)
+				pipe := rdb.Pipeline()
+				recordReport(pipe, targetHash, -currentHamWeight, retention)
+				pipe.Exec(ctx)
+			}
+		}
+	}
+	recordReportSources(learned, source)
+	return knownLocally
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// --- Heuristics configuration ---
+
+// Every optional heuristic is switched on or off with HEURISTIC_<NAME>; its older setting
+// (REPLYTO_MISMATCH_CHECK, PROTECTED_DISPLAY_NAMES set, MASS_CAMPAIGN_THRESHOLD set...) is
+// still read as the default, so all of them stay off unless configured. Each heuristic
+// signal, optional or not, is weighted by HEURISTIC_WEIGHT_<LABEL> (percent, default 100),
+// which scales the confidence it brings: a soft_spam it raises alone gets 50% of the weight,
+// a match it accompanies gains 10% of it.
+
+// configurableHeuristic is a heuristic that can be switched on or off
+type configurableHeuristic struct {
+	Name    string
+	Enabled func() bool // Default from the heuristic's own settings
+}
+
+var configurableHeuristics = []configurableHeuristic{
+	{"replyto_mismatch", func() bool { return getEnvBool("REPLYTO_MISMATCH_CHECK", false) }},
+	{"msgid_domain_mismatch", func() bool { return getEnvBool("MSGID_DOMAIN_CHECK", false) }},
+	{"altpart_mismatch", func() bool { return getEnvBool("ALTPART_MISMATCH_CHECK", false) }},
+	{"display_name_spoof", func() bool { return len(getEnvList("PROTECTED_DISPLAY_NAMES")) > 0 }},
+	{"date_anomaly", func() bool { return getEnvBool("DATE_ANOMALY_CHECK", false) }},
+	{"empty_subject", func() bool { return getEnvBool("EMPTY_SUBJECT_CHECK", false) }},
+	{"new_sender", func() bool { return getEnvBool("NEW_SENDER_CHECK", false) }},
+	{"list_unsubscribe", func() bool { return getEnvBool("LIST_UNSUBSCRIBE_CHECK", false) }},
+	{"mass_campaign", func() bool { return getEnvInt64("MASS_CAMPAIGN_THRESHOLD", 0) > 0 }},
+}
+
+// heuristicConfig holds the parsed HEURISTIC_* settings
+type heuristicConfig struct {
+	Enabled map[string]bool
+	Weights map[string]float64 // Signal label -> weight (1 = 100%); unset labels weigh 1
+}
+
+// loadHeuristicConfig reads HEURISTIC_<NAME> and HEURISTIC_WEIGHT_<LABEL>
+func loadHeuristicConfig() heuristicConfig {
+	cfg := heuristicConfig{Enabled: make(map[string]bool), Weights: make(map[string]float64)}
+	for _, h := range configurableHeuristics {
+		cfg.Enabled[h.Name] = getEnvBool("HEURISTIC_"+strings.ToUpper(h.Name), h.Enabled())
+	}
+	for _, label := range append(append([]string{}, scoredHeuristics...), "list_unsubscribe") {
+		if w := getEnvInt64("HEURISTIC_WEIGHT_"+strings.ToUpper(label), 100); w != 100 {
+			cfg.Weights[label] = math.Max(0, float64(w)) / 100
+		}
+	}
+	return cfg
+}
+
+// currentHeuristicConfig returns the active heuristics settings
+func currentHeuristicConfig() heuristicConfig {
+	cfg, _ := heuristicSettings.Load().(heuristicConfig)
+	return cfg
+}
+
+// heuristicEnabled reports whether an optional heuristic is switched on
+func heuristicEnabled(name string) bool {
+	return currentHeuristicConfig().Enabled[name]
+}
+
+// heuristicWeight returns the weight of a heuristic signal (1 by default)
+func heuristicWeight(label string) float64 {
+	if w, ok := currentHeuristicConfig().Weights[label]; ok {
+		return w
+	}
+	return 1
+}
+
+// activeHeuristics lists the optional heuristics switched on, by name
+func (c heuristicConfig) activeHeuristics() []string {
+	active := []string{}
+	for name, on := range c.Enabled {
+		if on {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// weightPercents returns the configured weights as percents
+func (c heuristicConfig) weightPercents() map[string]int {
+	percents := make(map[string]int, len(c.Weights))
+	for label, w := range c.Weights {
+		percents[label] = int(math.Round(w * 100))
+	}
+	return percents
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Header heuristics ---
+
+const (
+	heuristicSoftConfidence = 0.5 // Confidence given to a soft_spam raised by a heuristic alone
+	heuristicBoost          = 0.1 // Confidence added to an existing match per heuristic signal
+)
+
+// heuristicSignal is a header-level anomaly that adjusts the verdict
+type heuristicSignal struct {
+	Label  string `json:"label"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// messageFacts holds per-message data gathered before the heuristics run
+type messageFacts struct {
+	FromDomain          string
+	DomainFirstSeen     int64            // Unix time the From domain was first analyzed (0 if unknown)
+	AltPartDistance     int              // Distance between the text and HTML alternatives (-1 if not comparable)
+	Date                *messageDate     // Date header check (nil when DATE_ANOMALY_CHECK is off)
+	DangerousAttachment *heuristicSignal // Attachment with a dangerous extension (DANGEROUS_ATTACHMENT_ACTION=soft_spam)
+}
+
+// evaluateHeuristics runs every enabled header check on a (non-whitelisted) message
+func evaluateHeuristics(env *enmime.Envelope, facts messageFacts) []heuristicSignal {
+	var signals []heuristicSignal
+	if heuristicEnabled("replyto_mismatch") {
+		if sig, ok := checkReplyToMismatch(env.GetHeader("From"), env.GetHeader("Reply-To")); ok {
+			signals = append(signals, sig)
+		}
+	}
+	if heuristicEnabled("msgid_domain_mismatch") {
+		ignored, _ := msgidDomainIgnore.Load().([]string)
+		if sig, ok := checkMessageIDDomain(env.GetHeader("Message-ID"), env.GetHeader("From"), env.GetHeader("Return-Path"), ignored); ok {
+			signals = append(signals, sig)
+		}
+	}
+	if heuristicEnabled("altpart_mismatch") {
+		if sig, ok := checkAltPartMismatch(facts.AltPartDistance, int(atomic.LoadInt64(&altPartMismatchDistance))); ok {
+			signals = append(signals, sig)
+		}
+	}
+	if protected, _ := protectedDisplayNames.Load().([]protectedDisplayName); len(protected) > 0 && heuristicEnabled("display_name_spoof") {
+		if sig, ok := checkDisplayNameSpoof(env.GetHeader("From"), protected); ok {
+			signals = append(signals, sig)
+		}
+	}
+	if sig, ok := checkDateAnomaly(facts.Date); ok {
+		signals = append(signals, sig)
+	}
+	if facts.DangerousAttachment != nil {
+		signals = append(signals, *facts.DangerousAttachment)
+	}
+	if heuristicEnabled("empty_subject") {
+		if sig, ok := checkEmptySubject(env); ok {
+			signals = append(signals, sig)
+		}
+	}
+	if heuristicEnabled("new_sender") {
+		window := time.Duration(atomic.LoadInt64(&newSenderWindow))
+		if sig, ok := checkNewSender(facts.FromDomain, facts.DomainFirstSeen, time.Now(), window); ok {
+			signals = append(signals, sig)
+		}
+	}
+	return signals
+}
+
+// applyHeuristic folds a signal into the verdict: an allow becomes soft_spam, an existing match
+// gains confidence (both scaled by HEURISTIC_WEIGHT_<LABEL>)
+func applyHeuristic(res *AnalysisResult, sig heuristicSignal) {
+	weight := heuristicWeight(sig.Label)
+	switch res.Action {
+	case "spam", "soft_spam":
+		res.Confidence += heuristicBoost * weight
+		if res.Confidence > 1.0 {
+			res.Confidence = 1.0
+		}
+	default:
+		if weight == 0 {
+			return
+		}
+		res.Action = "soft_spam"
+		res.Label = sig.Label
+		res.Confidence = math.Min(1.0, heuristicSoftConfidence*weight)
+	}
+}
+
+// sameOrgDomain treats a domain and its subdomains as the same sender organisation
+func sameOrgDomain(a, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// addressDomains returns the domain of every address in a header, tolerating unparsable lists
+func addressDomains(header string) []string {
+	var domains []string
+	if list, err := mail.ParseAddressList(header); err == nil {
+		for _, addr := range list {
+			if d := extractDomain(addr.Address); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		return domains
+	}
+	for _, part := range strings.Split(header, ",") {
+		if d := extractDomain(part); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// checkReplyToMismatch flags a Reply-To pointing outside the From domain
+func checkReplyToMismatch(fromHeader, replyToHeader string) (heuristicSignal, bool) {
+	fromDomain := extractDomain(fromHeader)
+	if fromDomain == "" || strings.TrimSpace(replyToHeader) == "" {
+		return heuristicSignal{}, false
+	}
+	for _, d := range addressDomains(replyToHeader) {
+		if !sameOrgDomain(fromDomain, d) {
+			return heuristicSignal{Label: "replyto_mismatch", Detail: fromDomain + " -> " + d}, true
+		}
+	}
+	return heuristicSignal{}, false
+}
+
+var reHeaderComment = regexp.MustCompile(`\([^()]*\)`)
+
+// messageIDDomain returns the domain part of a Message-ID header ("" when it has none).
+// Comments, missing angle brackets, quoted local parts holding "@" and trailing dots are tolerated.
+func messageIDDomain(header string) string {
+	id := strings.TrimSpace(reHeaderComment.ReplaceAllString(header, " "))
+	if start := strings.Index(id, "<"); start != -1 {
+		id = id[start+1:]
+		if end := strings.Index(id, ">"); end != -1 {
+			id = id[:end]
+		}
+	} else if fields := strings.Fields(id); len(fields) > 0 {
+		id = fields[0]
+	}
+	at := strings.LastIndex(id, "@")
+	if at == -1 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(id[at+1:])), ".")
+}
+
+// validHostname reports whether a domain looks like a real host name: at least two labels of
+// letters, digits, hyphens or underscores, and a TLD that is not numeric
+func validHostname(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
+
+// checkMessageIDDomain flags a Message-ID whose domain is garbage or belongs to neither the
+// From nor the Return-Path domain. Message-IDs from the ignored domains (mailing services
+// generating IDs for their customers) and messages without Message-ID are not flagged.
+func checkMessageIDDomain(messageID, fromHeader, returnPath string, ignored []string) (heuristicSignal, bool) {
+	fromDomain := extractDomain(fromHeader)
+	if fromDomain == "" || strings.TrimSpace(messageID) == "" {
+		return heuristicSignal{}, false
+	}
+	domain := messageIDDomain(messageID)
+	switch {
+	case domain == "":
+		return heuristicSignal{Label: "msgid_domain_mismatch", Detail: "no domain"}, true
+	case !validHostname(domain):
+		return heuristicSignal{Label: "msgid_domain_mismatch", Detail: "invalid domain " + domain}, true
+	}
+	if sameOrgDomain(domain, fromDomain) {
+		return heuristicSignal{}, false
+	}
+	if rp := extractDomain(returnPath); rp != "" && sameOrgDomain(domain, rp) {
+		return heuristicSignal{}, false
+	}
+	for _, d := range ignored {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return heuristicSignal{}, false
+		}
+	}
+	return heuristicSignal{Label: "msgid_domain_mismatch", Detail: fromDomain + " -> " + domain}, true
+}
+
+// checkEmptySubject flags messages without a Subject header or with a blank one
+func checkEmptySubject(env *enmime.Envelope) (heuristicSignal, bool) {
+	if env.Root == nil {
+		return heuristicSignal{}, false
+	}
+	values, present := env.Root.Header[textproto.CanonicalMIMEHeaderKey("Subject")]
+	if !present || len(values) == 0 {
+		return heuristicSignal{Label: "empty_subject", Detail: "missing"}, true
+	}
+	if strings.TrimSpace(env.GetHeader("Subject")) == "" {
+		return heuristicSignal{Label: "empty_subject", Detail: "empty"}, true
+	}
+	return heuristicSignal{}, false
+}
+
+// touchDomainFirstSeen records the first time a From domain is analyzed and returns it.
+// The record is kept alive while the domain keeps sending.
+func touchDomainFirstSeen(domain string) int64 {
+	if domain == "" {
+		return 0
+	}
+	key := DomainFirstSeenPrefix + domain
+	pipe := rdb.Pipeline()
+	pipe.SetNX(ctx, key, time.Now().Unix(), 0)
+	pipe.Expire(ctx, key, time.Duration(atomic.LoadInt64(&domainFirstSeenRetention)))
+	get := pipe.Get(ctx, key)
+	pipe.Exec(ctx)
+	firstSeen, _ := get.Int64()
+	return firstSeen
+}
+
+// domainFirstSeen returns when a From domain was first analyzed, without recording it
+func domainFirstSeen(domain string) int64 {
+	if domain == "" {
+		return 0
+	}
+	firstSeen, _ := rdb.Get(ctx, DomainFirstSeenPrefix+domain).Int64()
+	return firstSeen
+}
+
+// checkNewSender flags domains first seen within the recency window
+func checkNewSender(domain string, firstSeen int64, now time.Time, window time.Duration) (heuristicSignal, bool) {
+	if domain == "" || firstSeen == 0 {
+		return heuristicSignal{}, false
+	}
+	age := now.Sub(time.Unix(firstSeen, 0))
+	if age < window {
+		return heuristicSignal{Label: "new_sender", Detail: domain + " first seen " + age.Round(time.Second).String() + " ago"}, true
+	}
+	return heuristicSignal{}, false
+}
+
+// missingHeaders lists the REQUIRED_HEADERS absent (or empty) on a message
+func missingHeaders(env *enmime.Envelope) []string {
+	required, _ := requiredHeaders.Load().([]string)
+	var missing []string
+	for _, h := range required {
+		if strings.TrimSpace(env.GetHeader(h)) == "" {
+			missing = append(missing, h)
+		}
+	}
+	return missing
+}
+
+// getMissingHeadersAction returns MISSING_HEADERS_ACTION: scan, soft_spam or spam
+func getMissingHeadersAction() string {
+	if action, ok := missingHeadersAction.Load().(string); ok && action != "" {
+		return action
+	}
+	return "scan"
+}
+
+// validListUnsubscribe reports whether a List-Unsubscribe header carries a usable mailto or http(s) target
+func validListUnsubscribe(value string) bool {
+	v := strings.ToLower(value)
+	return strings.Contains(v, "<mailto:") || strings.Contains(v, "<https://") || strings.Contains(v, "<http://")
+}
+
+// checkListUnsubscribe treats a valid List-Unsubscribe as a mild ham signal, and its absence
+// on mail sent to several recipients as a mild spam signal. delta is the confidence adjustment.
+func checkListUnsubscribe(listUnsubscribe string, recipients int) (sig heuristicSignal, delta float64, ok bool) {
+	if validListUnsubscribe(listUnsubscribe) {
+		return heuristicSignal{Label: "list_unsubscribe", Detail: "present"}, -heuristicBoost, true
+	}
+	if recipients > 1 {
+		return heuristicSignal{Label: "list_unsubscribe_missing", Detail: fmt.Sprintf("absent with %d recipients", recipients)}, heuristicBoost, true
+	}
+	return heuristicSignal{}, 0, false
+}
+
+// applyListUnsubscribe adjusts the confidence of a spam/soft_spam verdict. A soft_spam
+// falling below the heuristic-only confidence is downgraded to allow.
+func applyListUnsubscribe(res *AnalysisResult, delta float64) {
+	if res.Action != "spam" && res.Action != "soft_spam" {
+		return
+	}
+	res.Confidence = math.Max(0, math.Min(1.0, res.Confidence+delta))
+	if res.Action == "soft_spam" && res.Confidence < heuristicSoftConfidence {
+		res.Action = "allow"
+		res.Label = ""
+		res.Confidence = 0
+	}
+}
+
+var (
+	reHTMLInvisible = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)>`)
+	reHTMLTag       = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlText extracts the visible text of an HTML part
+func htmlText(htmlBody string) string {
+	text := reHTMLInvisible.ReplaceAllString(htmlBody, " ")
+	text = reHTMLTag.ReplaceAllString(text, " ")
+	return html.UnescapeString(text)
+}
+
+// isMultipartAlternative reports whether the message has a multipart/alternative part
+func isMultipartAlternative(env *enmime.Envelope) bool {
+	var walk func(p *enmime.Part) bool
+	walk = func(p *enmime.Part) bool {
+		for ; p != nil; p = p.NextSibling {
+			if strings.EqualFold(p.ContentType, "multipart/alternative") || walk(p.FirstChild) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(env.Root)
+}
+
+// altPartDistance compares the normalized text and HTML alternatives of a message.
+// Returns -1 unless both alternatives exist and are long enough to hash.
+func altPartDistance(env *enmime.Envelope) int {
+	if env.Text == "" || env.HTML == "" || !isMultipartAlternative(env) {
+		return -1
+	}
+	textSig, err := computeLocalTLSH(normalizeEmailBody(env.Text, ""))
+	if err != nil {
+		return -1
+	}
+	htmlSig, err := computeLocalTLSH(normalizeEmailBody(htmlText(env.HTML), ""))
+	if err != nil {
+		return -1
+	}
+	dist, err := computeDistance(textSig, htmlSig, true, 0)
+	if err != nil {
+		return -1
+	}
+	return dist
+}
+
+// checkAltPartMismatch flags text and HTML alternatives telling different stories
+func checkAltPartMismatch(distance, maxDistance int) (heuristicSignal, bool) {
+	if distance > maxDistance {
+		return heuristicSignal{Label: "altpart_mismatch", Detail: fmt.Sprintf("text/html distance %d", distance)}, true
+	}
+	return heuristicSignal{}, false
+}
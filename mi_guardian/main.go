@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -33,8 +34,20 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func init() {
-	prometheus.MustRegister(promScanned, promLocalMatch, promOracleMatch, promCacheHits)
+// registerMetrics registers all Guardian metrics with constant node_id/version labels,
+// so a fleet scraped into one Prometheus keeps each node's series distinct
+func registerMetrics(reg prometheus.Registerer, node string) {
+	wrapped := prometheus.WrapRegistererWith(prometheus.Labels{"node_id": node, "version": EngineVersion}, reg)
+	wrapped.MustRegister(
+		promScanned, promLocalMatch, promOracleMatch, promCacheHits,
+		promOracleCachePromotions, promBodyHashFailures, promAutoWhitelisted,
+		promCompactionMerged, promCompactionLastRun, promTrapAutoLearned,
+		promRedundantRawSkipped, promOracleFingerprintHits, promResetInProgress, promResetDeleted,
+		promMode, promModeChanges, promOracleSkipped, promBadAttachmentHits, promReportsRejected,
+		promAttachmentOracleCapped, promAnalyzeInFlight, promAnalyzeRejected,
+		promLargeImagesSkipped, promReportsSuppressed, promUserSignals, promOracleCacheWarmed, promHamSamples,
+		promOracleMalformed, promBodyCache, promCharsetRedecoded, promAuditLog,
+	)
 }
 
 func main() {
@@ -82,17 +95,42 @@ func main() {
 
 	nodeID = initNode()
 	log.Printf("[Mailuminati] Engine %s started. Node: %s", EngineVersion, nodeID)
+	registerMetrics(prometheus.DefaultRegisterer, nodeID)
+	if provider, err := initTracing(); err != nil {
+		log.Printf("[Mailuminati] Tracing disabled: %v", err)
+	} else if provider != nil {
+		shutdownTracingOnSignal(provider)
+	}
 
 	// Workers
+	go warmOracleCache()
 	go syncWorker()
 	go statsWorker()
+	go compactionWorker()
+	if getEnvBool("QUEUE_MODE", false) {
+		go queueWorker()
+	}
+	go badAttachmentFeedWorker()
+	go hamSampleWorker()
 
 	// Endpoints
 	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/analyze", analyzeHandler)
+	http.HandleFunc("/analyze", limitAnalyzeConcurrency(analyzeHandler))
+	http.HandleFunc("/explain", logRequestHandler(requireAdmin(explainHandler)))
 	http.HandleFunc("/report", logRequestHandler(reportHandler))
+	http.HandleFunc("/signal", logRequestHandler(requireAdmin(signalHandler)))
 	http.HandleFunc("/status", logRequestHandler(statusHandler))
+	http.HandleFunc("/config", logRequestHandler(configHandler))
 	http.HandleFunc("/whitelist", logRequestHandler(whitelistHandler))
+	http.HandleFunc("/blacklist", logRequestHandler(requireAdmin(blacklistHandler)))
+	http.HandleFunc("/learning/softspam", logRequestHandler(requireAdmin(softSpamTrendsHandler)))
+	http.HandleFunc("/learning/inspect", logRequestHandler(requireAdmin(learningInspectHandler)))
+	http.HandleFunc("/stats/top-domains", logRequestHandler(requireAdmin(topDomainsHandler)))
+	http.HandleFunc("/admin/sync/apply", logRequestHandler(requireAdmin(adminSyncApplyHandler)))
+	http.HandleFunc("/admin/mode", logRequestHandler(requireAdmin(adminModeHandler)))
+	http.HandleFunc("/debug/hash", logRequestHandler(requireAdmin(debugHashHandler)))
+	http.HandleFunc("/admin/badhash/attachment", logRequestHandler(requireAdmin(adminBadAttachmentHandler)))
+	http.HandleFunc("/admin/report-dedup", logRequestHandler(requireAdmin(adminReportDedupHandler)))
 
 	port := getEnv("PORT", "12421")
 	bindAddr := getEnv("GUARDIAN_BIND_ADDR", "127.0.0.1")
@@ -117,6 +155,22 @@ func refreshLogicConfig() {
 		atomic.StoreInt64(&hamWeight, 2)
 	}
 
+	// Per-signature-type weights (SPAM_WEIGHT_URL, HAM_WEIGHT_SUBJECT, ...), unset or 0 = global weight
+	typeSpam := make(map[SignatureType]int64)
+	typeHam := make(map[SignatureType]int64)
+	for _, t := range allSignatureTypes {
+		suffix := strings.ToUpper(t.String())
+		if w := getEnvInt64("SPAM_WEIGHT_"+suffix, 0); w > 0 {
+			typeSpam[t] = w
+		}
+		if w := getEnvInt64("HAM_WEIGHT_"+suffix, 0); w > 0 {
+			typeHam[t] = w
+		}
+	}
+	typeSpamWeights.Store(typeSpam)
+	typeHamWeights.Store(typeHam)
+	signalWeights.Store(loadSignalWeights())
+
 	// Load retention duration from env/config
 	// Note: localRetentionDuration is not int64, so atomic.Store is tricky.
 	// But in this context (SIGHUP), a simple assignment is mostly safe if we assume
@@ -135,6 +189,223 @@ func refreshLogicConfig() {
 	} else {
 		localRetentionDuration = time.Duration(DefaultLocalRetention) * 24 * time.Hour
 	}
+
+	if q := getEnvInt64("BAND_QUORUM", 4); q > 0 {
+		atomic.StoreInt64(&bandQuorum, q)
+	} else {
+		atomic.StoreInt64(&bandQuorum, 4)
+	}
+	atomic.StoreInt64(&quorumNormalized, getEnvInt64("QUORUM_NORMALIZED", 0))
+	atomic.StoreInt64(&quorumRaw, getEnvInt64("QUORUM_RAW", 0))
+	atomic.StoreInt64(&quorumURL, getEnvInt64("QUORUM_URL", 0))
+	atomic.StoreInt64(&quorumSubject, getEnvInt64("QUORUM_SUBJECT", 0))
+	atomic.StoreInt64(&quorumAttachment, getEnvInt64("QUORUM_ATTACHMENT", 0))
+	atomic.StoreInt64(&quorumCombined, getEnvInt64("QUORUM_COMBINED", 0))
+	atomic.StoreInt64(&quorumStructure, getEnvInt64("QUORUM_STRUCTURE", 0))
+	atomic.StoreInt64(&retentionDaysNormalized, getEnvInt64("RETENTION_DAYS_NORMALIZED", 0))
+	atomic.StoreInt64(&retentionDaysRaw, getEnvInt64("RETENTION_DAYS_RAW", 0))
+	atomic.StoreInt64(&retentionDaysURL, getEnvInt64("RETENTION_DAYS_URL", 0))
+	atomic.StoreInt64(&retentionDaysSubject, getEnvInt64("RETENTION_DAYS_SUBJECT", 0))
+	atomic.StoreInt64(&retentionDaysAttachment, getEnvInt64("RETENTION_DAYS_ATTACHMENT", 0))
+	atomic.StoreInt64(&retentionDaysCombined, getEnvInt64("RETENTION_DAYS_COMBINED", 0))
+	atomic.StoreInt64(&retentionDaysStructure, getEnvInt64("RETENTION_DAYS_STRUCTURE", 0))
+	atomic.StoreInt64(&maxHashLifetime, int64(getEnvDuration("MAX_HASH_LIFETIME", 0)))
+	atomic.StoreInt64(&minLengthNormalized, getEnvInt64("MIN_LENGTH_NORMALIZED", 200))
+	atomic.StoreInt64(&minLengthRaw, getEnvInt64("MIN_LENGTH_RAW", 200))
+	atomic.StoreInt64(&minLengthURL, getEnvInt64("MIN_LENGTH_URL", 100))
+	atomic.StoreInt64(&minLengthSubject, getEnvInt64("MIN_LENGTH_SUBJECT", MinSubjectLength))
+	atomic.StoreInt64(&minLengthAttachment, getEnvInt64("MIN_LENGTH_ATTACHMENT", 128))
+	atomic.StoreInt64(&minLengthCombined, getEnvInt64("MIN_LENGTH_COMBINED", 200))
+	atomic.StoreInt64(&minLengthStructure, getEnvInt64("MIN_LENGTH_STRUCTURE", 200))
+	atomic.StoreInt64(&minVisualSize, getEnvInt64("MIN_VISUAL_SIZE", MinVisualSize))
+	combinedSignature.Store(getEnvBool("COMBINED_SIGNATURE", false))
+	structureSignature.Store(getEnvBool("STRUCTURE_SIGNATURE", false))
+	skipRawForHTML.Store(getEnvBool("SKIP_RAW_FOR_HTML", false))
+	atomic.StoreInt64(&maxVisualSize, getEnvInt64("MAX_VISUAL_SIZE", 0))
+	largeImagePerceptual.Store(getEnvBool("LARGE_IMAGE_PERCEPTUAL", false))
+	atomic.StoreInt64(&reportHalfLife, int64(getEnvDuration("REPORT_HALF_LIFE", 0)))
+	atomic.StoreInt64(&reportMinWeightedScore, getEnvInt64("REPORT_MIN_WEIGHTED_SCORE", 50))
+	atomic.StoreInt64(&learningMinSources, getEnvInt64("LEARNING_MIN_SOURCES", 0))
+	atomic.StoreInt64(&reportContentDedupWindow, int64(getEnvDuration("REPORT_CONTENT_DEDUP_WINDOW", 0)))
+	atomic.StoreInt64(&reportMaxScanAge, int64(getEnvDuration("REPORT_MAX_SCAN_AGE", 0)))
+	atomic.StoreInt64(&reportMaxClockSkew, int64(getEnvDuration("REPORT_MAX_CLOCK_SKEW", 5*time.Minute)))
+	dequoteForwards.Store(getEnvBool("DEQUOTE_FORWARDS", false))
+	atomic.StoreInt64(&forwardedBlockMinSize, getEnvInt64("FORWARDED_BLOCK_MIN_SIZE", 0))
+	badAttachmentCheck.Store(getEnvBool("BAD_ATTACHMENT_CHECK", false))
+	atomic.StoreInt64(&maxAttachmentOracleCalls, getEnvInt64("MAX_ATTACHMENT_ORACLE_CALLS", 0))
+	oracleLocalOnlyTypes.Store(getEnvSignatureTypes("ORACLE_LOCAL_ONLY_TYPES"))
+	tlshIgnoreLengthTypes.Store(getEnvSignatureTypes("TLSH_IGNORE_LENGTH_TYPES"))
+	if interval := getEnvDuration("BAD_ATTACHMENT_FEED_INTERVAL", time.Hour); interval > 0 {
+		atomic.StoreInt64(&badAttachmentFeedInterval, int64(interval))
+	}
+	if size := getEnvInt64("QUEUE_BATCH_SIZE", 10); size > 0 {
+		atomic.StoreInt64(&queueBatchSize, size)
+	}
+	atomic.StoreInt64(&queueOutputMaxLen, getEnvInt64("QUEUE_OUTPUT_MAXLEN", 100000))
+	normalizeSteps.Store(loadNormalizeSteps())
+
+	windows, err := parseMaintenanceWindows(getEnv("ORACLE_MAINTENANCE_WINDOWS", ""))
+	if err != nil {
+		log.Printf("[Mailuminati] Invalid ORACLE_MAINTENANCE_WINDOWS (%v), no window applied", err)
+		windows = nil
+	}
+	maintenanceWindows.Store(windows)
+	base64Decode.Store(getEnvBool("BASE64_DECODE", false))
+	emojiNormalize.Store(getEnvBool("EMOJI_NORMALIZE", false))
+	charsetSniffing.Store(getEnvBool("CHARSET_SNIFFING", false))
+	atomic.StoreInt64(&base64MinRun, getEnvInt64("BASE64_MIN_LENGTH", 80))
+	atomic.StoreInt64(&base64MaxDecoded, getEnvInt64("BASE64_MAX_DECODED", 64*1024))
+	if batch := getEnvInt64("RESET_BATCH_SIZE", 500); batch > 0 {
+		atomic.StoreInt64(&resetBatchSize, batch)
+	}
+	atomic.StoreInt64(&resetBatchDelay, int64(getEnvDuration("RESET_BATCH_DELAY", 50*time.Millisecond)))
+	atomic.StoreInt64(&redundantRawDistance, getEnvInt64("REDUNDANT_RAW_DISTANCE", -1))
+	if stride := getEnvInt64("BAND_SUBSET_STRIDE", 1); stride > 0 {
+		atomic.StoreInt64(&bandSubsetStride, stride)
+	}
+	atomic.StoreInt64(&bandSubsetMax, getEnvInt64("BAND_SUBSET_MAX", 0))
+
+	deepScanDomains.Store(getEnvList("DEEP_SCAN_DOMAINS"))
+	atomic.StoreInt64(&deepScanBonus, getEnvInt64("DEEP_SCAN_THRESHOLD_BONUS", 15))
+
+	atomic.StoreInt64(&spamMinConfidence, getEnvInt64("SPAM_MIN_CONFIDENCE", 0))
+	atomic.StoreInt64(&oracleCacheMinConfidence, getEnvInt64("ORACLE_CACHE_MIN_CONFIDENCE", 0))
+	promoteOracleCache.Store(getEnvBool("PROMOTE_ORACLE_CACHE_MATCHES", false))
+	atomic.StoreInt64(&promoteMinConfidence, getEnvInt64("PROMOTE_MIN_CONFIDENCE", 90))
+	atomic.StoreInt64(&promoteScore, getEnvInt64("PROMOTE_SCORE", 1))
+	oracleCacheWarmStart.Store(getEnvBool("ORACLE_CACHE_WARM_START", false))
+	atomic.StoreInt64(&oracleCacheWarmStartLimit, getEnvInt64("ORACLE_CACHE_WARM_START_LIMIT", 10000))
+	hamSampleSettings.Store(loadHamSampleConfig())
+	atomic.StoreInt64(&oracleMalformedRetries, max(getEnvInt64("ORACLE_MALFORMED_RETRIES", 0), 0))
+	loadOracleMalformedAction()
+	scoreSettings.Store(loadScoreConfig())
+	responseIncludeHashes.Store(getEnvBool("RESPONSE_INCLUDE_HASHES", true))
+	atomic.StoreInt64(&normalizedBodyCacheSize, getEnvInt64("NORMALIZED_BODY_CACHE_SIZE", 0))
+	atomic.StoreInt64(&oracleLastKnownTTL, int64(getEnvDuration("ORACLE_LAST_KNOWN_TTL", 24*time.Hour)))
+
+	switch action := strings.ToLower(getEnv("BODY_HASH_FAILURE_ACTION", "ignore")); action {
+	case "ignore", "soft_spam", "exact":
+		bodyHashFailureAction.Store(action)
+	default:
+		log.Printf("[Mailuminati] Invalid BODY_HASH_FAILURE_ACTION %q, using ignore", action)
+		bodyHashFailureAction.Store("ignore")
+	}
+
+	atomic.StoreInt64(&spamResponseDelay, int64(getEnvDuration("SPAM_RESPONSE_DELAY", 0)))
+	setAnalyzeConcurrency(getEnvInt64("MAX_CONCURRENT_ANALYZE", 0))
+	configureTopDomains(getEnvInt64("TOP_DOMAINS_SIZE", 0), getEnvDuration("TOP_DOMAINS_WINDOW", time.Hour))
+	switch format := strings.ToLower(getEnv("VERDICT_LOG_FORMAT", "")); format {
+	case "", SIEMFormatCEF, SIEMFormatLEEF:
+		verdictLogFormat.Store(format)
+	default:
+		log.Printf("[Mailuminati] Invalid VERDICT_LOG_FORMAT %q, verdict log disabled", format)
+		verdictLogFormat.Store("")
+	}
+	configureAuditLog(loadAuditConfig())
+	atomic.StoreInt64(&analyzeQueueTimeout, int64(getEnvDuration("ANALYZE_QUEUE_TIMEOUT", 0)))
+
+	softSpamTracking.Store(getEnvBool("SOFT_SPAM_TRACKING", false))
+	atomic.StoreInt64(&softSpamTrackingTTL, int64(getEnvDuration("SOFT_SPAM_TRACKING_TTL", 24*time.Hour)))
+	atomic.StoreInt64(&softSpamDeltaLocal, getEnvInt64("SOFT_SPAM_DELTA_LOCAL", -1))
+	atomic.StoreInt64(&softSpamDeltaOracleCache, getEnvInt64("SOFT_SPAM_DELTA_ORACLE_CACHE", -1))
+	atomic.StoreInt64(&softSpamEscalateLocal, getEnvInt64("SOFT_SPAM_ESCALATE_LOCAL", 0))
+	atomic.StoreInt64(&softSpamEscalateOracleCache, getEnvInt64("SOFT_SPAM_ESCALATE_ORACLE_CACHE", 0))
+
+	switch metric := strings.ToLower(getEnv("DISTANCE_METRIC_URL", "tlsh")); metric {
+	case "tlsh", "jaccard":
+		urlDistanceJaccard.Store(metric == "jaccard")
+	default:
+		log.Printf("[Mailuminati] Invalid DISTANCE_METRIC_URL %q, using tlsh", metric)
+		urlDistanceJaccard.Store(false)
+	}
+
+	autoWhitelist.Store(getEnvBool("AUTO_WHITELIST", false))
+	atomic.StoreInt64(&autoWhitelistHamReports, getEnvInt64("AUTO_WHITELIST_HAM_REPORTS", 5))
+	atomic.StoreInt64(&autoWhitelistWindow, int64(getEnvDuration("AUTO_WHITELIST_WINDOW", 7*24*time.Hour)))
+	atomic.StoreInt64(&autoWhitelistTTL, int64(getEnvDuration("AUTO_WHITELIST_TTL", 30*24*time.Hour)))
+
+	switch action := strings.ToLower(getEnv("PARTIAL_MATCH_ACTION", "ignore")); action {
+	case "ignore", "soft_spam":
+		partialMatchSoftSpam.Store(action == "soft_spam")
+	default:
+		log.Printf("[Mailuminati] Invalid PARTIAL_MATCH_ACTION %q, using ignore", action)
+		partialMatchSoftSpam.Store(false)
+	}
+
+	compactionEnabled.Store(getEnvBool("COMPACTION_ENABLED", false))
+	if interval := getEnvDuration("COMPACTION_INTERVAL", 6*time.Hour); interval > 0 {
+		atomic.StoreInt64(&compactionInterval, int64(interval))
+	}
+	atomic.StoreInt64(&compactionDistance, getEnvInt64("COMPACTION_DISTANCE", 10))
+
+	atomic.StoreInt64(&massCampaignThreshold, getEnvInt64("MASS_CAMPAIGN_THRESHOLD", 0))
+	if window := getEnvDuration("MASS_CAMPAIGN_WINDOW", 10*time.Minute); window > 0 {
+		atomic.StoreInt64(&massCampaignWindow, int64(window))
+	}
+	switch action := strings.ToLower(getEnv("MASS_CAMPAIGN_ACTION", "soft_spam")); action {
+	case "soft_spam", "spam":
+		massCampaignSpam.Store(action == "spam")
+	default:
+		log.Printf("[Mailuminati] Invalid MASS_CAMPAIGN_ACTION %q, using soft_spam", action)
+		massCampaignSpam.Store(false)
+	}
+
+	spamTrapRecipients.Store(getEnvList("SPAM_TRAP_RECIPIENTS"))
+	spamTrapAutoLearn.Store(getEnvBool("SPAM_TRAP_AUTO_LEARN", false))
+
+	requiredHeaders.Store(getEnvList("REQUIRED_HEADERS"))
+	switch action := strings.ToLower(getEnv("MISSING_HEADERS_ACTION", "scan")); action {
+	case "scan", "soft_spam", "spam":
+		missingHeadersAction.Store(action)
+	default:
+		log.Printf("[Mailuminati] Invalid MISSING_HEADERS_ACTION %q, using scan", action)
+		missingHeadersAction.Store("scan")
+	}
+	switch action := strings.ToLower(getEnv("DANGEROUS_ATTACHMENT_ACTION", "off")); action {
+	case "off", "soft_spam", "spam":
+		dangerousAttachmentAction.Store(action)
+	default:
+		log.Printf("[Mailuminati] Invalid DANGEROUS_ATTACHMENT_ACTION %q, using off", action)
+		dangerousAttachmentAction.Store("off")
+	}
+	dangerousExtensions.Store(loadDangerousExtensions())
+
+	switch policy := strings.ToLower(getEnv("LIST_CONFLICT_POLICY", ListConflictMostSpecific)); policy {
+	case ListConflictBlacklistWins, ListConflictWhitelistWins, ListConflictMostSpecific:
+		listConflictPolicy.Store(policy)
+	default:
+		log.Printf("[Mailuminati] Invalid LIST_CONFLICT_POLICY %q, using %s", policy, ListConflictMostSpecific)
+		listConflictPolicy.Store(ListConflictMostSpecific)
+	}
+
+	userMessages.Store(loadUserMessages())
+	smtpResponses.Store(loadSMTPResponses())
+
+	switch policy := strings.ToLower(getEnv("LOCAL_CONFLICT_POLICY", LocalConflictAnySpam)); policy {
+	case LocalConflictAnySpam, LocalConflictHighestScore, LocalConflictNearest, LocalConflictNetScore:
+		localConflictPolicy.Store(policy)
+	default:
+		log.Printf("[Mailuminati] Invalid LOCAL_CONFLICT_POLICY %q, using %s", policy, LocalConflictAnySpam)
+		localConflictPolicy.Store(LocalConflictAnySpam)
+	}
+	loadVerdictCombiner()
+
+	heuristicSettings.Store(loadHeuristicConfig())
+	protectedDisplayNames.Store(parseProtectedDisplayNames(getEnvList("PROTECTED_DISPLAY_NAMES")))
+	atomic.StoreInt64(&newSenderWindow, int64(getEnvDuration("NEW_SENDER_WINDOW", 72*time.Hour)))
+	msgidDomainIgnore.Store(getEnvList("MSGID_DOMAIN_IGNORE"))
+	atomic.StoreInt64(&altPartMismatchDistance, getEnvInt64("ALTPART_MISMATCH_DISTANCE", 150))
+	atomic.StoreInt64(&dateMaxFutureSkew, int64(getEnvDuration("DATE_MAX_FUTURE_SKEW", 24*time.Hour)))
+	atomic.StoreInt64(&dateMaxAge, int64(getEnvDuration("DATE_MAX_AGE", 30*24*time.Hour)))
+	if retention := getEnvDuration("DOMAIN_FIRST_SEEN_RETENTION", 90*24*time.Hour); retention > 0 {
+		atomic.StoreInt64(&domainFirstSeenRetention, int64(retention))
+	}
+
+	// Last, once everything it depends on is loaded
+	version := computeVerdictSchemaVersion()
+	if previous, ok := verdictSchemaVersion.Swap(version).(string); ok && previous != version {
+		log.Printf("[Mailuminati] Verdict schema version changed: %s -> %s (cached verdicts and stored scans are now stale)", previous, version)
+	}
 }
 
 func initNode() string {
@@ -16,15 +16,45 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/quotedprintable"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/jhillyerd/enmime"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // TestComputeLocalTLSH checks that the generated hash is valid and properly formatted (T1 + Uppercase)
@@ -400,3 +430,5339 @@ func TestDoSync(t *testing.T) {
 	// Simply call doSync and ensure it doesn't crash
 	doSync()
 }
+
+// withConfig applies config file values for the duration of a test, as a SIGHUP reload would
+func withConfig(t *testing.T, values map[string]string) {
+	t.Helper()
+	configMutex.Lock()
+	for k, v := range values {
+		configMap[k] = v
+	}
+	configMutex.Unlock()
+	refreshLogicConfig()
+
+	t.Cleanup(func() {
+		configMutex.Lock()
+		for k := range values {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+		refreshLogicConfig()
+	})
+}
+
+// useMiniredis points rdb at an in-memory Redis for the duration of a test
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	original := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+		// Background writes (storeScanResult) may still be running: never leave rdb nil
+		if original != nil {
+			rdb = original
+		}
+	})
+	return mr
+}
+
+// TestDeepScanProfile checks that deep-scan senders get tighter thresholds, never below 0
+func TestDeepScanProfile(t *testing.T) {
+	withConfig(t, map[string]string{
+		"DEEP_SCAN_DOMAINS":         ".zip, freemail.example",
+		"DEEP_SCAN_THRESHOLD_BONUS": "20",
+	})
+
+	base := defaultProfile()
+	zip := profileForSender("Invoice <billing@invoice-2024.zip>")
+	if zip.Name != "deep_scan" {
+		t.Fatalf("expected deep_scan profile for .zip sender, got %s", zip.Name)
+	}
+	for _, sigType := range []SignatureType{SigNormalized, SigRaw, SigURL, SigSubject, SigAttachment} {
+		if want := max(base.threshold(sigType)-20, 0); zip.threshold(sigType) != want {
+			t.Errorf("%s: deep-scan threshold %d, want %d (default %d)", sigType, zip.threshold(sigType), want, base.threshold(sigType))
+		}
+	}
+	withConfig(t, map[string]string{"DEEP_SCAN_THRESHOLD_BONUS": "1000"})
+	if got := deepScanProfile().threshold(SigNormalized); got != 0 {
+		t.Errorf("deep-scan threshold should be clamped to 0, got %d", got)
+	}
+	// An exact match still matches, with full confidence, under a clamped threshold
+	if c := getConfidenceForMatch(0, deepScanProfile().threshold(SigNormalized)); c != 1.0 {
+		t.Errorf("exact match under a clamped threshold should have confidence 1, got %v", c)
+	}
+	useMiniredis(t)
+	body := strings.Repeat("Your invoice is attached, open the archive to review the overdue payment today. ", 4)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	learnSpamHash(sig, 1, SigNormalized)
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: billing@invoice-2024.zip\r\nMessage-ID: <clamped@x>\r\n\r\n" + body))
+	if res := analyzeEnvelope(context.Background(), env).Result; res.Action != "spam" || res.Confidence != 1.0 {
+		t.Errorf("exact local match under a clamped threshold should be spam with confidence 1, got %+v", res)
+	}
+
+	if p := profileForSender("user@mx.freemail.example"); p.Name != "deep_scan" {
+		t.Errorf("subdomain of a listed domain should be deep-scanned, got %s", p.Name)
+	}
+	if p := profileForSender("user@example.com"); p.Name != "default" {
+		t.Errorf("unlisted sender should use the default profile, got %s", p.Name)
+	}
+	if p := profileForSender("user@notzip.com"); p.Name != "default" {
+		t.Errorf("TLD suffix must not match inside a label, got %s", p.Name)
+	}
+}
+
+// TestAnalyzeResponseProvenance checks that learned_at/cached_at are returned with the verdict
+func TestAnalyzeResponseProvenance(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeAnalyzeResponse(rr, scanOutcome{
+		Result: AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, LearnedAt: 1700000000},
+	})
+	body := rr.Body.String()
+	if !strings.Contains(body, `"learned_at":1700000000`) {
+		t.Errorf("response should contain learned_at, got %s", body)
+	}
+	if strings.Contains(body, "cached_at") {
+		t.Errorf("cached_at should be omitted when unknown, got %s", body)
+	}
+}
+
+// TestResponseIncludeHashes checks that RESPONSE_INCLUDE_HASHES=false keeps signatures out
+// of analyze responses, except for admin callers, while reports still find them
+func TestResponseIncludeHashes(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret", "RESPONSE_INCLUDE_HASHES": "false"})
+
+	analyze := func(msgID, token string) string {
+		email := "Subject: Hashes\r\nMessage-ID: " + msgID + "\r\n\r\n" + strings.Repeat("Please review the quarterly figures before the meeting on Thursday. ", 8)
+		req := httptest.NewRequest("POST", "/analyze", strings.NewReader(email))
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("analyze returned %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr.Body.String()
+	}
+
+	if body := analyze("<nohash@test.com>", ""); strings.Contains(body, `"hashes"`) {
+		t.Errorf("hashes should be omitted, got %s", body)
+	}
+	if body := analyze("<admin@test.com>", "s3cret"); !strings.Contains(body, `"hashes"`) {
+		t.Errorf("admin callers should get hashes, got %s", body)
+	}
+
+	// The scan result is stored with its hashes, so a report still learns them
+	sum := sha1.Sum([]byte("<nohash@test.com>"))
+	key := "mi:msgid:" + hex.EncodeToString(sum[:])
+	for i := 0; i < 50 && rdb.Exists(ctx, key).Val() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var scan ScanResult
+	if data, err := rdb.Get(ctx, key).Bytes(); err != nil || json.Unmarshal(data, &scan) != nil || len(scan.Hashes) == 0 {
+		t.Fatalf("scan result should keep the hashes (err %v)", err)
+	}
+	rr := httptest.NewRecorder()
+	reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"<nohash@test.com>","report_type":"spam"}`)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("report should succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+scan.Hashes[0]).Int(); score == 0 {
+		t.Error("reported hash should be learned")
+	}
+
+	// The near miss loses its hash too
+	outcome := scanOutcome{
+		Result: AnalysisResult{Action: "allow", NearMiss: &NearMiss{Hash: "T1ABC", Distance: 80, Threshold: 70}},
+		Hashes: []string{"T1ABC"},
+	}
+	stripped := outcome.withoutHashes()
+	if stripped.Hashes != nil || stripped.Result.NearMiss.Hash != "" || stripped.Result.NearMiss.Distance != 80 {
+		t.Errorf("unexpected stripped outcome %+v", stripped.Result.NearMiss)
+	}
+	if outcome.Result.NearMiss.Hash != "T1ABC" {
+		t.Error("withoutHashes should not modify the original outcome")
+	}
+
+	// /explain applies the same rule to its signatures
+	explain := func(token string) string {
+		email := "Subject: Hashes\r\nMessage-ID: <explain-hash@test.com>\r\n\r\n" + strings.Repeat("Please review the quarterly figures before the meeting on Thursday. ", 8)
+		req := httptest.NewRequest("POST", "/explain", strings.NewReader(email))
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		rr := httptest.NewRecorder()
+		explainHandler(rr, req)
+		return rr.Body.String()
+	}
+	if body := explain(""); strings.Contains(body, `"hash"`) || !strings.Contains(body, `"type":"normalized"`) {
+		t.Errorf("explain signatures should be listed without hashes, got %s", body)
+	}
+	if body := explain("s3cret"); !strings.Contains(body, `"hash"`) {
+		t.Errorf("admin callers should get the explain hashes, got %s", body)
+	}
+}
+
+// TestExplainHandler checks the /explain endpoint
+func TestExplainHandler(t *testing.T) {
+	mr := useMiniredis(t)
+
+	req, _ := http.NewRequest("GET", "/explain", nil)
+	rr := httptest.NewRecorder()
+	explainHandler(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /explain returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	emailBody := "From: news@explain.example\r\nSubject: Explain me\r\nMessage-ID: <explain@test.com>\r\n\r\n" + strings.Repeat("Explain this reasonably long test email body please. ", 10)
+	req, _ = http.NewRequest("POST", "/explain", strings.NewReader(emailBody))
+	rr = httptest.NewRecorder()
+	explainHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /explain returned unexpected status: %d", rr.Code)
+	}
+	body := rr.Body.String()
+	for _, field := range []string{`"verdict"`, `"profile":"default"`, `"type":"normalized"`} {
+		if !strings.Contains(body, field) {
+			t.Errorf("explain response missing %s: %s", field, body)
+		}
+	}
+
+	// Dry run: no stored scan, sender first-seen record nor any other key
+	time.Sleep(50 * time.Millisecond)
+	if keys := mr.Keys(); len(keys) > 0 {
+		t.Errorf("/explain should leave no trace in Redis, got %v", keys)
+	}
+
+	rr = httptest.NewRecorder()
+	requireAdmin(explainHandler)(rr, httptest.NewRequest("POST", "/explain", strings.NewReader(emailBody)))
+	if rr.Code == http.StatusOK {
+		t.Errorf("unauthenticated /explain should be refused, got %d", rr.Code)
+	}
+}
+
+// TestReplyToMismatch checks the Reply-To vs From domain comparison
+func TestReplyToMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		replyTo  string
+		mismatch bool
+	}{
+		{"No Reply-To", "PayPal <service@paypal.com>", "", false},
+		{"Same domain", "PayPal <service@paypal.com>", "support@paypal.com", false},
+		{"Subdomain", "PayPal <service@paypal.com>", "Help <help@mail.paypal.com>", false},
+		{"Different domain", "PayPal <service@paypal.com>", "PayPal <claims@paypa1-support.ru>", true},
+		{"Second address differs", "news@shop.example", "a@shop.example, b@elsewhere.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, got := checkReplyToMismatch(tt.from, tt.replyTo)
+			if got != tt.mismatch {
+				t.Fatalf("checkReplyToMismatch(%q, %q) = %v, want %v", tt.from, tt.replyTo, got, tt.mismatch)
+			}
+			if got && sig.Label != "replyto_mismatch" {
+				t.Errorf("unexpected label %q", sig.Label)
+			}
+		})
+	}
+}
+
+// TestMessageIDDomainMismatch checks Message-ID domain parsing and its comparison with From and Return-Path
+func TestMessageIDDomainMismatch(t *testing.T) {
+	for header, want := range map[string]string{
+		"<abc123@mail.example.com>":             "mail.example.com",
+		"  <ABC@Example.COM.>  ":                "example.com",
+		"abc@example.com":                       "example.com",
+		"(generated) <abc@example.com> (id)":    "example.com",
+		`<"odd@local"@example.com>`:             "example.com",
+		"<abc@[192.0.2.1]>":                     "[192.0.2.1]",
+		"<no-domain-here>":                      "",
+		"<abc@example.com> <other@elsewhere.x>": "example.com",
+	} {
+		if got := messageIDDomain(header); got != want {
+			t.Errorf("messageIDDomain(%q) = %q, want %q", header, got, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		messageID  string
+		from       string
+		returnPath string
+		ignored    []string
+		mismatch   bool
+	}{
+		{"Same domain", "<1@example.com>", "a@example.com", "", nil, false},
+		{"Sending subdomain", "<1@mta3.mail.example.com>", "News <news@example.com>", "", nil, false},
+		{"Return-Path domain", "<1@bounces.esp.example>", "a@shop.example", "<b-1@esp.example>", nil, false},
+		{"Ignored domain", "<1@eur01.prod.outlook.com>", "a@shop.example", "", []string{"outlook.com"}, false},
+		{"No Message-ID", "", "a@shop.example", "", nil, false},
+		{"No From domain", "<1@elsewhere.example>", "undisclosed", "", nil, false},
+		{"Unrelated domain", "<1@bulk-mailer.example>", "PayPal <service@paypal.com>", "", nil, true},
+		{"No domain", "<1234567890>", "a@shop.example", "", nil, true},
+		{"Garbage domain", "<1@XKQZJ>", "a@shop.example", "", nil, true},
+		{"Numeric TLD", "<1@192.0.2.1>", "a@shop.example", "", nil, true},
+		{"IP literal", "<1@[192.0.2.1]>", "a@shop.example", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, got := checkMessageIDDomain(tt.messageID, tt.from, tt.returnPath, tt.ignored)
+			if got != tt.mismatch {
+				t.Fatalf("checkMessageIDDomain(%q, %q, %q) = %v (%s), want %v", tt.messageID, tt.from, tt.returnPath, got, sig.Detail, tt.mismatch)
+			}
+			if got && sig.Label != "msgid_domain_mismatch" {
+				t.Errorf("unexpected label %q", sig.Label)
+			}
+		})
+	}
+
+	// Off by default; on, it raises soft_spam on non-whitelisted senders only
+	useMiniredis(t)
+	withConfig(t, map[string]string{"MSGID_DOMAIN_CHECK": "", "HEURISTIC_MSGID_DOMAIN_MISMATCH": "", "MSGID_DOMAIN_IGNORE": ""})
+	analyze := func(from string) AnalysisResult {
+		raw := "From: " + from + "\r\nMessage-ID: <x1@bulk-mailer.example>\r\nSubject: Account\r\n\r\nPlease sign in to review your account."
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+	if res := analyze("service@paypal.com"); res.Action != "allow" {
+		t.Fatalf("disabled heuristic should not fire, got %+v", res)
+	}
+	withConfig(t, map[string]string{"MSGID_DOMAIN_CHECK": "true"})
+	if res := analyze("service@paypal.com"); res.Action != "soft_spam" || res.Label != "msgid_domain_mismatch" || res.ReasonCode != ReasonMsgIDMismatch {
+		t.Errorf("mismatch should raise soft_spam/msgid_domain_mismatch, got %+v", res)
+	}
+	withConfig(t, map[string]string{"MSGID_DOMAIN_IGNORE": "bulk-mailer.example"})
+	if res := analyze("service@paypal.com"); res.Action != "allow" {
+		t.Errorf("ignored Message-ID domain should not be flagged, got %+v", res)
+	}
+	withConfig(t, map[string]string{"MSGID_DOMAIN_IGNORE": ""})
+	rdb.SAdd(ctx, "mi:whitelist:domain", "paypal.com")
+	if res := analyze("service@paypal.com"); res.Action != "allow" {
+		t.Errorf("whitelisted sender should not be flagged, got %+v", res)
+	}
+}
+
+// TestReplyToMismatchToggle checks that the heuristic only runs when enabled and how it affects the verdict
+func TestReplyToMismatchToggle(t *testing.T) {
+	raw := "From: PayPal <service@paypal.com>\r\nReply-To: claims@paypa1-support.ru\r\nSubject: Account\r\n\r\nPlease reply."
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withConfig(t, map[string]string{"REPLYTO_MISMATCH_CHECK": "false"})
+	if signals := evaluateHeuristics(env, messageFacts{}); len(signals) != 0 {
+		t.Errorf("disabled heuristic should not fire, got %v", signals)
+	}
+
+	withConfig(t, map[string]string{"REPLYTO_MISMATCH_CHECK": "true"})
+	signals := evaluateHeuristics(env, messageFacts{})
+	if len(signals) != 1 {
+		t.Fatalf("expected one signal, got %v", signals)
+	}
+
+	res := AnalysisResult{Action: "allow"}
+	applyHeuristic(&res, signals[0])
+	if res.Action != "soft_spam" || res.Label != "replyto_mismatch" {
+		t.Errorf("allow should become soft_spam/replyto_mismatch, got %s/%s", res.Action, res.Label)
+	}
+
+	res = AnalysisResult{Action: "spam", Label: "local_spam", Confidence: 0.7}
+	applyHeuristic(&res, signals[0])
+	if res.Action != "spam" || res.Label != "local_spam" || res.Confidence <= 0.7 {
+		t.Errorf("spam verdict should keep its label and gain confidence, got %+v", res)
+	}
+}
+
+// TestHeuristicsConfig checks that each optional heuristic is toggled by HEURISTIC_<NAME>,
+// defaults to its older setting, and is weighted by HEURISTIC_WEIGHT_<LABEL>
+func TestHeuristicsConfig(t *testing.T) {
+	useMiniredis(t)
+	legacy := map[string]string{
+		"REPLYTO_MISMATCH_CHECK":    "true",
+		"MSGID_DOMAIN_CHECK":        "true",
+		"ALTPART_MISMATCH_CHECK":    "true",
+		"ALTPART_MISMATCH_DISTANCE": "0",
+		"PROTECTED_DISPLAY_NAMES":   "PayPal=paypal.com",
+		"DATE_ANOMALY_CHECK":        "true",
+		"EMPTY_SUBJECT_CHECK":       "true",
+		"NEW_SENDER_CHECK":          "true",
+		"LIST_UNSUBSCRIBE_CHECK":    "true",
+		"MASS_CAMPAIGN_THRESHOLD":   "1",
+	}
+	unset := make(map[string]string, len(legacy))
+	for k := range legacy {
+		unset[k] = ""
+	}
+	for _, h := range configurableHeuristics {
+		unset["HEURISTIC_"+strings.ToUpper(h.Name)] = ""
+	}
+	withConfig(t, unset)
+
+	// One message tripping every optional heuristic
+	raw := "From: PayPal <service@paypal-notice.example>\r\nReply-To: claims@elsewhere.example\r\nMessage-ID: <1@bulk-mailer.example>\r\n" +
+		"To: a@example.com, b@example.com\r\nDate: Mon, 1 Jan 2035 10:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("Your account statement is ready, sign in to read it. ", 6) + "\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>" + strings.Repeat("Congratulations, you won a gift card, claim the prize today! ", 6) + "</p>\r\n--b--\r\n"
+	fired := func() map[string]bool {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		labels := make(map[string]bool)
+		for _, h := range analyzeEnvelope(context.Background(), env).Heuristics {
+			labels[strings.TrimSuffix(h.Label, "_missing")] = true
+		}
+		return labels
+	}
+
+	if got := fired(); len(got) != 0 {
+		t.Fatalf("all heuristics should be off by default, got %v", got)
+	}
+	withConfig(t, legacy)
+	for _, h := range configurableHeuristics {
+		if !fired()[h.Name] {
+			t.Errorf("%s should default to its older setting", h.Name)
+		}
+	}
+
+	for _, h := range configurableHeuristics {
+		key := "HEURISTIC_" + strings.ToUpper(h.Name)
+		withConfig(t, map[string]string{key: "false"})
+		got := fired()
+		if got[h.Name] || len(got) != len(configurableHeuristics)-1 {
+			t.Errorf("%s=false should only switch %s off, got %v", key, h.Name, got)
+		}
+		withConfig(t, map[string]string{key: "true"})
+	}
+
+	// Switched on alone, without the older setting (the settings they need would switch
+	// display_name_spoof and mass_campaign on)
+	off := map[string]string{"ALTPART_MISMATCH_DISTANCE": "0", "PROTECTED_DISPLAY_NAMES": "PayPal=paypal.com", "MASS_CAMPAIGN_THRESHOLD": "1"}
+	for k := range unset {
+		if _, ok := off[k]; !ok {
+			off[k] = ""
+		}
+	}
+	for _, h := range configurableHeuristics {
+		off["HEURISTIC_"+strings.ToUpper(h.Name)] = "false"
+	}
+	withConfig(t, off)
+	for _, h := range configurableHeuristics {
+		key := "HEURISTIC_" + strings.ToUpper(h.Name)
+		withConfig(t, map[string]string{key: "true"})
+		if got := fired(); !got[h.Name] || len(got) != 1 {
+			t.Errorf("%s=true should only switch %s on, got %v", key, h.Name, got)
+		}
+		withConfig(t, map[string]string{key: "false"})
+	}
+
+	rr := httptest.NewRecorder()
+	withConfig(t, map[string]string{"HEURISTIC_DATE_ANOMALY": "true", "HEURISTIC_EMPTY_SUBJECT": "true", "HEURISTIC_WEIGHT_EMPTY_SUBJECT": "160"})
+	configHandler(rr, httptest.NewRequest("GET", "/config", nil))
+	if body := rr.Body.String(); !strings.Contains(body, `"heuristics":{"active":["date_anomaly","empty_subject"],"weights":{"empty_subject":160}}`) {
+		t.Errorf("/config should list the active heuristics and weights, got %s", body)
+	}
+
+	// Weights scale the confidence a signal brings
+	sig := heuristicSignal{Label: "empty_subject"}
+	res := AnalysisResult{Action: "allow"}
+	applyHeuristic(&res, sig)
+	if res.Action != "soft_spam" || res.Confidence != 0.8 {
+		t.Errorf("weight 160 should raise a soft_spam at 0.8, got %+v", res)
+	}
+	res = AnalysisResult{Action: "spam", Confidence: 0.5}
+	applyHeuristic(&res, sig)
+	if math.Abs(res.Confidence-0.66) > 1e-9 {
+		t.Errorf("weight 160 should add 0.16 to a match, got %f", res.Confidence)
+	}
+	withConfig(t, map[string]string{"HEURISTIC_WEIGHT_EMPTY_SUBJECT": "0"})
+	res = AnalysisResult{Action: "allow"}
+	applyHeuristic(&res, sig)
+	if res.Action != "allow" {
+		t.Errorf("a signal weighing 0 should not raise a verdict, got %+v", res)
+	}
+}
+
+// TestShouldPromoteOracleCacheMatch checks the promotion flag and confidence gate
+func TestShouldPromoteOracleCacheMatch(t *testing.T) {
+	if shouldPromoteOracleCacheMatch(1.0) {
+		t.Error("promotion must be disabled by default")
+	}
+
+	promoteOracleCache.Store(true)
+	atomic.StoreInt64(&promoteMinConfidence, 90)
+	defer promoteOracleCache.Store(false)
+
+	if !shouldPromoteOracleCacheMatch(0.95) {
+		t.Error("strong match should be promoted")
+	}
+	if !shouldPromoteOracleCacheMatch(0.90) {
+		t.Error("match at the minimum confidence should be promoted")
+	}
+	if shouldPromoteOracleCacheMatch(0.75) {
+		t.Error("weak match should not be promoted")
+	}
+}
+
+// TestGetQuorumForType checks the global band quorum and its per-type overrides
+func TestGetQuorumForType(t *testing.T) {
+	allTypes := []SignatureType{SigNormalized, SigRaw, SigURL, SigSubject, SigAttachment}
+	for _, sigType := range allTypes {
+		if q := getQuorumForType(sigType); q != 4 {
+			t.Errorf("%s: default quorum should be 4, got %d", sigType, q)
+		}
+	}
+
+	withConfig(t, map[string]string{
+		"BAND_QUORUM":       "5",
+		"QUORUM_NORMALIZED": "6",
+		"QUORUM_RAW":        "7",
+		"QUORUM_URL":        "2",
+		"QUORUM_ATTACHMENT": "3",
+	})
+	expected := map[SignatureType]int{
+		SigNormalized: 6,
+		SigRaw:        7,
+		SigURL:        2,
+		SigSubject:    5, // Not overridden: falls back to BAND_QUORUM
+		SigAttachment: 3,
+	}
+	for sigType, want := range expected {
+		if q := getQuorumForType(sigType); q != want {
+			t.Errorf("%s: expected quorum %d, got %d", sigType, want, q)
+		}
+	}
+}
+
+// TestRequireAdmin checks the admin token guard
+func TestRequireAdmin(t *testing.T) {
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("POST", "/admin/sync/apply", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("admin endpoints should be disabled without ADMIN_TOKEN, got %d", rr.Code)
+	}
+
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer wrong")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token should return 401, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer s3cret")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid bearer token should pass, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Admin-Token", "s3cret")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid X-Admin-Token should pass, got %d", rr.Code)
+	}
+}
+
+// TestAdminSyncApplyHandler checks the /admin/sync/apply endpoint
+func TestAdminSyncApplyHandler(t *testing.T) {
+	if rdb == nil {
+		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	}
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+	handler := requireAdmin(adminSyncApplyHandler)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/admin/sync/apply", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post("{invalid json"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid JSON should return 400, got %d", rr.Code)
+	}
+	if rr := post(`{"new_seq": 1, "action": "NOPE", "ops": []}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown action should return 400, got %d", rr.Code)
+	}
+
+	// 200 when Redis is up, 500 when it is not
+	rr := post(`{"new_seq": 42, "action": "UPDATE_DELTA", "ops": [{"action": "add", "bands": ["1:ABCDEF", "2:BCDEF0"]}]}`)
+	if rr.Code != http.StatusOK && rr.Code != http.StatusInternalServerError {
+		t.Errorf("valid sync payload returned unexpected status %d", rr.Code)
+	}
+	if rr.Code == http.StatusOK && !strings.Contains(rr.Body.String(), `"bands":2`) {
+		t.Errorf("unexpected body: %s", rr.Body.String())
+	}
+}
+
+// TestRegisterMetricsLabels checks that Guardian metrics carry the node_id and version labels
+func TestRegisterMetricsLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	registerMetrics(reg, "test-node-id")
+	promScanned.Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mf := range families {
+		if mf.GetName() != "mailuminati_guardian_scanned_total" {
+			continue
+		}
+		found = true
+		labels := map[string]string{}
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if labels["node_id"] != "test-node-id" || labels["version"] != EngineVersion {
+			t.Errorf("unexpected labels: %v", labels)
+		}
+	}
+	if !found {
+		t.Error("mailuminati_guardian_scanned_total not registered")
+	}
+}
+
+// TestBodyHashFailureAction checks the fallbacks used when the normalized body cannot be hashed
+func TestBodyHashFailureAction(t *testing.T) {
+	if rdb == nil {
+		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	}
+	// Long but too uniform for TLSH ("q3 is zero")
+	raw := "From: a@unhashable.example\r\nSubject: hi\r\n\r\n" + strings.Repeat("abc ", 80)
+
+	analyze := func() scanOutcome {
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	if out := analyze(); out.Result.Action != "allow" || out.Result.Label != "" {
+		t.Errorf("ignore mode should return a bare allow, got %+v", out.Result)
+	}
+
+	withConfig(t, map[string]string{"BODY_HASH_FAILURE_ACTION": "soft_spam"})
+	if out := analyze(); out.Result.Action != "soft_spam" || out.Result.Label != "unhashable_body" {
+		t.Errorf("soft_spam mode should flag the message, got %+v", out.Result)
+	}
+
+	withConfig(t, map[string]string{"BODY_HASH_FAILURE_ACTION": "exact"})
+	out := analyze()
+	if len(out.Hashes) != 1 || !strings.HasPrefix(out.Hashes[0], "X1") {
+		t.Fatalf("exact mode should store a SHA-256 fallback signature, got %v", out.Hashes)
+	}
+	if isTLSHSignature(out.Hashes[0]) {
+		t.Error("exact fallback signature must not be treated as TLSH")
+	}
+	if out.Hashes[0] != exactBodySignature(normalizeEmailBody(strings.Repeat("abc ", 80), "")) {
+		t.Error("exact fallback signature should be stable for identical content")
+	}
+}
+
+// TestTarpitBoundedByDeadline checks that the spam response delay never outlives the request
+func TestTarpitBoundedByDeadline(t *testing.T) {
+	start := time.Now()
+	tarpit(context.Background(), 0)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("zero delay should return immediately")
+	}
+
+	start = time.Now()
+	tarpit(context.Background(), 30*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("delay not applied: %v", elapsed)
+	}
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	tarpit(reqCtx, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("tarpit should stop at the request deadline, took %v", elapsed)
+	}
+}
+
+// TestSoftSpamTrends checks soft_spam occurrence tracking and the /learning/softspam endpoint
+func TestSoftSpamTrends(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{"SOFT_SPAM_TRACKING": "true", "SOFT_SPAM_TRACKING_TTL": "1h"})
+
+	rising := contentFingerprint("rising campaign body")
+	other := contentFingerprint("other body")
+	for i := 0; i < 3; i++ {
+		recordSoftSpam(rising, AnalysisResult{Action: "soft_spam", Label: "local_soft", MatchType: "normalized"})
+	}
+	recordSoftSpam(other, AnalysisResult{Action: "soft_spam", Label: "oracle_cache_soft", MatchType: "url"})
+
+	trends, err := topSoftSpamTrends(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trends) != 2 {
+		t.Fatalf("expected 2 trends, got %d", len(trends))
+	}
+	if trends[0].Fingerprint != rising || trends[0].Count != 3 || trends[0].Label != "local_soft" {
+		t.Errorf("unexpected top trend: %+v", trends[0])
+	}
+	if trends[0].FirstSeen == 0 || trends[0].LastSeen < trends[0].FirstSeen {
+		t.Errorf("timestamps not recorded: %+v", trends[0])
+	}
+
+	req, _ := http.NewRequest("GET", "/learning/softspam?limit=1", nil)
+	rr := httptest.NewRecorder()
+	softSpamTrendsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, rising) || strings.Contains(body, other) {
+		t.Errorf("limit=1 should only return the top trend, got %s", body)
+	}
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+	rr = httptest.NewRecorder()
+	requireAdmin(softSpamTrendsHandler)(rr, httptest.NewRequest("GET", "/learning/softspam", nil))
+	if rr.Code != http.StatusUnauthorized || strings.Contains(rr.Body.String(), rising) {
+		t.Errorf("unauthenticated trends should be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Short TTL: everything disappears once the window has passed
+	mr.FastForward(2 * time.Hour)
+	if trends, _ := topSoftSpamTrends(10); len(trends) != 0 {
+		t.Errorf("expired trends should be gone, got %+v", trends)
+	}
+
+	// The next soft_spam verdict trims the fingerprints that left the window from the index
+	mr.ZAdd(SoftSpamTrendKey, float64(time.Now().Add(-2*time.Hour).Unix()), rising)
+	fresh := contentFingerprint("fresh campaign body")
+	recordSoftSpam(fresh, AnalysisResult{Action: "soft_spam", Label: "local_soft", MatchType: "normalized"})
+	members, _ := mr.ZMembers(SoftSpamTrendKey)
+	if len(members) != 1 || members[0] != fresh {
+		t.Errorf("stale fingerprints should be trimmed from the trend index, got %v", members)
+	}
+}
+
+// TestURLJaccardDistancer compares the Jaccard URL-set metric with TLSH over concatenated URLs
+func TestURLJaccardDistancer(t *testing.T) {
+	urls := []string{
+		"https://login.example-bank.com/verify/account",
+		"https://login.example-bank.com/secure/update",
+		"https://cdn.phish.example/assets/logo.png",
+		"https://track.phish.example/open?id=campaign",
+		"https://phish.example/unsubscribe/now",
+	}
+	reordered := []string{urls[4], urls[2], urls[0], urls[3], urls[1], "https://extra.example/one-more-link"}
+
+	a, b := urlSetSignature(urls), urlSetSignature(reordered)
+	jd := urlJaccardDistancer{}
+	dists, err := jd.Distances(a, []string{a, b, urlSetSignature([]string{"https://unrelated.example/x", "https://unrelated.example/y"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dists[a] != 0 {
+		t.Errorf("identical URL sets should have distance 0, got %d", dists[a])
+	}
+	if dists[b] != 17 { // 5 shared / 6 total
+		t.Errorf("expected Jaccard distance 17 for one added URL, got %d", dists[b])
+	}
+	for sig, d := range dists {
+		if sig != a && sig != b && d != 100 {
+			t.Errorf("disjoint URL sets should have distance 100, got %d", d)
+		}
+	}
+
+	// Order does not matter for the set signature, while it shifts the TLSH of the concatenation
+	if urlSetSignature(urls) != urlSetSignature([]string{urls[3], urls[1], urls[4], urls[0], urls[2]}) {
+		t.Error("URL-set signature should not depend on URL order")
+	}
+	h1, err1 := computeLocalTLSH(strings.Join(urls, "\n"))
+	h2, err2 := computeLocalTLSH(strings.Join(reordered, "\n"))
+	if err1 == nil && err2 == nil {
+		tlshDist, _ := tlshDistancer{}.Distances(h1, []string{h2})
+		t.Logf("same URLs reordered + 1 added: TLSH distance %d, Jaccard distance %d", tlshDist[h2], dists[b])
+	}
+
+	if distancerForSignature(a).Name() != "jaccard" || distancerForSignature(h1).Name() != "tlsh" {
+		t.Error("distancer should follow the signature format")
+	}
+	if bands := signatureBands(b); len(bands) != 6 || !strings.HasPrefix(bands[0], "u:") {
+		t.Errorf("URL-set signature should have one band per URL, got %v", bands)
+	}
+	if isTLSHSignature(a) {
+		t.Error("URL-set signatures must stay local (not TLSH)")
+	}
+}
+
+// TestDistanceMetricForType checks DISTANCE_METRIC_URL
+func TestDistanceMetricForType(t *testing.T) {
+	if getDistanceMetricForType(SigURL) != "tlsh" {
+		t.Error("TLSH must be the default metric")
+	}
+	withConfig(t, map[string]string{"DISTANCE_METRIC_URL": "jaccard"})
+	if getDistanceMetricForType(SigURL) != "jaccard" {
+		t.Error("SigURL should use jaccard when configured")
+	}
+	if getDistanceMetricForType(SigNormalized) != "tlsh" {
+		t.Error("other types always use TLSH")
+	}
+}
+
+// TestAutoWhitelist checks that repeated ham reports whitelist a sender domain only when enabled
+func TestAutoWhitelist(t *testing.T) {
+	mr := useMiniredis(t)
+
+	if recordHamForSender("news.example") {
+		t.Fatal("auto-whitelisting must be opt-in")
+	}
+	if mr.Exists(HamCountPrefix + "news.example") {
+		t.Error("ham reports should not be counted while disabled")
+	}
+
+	withConfig(t, map[string]string{
+		"AUTO_WHITELIST":             "true",
+		"AUTO_WHITELIST_HAM_REPORTS": "3",
+		"AUTO_WHITELIST_TTL":         "48h",
+	})
+	for i := 0; i < 2; i++ {
+		if recordHamForSender("news.example") {
+			t.Fatalf("whitelisted too early after %d reports", i+1)
+		}
+	}
+	if !recordHamForSender("news.example") {
+		t.Fatal("third ham report should whitelist the domain")
+	}
+
+	if ok, reason := isWhitelisted("Newsletter <hello@news.example>"); !ok || reason != "auto_domain:news.example" {
+		t.Errorf("sender should be auto-whitelisted, got %v %q", ok, reason)
+	}
+	if entries := listAutoWhitelist(); entries["news.example"] == 0 {
+		t.Errorf("auto entry should be listed for review, got %v", entries)
+	}
+
+	// Turning the feature off disables the existing entries
+	withConfig(t, map[string]string{"AUTO_WHITELIST": "false"})
+	if ok, _ := isWhitelisted("hello@news.example"); ok {
+		t.Error("auto-whitelist entries should not apply while AUTO_WHITELIST is off")
+	}
+	withConfig(t, map[string]string{"AUTO_WHITELIST": "true"})
+
+	// Soft whitelist: the entry expires
+	mr.FastForward(49 * time.Hour)
+	if ok, _ := isWhitelisted("hello@news.example"); ok {
+		t.Error("auto-whitelist entry should expire after AUTO_WHITELIST_TTL")
+	}
+}
+
+// TestPartialMatchAction checks both PARTIAL_MATCH_ACTION modes
+func TestPartialMatchAction(t *testing.T) {
+	res := AnalysisResult{Action: "allow", ProximityMatch: true}
+	applyPartialMatch(&res, 7, 21, SigNormalized)
+	if res.Action != "allow" {
+		t.Errorf("ignore mode should leave the verdict untouched, got %+v", res)
+	}
+
+	withConfig(t, map[string]string{"PARTIAL_MATCH_ACTION": "soft_spam"})
+
+	res = AnalysisResult{Action: "allow", ProximityMatch: true}
+	applyPartialMatch(&res, 7, 21, SigURL)
+	if res.Action != "soft_spam" || res.Label != "oracle_partial" || res.MatchType != "url" {
+		t.Errorf("soft_spam mode should flag the partial match, got %+v", res)
+	}
+	if res.Confidence < 0.33 || res.Confidence > 0.34 {
+		t.Errorf("confidence should be the band-match ratio 7/21, got %f", res.Confidence)
+	}
+
+	// A stronger existing soft_spam or a spam verdict is kept
+	res = AnalysisResult{Action: "soft_spam", Label: "local_soft", Confidence: 0.8}
+	applyPartialMatch(&res, 7, 21, SigURL)
+	if res.Label != "local_soft" {
+		t.Errorf("weaker partial match should not replace a stronger soft_spam, got %+v", res)
+	}
+	res = AnalysisResult{Action: "spam", Label: "local_spam", Confidence: 0.9}
+	applyPartialMatch(&res, 21, 21, SigURL)
+	if res.Action != "spam" {
+		t.Errorf("spam verdict must not be downgraded, got %+v", res)
+	}
+}
+
+// TestCompactLearnedHashes checks that near-duplicate learned hashes are merged into one representative
+func TestCompactLearnedHashes(t *testing.T) {
+	mr := useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Claim your exclusive reward now, limited offer for loyal customers only. ", 8)
+	h1, _ := computeLocalTLSH(base)
+	h2, _ := computeLocalTLSH(strings.Replace(base, "loyal", "valued", 1))
+	h3, _ := computeLocalTLSH(strings.Repeat("Quarterly infrastructure report attached, see the capacity section. ", 8))
+	d12, _ := computeDistance(h1, h2, false, 0)
+	d13, _ := computeDistance(h1, h3, false, 0)
+	if d12 >= d13 {
+		t.Fatalf("test fixture: variants should be closer (%d) than unrelated content (%d)", d12, d13)
+	}
+
+	learnSpamHash(h1, 3, SigNormalized)
+	learnSpamHash(h2, 1, SigNormalized)
+	learnSpamHash(h3, 1, SigNormalized)
+	mr.Set(LocalLearnedPrefix+h2, "1000") // Variant learned first
+
+	if merged := compactLearnedHashes(d12); merged != 1 {
+		t.Fatalf("expected 1 merged hash, got %d", merged)
+	}
+
+	if score, _ := mr.Get(LocalScorePrefix + h1); score != "4" {
+		t.Errorf("representative should carry the summed score 4, got %s", score)
+	}
+	if learned, _ := mr.Get(LocalLearnedPrefix + h1); learned != "1000" {
+		t.Errorf("representative should keep the oldest learned_at, got %s", learned)
+	}
+	if mr.Exists(LocalScorePrefix+h2) || mr.Exists(LocalLearnedPrefix+h2) {
+		t.Error("merged hash should be pruned")
+	}
+	for _, band := range signatureBands(h2) {
+		if ok, _ := mr.SIsMember(LocalFragPrefix+band, h2); ok {
+			t.Fatalf("merged hash still indexed in band %s", band)
+		}
+	}
+	if !mr.Exists(LocalScorePrefix + h3) {
+		t.Error("unrelated hash must be kept")
+	}
+
+	if merged := compactLearnedHashes(d12); merged != 0 {
+		t.Errorf("second run should have nothing left to merge, got %d", merged)
+	}
+
+	// A report landing on a member after the scores were read is carried over by the merge
+	h4, _ := computeLocalTLSH(strings.Replace(base, "reward", "prize", 1))
+	learnSpamHash(h4, 1, SigNormalized)
+	scores := map[string]int64{h1: 4, h4: 1}
+	learnSpamHash(h4, 2, SigNormalized)
+	mergeLearnedHashes(h1, []string{h4}, scores, map[string]int64{}, map[string]string{})
+	if score, _ := mr.Get(LocalScorePrefix + h1); score != "7" {
+		t.Errorf("merge should use the member's current score (4+3), got %s", score)
+	}
+	if mr.Exists(LocalScorePrefix + h4) {
+		t.Error("merged hash should be pruned")
+	}
+}
+
+// TestCampaignID checks that compaction assigns a stable campaign ID returned with local matches
+func TestCampaignID(t *testing.T) {
+	mr := useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your invoice is overdue, settle the outstanding balance today to avoid fees. ", 8)
+	variant := func(body string) string { return normalizeEmailBody(body, "") }
+	h1, _ := computeLocalTLSH(variant(base))
+	h2, _ := computeLocalTLSH(variant(strings.Replace(base, "fees", "costs", 1)))
+	h3, _ := computeLocalTLSH(variant(strings.Replace(base, "today", "now", 1)))
+	maxDist := 0
+	for _, h := range []string{h2, h3} {
+		d, _ := computeDistance(h1, h, false, 0)
+		maxDist = max(maxDist, d)
+	}
+
+	learnSpamHash(h1, 3, SigNormalized)
+	learnSpamHash(h2, 1, SigNormalized)
+	if localCampaignID(h1) != "" {
+		t.Fatal("a hash that absorbed nothing has no campaign")
+	}
+	compactLearnedHashes(maxDist)
+	campaign := localCampaignID(h1)
+	if campaign != newCampaignID(h1) {
+		t.Fatalf("merged cluster should get a campaign ID, got %q", campaign)
+	}
+	if ttl := mr.TTL(LocalCampaignPrefix + h1); ttl <= 0 {
+		t.Errorf("campaign ID should expire with its hash, TTL %s", ttl)
+	}
+
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <cmp@x>\r\n\r\n" + base))
+	outcome := analyzeEnvelope(context.Background(), env)
+	if outcome.Result.Label != "local_spam" || outcome.Result.CampaignID != campaign {
+		t.Fatalf("local match should carry the campaign ID, got %+v", outcome.Result)
+	}
+	if body := string(analyzeResponseBody(outcome)); !strings.Contains(body, `"campaign_id":"`+campaign+`"`) {
+		t.Errorf("response should contain campaign_id, got %s", body)
+	}
+
+	// A stronger variant becomes the representative and takes over the campaign
+	learnSpamHash(h3, 10, SigNormalized)
+	compactLearnedHashes(maxDist)
+	if got := localCampaignID(h3); got != campaign {
+		t.Errorf("campaign ID should survive a new representative, got %q want %q", got, campaign)
+	}
+	if mr.Exists(LocalCampaignPrefix + h1) {
+		t.Error("merged representative should lose its campaign key")
+	}
+
+	// Merging two campaigns keeps the strongest member's
+	scores := map[string]int64{"rep": 5, "a": 1, "b": 3}
+	campaigns := map[string]string{"a": "cmp_a", "b": "cmp_b"}
+	if got := clusterCampaignID("rep", []string{"a", "b"}, scores, campaigns); got != "cmp_b" {
+		t.Errorf("expected the strongest member's campaign, got %q", got)
+	}
+	campaigns["rep"] = "cmp_rep"
+	if got := clusterCampaignID("rep", []string{"a", "b"}, scores, campaigns); got != "cmp_rep" {
+		t.Errorf("representative should keep its campaign, got %q", got)
+	}
+}
+
+// TestLearningConfirmation checks that LEARNING_MIN_SOURCES holds local matches as soft_spam
+// until enough distinct sources reported them
+func TestLearningConfirmation(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"LEARNING_MIN_SOURCES": "2"})
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your invoice is overdue, settle the outstanding balance today to avoid fees. ", 8)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	variant := strings.Replace(base, "fees", "costs", 1)
+	analyze := func(body string) AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <conf@x>\r\n\r\n" + body))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+	report := func(source string) {
+		learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", source)
+	}
+
+	report("mx1")
+	report("mx1")
+	if res := analyze(variant); res.Action != "soft_spam" || res.Label != "local_unconfirmed" || res.ReasonCode != ReasonLocalUnconfirmed {
+		t.Fatalf("a hash reported by one source should be held as soft_spam, got %+v", res)
+	}
+	if n := localSourceCount(sig); n != 1 {
+		t.Errorf("repeated reports from one source should count once, got %d", n)
+	}
+
+	report("mx2")
+	if res := analyze(variant); res.Action != "spam" || res.Label != "local_spam" {
+		t.Fatalf("a hash reported by two sources should block, got %+v", res)
+	}
+
+	// Hashes learned by Guardian itself, or before sources were tracked, need no confirmation
+	trapSig, _ := computeLocalTLSH(normalizeEmailBody(strings.Repeat("Claim the prize waiting in your account, verify your details now. ", 8), ""))
+	learnFromReport([]TypedSignature{{Hash: trapSig, Type: SigNormalized}}, "spam", ReportSourceSystem)
+	learnFromReport([]TypedSignature{{Hash: trapSig, Type: SigNormalized}}, "spam", "mx1")
+	if !localHashConfirmed(trapSig) {
+		t.Error("a hash learned by Guardian itself should be confirmed")
+	}
+	legacy, _ := computeLocalTLSH(normalizeEmailBody(strings.Repeat("Minutes of the weekly planning meeting, action items below. ", 8), ""))
+	learnSpamHash(legacy, 1, SigNormalized)
+	if !localHashConfirmed(legacy) {
+		t.Error("a hash without tracked sources should be confirmed")
+	}
+
+	// Sources default to the client IP and can't claim the system marker
+	req := httptest.NewRequest(http.MethodPost, "/report", nil)
+	req.RemoteAddr = "192.0.2.7:4242"
+	if got := reportSource("", req); got != "192.0.2.7" {
+		t.Errorf("source should default to the client IP, got %q", got)
+	}
+	if got := reportSource("mx9", req); got != "192.0.2.7" {
+		t.Errorf("a declared source needs the admin token, got %q", got)
+	}
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	req.Header.Set("Authorization", "Bearer secret")
+	if got := reportSource(" @System ", req); got != "system" {
+		t.Errorf("declared source should be sanitized, got %q", got)
+	}
+
+	// Disabled: every trusted hash blocks
+	withConfig(t, map[string]string{"LEARNING_MIN_SOURCES": "0"})
+	refreshLogicConfig()
+	rdb.Del(ctx, LocalSourcesPrefix+sig)
+	report("mx1")
+	if rdb.Exists(ctx, LocalSourcesPrefix+sig).Val() != 0 {
+		t.Error("sources should not be tracked when confirmation is off")
+	}
+	if res := analyze(variant); res.Label != "local_spam" {
+		t.Errorf("confirmation off should block on one report, got %+v", res)
+	}
+}
+
+// TestNewSenderHeuristic checks first-seen tracking and the new_sender signal
+func TestNewSenderHeuristic(t *testing.T) {
+	mr := useMiniredis(t)
+	refreshLogicConfig()
+
+	established := time.Now().Add(-30 * 24 * time.Hour).Unix()
+	mr.Set(DomainFirstSeenPrefix+"established.example", fmt.Sprint(established))
+
+	if got := touchDomainFirstSeen("established.example"); got != established {
+		t.Errorf("existing first-seen must not be overwritten, got %d want %d", got, established)
+	}
+	brandNew := touchDomainFirstSeen("brand-new.example")
+	if brandNew == 0 || time.Now().Unix()-brandNew > 5 {
+		t.Errorf("first analyze should record the current time, got %d", brandNew)
+	}
+	if ttl := mr.TTL(DomainFirstSeenPrefix + "brand-new.example"); ttl <= 0 {
+		t.Error("first-seen records should expire when the domain stops sending")
+	}
+
+	now := time.Now()
+	if sig, ok := checkNewSender("brand-new.example", brandNew, now, 72*time.Hour); !ok || sig.Label != "new_sender" {
+		t.Errorf("brand-new domain should be flagged, got %v %+v", ok, sig)
+	}
+	if _, ok := checkNewSender("established.example", established, now, 72*time.Hour); ok {
+		t.Error("established domain should not be flagged")
+	}
+
+	raw := "From: promo@brand-new.example\r\nSubject: hi\r\n\r\nHello"
+	env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+	facts := messageFacts{FromDomain: "brand-new.example", DomainFirstSeen: brandNew}
+	if signals := evaluateHeuristics(env, facts); len(signals) != 0 {
+		t.Errorf("heuristic must be disabled by default, got %v", signals)
+	}
+	withConfig(t, map[string]string{"NEW_SENDER_CHECK": "true", "NEW_SENDER_WINDOW": "24h"})
+	if signals := evaluateHeuristics(env, facts); len(signals) != 1 || signals[0].Label != "new_sender" {
+		t.Errorf("expected new_sender signal, got %v", signals)
+	}
+}
+
+// TestMissingHeaders checks REQUIRED_HEADERS / MISSING_HEADERS_ACTION
+func TestMissingHeaders(t *testing.T) {
+	useMiniredis(t)
+	body := strings.Repeat("A perfectly normal message body with enough words to hash. ", 6)
+	noMsgID := "From: alice@example.com\r\nSubject: hello\r\n\r\n" + body
+	noFrom := "Message-ID: <nofrom@example.com>\r\nSubject: hello\r\n\r\n" + body
+	complete := "From: alice@example.com\r\nMessage-ID: <ok@example.com>\r\nSubject: hello\r\n\r\n" + body
+
+	analyze := func(raw string) scanOutcome {
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	// Default: scan anyway
+	withConfig(t, map[string]string{"REQUIRED_HEADERS": "Message-ID, From"})
+	if out := analyze(noMsgID); out.Result.Label == "missing_headers" || len(out.Hashes) == 0 {
+		t.Errorf("default action should scan the message, got %+v", out.Result)
+	}
+
+	withConfig(t, map[string]string{"MISSING_HEADERS_ACTION": "spam"})
+	out := analyze(noMsgID)
+	if out.Result.Action != "spam" || out.Result.Label != "missing_headers" || len(out.Hashes) != 0 {
+		t.Errorf("missing Message-ID should be spam without scanning, got %+v (%d hashes)", out.Result, len(out.Hashes))
+	}
+	if len(out.Heuristics) != 1 || out.Heuristics[0].Detail != "message-id" {
+		t.Errorf("missing header should be reported, got %+v", out.Heuristics)
+	}
+
+	withConfig(t, map[string]string{"MISSING_HEADERS_ACTION": "soft_spam"})
+	if out := analyze(noFrom); out.Result.Action != "soft_spam" || out.Heuristics[0].Detail != "from" {
+		t.Errorf("missing From should be soft_spam, got %+v %+v", out.Result, out.Heuristics)
+	}
+	// The scan is stored with the body signature, so the message can be reported
+	sum := sha1.Sum([]byte("<nofrom@example.com>"))
+	scanKey := "mi:msgid:" + hex.EncodeToString(sum[:])
+	for i := 0; i < 50 && rdb.Exists(ctx, scanKey).Val() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var scan ScanResult
+	if data, err := rdb.Get(ctx, scanKey).Bytes(); err != nil || json.Unmarshal(data, &scan) != nil || len(scan.Hashes) != 1 {
+		t.Errorf("scan of a message missing headers should be stored with its body signature, got %+v (%v)", scan, err)
+	}
+	if out := analyze(complete); out.Result.Label == "missing_headers" {
+		t.Errorf("complete message should be scanned normally, got %+v", out.Result)
+	}
+}
+
+// TestMassCampaign checks the burst counter per content fingerprint
+func TestMassCampaign(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{"MASS_CAMPAIGN_THRESHOLD": "3", "MASS_CAMPAIGN_WINDOW": "5m"})
+
+	fp := contentFingerprint("zero-day campaign body")
+	for i := 1; i < 3; i++ {
+		if _, ok := checkMassCampaign(fp, false); ok {
+			t.Fatalf("copy %d should stay below the burst threshold", i)
+		}
+	}
+	sig, ok := checkMassCampaign(fp, false)
+	if !ok || sig.Label != "mass_campaign" {
+		t.Fatalf("third copy should be flagged, got %+v %v", sig, ok)
+	}
+	if _, ok := checkMassCampaign(contentFingerprint("unrelated body"), false); ok {
+		t.Error("other content must have its own counter")
+	}
+
+	res := AnalysisResult{Action: "allow"}
+	applyMassCampaign(&res, sig)
+	if res.Action != "soft_spam" || res.Label != "mass_campaign" {
+		t.Errorf("default action should be soft_spam, got %+v", res)
+	}
+
+	// The counter expires with the window
+	mr.FastForward(6 * time.Minute)
+	if _, ok := checkMassCampaign(fp, false); ok {
+		t.Error("counter should restart after the window")
+	}
+
+	withConfig(t, map[string]string{"MASS_CAMPAIGN_THRESHOLD": "3", "MASS_CAMPAIGN_ACTION": "spam"})
+	res = AnalysisResult{Action: "soft_spam", Label: "local_soft", Confidence: 0.4}
+	applyMassCampaign(&res, sig)
+	if res.Action != "spam" || res.Label != "mass_campaign" || res.Confidence != heuristicSoftConfidence {
+		t.Errorf("spam action should escalate soft_spam, got %+v", res)
+	}
+
+	withConfig(t, map[string]string{})
+	if _, ok := checkMassCampaign(fp, false); ok {
+		t.Error("check should be disabled by default")
+	}
+}
+
+// TestSpamTrapRecipient checks that trap mail is scanned but forced to allow without oracle calls
+func TestSpamTrapRecipient(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"SPAM_TRAP_RECIPIENTS": "Trap@Example.com"})
+
+	var oracleCalls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&oracleCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": {"action": "spam", "label": "oracle_spam", "confidence": 1}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	// Every band of the body signature is known to the oracle
+	body := strings.Repeat("Limited time offer on replica watches, order today and save big. ", 8)
+	sig, err := computeLocalTLSH(normalizeEmailBody(body, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, band := range extractBands_6_3(sig) {
+		rdb.SAdd(ctx, FragKeyPrefix+band, "1")
+	}
+
+	analyze := func(to string) scanOutcome {
+		raw := "From: spammer@example.net\r\nTo: " + to + "\r\nMessage-ID: <trap@example.net>\r\nSubject: offer\r\n\r\n" + body
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	out := analyze("Trap Box <trap@example.com>")
+	if out.Result.Action != "allow" || out.Result.Label != "spam_trap" {
+		t.Errorf("trap delivery should be forced to allow, got %+v", out.Result)
+	}
+	if len(out.Hashes) == 0 {
+		t.Error("trap delivery should still compute signatures")
+	}
+	if n := atomic.LoadInt64(&oracleCalls); n != 0 {
+		t.Errorf("oracle should not be called for trap mail, got %d calls", n)
+	}
+
+	// Auto-learn is off by default: trap deliveries are only collected
+	if n, _ := rdb.Exists(ctx, LocalScorePrefix+sig).Result(); n != 0 {
+		t.Error("auto-learn disabled: trap delivery should not be learned")
+	}
+
+	// Trap hits are auto-learned in the background: the normalized signature gets a positive local score
+	withConfig(t, map[string]string{"SPAM_TRAP_AUTO_LEARN": "true"})
+	analyze("trap@example.com")
+	deadline := time.Now().Add(time.Second)
+	for score, _ := rdb.Get(ctx, LocalScorePrefix+sig).Int64(); score <= 0; score, _ = rdb.Get(ctx, LocalScorePrefix+sig).Int64() {
+		if time.Now().After(deadline) {
+			t.Fatalf("trap delivery should be learned as spam, score %d", score)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for testutil.ToFloat64(promTrapAutoLearned) != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(promTrapAutoLearned); got != 1 {
+		t.Errorf("trap auto-learn metric = %v, want 1", got)
+	}
+
+	// Learned locally: a regular recipient now gets a local spam verdict
+	out = analyze("user@example.com")
+	if out.Result.Action != "spam" || out.Result.Label != "local_spam" {
+		t.Errorf("learned trap content should be spam for other recipients, got %+v", out.Result)
+	}
+
+	rdb.FlushAll(ctx)
+	for _, band := range extractBands_6_3(sig) {
+		rdb.SAdd(ctx, FragKeyPrefix+band, "1")
+	}
+	out = analyze("user@example.com")
+	if out.Result.Action != "spam" || atomic.LoadInt64(&oracleCalls) == 0 {
+		t.Errorf("regular recipient should go through the oracle, got %+v", out.Result)
+	}
+}
+
+// TestReasonCodes checks that every verdict path maps to a documented reason code
+func TestReasonCodes(t *testing.T) {
+	valid := map[ReasonCode]bool{
+		ReasonClean: true, ReasonWhitelisted: true, ReasonSpamTrap: true,
+		ReasonLocalSpam: true, ReasonLocalExact: true, ReasonLocalSoft: true,
+		ReasonOracleSpam: true, ReasonOracleSoft: true, ReasonOracleCacheMatch: true,
+		ReasonOracleCacheSoft: true, ReasonOraclePartial: true, ReasonMissingHeaders: true,
+		ReasonMassCampaign: true, ReasonReplyToMismatch: true, ReasonNewSender: true,
+		ReasonUnhashableBody: true, ReasonModeAllowAll: true, ReasonModeScanOnly: true, ReasonAltPartMismatch: true, ReasonBadAttachment: true, ReasonBlacklisted: true, ReasonEmptySubject: true, ReasonDisplayNameSpoof: true, ReasonDateAnomaly: true, ReasonDangerousFile: true, ReasonSoftEscalated: true, ReasonScore: true, ReasonLocalUnconfirmed: true, ReasonMsgIDMismatch: true, ReasonOracleMalformed: true,
+	}
+
+	tests := []struct {
+		res  AnalysisResult
+		want ReasonCode
+	}{
+		{AnalysisResult{Action: "allow"}, ReasonClean},
+		{AnalysisResult{Action: "allow", ProximityMatch: true}, ReasonClean},
+		{AnalysisResult{Action: "allow", Label: "whitelisted"}, ReasonWhitelisted},
+		{AnalysisResult{Action: "allow", Label: "spam_trap"}, ReasonSpamTrap},
+		{AnalysisResult{Action: "spam", Label: "local_spam"}, ReasonLocalSpam},
+		{AnalysisResult{Action: "spam", Label: "local_exact"}, ReasonLocalExact},
+		{AnalysisResult{Action: "soft_spam", Label: "local_soft"}, ReasonLocalSoft},
+		{AnalysisResult{Action: "soft_spam", Label: "local_unconfirmed"}, ReasonLocalUnconfirmed},
+		{AnalysisResult{Action: "spam", Label: "oracle_cache_match"}, ReasonOracleCacheMatch},
+		{AnalysisResult{Action: "soft_spam", Label: "oracle_cache_soft"}, ReasonOracleCacheSoft},
+		{AnalysisResult{Action: "soft_spam", Label: "oracle_partial"}, ReasonOraclePartial},
+		{AnalysisResult{Action: "soft_spam", Label: "oracle_malformed"}, ReasonOracleMalformed},
+		{AnalysisResult{Action: "spam", Label: "missing_headers"}, ReasonMissingHeaders},
+		{AnalysisResult{Action: "soft_spam", Label: "mass_campaign"}, ReasonMassCampaign},
+		{AnalysisResult{Action: "soft_spam", Label: "replyto_mismatch"}, ReasonReplyToMismatch},
+		{AnalysisResult{Action: "soft_spam", Label: "new_sender"}, ReasonNewSender},
+		{AnalysisResult{Action: "soft_spam", Label: "unhashable_body"}, ReasonUnhashableBody},
+		{AnalysisResult{Action: "spam", Label: "phishing_campaign_42"}, ReasonOracleSpam},
+		{AnalysisResult{Action: "spam"}, ReasonOracleSpam},
+		{AnalysisResult{Action: "soft_spam", Label: "oracle_whatever"}, ReasonOracleSoft},
+	}
+	for _, tt := range tests {
+		got := reasonCodeFor(tt.res)
+		if got != tt.want {
+			t.Errorf("reasonCodeFor(%s/%s) = %s, want %s", tt.res.Action, tt.res.Label, got, tt.want)
+		}
+		if !valid[got] {
+			t.Errorf("reasonCodeFor(%s/%s) returned undocumented code %q", tt.res.Action, tt.res.Label, got)
+		}
+	}
+	for label, code := range labelReasonCodes {
+		if !valid[code] {
+			t.Errorf("label %q maps to undocumented code %q", label, code)
+		}
+	}
+
+	// analyzeEnvelope always fills the code, including on early returns
+	useMiniredis(t)
+	withConfig(t, map[string]string{"REQUIRED_HEADERS": "Message-ID", "MISSING_HEADERS_ACTION": "soft_spam"})
+	rdb.SAdd(ctx, "mi:whitelist:email", "friend@example.com")
+	body := strings.Repeat("Minutes of the weekly planning meeting, action items below. ", 6)
+	for raw, want := range map[string]ReasonCode{
+		"From: friend@example.com\r\nMessage-ID: <a@x>\r\n\r\n" + body:  ReasonWhitelisted,
+		"From: someone@example.com\r\n\r\n" + body:                      ReasonMissingHeaders,
+		"From: someone@example.com\r\nMessage-ID: <b@x>\r\n\r\n" + body: ReasonClean,
+	} {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		if got := analyzeEnvelope(context.Background(), env).Result.ReasonCode; got != want {
+			t.Errorf("analyzeEnvelope reason code = %s, want %s", got, want)
+		}
+	}
+}
+
+// TestListUnsubscribe checks the List-Unsubscribe confidence adjustment
+func TestListUnsubscribe(t *testing.T) {
+	if _, _, ok := checkListUnsubscribe("", 1); ok {
+		t.Error("absent header on single-recipient mail should not signal")
+	}
+	if _, _, ok := checkListUnsubscribe("unsubscribe me please", 1); ok {
+		t.Error("invalid header should be treated as absent")
+	}
+
+	sig, delta, ok := checkListUnsubscribe("<mailto:unsub@list.example.com>, <https://list.example.com/u/1>", 5)
+	if !ok || sig.Label != "list_unsubscribe" || delta >= 0 {
+		t.Fatalf("valid header should be a ham signal, got %+v %v %v", sig, delta, ok)
+	}
+
+	// Heuristic-only soft_spam is downgraded, a strong match only loses a little
+	res := AnalysisResult{Action: "soft_spam", Label: "new_sender", Confidence: heuristicSoftConfidence}
+	applyListUnsubscribe(&res, delta)
+	if res.Action != "allow" || res.Label != "" {
+		t.Errorf("weak soft_spam should become allow, got %+v", res)
+	}
+	res = AnalysisResult{Action: "spam", Label: "local_spam", Confidence: 0.9}
+	applyListUnsubscribe(&res, delta)
+	if res.Action != "spam" || res.Confidence < 0.79 || res.Confidence > 0.81 {
+		t.Errorf("spam should keep its verdict with lower confidence, got %+v", res)
+	}
+
+	sig, delta, ok = checkListUnsubscribe("", 3)
+	if !ok || sig.Label != "list_unsubscribe_missing" || delta <= 0 {
+		t.Fatalf("missing header on bulk mail should be a spam signal, got %+v %v %v", sig, delta, ok)
+	}
+	res = AnalysisResult{Action: "soft_spam", Label: "local_soft", Confidence: 0.6}
+	applyListUnsubscribe(&res, delta)
+	if res.Action != "soft_spam" || res.Confidence < 0.69 {
+		t.Errorf("soft_spam confidence should rise, got %+v", res)
+	}
+	res = AnalysisResult{Action: "allow"}
+	applyListUnsubscribe(&res, delta)
+	if res.Action != "allow" || res.Confidence != 0 {
+		t.Errorf("allow should be left untouched, got %+v", res)
+	}
+
+	// Toggle: with the check on, a header-only soft_spam is cleared by a valid List-Unsubscribe
+	useMiniredis(t)
+	withConfig(t, map[string]string{"REPLYTO_MISMATCH_CHECK": "true", "LIST_UNSUBSCRIBE_CHECK": "true"})
+	raw := "From: news@shop.example.com\r\nReply-To: replies@mailer.example.net\r\nTo: a@example.org, b@example.org\r\n" +
+		"List-Unsubscribe: <https://shop.example.com/unsub>\r\nMessage-ID: <n@shop>\r\n\r\nWeekly deals."
+	env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+	if out := analyzeEnvelope(context.Background(), env); out.Result.Action != "allow" {
+		t.Errorf("list mail should be downgraded to allow, got %+v", out.Result)
+	}
+	withConfig(t, map[string]string{"LIST_UNSUBSCRIBE_CHECK": "false"})
+	env, _ = enmime.ReadEnvelope(strings.NewReader(raw))
+	if out := analyzeEnvelope(context.Background(), env); out.Result.Action != "soft_spam" {
+		t.Errorf("check disabled: verdict should be unchanged, got %+v", out.Result)
+	}
+}
+
+// TestBandSubset checks the band subset scheme and that analyze and learning stay aligned
+func TestBandSubset(t *testing.T) {
+	bands := []string{"b0", "b1", "b2", "b3", "b4", "b5", "b6"}
+	tests := []struct {
+		stride, max int
+		want        string
+	}{
+		{1, 0, "b0,b1,b2,b3,b4,b5,b6"},
+		{2, 0, "b0,b2,b4,b6"},
+		{1, 3, "b0,b1,b2"},
+		{3, 2, "b0,b3"},
+		{0, 0, "b0,b1,b2,b3,b4,b5,b6"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(bandSubset(bands, tt.stride, tt.max), ","); got != tt.want {
+			t.Errorf("bandSubset(stride=%d, max=%d) = %s, want %s", tt.stride, tt.max, got, tt.want)
+		}
+	}
+
+	useMiniredis(t)
+	withConfig(t, map[string]string{"BAND_SUBSET_STRIDE": "2", "BAND_SUBSET_MAX": "6"})
+
+	body := strings.Repeat("Your parcel is waiting, confirm delivery fees at the link below today. ", 8)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	if n := len(lookupBands(sig)); n != 6 {
+		t.Fatalf("expected 6 lookup bands, got %d", n)
+	}
+	if urlSig := urlSetSignature([]string{"https://a.example/x", "https://b.example/y"}); len(lookupBands(urlSig)) != len(signatureBands(urlSig)) {
+		t.Error("URL-set signatures should keep every band")
+	}
+
+	// Learning stores every band; the subset lookup still finds the entry
+	learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "")
+	if n, _ := rdb.Exists(ctx, LocalFragPrefix+signatureBands(sig)[1]).Result(); n != 1 {
+		t.Error("learning should index bands outside the lookup subset too")
+	}
+	if !learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "") {
+		t.Error("second report should find the learned hash through the subset")
+	}
+
+	raw := "From: courier@parcel.example\r\nMessage-ID: <p@parcel>\r\n\r\n" + body
+	env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+	if out := analyzeEnvelope(context.Background(), env); out.Result.Label != "local_spam" {
+		t.Errorf("analyze with a band subset should match the learned hash, got %+v", out.Result)
+	}
+}
+
+// TestTracingSpans checks the analyze span tree and trace propagation to the oracle
+func TestTracingSpans(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	originalTracer, originalPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		tracer = originalTracer
+		otel.SetTextMapPropagator(originalPropagator)
+	}()
+
+	var oracleTraceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oracleTraceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": {"action": "allow"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	body := strings.Repeat("Exclusive crypto presale, only a few spots left, reserve yours. ", 8)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	for _, band := range extractBands_6_3(sig) {
+		rdb.SAdd(ctx, FragKeyPrefix+band, "1")
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/analyze", strings.NewReader("From: a@example.com\r\nMessage-ID: <t@x>\r\n\r\n"+body))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	analyzeHandler(httptest.NewRecorder(), req)
+
+	names := map[string]int{}
+	for _, s := range exporter.GetSpans() {
+		names[s.Name]++
+		if got := s.SpanContext.TraceID().String(); got != traceID {
+			t.Errorf("span %s not in the caller's trace: %s", s.Name, got)
+		}
+	}
+	for _, name := range []string{"analyze", "normalize", "band_lookup", "oracle"} {
+		if names[name] == 0 {
+			t.Errorf("missing span %q, got %v", name, names)
+		}
+	}
+	if !strings.Contains(oracleTraceparent, traceID) {
+		t.Errorf("trace context not propagated to the oracle: %q", oracleTraceparent)
+	}
+}
+
+// TestRedundantRawSignature checks that plaintext-only mail doesn't get a duplicate raw signature
+func TestRedundantRawSignature(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	analyze := func(body string) scanOutcome {
+		raw := "From: a@example.com\r\nMessage-ID: <r@x>\r\n\r\n" + body
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return analyzeEnvelope(context.Background(), env)
+	}
+	types := func(out scanOutcome) string {
+		var names []string
+		for _, s := range out.Signatures {
+			names = append(names, s.Type.String())
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Disabled by default: the raw signature is kept even when identical
+	plain := strings.TrimSpace(strings.Repeat("hello team please find the minutes of our weekly meeting below action items are listed ", 6))
+	if got := types(analyze(plain)); got != "normalized,raw" {
+		t.Errorf("-1 should never skip the raw signature, got %s", got)
+	}
+
+	// Already-normalized plaintext: the raw TLSH is identical, skipped from distance 0
+	withConfig(t, map[string]string{"REDUNDANT_RAW_DISTANCE": "0"})
+	before := testutil.ToFloat64(promRedundantRawSkipped)
+	out := analyze(plain)
+	if got := types(out); got != "normalized" || !out.Signatures[0].CoversRaw || len(out.Hashes) != 1 {
+		t.Errorf("identical raw signature should be skipped, got %s (%+v)", got, out.Signatures)
+	}
+	if testutil.ToFloat64(promRedundantRawSkipped) != before+1 {
+		t.Error("skipped raw signature should be counted")
+	}
+
+	// Plaintext that normalization barely changes: only skipped within the configured distance
+	mixed := strings.Repeat("Hello team, please find the minutes of our weekly meeting below. Action items are listed. ", 6)
+	if got := types(analyze(mixed)); got != "normalized,raw" {
+		t.Errorf("distance 0 should keep a differing raw signature, got %s", got)
+	}
+	withConfig(t, map[string]string{"REDUNDANT_RAW_DISTANCE": "30"})
+	if out := analyze(mixed); types(out) != "normalized" || !out.Signatures[0].CoversRaw {
+		t.Errorf("near-identical raw signature should be skipped, got %s", types(out))
+	}
+}
+
+// TestPerTypeRetention checks that learned hashes expire according to their signature type
+func TestPerTypeRetention(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{
+		"LOCAL_RETENTION_DAYS":   "15",
+		"RETENTION_DAYS_URL":     "60",
+		"RETENTION_DAYS_SUBJECT": "3",
+	})
+	day := 24 * time.Hour
+
+	if got := getRetentionForType(SigRaw); got != 15*day {
+		t.Errorf("unset type should use LOCAL_RETENTION_DAYS, got %s", got)
+	}
+	if got := getRetentionForType(SigUnknown); got != 15*day {
+		t.Errorf("unknown type should use LOCAL_RETENTION_DAYS, got %s", got)
+	}
+
+	urlSig, _ := computeLocalTLSH(strings.Repeat("https://login.example-bank.test/verify?session=abc\n", 6))
+	subjSig, _ := computeLocalTLSH(strings.Repeat("urgent: your mailbox storage is almost full ", 5))
+
+	// Report path: the type comes from the stored scan result
+	scan, _ := json.Marshal(ScanResult{
+		Hashes: []string{urlSig, subjSig},
+		Types:  map[string]string{urlSig: "url", subjSig: "subject"},
+	})
+	sum := sha1.Sum([]byte("<typed@example.com>"))
+	rdb.Set(ctx, "mi:msgid:"+hex.EncodeToString(sum[:]), scan, time.Hour)
+	req := httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"<typed@example.com>","report_type":"spam"}`))
+	reportHandler(httptest.NewRecorder(), req)
+
+	if ttl := mr.TTL(LocalScorePrefix + urlSig); ttl != 60*day {
+		t.Errorf("URL hash TTL = %s, want 60 days", ttl)
+	}
+	if ttl := mr.TTL(LocalScorePrefix + subjSig); ttl != 3*day {
+		t.Errorf("subject hash TTL = %s, want 3 days", ttl)
+	}
+	if ttl := mr.TTL(LocalFragPrefix + extractBands_6_3(subjSig)[0]); ttl != 3*day {
+		t.Errorf("subject band TTL = %s, want 3 days", ttl)
+	}
+	// A band shared with a longer-lived hash is never shortened by a refresh
+	sharedBand := LocalFragPrefix + extractBands_6_3(subjSig)[0]
+	mr.SetTTL(sharedBand, 60*day)
+	learnSpamHash(subjSig, 1, SigSubject)
+	if ttl := mr.TTL(sharedBand); ttl != 60*day {
+		t.Errorf("shared band TTL = %s, should stay 60 days", ttl)
+	}
+	if typ, _ := rdb.Get(ctx, LocalTypePrefix+urlSig).Result(); typ != "url" {
+		t.Errorf("learned type not stored, got %q", typ)
+	}
+
+	// Later learning keeps the first type and its retention
+	learnSpamHash(urlSig, 1, SigSubject)
+	if ttl := mr.TTL(LocalScorePrefix + urlSig); ttl != 60*day {
+		t.Errorf("relearned URL hash should keep its URL retention, got %s", ttl)
+	}
+}
+
+// TestOracleFingerprintCache checks that one oracle spam verdict covers every signature of
+// the same content, while other verdicts are asked per signature
+func TestOracleFingerprintCache(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	var oracleCalls int64
+	verdict := `{"result": {"action": "spam", "confidence": 1}}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&oracleCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(verdict))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	text := strings.Repeat("Congratulations, you have been selected for our annual loyalty programme rewards. ", 6)
+	html := "<html><body><p>" + strings.Repeat("Congratulations, you have been <b>selected</b> for our annual loyalty rewards.<br>", 6) + "</p></body></html>"
+	normSig, _ := computeLocalTLSH(normalizeEmailBody(text, html))
+	rawSig, _ := computeLocalTLSH(text + html)
+	fp := contentFingerprint(normalizeEmailBody(text, html))
+
+	before := testutil.ToFloat64(promOracleFingerprintHits)
+	for _, sig := range []string{normSig, rawSig} {
+		if res := oracleDecisionForContent(context.Background(), fp, sig); res.Action != "spam" {
+			t.Errorf("expected the spam verdict for %s, got %+v", sig, res)
+		}
+	}
+	if n := atomic.LoadInt64(&oracleCalls); n != 1 {
+		t.Errorf("expected a single oracle call for the content, got %d", n)
+	}
+	if testutil.ToFloat64(promOracleFingerprintHits) != before+1 {
+		t.Error("fingerprint cache hit should be counted")
+	}
+	if n, _ := rdb.Exists(ctx, OracleFingerprintPrefix+fp).Result(); n != 1 {
+		t.Error("spam verdict should be cached under the content fingerprint")
+	}
+
+	// Non-spam verdicts are not shared between signatures
+	rdb.FlushAll(ctx)
+	verdict = `{"result": {"action": "allow"}}`
+	atomic.StoreInt64(&oracleCalls, 0)
+	oracleDecisionForContent(context.Background(), fp, normSig)
+	oracleDecisionForContent(context.Background(), fp, rawSig)
+	if n := atomic.LoadInt64(&oracleCalls); n != 2 {
+		t.Errorf("expected an oracle call per signature for allow verdicts, got %d", n)
+	}
+	if n, _ := rdb.Exists(ctx, OracleFingerprintPrefix+fp).Result(); n != 0 {
+		t.Error("allow verdicts must not be cached by fingerprint")
+	}
+
+	// Oracle unreachable: nothing is cached by fingerprint
+	rdb.FlushAll(ctx)
+	oracleURL = "http://127.0.0.1:1"
+	oracleDecisionForContent(context.Background(), fp, normSig)
+	if n, _ := rdb.Exists(ctx, OracleFingerprintPrefix+fp).Result(); n != 0 {
+		t.Error("failed oracle calls must not be cached")
+	}
+}
+
+// TestOracleSoftSpam checks that an oracle soft_spam verdict is kept rather than collapsed to allow
+func TestOracleSoftSpam(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{"SOFT_SPAM_TRACKING": "true"})
+
+	var oracleCalls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&oracleCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": {"action": "soft_spam"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	body := strings.Repeat("Improve your website ranking with our guaranteed search engine package. ", 8)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	for _, band := range extractBands_6_3(sig) {
+		rdb.SAdd(ctx, FragKeyPrefix+band, "1")
+	}
+	analyze := func() scanOutcome {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: seo@example.com\r\nMessage-ID: <seo@x>\r\n\r\n" + body))
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	out := analyze()
+	if out.Result.Action != "soft_spam" || out.Result.Label != "oracle_soft" || out.Result.ReasonCode != ReasonOracleSoft {
+		t.Fatalf("oracle soft_spam should be kept, got %+v", out.Result)
+	}
+	if out.Result.Confidence != heuristicSoftConfidence || out.Result.MatchType != "normalized" {
+		t.Errorf("missing confidence/match type should be filled in, got %+v", out.Result)
+	}
+	if ttl := mr.TTL("mi:oracle_cache:" + sig); ttl != 5*time.Minute {
+		t.Errorf("soft_spam should be cached with the ham TTL, got %s", ttl)
+	}
+
+	// Recorded for soft-spam trend tracking (asynchronously)
+	deadline := time.Now().Add(time.Second)
+	for !mr.Exists(SoftSpamKeyPrefix + out.Fingerprint) {
+		if time.Now().After(deadline) {
+			t.Fatal("oracle soft_spam should be tracked as a soft-spam trend")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	calls := atomic.LoadInt64(&oracleCalls)
+	if out := analyze(); out.Result.Action != "soft_spam" || atomic.LoadInt64(&oracleCalls) != calls {
+		t.Errorf("cached soft_spam should be reused without calling the oracle, got %+v", out.Result)
+	}
+}
+
+// TestDequoteForwards checks that forwarded/quoted spam normalizes like the original
+func TestDequoteForwards(t *testing.T) {
+	original := strings.Repeat("Dear winner,\nYour email address has won the international lottery draw.\n"+
+		"Send your full name, address and bank details to claim the prize of five million dollars.\n"+
+		"Reply quickly, this offer is only valid for a few days.\n", 3) + "Regards, the lottery board"
+
+	var quoted strings.Builder
+	quoted.WriteString("On Mon, 5 Jan 2026 at 10:12, Lottery Board <board@lottery.example> wrote:\n")
+	for _, line := range strings.Split(original, "\n") {
+		quoted.WriteString("> " + line + "\n")
+	}
+	forwarded := "---------- Forwarded message ---------\nFrom: Lottery Board <board@lottery.example>\n" +
+		"Date: Mon, 5 Jan 2026 at 10:12\nSubject: You won\nTo: <me@example.com>\n\n" + original
+
+	withConfig(t, map[string]string{"DEQUOTE_FORWARDS": "false"})
+	if normalizeEmailBody(quoted.String(), "") == normalizeEmailBody(original, "") {
+		t.Fatal("fixture: quoting should change the normalized body when disabled")
+	}
+
+	withConfig(t, map[string]string{"DEQUOTE_FORWARDS": "true"})
+	want := normalizeEmailBody(original, "")
+	for name, body := range map[string]string{"quoted": quoted.String(), "forwarded": forwarded} {
+		if got := normalizeEmailBody(body, ""); got != want {
+			t.Errorf("%s body should normalize like the original:\n got: %q\nwant: %q", name, got, want)
+		}
+	}
+
+	// With the reporter's own comment on top, the hash is still much closer to the original
+	commented := "FYI, this is spam, please block.\n\n" + quoted.String()
+	origSig, _ := computeLocalTLSH(want)
+	dequotedSig, _ := computeLocalTLSH(normalizeEmailBody(commented, ""))
+	withConfig(t, map[string]string{"DEQUOTE_FORWARDS": "false"})
+	quotedSig, _ := computeLocalTLSH(normalizeEmailBody(commented, ""))
+	dDequoted, _ := computeDistance(origSig, dequotedSig, false, 0)
+	dQuoted, _ := computeDistance(origSig, quotedSig, false, 0)
+	if dDequoted >= dQuoted {
+		t.Errorf("dequoted distance %d should be smaller than quoted distance %d", dDequoted, dQuoted)
+	}
+
+	if got := dequoteHTML(`<div>hi</div><blockquote class="gmail_quote" type="cite"><p>offer</p></blockquote>`); got != `<div>hi</div><p>offer</p>` {
+		t.Errorf("blockquote tags should be unwrapped, got %q", got)
+	}
+}
+
+// TestThresholdOverrides checks per-request threshold overrides for admin callers only
+func TestThresholdOverrides(t *testing.T) {
+	o, err := parseThresholdOverrides("normalized=60, URL=40 ,soft_delta=5")
+	if err != nil || o.PerType[SigNormalized] != 60 || o.PerType[SigURL] != 40 || o.SoftDelta != 5 {
+		t.Errorf("unexpected overrides %+v (%v)", o, err)
+	}
+	for _, bad := range []string{"normalized", "normalized=abc", "bogus=10", "url=-1", "raw=999"} {
+		if _, err := parseThresholdOverrides(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+
+	base := strings.Repeat("Your invoice is overdue, settle the outstanding balance today to avoid fees. ", 8)
+	learned, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	learnSpamHash(learned, 1, SigNormalized)
+	variant := strings.Replace(base, "fees", "costs", 1)
+
+	analyze := func(headers map[string]string) (int, string) {
+		req := httptest.NewRequest("POST", "/analyze", strings.NewReader("From: billing@example.com\r\nMessage-ID: <o@x>\r\n\r\n"+variant))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+	strict := "normalized=0, raw=0, soft_delta=0"
+
+	if _, body := analyze(nil); !strings.Contains(body, `"action":"spam"`) {
+		t.Fatalf("fixture: variant should match with default thresholds, got %s", body)
+	}
+	if _, body := analyze(map[string]string{ThresholdOverrideHeader: strict}); !strings.Contains(body, `"action":"spam"`) {
+		t.Errorf("overrides from non-admin callers must be ignored, got %s", body)
+	}
+	if _, body := analyze(map[string]string{ThresholdOverrideHeader: strict, "X-Admin-Token": "s3cret"}); strings.Contains(body, `"spam"`) {
+		t.Errorf("admin strict override should stop the match, got %s", body)
+	}
+	if code, _ := analyze(map[string]string{ThresholdOverrideHeader: "bogus=1", "X-Admin-Token": "s3cret"}); code != http.StatusBadRequest {
+		t.Errorf("invalid admin override should be rejected, got %d", code)
+	}
+
+	// Overrides only live for the request
+	if _, body := analyze(nil); !strings.Contains(body, `"action":"spam"`) {
+		t.Errorf("later requests should use the configured thresholds, got %s", body)
+	}
+}
+
+// TestSoftSpamPerSource checks the per-source soft deltas and escalation counts
+func TestSoftSpamPerSource(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your invoice is overdue, settle the outstanding balance today to avoid fees. ", 8)
+	variant := strings.Replace(base, "fees", "costs", 1)
+	learned, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	variantSig, _ := computeLocalTLSH(normalizeEmailBody(variant, ""))
+	dist, _ := computeDistance(learned, variantSig, true, 0)
+	if dist == 0 {
+		t.Fatal("fixture: the variant should differ from the learned body")
+	}
+
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: billing@example.com\r\nMessage-ID: <ps@x>\r\n\r\n" + variant))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	// The variant lands just beyond the spam threshold
+	previous := atomic.LoadInt64(&thresholdNormalized)
+	atomic.StoreInt64(&thresholdNormalized, int64(dist-1))
+	t.Cleanup(func() { atomic.StoreInt64(&thresholdNormalized, previous) })
+
+	// Unset, the source uses the global delta
+	if p := defaultProfile(); p.softThreshold(SigNormalized, SoftSourceLocal) != dist-1+int(softSpamDelta) {
+		t.Errorf("unexpected default soft threshold %d", p.softThreshold(SigNormalized, SoftSourceLocal))
+	}
+
+	learnSpamHash(learned, 1, SigNormalized)
+	withConfig(t, map[string]string{"SOFT_SPAM_DELTA_LOCAL": "0", "SOFT_SPAM_DELTA_ORACLE_CACHE": "10"})
+	if res := analyze(); res.Action != "allow" {
+		t.Errorf("local soft matches are off with a 0 delta, got %+v", res)
+	}
+	withConfig(t, map[string]string{"SOFT_SPAM_DELTA_LOCAL": "5", "SOFT_SPAM_DELTA_ORACLE_CACHE": "0"})
+	if res := analyze(); res.Action != "soft_spam" || res.Label != "local_soft" {
+		t.Errorf("expected a local soft match, got %+v", res)
+	}
+
+	// Escalation counts the soft_spam verdicts of the content, per source
+	withConfig(t, map[string]string{"SOFT_SPAM_ESCALATE_LOCAL": "2", "SOFT_SPAM_ESCALATE_ORACLE_CACHE": "1"})
+	if res := analyze(); res.Action != "soft_spam" {
+		t.Errorf("first counted copy should stay soft_spam, got %+v", res)
+	}
+	if res := analyze(); res.Action != "spam" || res.ReasonCode != ReasonSoftEscalated {
+		t.Errorf("second counted copy should escalate to spam, got %+v", res)
+	}
+	withConfig(t, map[string]string{"SPAM_MIN_CONFIDENCE": "95"})
+	if res := analyze(); res.Action != "spam" || res.Confidence < 0.95 {
+		t.Errorf("escalated verdicts should not be demoted by SPAM_MIN_CONFIDENCE, got %+v", res)
+	}
+	if rdb.Exists(ctx, SoftSpamTrendKey).Val() != 0 {
+		t.Error("escalation counts should not show in the trends with SOFT_SPAM_TRACKING off")
+	}
+
+	// Same distance, oracle cache source
+	rdb.FlushAll(ctx)
+	cacheLearned := func() {
+		cacheOracleSpam(learned, AnalysisResult{Action: "spam", CachedAt: time.Now().Unix(), SchemaVersion: currentVerdictSchemaVersion()}, time.Hour)
+	}
+	withConfig(t, map[string]string{"SOFT_SPAM_DELTA_ORACLE_CACHE": "0"})
+	cacheLearned()
+	if res := analyze(); res.Action != "allow" {
+		t.Errorf("oracle cache soft matches are off with a 0 delta, got %+v", res)
+	}
+	withConfig(t, map[string]string{"SOFT_SPAM_DELTA_LOCAL": "0", "SOFT_SPAM_DELTA_ORACLE_CACHE": "5", "SOFT_SPAM_ESCALATE_ORACLE_CACHE": "1"})
+	cacheLearned()
+	if res := analyze(); res.Action != "spam" || res.Label != "soft_spam_escalated" {
+		t.Errorf("an oracle cache soft match should escalate on the first copy, got %+v", res)
+	}
+}
+
+// TestThrottledReset checks that RESET_DB runs in the background without blocking analyze
+func TestThrottledReset(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{"RESET_BATCH_SIZE": "50", "RESET_BATCH_DELAY": "20ms"})
+
+	for i := 0; i < 1000; i++ {
+		mr.Set(fmt.Sprintf("%s%06d", FragKeyPrefix, i), "1")
+	}
+	mr.Set(MetaVer, "42")
+	mr.Set(LocalScorePrefix+"keep", "3")
+
+	if err := applySyncResponse(SyncResponse{Action: "RESET_DB"}); err != nil {
+		t.Fatal(err)
+	}
+	if !resetInProgress.Load() {
+		t.Fatal("reset should be running in the background")
+	}
+	if startReset() {
+		t.Error("a second reset must not start while one is running")
+	}
+
+	// Analyze keeps responding promptly while the reset runs
+	body := strings.Repeat("Quarterly newsletter with product updates and upcoming events for members. ", 6)
+	start := time.Now()
+	req := httptest.NewRequest("POST", "/analyze", strings.NewReader("From: news@example.com\r\nMessage-ID: <r@x>\r\n\r\n"+body))
+	rr := httptest.NewRecorder()
+	analyzeHandler(rr, req)
+	if rr.Code != http.StatusOK || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("analyze should answer during the reset, got %d after %s", rr.Code, time.Since(start))
+	}
+	if !resetInProgress.Load() || testutil.ToFloat64(promResetInProgress) != 1 {
+		t.Error("reset should still be in progress after the analyze call")
+	}
+	if seq, _ := rdb.Get(ctx, MetaVer).Int(); seq != 42 {
+		t.Errorf("sync sequence must only be rewound at the end, got %d", seq)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for resetInProgress.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("reset did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys, _ := rdb.Keys(ctx, FragKeyPrefix+"*").Result(); len(keys) != 0 {
+		t.Errorf("%d oracle bands left after reset", len(keys))
+	}
+	if seq, _ := rdb.Get(ctx, MetaVer).Int(); seq != 0 {
+		t.Errorf("sync sequence should be 0 after reset, got %d", seq)
+	}
+	if !mr.Exists(LocalScorePrefix + "keep") {
+		t.Error("local learning must survive an oracle reset")
+	}
+	if got := testutil.ToFloat64(promResetDeleted); got != 1000 {
+		t.Errorf("progress gauge = %v, want 1000", got)
+	}
+	if testutil.ToFloat64(promResetInProgress) != 0 {
+		t.Error("in-progress gauge should be cleared")
+	}
+}
+
+// TestCombinedSignature checks the optional subject + body signature
+func TestCombinedSignature(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"COMBINED_SIGNATURE": "true"})
+
+	analyze := func(subject, body string) scanOutcome {
+		raw := "From: promo@deals.example\r\nSubject: " + subject + "\r\nMessage-ID: <c@x>\r\n\r\n" + body
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	// Subject (<= 30 chars) and body (< 200 chars) are each too short for their own signature
+	learned := analyze("Cheap watches, order today",
+		"Genuine designer watches at factory prices. Free shipping worldwide, pay on delivery. Visit our shop now and get a second watch for free, stock is limited so hurry up before midnight tonight")
+	if len(learned.Signatures) != 1 || learned.Signatures[0].Type != SigCombined {
+		t.Fatalf("expected a single combined signature, got %+v", learned.Signatures)
+	}
+	learnFromReport(learned.Signatures, "spam", "")
+
+	out := analyze("Cheap watches, order today!",
+		"Genuine designer watches at factory prices. Free shipping worldwide, pay on delivery. Visit our shop now and get a second watch for free, stock is limited so hurry up before midnight tonight!")
+	if out.Result.Action != "spam" || out.Result.MatchType != "combined" {
+		t.Errorf("variant should match the learned combined signature, got %+v", out.Result)
+	}
+
+	withConfig(t, map[string]string{"COMBINED_SIGNATURE": "false"})
+	if out := analyze("Cheap watches, order now", "Genuine designer watches at factory prices."); len(out.Signatures) != 0 {
+		t.Errorf("combined signature should be disabled, got %+v", out.Signatures)
+	}
+}
+
+// TestNearMiss checks that the closest non-matching learned hash is reported
+func TestNearMiss(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your parcel could not be delivered because the customs fee is unpaid. "+
+		"Please confirm your address and pay the small fee within two days to avoid the return of the package. ", 3)
+	learnedSig, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	learnFromReport([]TypedSignature{{Hash: learnedSig, Type: SigNormalized}}, "spam", "")
+
+	analyze := func(reqCtx context.Context, body string) scanOutcome {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <nm@x>\r\n\r\n" + body))
+		return analyzeEnvelope(reqCtx, env)
+	}
+	variant := strings.Replace(base, "two days", "three days", -1)
+
+	// A strict threshold turns the close variant into a near miss
+	strict := context.WithValue(context.Background(), thresholdOverridesKey{},
+		thresholdOverrides{PerType: map[SignatureType]int{SigNormalized: 5}, SoftDelta: 0})
+	out := analyze(strict, variant)
+	nm := out.Result.NearMiss
+	if out.Result.Action != "allow" || nm == nil {
+		t.Fatalf("expected a near miss on an allow verdict, got %+v", out.Result)
+	}
+	if nm.Hash != learnedSig || nm.Distance <= nm.Threshold || nm.Threshold != 5 || nm.MatchType != "normalized" {
+		t.Errorf("unexpected near miss %+v", nm)
+	}
+	if perSig, ok := out.NearMisses[out.Signatures[0].Hash]; !ok || perSig != *nm {
+		t.Errorf("near miss should be kept per signature, got %+v", out.NearMisses)
+	}
+
+	// A spam verdict carries no near miss
+	if out := analyze(context.Background(), variant); out.Result.Action != "spam" || out.Result.NearMiss != nil {
+		t.Errorf("spam verdict should not report a near miss, got %+v", out.Result)
+	}
+}
+
+// TestOperatingMode checks the /admin/mode panic button
+func TestOperatingMode(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+	handler := requireAdmin(adminModeHandler)
+
+	setModeReq := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/mode", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	body := strings.Repeat("Claim your free gift card now, only a few left. Click the link and enter your card number to confirm. ", 4)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "")
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <mode@x>\r\n\r\n" + body))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	if res := analyze(); res.Action != "spam" || currentMode() != ModeNormal {
+		t.Fatalf("normal mode should block, got %+v", res)
+	}
+
+	if rr := setModeReq(`{"mode": "block_all"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode should return 400, got %d", rr.Code)
+	}
+
+	before := testutil.ToFloat64(promModeChanges.WithLabelValues(ModeScanOnly))
+	if rr := setModeReq(`{"mode": "scan_only"}`); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"scan_only"`) {
+		t.Fatalf("setting scan_only failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if testutil.ToFloat64(promModeChanges.WithLabelValues(ModeScanOnly)) != before+1 {
+		t.Error("mode change should be counted")
+	}
+	if res := analyze(); res.Action != "allow" || res.ReasonCode != ReasonModeScanOnly || res.MatchType != "normalized" {
+		t.Errorf("scan_only should scan but allow, got %+v", res)
+	}
+
+	setModeReq(`{"mode": "allow_all"}`)
+	if res := analyze(); res.Action != "allow" || res.ReasonCode != ReasonModeAllowAll || res.MatchType != "" {
+		t.Errorf("allow_all should allow without scanning, got %+v", res)
+	}
+
+	rr := httptest.NewRecorder()
+	statusHandler(rr, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(rr.Body.String(), `"mode":"allow_all"`) {
+		t.Errorf("/status should expose the mode, got %s", rr.Body.String())
+	}
+
+	setModeReq(`{"mode": "normal"}`)
+	if res := analyze(); res.Action != "spam" {
+		t.Errorf("back to normal should block again, got %+v", res)
+	}
+}
+
+// TestNormalizeSteps checks the configurable normalization pipeline
+func TestNormalizeSteps(t *testing.T) {
+	body := `Visit https://shop.example/?UTM_Source=News&id=42 now`
+
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": ""})
+	if got := normalizeEmailBody(body, ""); got != "visit https://shop.example/?&id=42 now" {
+		t.Errorf("default pipeline: got %q", got)
+	}
+
+	// Reordered and reduced pipelines
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "lowercase, trackers, spaces"})
+	if got := normalizeEmailBody(body+"  ", ""); got != "visit https://shop.example/?&id=42 now" {
+		t.Errorf("reordered pipeline: got %q", got)
+	}
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "trackers"})
+	if got := normalizeEmailBody(body, ""); got != "Visit https://shop.example/?&id=42 now" {
+		t.Errorf("lowercase should be disabled, got %q", got)
+	}
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "none"})
+	if got := normalizeEmailBody(body, ""); got != body {
+		t.Errorf("none should leave the body untouched, got %q", got)
+	}
+
+	// Order matters: digits masked before hex ids keep the hex run shorter
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "long_digits,hex_ids"})
+	a := normalizeEmailBody("ref 1234567abc", "")
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "hex_ids,long_digits"})
+	b := normalizeEmailBody("ref 1234567abc", "")
+	if a != "ref ****abc" || b != "ref ****" {
+		t.Errorf("step order not respected: %q / %q", a, b)
+	}
+
+	for _, bad := range []string{"lowercase,bogus", "lowercase,lowercase"} {
+		withConfig(t, map[string]string{"NORMALIZE_STEPS": bad})
+		if got := len(currentNormalizeSteps()); got != len(builtinNormalizeSteps) {
+			t.Errorf("invalid %q should fall back to the default order, got %d steps", bad, got)
+		}
+	}
+
+	// Steps with their own setting are placed like the others, and only run while enabled
+	withConfig(t, map[string]string{"EMOJI_NORMALIZE": "true", "NORMALIZE_STEPS": "lowercase"})
+	if got := normalizeEmailBody("Sale 🔥🔥 NOW", ""); got != "sale 🔥🔥 now" {
+		t.Errorf("emoji step left out of the pipeline should not run, got %q", got)
+	}
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "emoji,lowercase"})
+	if got := normalizeEmailBody("Sale 🔥🔥 NOW", ""); got != "sale [emoji] now" {
+		t.Errorf("emoji step in the pipeline should run, got %q", got)
+	}
+	withConfig(t, map[string]string{"EMOJI_NORMALIZE": "false"})
+	if got := normalizeEmailBody("Sale 🔥🔥 NOW", ""); got != "sale 🔥🔥 now" {
+		t.Errorf("emoji step should not run while EMOJI_NORMALIZE is off, got %q", got)
+	}
+
+	// Custom rules: appended to the default order, placeable by name, invalid ones ignored
+	withConfig(t, map[string]string{
+		"NORMALIZE_STEPS":        "",
+		"NORMALIZE_CUSTOM_RULES": "order_ids=(?i)ORD-[a-z]+=>ORD; broken=([=>x; lowercase=a=>b; no arrow",
+	})
+	steps := currentNormalizeSteps()
+	if len(steps) != len(builtinNormalizeSteps)+1 || steps[len(steps)-1].Name != "order_ids" {
+		t.Fatalf("expected the built-ins plus one valid custom rule, got %d steps", len(steps))
+	}
+	if got := normalizeEmailBody("Your order ORD-ABC shipped", ""); got != "your order ORD shipped" {
+		t.Errorf("custom rule should run last by default, got %q", got)
+	}
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "order_ids,lowercase"})
+	if got := normalizeEmailBody("Your order ORD-ABC shipped", ""); got != "your order ord shipped" {
+		t.Errorf("custom rule should run where listed, got %q", got)
+	}
+	version := computeVerdictSchemaVersion()
+	withConfig(t, map[string]string{"NORMALIZE_CUSTOM_RULES": "order_ids=(?i)ORD-[a-z]+=>REF"})
+	if computeVerdictSchemaVersion() == version {
+		t.Error("changing a custom rule should change the verdict schema version")
+	}
+}
+
+// TestNormalizedBodyCache checks that identical bodies are normalized and hashed once
+func TestNormalizedBodyCache(t *testing.T) {
+	useMiniredis(t)
+	normalizedBodies = &bodyCache{order: list.New(), items: make(map[string]*list.Element)}
+
+	text := strings.Repeat("Your mailbox is almost full. Click the link below to upgrade your storage for free today. ", 3)
+	html := "<p>" + text + "</p>"
+	lookups := func(result string) float64 { return testutil.ToFloat64(promBodyCache.WithLabelValues(result)) }
+
+	withConfig(t, map[string]string{"NORMALIZED_BODY_CACHE_SIZE": "0"})
+	analyzeBody(text, html)
+	if normalizedBodies.len() != 0 {
+		t.Fatal("nothing should be cached when the cache is off")
+	}
+
+	withConfig(t, map[string]string{"NORMALIZED_BODY_CACHE_SIZE": "2"})
+	hits, misses := lookups("hit"), lookups("miss")
+	first := analyzeBody(text, html)
+	second := analyzeBody(text, html)
+	if lookups("miss")-misses != 1 || lookups("hit")-hits != 1 {
+		t.Errorf("expected 1 miss then 1 hit, got %v misses and %v hits", lookups("miss")-misses, lookups("hit")-hits)
+	}
+	if first != second || first.Signature == "" || first.Normalized != normalizeEmailBody(text, html) {
+		t.Errorf("the cached entry should be reused: %+v", second)
+	}
+	if sig, _ := computeLocalTLSH(first.Normalized); sig != first.Signature {
+		t.Errorf("cached signature %s differs from %s", first.Signature, sig)
+	}
+	// The raw signature is only computed when asked for
+	if first.rawSig != "" {
+		t.Error("raw signature should not be computed before it is needed")
+	}
+	rawSig, _ := first.RawSignature()
+	if sig, _ := computeLocalTLSH(text + html); sig == "" || rawSig != sig {
+		t.Errorf("raw signature %s should be the TLSH of the raw body %s", rawSig, sig)
+	}
+
+	// Same parts split differently are another body
+	if analyzeBody(text+html, "") == first {
+		t.Error("text and HTML should both be part of the key")
+	}
+
+	// Normalization settings changed: the entry is recomputed
+	withConfig(t, map[string]string{"NORMALIZED_BODY_CACHE_SIZE": "2", "NORMALIZE_STEPS": "spaces"})
+	if e := analyzeBody(text, html); e == first || e.Normalized == first.Normalized {
+		t.Error("an entry from another schema version should not be reused")
+	}
+
+	// Bounded: the least recent entries go first
+	analyzeBody("another body", "")
+	if n := normalizedBodies.len(); n != 2 {
+		t.Errorf("expected 2 entries at most, got %d", n)
+	}
+	if _, ok := normalizedBodies.get(bodyCacheKey(text+html, "")); ok {
+		t.Error("the least recent entry should have been evicted")
+	}
+}
+
+// TestBase64Evasion checks that base64 blobs in the visible body are hashed decoded
+func TestBase64Evasion(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"BASE64_DECODE": "false"})
+
+	payload := strings.Repeat("Cheap meds without prescription, discreet delivery to your door. "+
+		"Order today and save up to eighty percent on all brand products. ", 3)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(payload, ""))
+	learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "")
+
+	blob := base64.StdEncoding.EncodeToString([]byte(payload))
+	var wrapped strings.Builder
+	for len(blob) > 76 {
+		wrapped.WriteString(blob[:76] + "\n")
+		blob = blob[76:]
+	}
+	wrapped.WriteString(blob)
+	analyze := func() AnalysisResult {
+		raw := "From: a@example.com\r\nMessage-ID: <b64@x>\r\n\r\n" + wrapped.String()
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	if res := analyze(); res.Action == "spam" {
+		t.Fatalf("base64 body should evade matching when decoding is off, got %+v", res)
+	}
+	withConfig(t, map[string]string{"BASE64_DECODE": "true"})
+	if res := analyze(); res.Action != "spam" || res.Label != "local_spam" {
+		t.Errorf("decoded base64 body should match the learned spam, got %+v", res)
+	}
+
+	// A block of narrow base64 lines is decoded wherever it sits, and the text around it is kept
+	narrow := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("buy now ", 10)))
+	var lines []string
+	for len(narrow) > 20 {
+		lines = append(lines, narrow[:20])
+		narrow = narrow[20:]
+	}
+	lines = append(lines, narrow)
+	block := "Hello,\n" + strings.Join(lines, "\r\n") + "\nThanks"
+	if got := decodeBase64Runs(block, 80, 1024); got != "Hello,\n"+strings.Repeat("buy now ", 10)+"\nThanks" {
+		t.Errorf("narrow base64 block should be decoded, got %q", got)
+	}
+
+	// Binary blobs, short runs and anything past the budget are left alone
+	binary := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x00, 0xff, 0x10, 0x80}, 30))
+	if got := decodeBase64Runs(binary, 80, 1024); got != binary {
+		t.Errorf("binary blob should not be decoded, got %q", got)
+	}
+	short := base64.StdEncoding.EncodeToString([]byte("hello hello hello hello hello hello"))
+	if got := decodeBase64Runs(short, 80, 1024); got != short {
+		t.Errorf("short run should not be decoded, got %q", got)
+	}
+	text := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("buy now ", 20)))
+	if got := decodeBase64Runs(text+" "+text, 80, 200); got != strings.Repeat("buy now ", 20)+" "+text {
+		t.Errorf("decoding should stop at the budget, got %q", got)
+	}
+}
+
+// TestCharsetSniffing checks that UTF-8 text declared us-ascii is re-decoded before normalization
+func TestCharsetSniffing(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"CHARSET_SNIFFING": "false"})
+
+	// Under 100 characters: enmime decodes it as declared, without detecting the charset
+	payload := "您的账户已被冻结，请立即点击下方链接验证您的身份信息，否则账户将在二十四小时内被永久关闭。逾期未处理的账户余额将被清零，感谢您的配合。"
+	message := func(charset string) []byte {
+		return []byte("From: a@example.com\r\nMessage-ID: <cs@x>\r\nContent-Type: text/plain; charset=" + charset +
+			"\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" + payload)
+	}
+	labeled, _ := parseEnvelope(message("utf-8"))
+	sig, _ := computeLocalTLSH(normalizeEmailBody(labeled.Text, labeled.HTML))
+	learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "")
+	analyze := func(raw []byte) AnalysisResult {
+		env, err := parseEnvelope(raw)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	if res := analyze(message("us-ascii")); res.Action == "spam" {
+		t.Fatalf("mislabeled body should be mis-decoded when sniffing is off, got %+v", res)
+	}
+	withConfig(t, map[string]string{"CHARSET_SNIFFING": "true"})
+	if res := analyze(message("us-ascii")); res.Action != "spam" || res.Label != "local_spam" {
+		t.Errorf("re-decoded body should match its correctly labeled equivalent, got %+v", res)
+	}
+
+	// Transfer-encoded alternative parts are re-decoded too
+	var qp strings.Builder
+	w := quotedprintable.NewWriter(&qp)
+	w.Write([]byte(payload))
+	w.Close()
+	multipart := "From: a@example.com\r\nMessage-ID: <cs2@x>\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=\"US-ASCII\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" + qp.String() + "\r\n" +
+		"--b\r\nContent-Type: text/html; charset=us-ascii\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p>" + qp.String() + "</p>\r\n--b--\r\n"
+	env, _ := parseEnvelope([]byte(multipart))
+	if env.Text != payload || !strings.Contains(env.HTML, payload) {
+		t.Errorf("quoted-printable parts should be re-decoded as UTF-8, got %q / %q", env.Text, env.HTML)
+	}
+
+	// Bytes that are not UTF-8 keep the declared decoding
+	env, _ = parseEnvelope([]byte("From: a@example.com\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nCaf\xe9 cr\xe8me\r\n"))
+	if !strings.Contains(env.Text, "Café crème") {
+		t.Errorf("non UTF-8 bytes should stay decoded as declared, got %q", env.Text)
+	}
+	if ids := mislabeledASCIIParts(labeled); len(ids) != 0 {
+		t.Errorf("a part labeled utf-8 is not mislabeled, got %v", ids)
+	}
+}
+
+// TestScopedReport checks that a report can be limited to some signature types
+func TestScopedReport(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	bodySig, _ := computeLocalTLSH(strings.Repeat("Hello, please find the invoice for last month attached to this email. ", 4))
+	attSig, _ := computeLocalTLSH(strings.Repeat("MZ this program cannot be run in DOS mode payload section data ", 4))
+	scan, _ := json.Marshal(ScanResult{
+		Hashes: []string{bodySig, attSig},
+		Types:  map[string]string{bodySig: "normalized", attSig: "attachment"},
+	})
+	report := func(msgID, body string) *httptest.ResponseRecorder {
+		sum := sha1.Sum([]byte(msgID))
+		rdb.Set(ctx, "mi:msgid:"+hex.EncodeToString(sum[:]), scan, time.Hour)
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := report("<bad@x>", `{"message-id":"<bad@x>","report_type":"spam","scope":["bogus"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown scope type should return 400, got %d", rr.Code)
+	}
+	if rr := report("<none@x>", `{"message-id":"<none@x>","report_type":"spam","scope":["url"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("empty scope should return 400, got %d", rr.Code)
+	}
+
+	report("<att@x>", `{"message-id":"<att@x>","report_type":"spam","scope":["Attachment"]}`)
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+attSig).Int(); score != 1 {
+		t.Errorf("attachment signature should be learned, score %d", score)
+	}
+	if rdb.Exists(ctx, LocalScorePrefix+bodySig).Val() != 0 {
+		t.Error("body signature outside the scope should not be learned")
+	}
+
+	// Old scan results without types have nothing in scope
+	if got := (ScanResult{Hashes: []string{bodySig}}).inScope([]SignatureType{SigNormalized}); len(got.Hashes) != 0 {
+		t.Errorf("untyped hashes should be dropped from a scoped report, got %v", got.Hashes)
+	}
+}
+
+// TestOracleMaintenanceWindows checks scheduled oracle downtime
+func TestOracleMaintenanceWindows(t *testing.T) {
+	windows, err := parseMaintenanceWindows("02:00-03:00, Sun 23:30-01:00")
+	if err != nil || len(windows) != 2 {
+		t.Fatalf("unexpected parse result %v (%v)", windows, err)
+	}
+	at := func(day, clock string) time.Time {
+		tm, _ := time.Parse("Mon 2006-01-02 15:04", day+" "+clock)
+		return tm
+	}
+	tests := []struct {
+		when time.Time
+		want bool
+	}{
+		{at("Wed 2026-01-07", "02:30"), true},
+		{at("Wed 2026-01-07", "03:00"), false},
+		{at("Sun 2026-01-04", "23:45"), true},
+		{at("Mon 2026-01-05", "00:30"), true}, // Tail of the Sunday window
+		{at("Tue 2026-01-06", "00:30"), false},
+		{at("Sat 2026-01-03", "23:45"), false},
+	}
+	for _, tt := range tests {
+		got := false
+		for _, w := range windows {
+			got = got || w.contains(tt.when)
+		}
+		if got != tt.want {
+			t.Errorf("%s: in window = %v, want %v", tt.when.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+	for _, bad := range []string{"25:00-26:00", "fri", "xyz 01:00-02:00", "01:00-01:00"} {
+		if _, err := parseMaintenanceWindows(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+
+	// Inside a window the oracle is not called and syncs are skipped
+	useMiniredis(t)
+	calls := 0
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"result": {"action": "spam"}}`))
+	}))
+	defer oracle.Close()
+	previousURL := oracleURL
+	oracleURL = oracle.URL
+	defer func() { oracleURL = previousURL }()
+
+	withConfig(t, map[string]string{"ORACLE_MAINTENANCE_WINDOWS": "00:00-23:59"})
+	before := testutil.ToFloat64(promOracleSkipped.WithLabelValues("analyze"))
+	if res := callOracleDecision(context.Background(), "T1AAAA"); res.Action != "allow" || calls != 0 {
+		t.Errorf("oracle should not be called in a window, got %+v (%d calls)", res, calls)
+	}
+	doSync()
+	if calls != 0 || testutil.ToFloat64(promOracleSkipped.WithLabelValues("analyze")) != before+1 {
+		t.Errorf("skipped calls should be counted and syncs skipped (%d calls)", calls)
+	}
+
+	rr := httptest.NewRecorder()
+	configHandler(rr, httptest.NewRequest("GET", "/config", nil))
+	if !strings.Contains(rr.Body.String(), `"windows":["00:00-23:59"]`) {
+		t.Errorf("/config should expose the schedule, got %s", rr.Body.String())
+	}
+
+	withConfig(t, map[string]string{"ORACLE_MAINTENANCE_WINDOWS": ""})
+	if res := callOracleDecision(context.Background(), "T1AAAA"); res.Action != "spam" || calls != 1 {
+		t.Errorf("oracle should be called outside windows, got %+v (%d calls)", res, calls)
+	}
+}
+
+// TestSpamminessScore checks that the score only grows with bad signals, and the score-derived actions
+func TestSpamminessScore(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "true"})
+	cfg := currentScoreConfig()
+
+	replyTo := heuristicSignal{Label: "replyto_mismatch"}
+	newSender := heuristicSignal{Label: "new_sender"}
+	dangerous := heuristicSignal{Label: "dangerous_attachment"}
+	steps := []struct {
+		name       string
+		match      float64
+		heuristics []heuristicSignal
+	}{
+		{"nothing", 0, nil},
+		{"one heuristic", 0, []heuristicSignal{replyTo}},
+		{"two heuristics", 0, []heuristicSignal{replyTo, newSender}},
+		{"three heuristics", 0, []heuristicSignal{replyTo, newSender, dangerous}},
+		{"soft match", 0.3, []heuristicSignal{replyTo, newSender, dangerous}},
+		{"spam match", 0.9, []heuristicSignal{replyTo, newSender, dangerous}},
+	}
+	previous := -1
+	for _, s := range steps {
+		score := spamminessScore(cfg, s.match, s.heuristics, 0)
+		if score <= previous || score > 100 {
+			t.Errorf("%s: score %d should be above %d", s.name, score, previous)
+		}
+		previous = score
+	}
+	if spamminessScore(cfg, 0, nil, 0) != 0 || spamminessScore(cfg, 1, nil, 0) != 100 {
+		t.Error("the score should span 0 to 100")
+	}
+	if got := spamminessScore(cfg, 0, []heuristicSignal{{Label: "list_unsubscribe"}}, 0); got != 0 {
+		t.Errorf("ham signals should not be scored, got %d", got)
+	}
+	if a, b := spamminessScore(cfg, 0.8, nil, 0), spamminessScore(cfg, 0.8, nil, 1); b >= a {
+		t.Errorf("a good sender reputation should lower the score: %d / %d", a, b)
+	}
+
+	// Per-label weights
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "true", "SCORE_WEIGHT_DANGEROUS_ATTACHMENT": "90"})
+	if got := spamminessScore(currentScoreConfig(), 0, []heuristicSignal{dangerous}, 0); got != 90 {
+		t.Errorf("expected the dangerous_attachment weight, got %d", got)
+	}
+
+	// End to end: the score is returned, and may set the action
+	raw := "From: PayPal <service@paypal.com>\r\nReply-To: claims@paypa1-support.ru\r\nMessage-ID: <sc@x>\r\nSubject: Account notice\r\n\r\nHello"
+	analyze := func() scanOutcome {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return analyzeEnvelope(context.Background(), env)
+	}
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "true", "REPLYTO_MISMATCH_CHECK": "true"})
+	outcome := analyze()
+	if outcome.Result.Score == nil || *outcome.Result.Score != 20 || outcome.Result.Action != "soft_spam" {
+		t.Fatalf("expected a score of 20 on the heuristic soft_spam, got %+v", outcome.Result)
+	}
+	if body := string(analyzeResponseBody(outcome)); !strings.Contains(body, `"score":20`) {
+		t.Errorf("the response should carry the score, got %s", body)
+	}
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "true", "REPLYTO_MISMATCH_CHECK": "true", "SCORE_ACTION": "true"})
+	if res := analyze().Result; res.Action != "allow" {
+		t.Errorf("a score below SCORE_SOFT_THRESHOLD should allow, got %+v", res)
+	}
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "true", "REPLYTO_MISMATCH_CHECK": "true", "SCORE_ACTION": "true", "SCORE_WEIGHT_REPLYTO_MISMATCH": "85"})
+	if res := analyze().Result; res.Action != "spam" || res.Label != "replyto_mismatch" {
+		t.Errorf("a score above SCORE_SPAM_THRESHOLD should be spam, got %+v", res)
+	}
+
+	withConfig(t, map[string]string{"SPAMMINESS_SCORE": "false"})
+	if res := analyze().Result; res.Score != nil {
+		t.Error("no score without SPAMMINESS_SCORE")
+	}
+}
+
+// TestConfidenceBreakdown checks the sub-signals returned with a verdict
+func TestConfidenceBreakdown(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	body := strings.Repeat("Your account has been suspended after unusual activity. Verify your identity within 24 hours "+
+		"by logging in with the secure link below or the account will be closed. ", 3)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	for i := 0; i < 2; i++ {
+		learnSpamHash(sig, 1, SigNormalized)
+	}
+
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <cb@x>\r\n\r\n" + body))
+	res := analyzeEnvelope(context.Background(), env).Result
+	b := res.ConfidenceBreakdown
+	if res.Label != "local_spam" || b == nil {
+		t.Fatalf("expected a local match with a breakdown, got %+v", res)
+	}
+	if b.Distance == nil || *b.Distance != res.Confidence {
+		t.Errorf("distance signal should equal the distance confidence %v, got %v", res.Confidence, b.Distance)
+	}
+	if b.BandRatio == nil || *b.BandRatio != 1 {
+		t.Errorf("identical signature should match every band, got %v", b.BandRatio)
+	}
+	if b.ScoreMagnitude == nil || *b.ScoreMagnitude != 2.0/scoreSaturation {
+		t.Errorf("score signal should reflect 2 reports, got %v", b.ScoreMagnitude)
+	}
+	if b.Recency == nil || *b.Recency < 0.99 {
+		t.Errorf("just-learned hash should be fresh, got %v", b.Recency)
+	}
+
+	// Oracle partial matches only carry the band ratio
+	withConfig(t, map[string]string{"PARTIAL_MATCH_ACTION": "soft_spam"})
+	partial := AnalysisResult{Action: "allow"}
+	applyPartialMatch(&partial, 5, 20, SigNormalized)
+	if pb := partial.ConfidenceBreakdown; pb == nil || pb.Distance != nil || *pb.BandRatio != 0.25 {
+		t.Errorf("unexpected partial match breakdown %+v", pb)
+	}
+	if got := newBreakdown(0.5, 1, 2).withRecency(time.Now().Add(-time.Hour).Unix(), 2*time.Hour); *got.Recency < 0.49 || *got.Recency > 0.51 {
+		t.Errorf("recency halfway through the lifetime should be 0.5, got %v", *got.Recency)
+	}
+	rr := httptest.NewRecorder()
+	writeAnalyzeResponse(rr, scanOutcome{Result: res})
+	if !strings.Contains(rr.Body.String(), `"confidence_breakdown":{"distance":1,"band_ratio":1`) {
+		t.Errorf("response should include the breakdown, got %s", rr.Body.String())
+	}
+}
+
+// TestAltPartMismatch checks the text vs HTML alternative divergence heuristic
+func TestAltPartMismatch(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ALTPART_MISMATCH_CHECK": "true"})
+
+	newsletter := strings.Repeat("Hi team, the quarterly planning meeting moves to Thursday at ten. "+
+		"Please update your calendars and bring the budget figures for your department. ", 3)
+	phish := strings.Repeat("Your mailbox password expires today. Click here to keep your account active "+
+		"and enter your current password to confirm ownership, otherwise all messages will be lost. ", 3)
+	message := func(text, html string) *enmime.Envelope {
+		raw := "From: a@example.com\r\nMessage-ID: <alt@x>\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + text + "\r\n" +
+			"--b\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" + html + "\r\n--b--\r\n"
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env
+	}
+
+	consistent := analyzeEnvelope(context.Background(), message(newsletter, "<html><body><p>"+newsletter+"</p></body></html>"))
+	if consistent.AltPartDistance == nil || *consistent.AltPartDistance > 150 || consistent.Result.Action != "allow" {
+		t.Errorf("matching alternatives should not be flagged, got %+v (distance %v)", consistent.Result, consistent.AltPartDistance)
+	}
+
+	mismatch := analyzeEnvelope(context.Background(), message(newsletter, "<html><style>p{}</style><body><p>"+phish+"</p></body></html>"))
+	if mismatch.Result.Action != "soft_spam" || mismatch.Result.Label != "altpart_mismatch" || mismatch.Result.ReasonCode != ReasonAltPartMismatch {
+		t.Errorf("diverging alternatives should be soft_spam, got %+v (distance %v)", mismatch.Result, mismatch.AltPartDistance)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/explain", strings.NewReader("From: a@example.com\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/alternative; boundary=\"b\"\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\n"+newsletter+
+		"\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>"+phish+"</p>\r\n--b--\r\n"))
+	explainHandler(rr, req)
+	if !strings.Contains(rr.Body.String(), `"altpart_distance":`) {
+		t.Errorf("/explain should expose the divergence distance, got %s", rr.Body.String())
+	}
+
+	// Single-part messages have nothing to compare
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\n\r\n" + phish))
+	if got := altPartDistance(env); got != -1 {
+		t.Errorf("single-part message should not be compared, got %d", got)
+	}
+}
+
+// TestPerTypeWeights checks per-signature-type report weights
+func TestPerTypeWeights(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"SPAM_WEIGHT": "1", "HAM_WEIGHT": "2", "SPAM_WEIGHT_URL": "3", "HAM_WEIGHT_URL": "1"})
+
+	urlSig, _ := computeLocalTLSH(strings.Repeat("https://secure-login.example-bank.test/verify?account=update\n", 5))
+	bodySig, _ := computeLocalTLSH(strings.Repeat("Dear customer, your account needs to be verified before the end of the week. ", 4))
+	learnFromReport([]TypedSignature{{Hash: urlSig, Type: SigURL}, {Hash: bodySig, Type: SigNormalized}}, "spam", "")
+
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+urlSig).Int(); score != 3 {
+		t.Errorf("URL report should apply SPAM_WEIGHT_URL, score %d", score)
+	}
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+bodySig).Int(); score != 1 {
+		t.Errorf("normalized report should apply the global weight, score %d", score)
+	}
+
+	learnFromReport([]TypedSignature{{Hash: urlSig, Type: SigURL}, {Hash: bodySig, Type: SigNormalized}}, "ham", "")
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+urlSig).Int(); score != 2 {
+		t.Errorf("URL ham report should apply HAM_WEIGHT_URL, score %d", score)
+	}
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+bodySig).Int(); score != -1 {
+		t.Errorf("normalized ham report should apply the global weight, score %d", score)
+	}
+	if got := getSpamWeightForType(SigUnknown); got != 1 {
+		t.Errorf("untyped signatures should use the global weight, got %d", got)
+	}
+}
+
+// TestOracleCacheMinConfidence checks the confidence gate on oracle-cache proximity verdicts
+func TestOracleCacheMinConfidence(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your parcel could not be delivered because the customs fee is unpaid. "+
+		"Please confirm your address and pay the small fee within two days to avoid the return of the package. ", 3)
+	cachedSig, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	data, _ := json.Marshal(AnalysisResult{Action: "spam", Label: "oracle", CachedAt: time.Now().Unix(), SchemaVersion: currentVerdictSchemaVersion()})
+	rdb.Set(ctx, "mi:oracle_cache:"+cachedSig, data, time.Hour)
+	for _, band := range extractBands_6_3(cachedSig) {
+		rdb.SAdd(ctx, OracleCacheFragPrefix+band, cachedSig)
+	}
+
+	variant := strings.Replace(base, "two days", "three days", -1)
+	variantSig, _ := computeLocalTLSH(normalizeEmailBody(variant, ""))
+	dist, _ := computeDistance(cachedSig, variantSig, false, 0)
+	confidence := getConfidenceForMatch(dist, getThresholdForType(SigNormalized))
+	percent := int(confidence * 100) // Truncated: the match is at or just above this percentage
+
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <occ@x>\r\n\r\n" + variant))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	withConfig(t, map[string]string{"ORACLE_CACHE_MIN_CONFIDENCE": fmt.Sprint(percent)})
+	if res := analyze(); res.Action != "spam" || res.Label != "oracle_cache_match" {
+		t.Errorf("match at %.3f should pass a %d%% gate, got %+v", confidence, percent, res)
+	}
+	withConfig(t, map[string]string{"ORACLE_CACHE_MIN_CONFIDENCE": fmt.Sprint(percent + 1)})
+	res := analyze()
+	if res.Action != "soft_spam" || res.Label != "oracle_cache_soft" || res.Confidence != confidence {
+		t.Errorf("match at %.3f should be soft_spam under a %d%% gate, got %+v", confidence, percent+1, res)
+	}
+
+	withConfig(t, map[string]string{"ORACLE_CACHE_MIN_CONFIDENCE": "90"})
+	if !meetsOracleCacheMinConfidence(0.90) || meetsOracleCacheMinConfidence(0.8999) {
+		t.Error("gate should be inclusive at the configured confidence")
+	}
+}
+
+// TestOracleCacheWarmStart checks that a startup snapshot fills the oracle proximity cache
+func TestOracleCacheWarmStart(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your parcel could not be delivered because the customs fee is unpaid. "+
+		"Please confirm your address and pay the small fee within two days to avoid the return of the package. ", 3)
+	spamSig, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	expiredSig, _ := computeLocalTLSH(normalizeEmailBody(strings.Repeat("An older campaign that left the cache a while ago, nothing to see. ", 4), ""))
+	now := time.Now()
+
+	var requests int32
+	var limit int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/snapshot" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		var payload struct {
+			Limit int64 `json:"limit"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		limit = payload.Limit
+		json.NewEncoder(w).Encode(snapshotResponse{Signatures: []snapshotEntry{
+			{Hash: spamSig, Type: "normalized", Label: "parcel_scam", Brand: "DHL", SeenAt: now.Add(-10 * time.Minute).Unix()},
+			{Hash: expiredSig, SeenAt: now.Add(-2 * oracleSpamCacheDuration).Unix()},
+			{Hash: "not-a-signature"},
+			{Hash: "T1" + strings.Repeat("ZZ", 35)}, // TLSH-shaped but not hex
+		}})
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	// Off by default
+	warmOracleCache()
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Fatal("no snapshot should be requested without ORACLE_CACHE_WARM_START")
+	}
+
+	withConfig(t, map[string]string{"ORACLE_CACHE_WARM_START": "true", "ORACLE_CACHE_WARM_START_LIMIT": "500"})
+	warmOracleCache()
+	if atomic.LoadInt32(&requests) != 1 || limit != 500 {
+		t.Fatalf("expected one snapshot request with limit 500, got %d requests (limit %d)", requests, limit)
+	}
+	if n, _ := rdb.Exists(ctx, "mi:oracle_cache:"+expiredSig).Result(); n != 0 {
+		t.Error("expired snapshot entries should not be cached")
+	}
+	if n, _ := rdb.Exists(ctx, "mi:oracle_cache:T1"+strings.Repeat("ZZ", 35)).Result(); n != 0 {
+		t.Error("invalid TLSH digests should not be cached")
+	}
+	ttl := rdb.TTL(ctx, "mi:oracle_cache:"+spamSig).Val()
+	if ttl <= 0 || ttl > oracleSpamCacheDuration-9*time.Minute {
+		t.Errorf("snapshot entry should be cached for its remaining lifetime, TTL %s", ttl)
+	}
+	for _, band := range signatureBands(spamSig) {
+		if ok, _ := rdb.SIsMember(ctx, OracleCacheFragPrefix+band, spamSig).Result(); !ok {
+			t.Fatalf("band %s of the snapshot signature should be indexed", band)
+		}
+	}
+
+	// A variant now matches by proximity, without any oracle call
+	variant := strings.Replace(base, "two days", "three days", -1)
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <warm@x>\r\n\r\n" + variant))
+	res := analyzeEnvelope(context.Background(), env).Result
+	if res.Action != "spam" || res.Label != "oracle_cache_match" || res.CachedAt != now.Add(-10*time.Minute).Unix() {
+		t.Errorf("variant should match the warmed cache, got %+v", res)
+	}
+
+	// Signatures queried since the snapshot keep their live verdict
+	live, _ := json.Marshal(AnalysisResult{Action: "spam", Label: "live", SchemaVersion: currentVerdictSchemaVersion()})
+	rdb.Set(ctx, "mi:oracle_cache:"+spamSig, live, time.Hour)
+	if n := applyOracleSnapshot(snapshotResponse{Signatures: []snapshotEntry{{Hash: spamSig}}}, now); n != 0 {
+		t.Errorf("a live cache entry should not be replaced, %d cached", n)
+	}
+	if res, _ := cachedOracleVerdict("mi:oracle_cache:" + spamSig); res.Label != "live" {
+		t.Errorf("live verdict overwritten: %+v", res)
+	}
+}
+
+// TestHamSampling checks which verdicts are sampled, the batch sent to the oracle and the /config disclosure
+func TestHamSampling(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+	hamSampleBuffer = nil
+	t.Cleanup(func() { hamSampleBuffer = nil })
+
+	var reported struct {
+		Signatures []string `json:"signatures"`
+		ReportType string   `json:"report_type"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/report" {
+			json.NewDecoder(r.Body).Decode(&reported)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	body := strings.Repeat("Hello, here is the document we talked about during the call yesterday afternoon. ", 4)
+	analyze := func(headers string) scanOutcome {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <hs@x>\r\n" + headers + "\r\n" + body))
+		return analyzeEnvelope(context.Background(), env)
+	}
+	subject := "Subject: Notes and the document from yesterday's planning call\r\n"
+
+	// Off by default
+	analyze(subject)
+	if len(hamSampleBuffer) != 0 {
+		t.Fatal("nothing should be sampled without HAM_SAMPLE_RATE")
+	}
+
+	withConfig(t, map[string]string{"HAM_SAMPLE_RATE": "1"})
+	outcome := analyze(subject)
+	var normalized string
+	for _, ts := range outcome.Signatures {
+		if ts.Type == SigNormalized {
+			normalized = ts.Hash
+		}
+	}
+	if normalized == "" || len(hamSampleBuffer) != 1 || hamSampleBuffer[0] != normalized {
+		t.Fatalf("expected the normalized signature only to be sampled, got %v", hamSampleBuffer)
+	}
+
+	// Flagged or whitelisted messages are never sampled
+	withConfig(t, map[string]string{"HAM_SAMPLE_RATE": "1", "EMPTY_SUBJECT_CHECK": "true"})
+	if res := analyze("").Result; res.Action != "soft_spam" || len(hamSampleBuffer) != 1 {
+		t.Errorf("soft_spam verdicts should not be sampled, got %+v with %d samples", res, len(hamSampleBuffer))
+	}
+	rdb.SAdd(ctx, "mi:whitelist:domain", "example.com")
+	analyze(subject)
+	rdb.SRem(ctx, "mi:whitelist:domain", "example.com")
+	if len(hamSampleBuffer) != 1 {
+		t.Error("whitelisted senders should not be sampled")
+	}
+
+	// Local-only types are never contributed, even when listed
+	withConfig(t, map[string]string{"HAM_SAMPLE_RATE": "1", "HAM_SAMPLE_TYPES": "normalized,subject", "ORACLE_LOCAL_ONLY_TYPES": "normalized"})
+	if got := hamSampleSignatures(currentHamSampleConfig(), outcome.Signatures); len(got) != 1 || got[0] == normalized {
+		t.Errorf("expected the subject signature only, got %v", got)
+	}
+
+	before := testutil.ToFloat64(promHamSamples.WithLabelValues("contributed"))
+	if n, err := flushHamSamples(); err != nil || n != 1 {
+		t.Fatalf("flush: %d, %v", n, err)
+	}
+	if reported.ReportType != hamObservationReport || len(reported.Signatures) != 1 || reported.Signatures[0] != normalized {
+		t.Errorf("unexpected ham observation report: %+v", reported)
+	}
+	if got := testutil.ToFloat64(promHamSamples.WithLabelValues("contributed")) - before; got != 1 {
+		t.Errorf("expected 1 contributed sample counted, got %v", got)
+	}
+	if n, _ := flushHamSamples(); n != 0 || len(hamSampleBuffer) != 0 {
+		t.Error("the buffer should be empty after a flush")
+	}
+
+	rr := httptest.NewRecorder()
+	configHandler(rr, httptest.NewRequest("GET", "/config", nil))
+	var cfg struct {
+		Contribution struct {
+			HamSampling struct {
+				Enabled bool     `json:"enabled"`
+				Rate    float64  `json:"rate"`
+				Types   []string `json:"types"`
+			} `json:"ham_sampling"`
+		} `json:"oracle_contribution"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &cfg)
+	if hs := cfg.Contribution.HamSampling; !hs.Enabled || hs.Rate != 1 || len(hs.Types) != 1 || hs.Types[0] != "subject" {
+		t.Errorf("unexpected /config disclosure: %s", rr.Body.String())
+	}
+
+	withConfig(t, map[string]string{"HAM_SAMPLE_RATE": "1.5"})
+	if currentHamSampleConfig().Rate != 0 {
+		t.Error("an invalid rate should disable sampling")
+	}
+}
+
+func TestOracleMalformedResponse(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	var calls int32
+	var garbage, unavailable atomic.Bool
+	var delay atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Duration(delay.Load()))
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if garbage.Load() {
+			w.Write([]byte("<html>502 Bad Gateway</html>"))
+			return
+		}
+		w.Write([]byte(`{"result":{"action":"spam","label":"phishing"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	query := func(sig string) AnalysisResult {
+		atomic.StoreInt32(&calls, 0)
+		return callOracleDecision(context.Background(), sig)
+	}
+
+	garbage.Store(true)
+	before := testutil.ToFloat64(promOracleMalformed.WithLabelValues("decode"))
+	if res := query("sig-allow"); res.Action != "allow" {
+		t.Errorf("a malformed response should allow by default, got %+v", res)
+	}
+	if got := testutil.ToFloat64(promOracleMalformed.WithLabelValues("decode")) - before; got != 1 {
+		t.Errorf("expected 1 malformed response counted, got %v", got)
+	}
+	if n, _ := rdb.Exists(ctx, "mi:oracle_cache:sig-allow").Result(); n != 0 {
+		t.Error("a malformed response should not be cached")
+	}
+
+	withConfig(t, map[string]string{"ORACLE_MALFORMED_RETRIES": "2", "ORACLE_MALFORMED_ACTION": "soft_spam"})
+	if res := query("sig-soft"); res.Action != "soft_spam" || res.Label != "oracle_malformed" || reasonCodeFor(res) != ReasonOracleMalformed {
+		t.Errorf("expected a soft_spam verdict, got %+v", res)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+
+	// Error statuses are outages, not malformed answers: no retry, no malformed verdict
+	unavailable.Store(true)
+	if res := query("sig-503"); res.Action != "allow" || res.Label != "" {
+		t.Errorf("an unavailable oracle should allow, got %+v", res)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("an error status should not be retried, got %d attempts", got)
+	}
+	unavailable.Store(false)
+
+	// Retries stop at the request deadline
+	withConfig(t, map[string]string{"ORACLE_MALFORMED_RETRIES": "20"})
+	delay.Store(int64(40 * time.Millisecond))
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+	start := time.Now()
+	callOracleDecision(reqCtx, "sig-deadline")
+	cancel()
+	if elapsed, got := time.Since(start), atomic.LoadInt32(&calls); elapsed > 500*time.Millisecond || got > 3 {
+		t.Errorf("retries should stop at the request deadline, took %v for %d attempts", elapsed, got)
+	}
+	delay.Store(0)
+	withConfig(t, map[string]string{"ORACLE_MALFORMED_RETRIES": "2"})
+
+	// last_known: the last valid verdict outlives the oracle cache
+	withConfig(t, map[string]string{"ORACLE_MALFORMED_ACTION": "last_known"})
+	garbage.Store(false)
+	if res := query("sig-known"); res.Action != "spam" {
+		t.Fatalf("expected the oracle spam verdict, got %+v", res)
+	}
+	rdb.Del(ctx, "mi:oracle_cache:sig-known")
+	garbage.Store(true)
+	if res := query("sig-known"); res.Action != "spam" || res.Label != "phishing" {
+		t.Errorf("expected the last known verdict, got %+v", res)
+	}
+	if res := query("sig-unknown"); res.Action != "allow" {
+		t.Errorf("without a last known verdict, expected allow, got %+v", res)
+	}
+
+	withConfig(t, map[string]string{"ORACLE_MALFORMED_ACTION": "block"})
+	if got := getOracleMalformedAction(); got != MalformedActionAllow {
+		t.Errorf("an invalid action should fall back to allow, got %s", got)
+	}
+}
+
+// TestQueueMode checks the Redis Streams consumer end to end
+func TestQueueMode(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"VERDICT_LOG_FORMAT": "leef"})
+	var logged bytes.Buffer
+	siemLogger.SetOutput(&logged)
+	defer siemLogger.SetOutput(os.Stdout)
+	previousNode := nodeID
+	nodeID = "test-node"
+	defer func() { nodeID = previousNode }()
+
+	body := strings.Repeat("Limited offer: replica handbags at ninety percent off, free express shipping worldwide today. ", 3)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	learnFromReport([]TypedSignature{{Hash: sig, Type: SigNormalized}}, "spam", "")
+
+	if err := ensureQueueGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureQueueGroup(); err != nil {
+		t.Fatalf("existing group should be reused: %v", err)
+	}
+	in, out, group := queueStreams()
+	rdb.XAdd(ctx, &redis.XAddArgs{Stream: in, Values: map[string]interface{}{
+		"id": "job-1", "message": "From: a@example.com\r\nMessage-ID: <q1@x>\r\n\r\n" + body,
+	}})
+	rdb.XAdd(ctx, &redis.XAddArgs{Stream: in, Values: map[string]interface{}{
+		"message": "From: b@example.com\r\nMessage-ID: <q2@x>\r\n\r\nHello, lunch at noon?",
+	}})
+	rdb.XAdd(ctx, &redis.XAddArgs{Stream: in, Values: map[string]interface{}{"id": "job-3"}})
+
+	if n, err := processQueueBatch(false, -1); err != nil || n != 3 {
+		t.Fatalf("expected 3 processed entries, got %d (%v)", n, err)
+	}
+	if n, _ := processQueueBatch(false, -1); n != 0 {
+		t.Errorf("queue should be drained, got %d", n)
+	}
+	if pending, _ := rdb.XPending(ctx, in, group).Result(); pending.Count != 0 {
+		t.Errorf("processed entries should be acknowledged, %d pending", pending.Count)
+	}
+
+	verdicts, _ := rdb.XRange(ctx, out, "-", "+").Result()
+	if len(verdicts) != 3 {
+		t.Fatalf("expected 3 verdicts, got %d", len(verdicts))
+	}
+	spam := verdicts[0].Values
+	if spam["id"] != "job-1" || spam["message_id"] != "<q1@x>" || spam["action"] != "spam" ||
+		!strings.Contains(spam["verdict"].(string), `"reason_code":"LOCAL_SPAM"`) {
+		t.Errorf("unexpected spam verdict %v", spam)
+	}
+	if clean := verdicts[1].Values; clean["action"] != "allow" || clean["id"] == "" || clean["message_id"] != "<q2@x>" {
+		t.Errorf("unexpected clean verdict %v", clean)
+	}
+	if bad := verdicts[2].Values; bad["id"] != "job-3" || bad["error"] != "Invalid MIME" {
+		t.Errorf("missing message should report an error, got %v", bad)
+	}
+	if lines := strings.Count(logged.String(), "LEEF:1.0|"); lines != 2 || !strings.Contains(logged.String(), "messageId=q1@x") {
+		t.Errorf("queue verdicts should reach the verdict log, got %q", logged.String())
+	}
+}
+
+// TestKnownBadAttachment checks the exact SHA-256 attachment check, its admin API and feed
+func TestKnownBadAttachment(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret", "BAD_ATTACHMENT_CHECK": "true"})
+
+	payload := "MZ fake dropper payload"
+	sum := sha256.Sum256([]byte(payload))
+	badHash := hex.EncodeToString(sum[:])
+	raw := "From: a@example.com\r\nMessage-ID: <att@x>\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPlease see the attached invoice.\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"invoice.exe\"\r\n\r\n" +
+		payload + "\r\n--b--\r\n"
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+	handler := requireAdmin(adminBadAttachmentHandler)
+	call := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/badhash/attachment", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if res := analyze(); res.Action != "allow" {
+		t.Fatalf("unknown attachment should be allowed, got %+v", res)
+	}
+	if rr := call("POST", `{"hashes":["not-a-hash"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid hash should return 400, got %d", rr.Code)
+	}
+	if rr := call("POST", `{"hashes":["`+strings.ToUpper(badHash)+`"]}`); rr.Code != http.StatusOK {
+		t.Fatalf("adding a hash failed: %d", rr.Code)
+	}
+	before := testutil.ToFloat64(promBadAttachmentHits)
+	if res := analyze(); res.Action != "spam" || res.ReasonCode != ReasonBadAttachment || res.Confidence != 1.0 {
+		t.Errorf("known bad attachment should be spam, got %+v", res)
+	}
+	if testutil.ToFloat64(promBadAttachmentHits) != before+1 {
+		t.Error("hit should be counted")
+	}
+	// The scan is stored all the same, so the message can be reported
+	sum1 := sha1.Sum([]byte("<att@x>"))
+	scanKey := "mi:msgid:" + hex.EncodeToString(sum1[:])
+	for i := 0; i < 50 && rdb.Exists(ctx, scanKey).Val() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rdb.Exists(ctx, scanKey).Val() == 0 {
+		t.Error("scan of a known bad attachment should be stored")
+	}
+	if rr := call("GET", ""); !strings.Contains(rr.Body.String(), badHash) {
+		t.Errorf("GET should list the hash, got %s", rr.Body.String())
+	}
+	call("DELETE", `{"hashes":["`+badHash+`"]}`)
+	if res := analyze(); res.Action != "allow" {
+		t.Errorf("removed hash should no longer match, got %+v", res)
+	}
+
+	// The feed fills its own set and survives alongside manual entries
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# known bad\n%s  invoice.exe\nnot-a-hash\n\n", badHash)
+	}))
+	defer feed.Close()
+	if n, err := refreshBadAttachmentFeed(feed.URL); err != nil || n != 1 {
+		t.Fatalf("feed refresh: %d hashes (%v)", n, err)
+	}
+	if res := analyze(); res.Label != "known_bad_attachment" {
+		t.Errorf("feed hash should match, got %+v", res)
+	}
+	if rr := call("GET", ""); !strings.Contains(rr.Body.String(), `"feed_count":1`) {
+		t.Errorf("GET should count feed entries, got %s", rr.Body.String())
+	}
+
+	withConfig(t, map[string]string{"BAD_ATTACHMENT_CHECK": "false"})
+	if res := analyze(); res.Action != "allow" {
+		t.Errorf("disabled check should allow, got %+v", res)
+	}
+}
+
+func TestDangerousAttachment(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	exts := loadDangerousExtensions()
+	tests := []struct {
+		filename string
+		want     string // Detail, "" when not flagged
+	}{
+		{`"report.pdf"`, ""},
+		{`"setup.EXE"`, "setup.EXE"},
+		{`"invoice.pdf.exe"`, "invoice.pdf.exe (double extension)"},
+		{`"invoice.pdf   .scr"`, "invoice.pdf   .scr (double extension)"},
+		{`"archive.tar.js"`, "archive.tar.js (double extension)"},
+		{`"payment.exe."`, "payment.exe. (disguised name)"},
+		{`"C:\\Users\\x\\run.bat"`, "run.bat"},
+		{`"=?UTF-8?B?ZmFjdHVyZS5kb2N4LnZicw==?="`, "facture.docx.vbs (double extension)"},
+		{"*=UTF-8''invoice%E2%80%AEfdp.exe", "invoicefdp.exe (disguised name)"},
+		{`"notes.2024.txt"`, ""},
+	}
+	for _, tt := range tests {
+		param := "filename=" + tt.filename
+		if strings.HasPrefix(tt.filename, "*") {
+			param = "filename" + tt.filename
+		}
+		raw := "From: a@example.com\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; " + param + "\r\n\r\nxx\r\n--b--\r\n"
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		sig, ok := checkDangerousAttachment(env, exts)
+		if ok != (tt.want != "") || sig.Detail != tt.want {
+			t.Errorf("%s: got %q (%v), want %q", tt.filename, sig.Detail, ok, tt.want)
+		}
+	}
+
+	raw := "From: a@example.com\r\nSubject: Your invoice\r\nMessage-ID: <da@x>\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPlease find the invoice attached.\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"invoice.pdf.exe\"\r\n\r\nMZ\r\n--b--\r\n"
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	if res := analyze(); res.Action != "allow" {
+		t.Fatalf("the check should be off by default, got %+v", res)
+	}
+	withConfig(t, map[string]string{"DANGEROUS_ATTACHMENT_ACTION": "soft_spam"})
+	if res := analyze(); res.Action != "soft_spam" || res.ReasonCode != ReasonDangerousFile {
+		t.Errorf("expected soft_spam, got %+v", res)
+	}
+	withConfig(t, map[string]string{"DANGEROUS_ATTACHMENT_ACTION": "spam"})
+	time.Sleep(20 * time.Millisecond) // Let the soft_spam scan be stored before clearing it
+	rdb.FlushAll(ctx)
+	if res := analyze(); res.Action != "spam" || res.Label != "dangerous_attachment" || res.Confidence != 1.0 {
+		t.Errorf("expected spam, got %+v", res)
+	}
+	// The scan is stored all the same, so the message can be reported
+	sum := sha1.Sum([]byte("<da@x>"))
+	scanKey := "mi:msgid:" + hex.EncodeToString(sum[:])
+	for i := 0; i < 50 && rdb.Exists(ctx, scanKey).Val() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rdb.Exists(ctx, scanKey).Val() == 0 {
+		t.Error("scan of a dangerous attachment judged spam should be stored")
+	}
+	withConfig(t, map[string]string{"DANGEROUS_ATTACHMENT_ACTION": "spam", "DANGEROUS_EXTENSIONS": ".scr, .vbs"})
+	if res := analyze(); res.Action != "allow" {
+		t.Errorf("exe is not listed, expected allow, got %+v", res)
+	}
+}
+
+// TestRecencyWeightedScores compares fresh and stale learning under REPORT_HALF_LIFE
+func TestRecencyWeightedScores(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"REPORT_HALF_LIFE": "72h"})
+
+	base := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	learned, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	learnSpamHash(learned, 2, SigNormalized)
+	variant := strings.Replace(base, "now", "today", 1)
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: it@example.com\r\nMessage-ID: <rw@x>\r\n\r\n" + variant))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+	inspect := func() map[string]interface{} {
+		rr := httptest.NewRecorder()
+		learningInspectHandler(rr, httptest.NewRequest("GET", "/learning/inspect?hash="+url.QueryEscape(learned), nil))
+		var body map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return body
+	}
+
+	// Fresh report: full weight
+	if w := weightedLocalScore(learned, 2); w < 1.99 || w > 2 {
+		t.Errorf("fresh report should keep its weight, got %.3f", w)
+	}
+	if res := analyze(); res.Action != "spam" || res.Label != "local_spam" {
+		t.Fatalf("fresh learning should block, got %+v", res)
+	}
+	if body := inspect(); body["reports"] != 1.0 || body["trusted"] != true || body["score"] != 2.0 {
+		t.Errorf("unexpected inspect output for a fresh hash: %v", body)
+	}
+
+	// Same report a week ago: 2 * 0.5^(168/72) ≈ 0.4, below the 0.5 floor
+	weekAgo := time.Now().Add(-7 * 24 * time.Hour)
+	rdb.Del(ctx, LocalReportsPrefix+learned)
+	rdb.ZAdd(ctx, LocalReportsPrefix+learned, &redis.Z{Score: float64(weekAgo.Unix()), Member: fmt.Sprintf("%d:2", weekAgo.UnixNano())})
+	if w := weightedLocalScore(learned, 2); w < 0.39 || w > 0.41 {
+		t.Errorf("week-old report should have decayed to ~0.4, got %.3f", w)
+	}
+	if res := analyze(); res.Action == "spam" {
+		t.Errorf("stale learning should no longer block, got %+v", res)
+	}
+	if body := inspect(); body["trusted"] != false || body["weighted_score"] != 0.397 || body["last_report"] != float64(weekAgo.Unix()) {
+		t.Errorf("unexpected inspect output for a stale hash: %v", body)
+	}
+
+	// A fresh report brings it back; a fresh ham report outweighs it again
+	learnSpamHash(learned, 1, SigNormalized)
+	if !localScoreTrusted(learned, 3) {
+		t.Error("fresh report should restore trust")
+	}
+	pipe := rdb.Pipeline()
+	recordReport(pipe, learned, -2, time.Hour)
+	pipe.Exec(ctx)
+	if localScoreTrusted(learned, 1) {
+		t.Error("fresh ham report should outweigh a stale spam report")
+	}
+
+	// Weighting disabled: the raw score decides
+	withConfig(t, map[string]string{"REPORT_HALF_LIFE": "0"})
+	if !localScoreTrusted(learned, 1) || localScoreTrusted(learned, 0) {
+		t.Error("without a half-life only the raw score should matter")
+	}
+
+	// Unknown hash
+	rr := httptest.NewRecorder()
+	learningInspectHandler(rr, httptest.NewRequest("GET", "/learning/inspect?hash=nope", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown hash should return 404, got %d", rr.Code)
+	}
+
+	// Admin only
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+	rr = httptest.NewRecorder()
+	requireAdmin(learningInspectHandler)(rr, httptest.NewRequest("GET", "/learning/inspect?hash="+url.QueryEscape(learned), nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated inspection should be refused, got %d", rr.Code)
+	}
+}
+
+// TestEmojiNormalization checks that emoji variation doesn't change body and subject hashes
+func TestEmojiNormalization(t *testing.T) {
+	useMiniredis(t)
+
+	if got := normalizeEmoji("Win 🎁🎉 big 👍🏽 now 👨‍👩‍👧 ❤️ ok"); got != "Win [emoji] big [emoji] now [emoji] [emoji] ok" {
+		t.Errorf("unexpected normalization: %q", got)
+	}
+	if got := normalizeEmoji("a <b>x = 1 + 2</b> naïve"); got != "a <b>x = 1 + 2</b> naïve" {
+		t.Errorf("text, markup and math symbols must be kept, got %q", got)
+	}
+
+	body := func(e1, e2 string) string {
+		return strings.Repeat("Congratulations "+e1+" you have been selected for an exclusive reward, claim it "+e2+" before midnight tonight. ", 4)
+	}
+	subjectA := "🔥🔥 Exclusive reward waiting for you, claim it now 🎁"
+	subjectB := "💥 Exclusive reward waiting for you, claim it now 🎉🎉🎉"
+	sigs := func(subject, b string) map[SignatureType]string {
+		raw := "From: promo@example.com\r\nMessage-ID: <e@x>\r\nSubject: " + mime.QEncoding.Encode("utf-8", subject) +
+			"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + b
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		out := map[SignatureType]string{}
+		for _, ts := range scanEnvelope(context.Background(), env).Signatures {
+			out[ts.Type] = ts.Hash
+		}
+		return out
+	}
+
+	a, b := sigs(subjectA, body("🎉", "⏰")), sigs(subjectB, body("🤑🤑", "⌛"))
+	if a[SigNormalized] == b[SigNormalized] || a[SigSubject] == b[SigSubject] {
+		t.Fatal("fixture: emoji variants should hash differently without normalization")
+	}
+
+	withConfig(t, map[string]string{"EMOJI_NORMALIZE": "true"})
+	a, b = sigs(subjectA, body("🎉", "⏰")), sigs(subjectB, body("🤑🤑", "⌛"))
+	if a[SigNormalized] == "" || a[SigNormalized] != b[SigNormalized] {
+		t.Errorf("emoji-varied bodies should share the normalized hash: %s vs %s", a[SigNormalized], b[SigNormalized])
+	}
+	if a[SigSubject] == "" || a[SigSubject] != b[SigSubject] {
+		t.Errorf("emoji-varied subjects should share the subject hash: %s vs %s", a[SigSubject], b[SigSubject])
+	}
+
+	// Emoji-heavy spam keeps its own fingerprint: the placeholders are part of the content
+	plain := sigs("Exclusive reward waiting for you, claim it now", body("", ""))
+	if plain[SigNormalized] == a[SigNormalized] {
+		t.Error("removing the emoji entirely should still change the hash")
+	}
+}
+
+// TestListConflictPolicy checks each precedence policy for senders on both lists
+func TestListConflictPolicy(t *testing.T) {
+	useMiniredis(t)
+
+	rdb.SAdd(ctx, "mi:whitelist:domain", "partner.example")
+	rdb.SAdd(ctx, "mi:blacklist:email", "rogue@partner.example")
+	rdb.SAdd(ctx, "mi:blacklist:domain", "bulk.example")
+	rdb.SAdd(ctx, "mi:whitelist:email", "ceo@bulk.example")
+	rdb.SAdd(ctx, "mi:whitelist:domain", "both.example")
+	rdb.SAdd(ctx, "mi:blacklist:domain", "both.example")
+
+	verdict := func(from string) string {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: " + from + "\r\nMessage-ID: <l@x>\r\n\r\nHello there"))
+		return analyzeEnvelope(context.Background(), env).Result.Label
+	}
+	cases := []struct {
+		from                                       string
+		mostSpecific, blacklistWins, whitelistWins string
+	}{
+		{"Rogue <rogue@partner.example>", "blacklisted", "blacklisted", "whitelisted"}, // email black, domain white
+		{"ceo@bulk.example", "whitelisted", "blacklisted", "whitelisted"},              // email white, domain black
+		{"info@both.example", "blacklisted", "blacklisted", "whitelisted"},             // tie at domain level
+		{"sales@bulk.example", "blacklisted", "blacklisted", "blacklisted"},            // blacklist only
+		{"team@partner.example", "whitelisted", "whitelisted", "whitelisted"},          // whitelist only
+	}
+	for _, policy := range []string{ListConflictMostSpecific, ListConflictBlacklistWins, ListConflictWhitelistWins} {
+		withConfig(t, map[string]string{"LIST_CONFLICT_POLICY": policy})
+		for _, c := range cases {
+			want := map[string]string{ListConflictMostSpecific: c.mostSpecific, ListConflictBlacklistWins: c.blacklistWins, ListConflictWhitelistWins: c.whitelistWins}[policy]
+			if got := verdict(c.from); got != want {
+				t.Errorf("%s: %s should be %s, got %s", policy, c.from, want, got)
+			}
+		}
+	}
+
+	// The default is most_specific_wins
+	withConfig(t, map[string]string{"LIST_CONFLICT_POLICY": ""})
+	if getListConflictPolicy() != ListConflictMostSpecific {
+		t.Errorf("unexpected default policy %s", getListConflictPolicy())
+	}
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: rogue@partner.example\r\nMessage-ID: <l@x>\r\n\r\nHello there"))
+	if res := analyzeEnvelope(context.Background(), env).Result; res.Action != "spam" || res.ReasonCode != ReasonBlacklisted {
+		t.Errorf("blacklisted sender should be spam, got %+v", res)
+	}
+
+	// Admin endpoint
+	req := httptest.NewRequest("POST", "/blacklist", strings.NewReader(`{"type":"domain","value":" Spam.Example "}`))
+	rr := httptest.NewRecorder()
+	blacklistHandler(rr, req)
+	if rr.Code != http.StatusOK || !rdb.SIsMember(ctx, "mi:blacklist:domain", "spam.example").Val() {
+		t.Errorf("POST /blacklist should add the domain, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	blacklistHandler(rr, httptest.NewRequest("DELETE", "/blacklist", strings.NewReader(`{"type":"domain","value":"spam.example"}`)))
+	if rdb.SIsMember(ctx, "mi:blacklist:domain", "spam.example").Val() {
+		t.Error("DELETE /blacklist should remove the domain")
+	}
+	rr = httptest.NewRecorder()
+	requireAdmin(blacklistHandler)(rr, httptest.NewRequest("POST", "/blacklist", strings.NewReader(`{"type":"domain","value":"rival.example"}`)))
+	if rr.Code == http.StatusOK || rdb.SIsMember(ctx, "mi:blacklist:domain", "rival.example").Val() {
+		t.Errorf("unauthenticated blacklist changes should be refused, got %d", rr.Code)
+	}
+}
+
+// TestReportScanAgeWindow checks that reports on too old or future-dated scans are rejected
+func TestReportScanAgeWindow(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"REPORT_MAX_SCAN_AGE": "1h", "REPORT_MAX_CLOCK_SKEW": "5m"})
+
+	sig, _ := computeLocalTLSH(strings.Repeat("Your account statement is ready, sign in to review the latest transactions. ", 4))
+	report := func(msgID string, scannedAt time.Time) *httptest.ResponseRecorder {
+		scan, _ := json.Marshal(ScanResult{Hashes: []string{sig}, Types: map[string]string{sig: "normalized"}, Timestamp: scannedAt.Unix()})
+		sum := sha1.Sum([]byte(msgID))
+		rdb.Set(ctx, "mi:msgid:"+hex.EncodeToString(sum[:]), scan, time.Hour)
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"`+msgID+`","report_type":"spam"}`)))
+		return rr
+	}
+	now := time.Now()
+	tooOld := testutil.ToFloat64(promReportsRejected.WithLabelValues("scan_too_old"))
+	future := testutil.ToFloat64(promReportsRejected.WithLabelValues("scan_in_future"))
+
+	if rr := report("<old@x>", now.Add(-2*time.Hour)); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "scan_too_old") {
+		t.Errorf("old scan should be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := report("<future@x>", now.Add(time.Hour)); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "scan_in_future") {
+		t.Errorf("future scan should be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rdb.Exists(ctx, LocalScorePrefix+sig).Val() != 0 {
+		t.Error("rejected reports must not be learned")
+	}
+	if testutil.ToFloat64(promReportsRejected.WithLabelValues("scan_too_old")) != tooOld+1 || testutil.ToFloat64(promReportsRejected.WithLabelValues("scan_in_future")) != future+1 {
+		t.Error("rejections should be counted by reason")
+	}
+
+	// Inside the window, including a small forward skew
+	report("<recent@x>", now.Add(-10*time.Minute))
+	report("<skewed@x>", now.Add(2*time.Minute))
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+sig).Int(); score != 2 {
+		t.Errorf("reports within the window should be learned, score %d", score)
+	}
+
+	// Disabled: any stored scan is accepted
+	withConfig(t, map[string]string{"REPORT_MAX_SCAN_AGE": "0"})
+	if reason := scanAgeRejection(now.Add(-72*time.Hour).Unix(), now); reason != "" {
+		t.Errorf("check should be disabled, got %s", reason)
+	}
+}
+
+// TestVerdictCombiners compares the combiners on the same message and checks the vote arithmetic
+func TestVerdictCombiners(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	// The body matches a learned spam by proximity, the subject exactly
+	base := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	learned, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	learnSpamHash(learned, 1, SigNormalized)
+	variant := strings.Replace(base, "now", "today", 1)
+	subject := "Action required: your mailbox storage is almost full"
+	subjectSig, _ := computeLocalTLSH(subjectHashContent(subject))
+	learnSpamHash(subjectSig, 1, SigSubject)
+	msg := "From: a@example.com\r\nMessage-ID: <vc@x>\r\nSubject: " + subject + "\r\n\r\n" + variant
+
+	analyze := func(combiner string, extra map[string]string) scanOutcome {
+		cfg := map[string]string{"VERDICT_COMBINER": combiner}
+		for k, v := range extra {
+			cfg[k] = v
+		}
+		withConfig(t, cfg)
+		env, _ := enmime.ReadEnvelope(strings.NewReader(msg))
+		return analyzeEnvelope(context.Background(), env)
+	}
+
+	first := analyze(CombinerFirstSpam, nil)
+	if res := first.Result; res.Action != "spam" || res.MatchType != "normalized" || res.Confidence >= 1.0 {
+		t.Errorf("first_spam should stop on the body match, got %+v", res)
+	}
+	if len(first.TypeVerdicts) != 1 {
+		t.Errorf("first_spam should not look further than the first spam, got %d type verdicts", len(first.TypeVerdicts))
+	}
+
+	strongest := analyze(CombinerStrongest, nil)
+	if res := strongest.Result; res.Action != "spam" || res.MatchType != "subject" || res.Confidence != 1.0 {
+		t.Errorf("strongest should pick the exact subject match, got %+v", res)
+	}
+	if len(strongest.TypeVerdicts) < 2 {
+		t.Errorf("strongest should look every signature up, got %+v", strongest.TypeVerdicts)
+	}
+
+	// Every type votes spam: the score is their mean confidence
+	sum := 0.0
+	for _, v := range strongest.TypeVerdicts {
+		sum += v.Result.Confidence
+	}
+	vote := analyze(CombinerWeightedVote, nil)
+	if res := vote.Result; res.Action != "spam" || res.MatchType != "subject" || math.Abs(res.Confidence-sum/float64(len(strongest.TypeVerdicts))) > 1e-9 {
+		t.Errorf("spam votes should make a spam, got %+v", res)
+	}
+	// Only the body votes: under the spam score it is soft_spam, under the soft score allowed
+	bodyOnly := map[string]string{"VERDICT_WEIGHT_RAW": "0", "VERDICT_WEIGHT_SUBJECT": "0", "VERDICT_VOTE_SPAM": "60"}
+	bodyConfidence := first.Result.Confidence
+	vote = analyze(CombinerWeightedVote, bodyOnly)
+	if res := vote.Result; res.Action != "soft_spam" || res.Label != "local_soft" || res.MatchType != "normalized" || res.Confidence != bodyConfidence {
+		t.Errorf("a score of %.3f should be soft_spam under a 60%% spam vote, got %+v", bodyConfidence, res)
+	}
+	bodyOnly["VERDICT_VOTE_SOFT"] = "60"
+	if res := analyze(CombinerWeightedVote, bodyOnly).Result; res.Action != "allow" {
+		t.Errorf("a score of %.3f should allow under a 60%% soft vote, got %+v", bodyConfidence, res)
+	}
+
+	// Per-type verdicts are shown by /explain
+	withConfig(t, map[string]string{"VERDICT_COMBINER": CombinerStrongest})
+	rr := httptest.NewRecorder()
+	explainHandler(rr, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(msg)))
+	var explained struct {
+		Combiner     string `json:"combiner"`
+		TypeVerdicts []struct {
+			Type    string         `json:"type"`
+			Verdict AnalysisResult `json:"verdict"`
+		} `json:"type_verdicts"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &explained)
+	if explained.Combiner != CombinerStrongest || len(explained.TypeVerdicts) < 2 || explained.TypeVerdicts[0].Type != "normalized" {
+		t.Errorf("unexpected /explain type verdicts: %s", rr.Body.String())
+	}
+
+	// Arithmetic on synthetic verdicts
+	withConfig(t, map[string]string{"VERDICT_COMBINER": CombinerWeightedVote, "VERDICT_WEIGHT_URL": "2", "VERDICT_WEIGHT_RAW": "1",
+		"VERDICT_WEIGHT_SUBJECT": "1", "VERDICT_VOTE_SPAM": "50", "VERDICT_VOTE_SOFT": "25"})
+	verdicts := []typeVerdict{
+		{Type: SigNormalized, Result: AnalysisResult{Action: "soft_spam", Label: "local_soft", Confidence: 0.8}},
+		{Type: SigURL, Result: AnalysisResult{Action: "spam", Label: "oracle"}}, // No confidence: certain
+		{Type: SigSubject, Result: AnalysisResult{Action: "allow", ProximityMatch: true}},
+	}
+	if res := combineTypeVerdicts(CombinerWeightedVote, verdicts); res.Action != "spam" || res.Label != "oracle" || math.Abs(res.Confidence-(0.4+2)/4) > 1e-9 {
+		t.Errorf("unexpected weighted vote: %+v", res)
+	}
+	if res := combineTypeVerdicts(CombinerStrongest, verdicts); res.Label != "oracle" {
+		t.Errorf("a spam without confidence should be the strongest, got %+v", res)
+	}
+	softOnly := verdicts[:1]
+	softOnly = append(softOnly, typeVerdict{Type: SigRaw, Result: AnalysisResult{Action: "soft_spam", Confidence: 1.0}})
+	if res := combineTypeVerdicts(CombinerWeightedVote, softOnly); res.Action != "soft_spam" {
+		t.Errorf("soft votes alone should never make a spam, got %+v", res)
+	}
+	if res := combineTypeVerdicts(CombinerStrongest, verdicts[2:]); res.Action != "allow" || !res.ProximityMatch {
+		t.Errorf("allow verdicts should combine into a proximity allow, got %+v", res)
+	}
+
+	merged := addTypeVerdict(nil, SigAttachment, AnalysisResult{Action: "soft_spam", Confidence: 0.9})
+	merged = addTypeVerdict(merged, SigAttachment, AnalysisResult{Action: "spam", Confidence: 0.6})
+	if len(merged) != 1 || merged[0].Result.Action != "spam" {
+		t.Errorf("a type verdict should be the most severe of its signatures, got %+v", merged)
+	}
+}
+
+// TestSpamMinConfidence checks the global spam/soft_spam confidence boundary
+func TestSpamMinConfidence(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	base := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	learned, _ := computeLocalTLSH(normalizeEmailBody(base, ""))
+	learnSpamHash(learned, 1, SigNormalized)
+	variant := strings.Replace(base, "now", "today", 1)
+	variantSig, _ := computeLocalTLSH(normalizeEmailBody(variant, ""))
+	dist, _ := computeDistance(learned, variantSig, false, 0)
+	confidence := getConfidenceForMatch(dist, getThresholdForType(SigNormalized))
+	percent := int(confidence * 100)
+
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <smc@x>\r\n\r\n" + variant))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	withConfig(t, map[string]string{"SPAM_MIN_CONFIDENCE": fmt.Sprint(percent)})
+	if res := analyze(); res.Action != "spam" || res.Label != "local_spam" {
+		t.Errorf("match at %.3f should stay spam under a %d%% minimum, got %+v", confidence, percent, res)
+	}
+	withConfig(t, map[string]string{"SPAM_MIN_CONFIDENCE": fmt.Sprint(percent + 1)})
+	res := analyze()
+	if res.Action != "soft_spam" || res.Label != "local_soft" || res.ReasonCode != ReasonLocalSoft || res.Distance != dist {
+		t.Errorf("match at %.3f should be soft_spam under a %d%% minimum, got %+v", confidence, percent+1, res)
+	}
+
+	// Inclusive boundary, labels without a soft counterpart kept, unknown confidence untouched
+	withConfig(t, map[string]string{"SPAM_MIN_CONFIDENCE": "80"})
+	at := AnalysisResult{Action: "spam", Label: "local_spam", Confidence: 0.80}
+	applySpamMinConfidence(&at, "")
+	below := AnalysisResult{Action: "spam", Label: "mass_campaign", Confidence: 0.79}
+	applySpamMinConfidence(&below, "")
+	unknown := AnalysisResult{Action: "spam", Label: "oracle"}
+	applySpamMinConfidence(&unknown, "")
+	if at.Action != "spam" || below.Action != "soft_spam" || below.Label != "mass_campaign" || unknown.Action != "spam" {
+		t.Errorf("unexpected boundary handling: %+v %+v %+v", at, below, unknown)
+	}
+}
+
+// TestDebugHash checks that /debug/hash reproduces the signatures computed by /analyze
+func TestDebugHash(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+
+	body := strings.Repeat("Dear customer, your account has been suspended. Verify your identity within 24 hours. ", 4)
+	subject := "Important: your account has been suspended today"
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <dbg@x>\r\nSubject: " + subject + "\r\n\r\n" + body))
+	scanned := map[SignatureType]string{}
+	for _, ts := range scanEnvelope(context.Background(), env).Signatures {
+		scanned[ts.Type] = ts.Hash
+	}
+
+	handler := requireAdmin(debugHashHandler)
+	debug := func(token, reqBody string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/debug/hash", strings.NewReader(reqBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+	content, _ := json.Marshal(env.Text)
+
+	if code, _ := debug("wrong", `{"content":`+string(content)+`}`); code != http.StatusUnauthorized {
+		t.Errorf("debug endpoint must be admin-only, got %d", code)
+	}
+	code, resp := debug("s3cret", `{"content":`+string(content)+`}`)
+	if code != http.StatusOK || resp["type"] != "normalized" || resp["signature"] != scanned[SigNormalized] {
+		t.Errorf("normalized signature should match the scan (%s), got %d %v", scanned[SigNormalized], code, resp)
+	}
+	if bands, _ := resp["bands"].([]interface{}); len(bands) != len(extractBands_6_3(scanned[SigNormalized])) {
+		t.Errorf("expected the signature's bands, got %v", resp["bands"])
+	}
+	if _, resp := debug("s3cret", `{"type":"subject","content":"`+subject+`"}`); resp["signature"] != scanned[SigSubject] {
+		t.Errorf("subject signature should match the scan (%s), got %v", scanned[SigSubject], resp)
+	}
+	b64 := base64.StdEncoding.EncodeToString([]byte(env.Text))
+	if _, resp := debug("s3cret", `{"type":"raw","base64":true,"content":"`+b64+`"}`); resp["signature"] == nil {
+		t.Errorf("base64 raw content should hash, got %v", resp)
+	}
+
+	if code, _ := debug("s3cret", `{"type":"bogus","content":"x"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown type should return 400, got %d", code)
+	}
+	if code, resp := debug("s3cret", `{"type":"raw","content":"too short"}`); code != http.StatusUnprocessableEntity || resp["error"] == nil {
+		t.Errorf("unhashable content should return 422 with the error, got %d %v", code, resp)
+	}
+}
+
+// TestEmptySubject checks the empty_subject signal for empty, short and normal subjects
+func TestEmptySubject(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"EMPTY_SUBJECT_CHECK": "true"})
+
+	body := strings.Repeat("Hello, here is the document we talked about during the call yesterday afternoon. ", 4)
+	analyze := func(subjectHeader string) scanOutcome {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <es@x>\r\n" + subjectHeader + "\r\n" + body))
+		return analyzeEnvelope(context.Background(), env)
+	}
+	hasSubjectSig := func(outcome scanOutcome) bool {
+		for _, ts := range outcome.Signatures {
+			if ts.Type == SigSubject {
+				return true
+			}
+		}
+		return false
+	}
+
+	for name, header := range map[string]string{"missing": "", "empty": "Subject:\r\n", "blank": "Subject:    \r\n"} {
+		outcome := analyze(header)
+		if res := outcome.Result; res.Action != "soft_spam" || res.Label != "empty_subject" || res.ReasonCode != ReasonEmptySubject {
+			t.Errorf("%s subject should be soft_spam, got %+v", name, res)
+		}
+		if hasSubjectSig(outcome) {
+			t.Errorf("%s subject should not be hashed", name)
+		}
+	}
+
+	short := analyze("Subject: Hi\r\n")
+	if short.Result.Action != "allow" || hasSubjectSig(short) {
+		t.Errorf("short subject should be allowed without a subject signature, got %+v", short.Result)
+	}
+	normal := analyze("Subject: Notes and the document from yesterday's planning call\r\n")
+	if normal.Result.Action != "allow" || !hasSubjectSig(normal) {
+		t.Errorf("normal subject should be allowed and hashed, got %+v", normal.Result)
+	}
+
+	// Whitelisted senders are never flagged
+	rdb.SAdd(ctx, "mi:whitelist:domain", "example.com")
+	if res := analyze("").Result; res.Action != "allow" || res.Label != "whitelisted" {
+		t.Errorf("whitelisted sender should not be flagged, got %+v", res)
+	}
+	rdb.SRem(ctx, "mi:whitelist:domain", "example.com")
+
+	// Shown in /config; no signal once disabled
+	rr := httptest.NewRecorder()
+	configHandler(rr, httptest.NewRequest("GET", "/config", nil))
+	if !strings.Contains(rr.Body.String(), `"empty_subject_check":true`) {
+		t.Errorf("/config should expose the check, got %s", rr.Body.String())
+	}
+	withConfig(t, map[string]string{"EMPTY_SUBJECT_CHECK": "false"})
+	if res := analyze("").Result; res.Action != "allow" {
+		t.Errorf("disabled check should allow, got %+v", res)
+	}
+}
+
+// TestDateAnomaly checks the Date header parsing and each anomaly
+func TestDateAnomaly(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]string{
+		"Tue, 10 Mar 2026 11:58:03 +0000":               "2026-03-10T11:58:03Z",
+		"10 Mar 2026 13:58:03 +0200":                    "2026-03-10T11:58:03Z",
+		"Tue,  10 Mar 2026 11:58 -0000 (UTC)":           "2026-03-10T11:58:00Z",
+		"Tue, 10 Mar 26 11:58:03 GMT":                   "2026-03-10T11:58:03Z",
+		"Tue, 10 Mar 2026 13:58:03 GMT+0200":            "2026-03-10T11:58:03Z",
+		"Tue, 10 Mar 2026 11:58:03 +0000 (Coordinated)": "2026-03-10T11:58:03Z",
+		"2026-03-10T11:58:03Z":                          "2026-03-10T11:58:03Z",
+		"Tue Mar 10 11:58:03 2026":                      "2026-03-10T11:58:03Z",
+		"Tuesday, 10-Mar-26 11:58:03 UTC":               "2026-03-10T11:58:03Z",
+		"Tue, 10 Mar 2026 11:58:03":                     "2026-03-10T11:58:03Z",
+	} {
+		got, ok := parseDateHeader(value)
+		if !ok || got.UTC().Format(time.RFC3339) != want {
+			t.Errorf("parseDateHeader(%q) = %v, %v; want %s", value, got, ok, want)
+		}
+	}
+
+	inspect := func(dateHeader string) *messageDate {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\n" + dateHeader + "Subject: x\r\n\r\nbody"))
+		return inspectDateHeader(env, now, 24*time.Hour, 30*24*time.Hour)
+	}
+	cases := []struct {
+		name, header, anomaly string
+	}{
+		{"recent", "Date: Tue, 10 Mar 2026 11:58:03 +0000\r\n", ""},
+		{"skewed", "Date: Tue, 10 Mar 2026 18:00:00 +0000\r\n", ""},
+		{"missing", "", DateAnomalyMissing},
+		{"blank", "Date:  \r\n", DateAnomalyMissing},
+		{"unparsable", "Date: yesterday at noon\r\n", DateAnomalyUnparsable},
+		{"future", "Date: Fri, 13 Mar 2026 12:00:00 +0000\r\n", DateAnomalyFuture},
+		{"past", "Date: Mon, 05 Jan 2015 08:00:00 +0000\r\n", DateAnomalyPast},
+	}
+	for _, c := range cases {
+		d := inspect(c.header)
+		if d == nil || d.Anomaly != c.anomaly {
+			t.Errorf("%s: expected anomaly %q, got %+v", c.name, c.anomaly, d)
+			continue
+		}
+		if _, flagged := checkDateAnomaly(d); flagged != (c.anomaly != "") {
+			t.Errorf("%s: unexpected signal state", c.name)
+		}
+	}
+	if d := inspect("Date: Fri, 13 Mar 2026 12:00:00 +0000\r\n"); d.Parsed != "2026-03-13T12:00:00Z" || d.Offset != "72h0m0s" {
+		t.Errorf("expected parsed date and offset of a future date, got %+v", d)
+	}
+
+	// End to end: off by default, soft_spam once enabled, shown in /explain
+	useMiniredis(t)
+	body := strings.Repeat("Hello, here is the document we talked about during the call yesterday afternoon. ", 4)
+	msg := "From: a@example.com\r\nMessage-ID: <da@x>\r\nSubject: Notes from the call\r\n\r\n" + body
+	env, _ := enmime.ReadEnvelope(strings.NewReader(msg))
+	if res := analyzeEnvelope(context.Background(), env).Result; res.Action != "allow" {
+		t.Errorf("missing date should not be flagged with the check off, got %+v", res)
+	}
+	withConfig(t, map[string]string{"DATE_ANOMALY_CHECK": "true"})
+	outcome := analyzeEnvelope(context.Background(), env)
+	if res := outcome.Result; res.Action != "soft_spam" || res.Label != "date_anomaly" || res.ReasonCode != ReasonDateAnomaly {
+		t.Errorf("missing date should be soft_spam, got %+v", res)
+	}
+
+	dated := "Date: " + time.Now().Add(-time.Minute).Format(time.RFC1123Z) + "\r\n" + msg
+	rr := httptest.NewRecorder()
+	explainHandler(rr, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(dated)))
+	var explained struct {
+		Verdict AnalysisResult `json:"verdict"`
+		Date    messageDate    `json:"date"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &explained); err != nil || explained.Date.Parsed == "" || explained.Date.Anomaly != "" || explained.Verdict.Action != "allow" {
+		t.Errorf("expected the parsed date in /explain, got %s", rr.Body.String())
+	}
+}
+
+// TestReportContentDedup checks that identical content under different Message-IDs is reported to the oracle once
+func TestReportContentDedup(t *testing.T) {
+	useMiniredis(t)
+	// Opt-in: without REPORT_CONTENT_DEDUP_WINDOW every report reaches the oracle
+	refreshLogicConfig()
+	if window := atomic.LoadInt64(&reportContentDedupWindow); window != 0 || contentReportKey("fp", "ham", nil) != "" {
+		t.Fatalf("content dedup should be disabled by default, window %s", time.Duration(window))
+	}
+	withConfig(t, map[string]string{"REPORT_CONTENT_DEDUP_WINDOW": "24h"})
+
+	var oracleReports int64
+	var failing atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&oracleReports, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	body := strings.Repeat("Limited offer: genuine watches at ninety percent off, only this weekend, order now. ", 4)
+	normalized := normalizeEmailBody(body, "")
+	sig, _ := computeLocalTLSH(normalized)
+	report := func(msgID, reportType string) *httptest.ResponseRecorder {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: " + msgID + "\r\n\r\n" + body))
+		storeScanResult(env, []string{sig}, map[string]string{sig: "normalized"}, contentFingerprint(normalized), "")
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"`+msgID+`","report_type":"`+reportType+`"}`)))
+		return rr
+	}
+
+	if rr := report("<first@x>", "ham"); rr.Code != http.StatusOK || atomic.LoadInt64(&oracleReports) != 1 {
+		t.Fatalf("first report should reach the oracle, got %d (%d calls)", rr.Code, oracleReports)
+	}
+	rr := report("<second@x>", "ham")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "duplicate_content") || atomic.LoadInt64(&oracleReports) != 1 {
+		t.Errorf("same content under another Message-ID should not be re-reported, got %d %s (%d calls)", rr.Code, rr.Body.String(), oracleReports)
+	}
+	if rr := report("<second@x>", "ham"); rr.Code != http.StatusConflict {
+		t.Errorf("per-message dedup should still apply, got %d", rr.Code)
+	}
+	if report("<third@x>", "spam"); atomic.LoadInt64(&oracleReports) != 2 {
+		t.Errorf("another report type is a separate report, got %d calls", oracleReports)
+	}
+
+	withConfig(t, map[string]string{"REPORT_CONTENT_DEDUP_WINDOW": "0"})
+	if report("<fourth@x>", "ham"); atomic.LoadInt64(&oracleReports) != 3 {
+		t.Errorf("disabled dedup should report again, got %d calls", oracleReports)
+	}
+
+	// A report the oracle refused doesn't hold the content back
+	rdb.FlushAll(ctx)
+	withConfig(t, map[string]string{"REPORT_CONTENT_DEDUP_WINDOW": "24h"})
+	failing.Store(true)
+	if rr := report("<fifth@x>", "ham"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("the oracle error should be returned, got %d", rr.Code)
+	}
+	failing.Store(false)
+	if rr := report("<sixth@x>", "ham"); rr.Code != http.StatusOK || atomic.LoadInt64(&oracleReports) != 5 {
+		t.Errorf("content refused by the oracle should be reported again, got %d %s (%d calls)", rr.Code, rr.Body.String(), oracleReports)
+	}
+}
+
+// TestSignatureCoverage checks the signatures_computed / signatures_failed summary
+func TestSignatureCoverage(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	analyze := func(raw string) map[string]interface{} {
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, httptest.NewRequest("POST", "/analyze", strings.NewReader(raw)))
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// Unhashable body, hashable subject: the body signatures are reported as failed
+	resp := analyze("From: a@example.com\r\nMessage-ID: <cov1@x>\r\nSubject: A subject long enough to get its own signature\r\n\r\n" + strings.Repeat("abc ", 80))
+	computed, _ := resp["signatures_computed"].(map[string]interface{})
+	failed, _ := resp["signatures_failed"].(map[string]interface{})
+	if computed["subject"] != 1.0 || computed["normalized"] != nil {
+		t.Errorf("expected only the subject signature computed, got %v", resp["signatures_computed"])
+	}
+	if failed["normalized"] != 1.0 || failed["raw"] != 1.0 {
+		t.Errorf("expected the body signatures failed, got %v", resp["signatures_failed"])
+	}
+
+	// Plain text body: the normalized signature covers the identical raw body
+	body := strings.Repeat("Meeting notes: we agreed on the new release schedule and the migration plan for next quarter. ", 3)
+	resp = analyze("From: a@example.com\r\nMessage-ID: <cov2@x>\r\nSubject: hi\r\n\r\n" + body)
+	computed, _ = resp["signatures_computed"].(map[string]interface{})
+	if computed["normalized"] != 1.0 || computed["raw"] != 1.0 || computed["subject"] != nil {
+		t.Errorf("unexpected coverage for a plain text body: %v", resp["signatures_computed"])
+	}
+	if failed, ok := resp["signatures_failed"].(map[string]interface{}); !ok || len(failed) != 0 {
+		t.Errorf("nothing should have failed, got %v", resp["signatures_failed"])
+	}
+
+	// Not scanned: no coverage
+	rdb.SAdd(ctx, "mi:blacklist:domain", "example.com")
+	resp = analyze("From: a@example.com\r\nMessage-ID: <cov3@x>\r\n\r\n" + body)
+	if resp["action"] != "spam" || resp["signatures_computed"] != nil || resp["signatures_failed"] != nil {
+		t.Errorf("unscanned messages should have null coverage, got %v", resp)
+	}
+}
+
+// TestAttachmentOracleCap checks that a message with many attachments makes a bounded number of oracle calls
+func TestAttachmentOracleCap(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"MAX_ATTACHMENT_ORACLE_CALLS": "3"})
+
+	var calls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Write([]byte(`{"result": {"action": "allow"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	// Eight distinct attachments, all present in the oracle band index
+	var raw strings.Builder
+	var attachments []string
+	raw.WriteString("From: a@example.com\r\nMessage-ID: <many@x>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n")
+	for i := 0; i < 8; i++ {
+		content := strings.Repeat(fmt.Sprintf("Document %d, section %d: figures, totals and remarks for archive number %d. ", i, i*7, i*131), 4)
+		attachments = append(attachments, content)
+		fmt.Fprintf(&raw, "--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"doc%d.bin\"\r\n\r\n%s\r\n", i, content)
+	}
+	raw.WriteString("--b--\r\n")
+	indexAttachments := func() {
+		for _, content := range attachments {
+			sig, _ := computeLocalTLSH(content)
+			for _, band := range extractBands_6_3(sig) {
+				rdb.Set(ctx, FragKeyPrefix+band, "1", 0)
+			}
+		}
+	}
+	indexAttachments()
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw.String()))
+		return analyzeEnvelope(context.Background(), env).Result
+	}
+
+	before := testutil.ToFloat64(promAttachmentOracleCapped)
+	res := analyze()
+	if n := atomic.LoadInt64(&calls); n != 3 {
+		t.Errorf("expected 3 oracle calls, got %d", n)
+	}
+	if capped := testutil.ToFloat64(promAttachmentOracleCapped) - before; capped != 5 {
+		t.Errorf("expected 5 capped attachment signatures, got %v", capped)
+	}
+	if !res.ProximityMatch {
+		t.Errorf("capped attachments still match the band index, got %+v", res)
+	}
+
+	// No limit by default (the oracle verdict cache is cleared so every attachment asks again)
+	withConfig(t, map[string]string{"MAX_ATTACHMENT_ORACLE_CALLS": ""})
+	rdb.FlushDB(ctx)
+	atomic.StoreInt64(&calls, 0)
+	indexAttachments()
+	analyze()
+	if n := atomic.LoadInt64(&calls); n != 8 {
+		t.Errorf("without a cap every attachment may call the oracle, got %d calls", n)
+	}
+}
+
+// TestVerdictSchemaVersion checks that cached verdicts and stored scans from another
+// engine config are recomputed instead of reused
+func TestVerdictSchemaVersion(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	var calls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Write([]byte(`{"result": {"action": "spam"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	sig, _ := computeLocalTLSH(strings.Repeat("Your parcel is waiting at the depot, pay the customs fee to schedule delivery. ", 4))
+	callOracleDecision(context.Background(), sig)
+	callOracleDecision(context.Background(), sig)
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("a current cached verdict should be reused, got %d oracle calls", n)
+	}
+	oldVersion := currentVerdictSchemaVersion()
+
+	// Tuning that doesn't change the signatures keeps the version
+	withConfig(t, map[string]string{"BAND_QUORUM": "3", "SOFT_SPAM_DELTA_LOCAL": "10", "MIN_LENGTH_URL": "40", "VERDICT_COMBINER": "vote"})
+	if currentVerdictSchemaVersion() != oldVersion {
+		t.Fatal("quorum, soft delta, minimum length and combiner tuning should not change the verdict schema version")
+	}
+
+	// A relevant config change bumps the version and forces a new oracle call
+	withConfig(t, map[string]string{"NORMALIZE_STEPS": "spaces"})
+	if currentVerdictSchemaVersion() == oldVersion {
+		t.Fatal("changing the normalization should change the verdict schema version")
+	}
+	res := callOracleDecision(context.Background(), sig)
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("a cached verdict from another version should be recomputed, got %d oracle calls", n)
+	}
+	if res.Action != "spam" {
+		t.Errorf("expected the recomputed verdict, got %+v", res)
+	}
+	if cached, ok := cachedOracleVerdict("mi:oracle_cache:" + sig); !ok || cached.SchemaVersion != currentVerdictSchemaVersion() {
+		t.Errorf("the recomputed verdict should be cached with the current version, got %+v", cached)
+	}
+
+	// A scan stored under the old version can no longer be reported
+	report := func(msgID, version string) *httptest.ResponseRecorder {
+		scan, _ := json.Marshal(ScanResult{Hashes: []string{sig}, Types: map[string]string{sig: "normalized"}, Timestamp: time.Now().Unix(), SchemaVersion: version})
+		sum := sha1.Sum([]byte(msgID))
+		rdb.Set(ctx, "mi:msgid:"+hex.EncodeToString(sum[:]), scan, time.Hour)
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"`+msgID+`","report_type":"spam"}`)))
+		return rr
+	}
+	if rr := report("<stale@x>", oldVersion); rr.Code != http.StatusGone || !strings.Contains(rr.Body.String(), "verdict_schema_changed") {
+		t.Errorf("a scan from another version should be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rdb.Exists(ctx, LocalScorePrefix+sig).Val() != 0 {
+		t.Error("stale scans must not be learned")
+	}
+	if rdb.Exists(ctx, ReportDedupPrefix+messageIDHash("<stale@x>")+":spam").Val() != 0 {
+		t.Error("a refused stale report should not hold the dedup lock")
+	}
+	if rr := report("<current@x>", currentVerdictSchemaVersion()); rr.Code != http.StatusOK {
+		t.Errorf("a current scan should be accepted, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The analyze response carries the version
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <v@x>\r\nSubject: hello\r\n\r\nShort body.\r\n"))
+	if v := analyzeEnvelope(context.Background(), env).Result.SchemaVersion; v != currentVerdictSchemaVersion() {
+		t.Errorf("expected version %s in the verdict, got %q", currentVerdictSchemaVersion(), v)
+	}
+}
+
+// TestUserMessages checks the end-user message lookup and its templating
+func TestUserMessages(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{
+		"USER_MESSAGE_ORACLE_SPAM_URL": "This message resembles a known phishing campaign targeting {brand} users",
+		"USER_MESSAGE_ORACLE_SPAM":     "This message matches a campaign reported as {label}",
+		"USER_MESSAGE_ATTACHMENT":      "An attachment of this message is known to be malicious",
+		"USER_MESSAGE_DEFAULT":         "This message looks like spam ({reason_code})",
+	})
+
+	cases := []struct {
+		name string
+		res  AnalysisResult
+		want string
+	}{
+		{"reason and type, brand", AnalysisResult{Action: "spam", Label: "phishing", MatchType: "url", Brand: "PayPal", ReasonCode: ReasonOracleSpam},
+			"This message resembles a known phishing campaign targeting PayPal users"},
+		{"no brand falls back to the reason", AnalysisResult{Action: "spam", Label: "phishing", MatchType: "url", ReasonCode: ReasonOracleSpam},
+			"This message matches a campaign reported as phishing"},
+		{"match type", AnalysisResult{Action: "spam", Label: "local_spam", MatchType: "attachment", ReasonCode: ReasonLocalSpam},
+			"An attachment of this message is known to be malicious"},
+		{"default", AnalysisResult{Action: "soft_spam", Label: "local_soft", MatchType: "normalized", ReasonCode: ReasonLocalSoft},
+			"This message looks like spam (LOCAL_SOFT)"},
+		{"allow", AnalysisResult{Action: "allow", ReasonCode: ReasonClean}, ""},
+	}
+	for _, c := range cases {
+		if got := userMessageFor(c.res); got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+
+	if _, ok := renderUserMessage("Targets {brand}", map[string]string{"label": "x"}); ok {
+		t.Error("a template with an unfilled placeholder should not render")
+	}
+	if msg, ok := renderUserMessage("Plain text, {unknown} kept", nil); !ok || msg != "Plain text, {unknown} kept" {
+		t.Errorf("unknown placeholders are left as is, got %q", msg)
+	}
+
+	// The message is part of the analyze response
+	body := analyzeResponseBody(scanOutcome{Result: AnalysisResult{Action: "spam", MatchType: "url", Brand: "PayPal", ReasonCode: ReasonOracleSpam,
+		UserMessage: userMessageFor(AnalysisResult{Action: "spam", MatchType: "url", Brand: "PayPal", ReasonCode: ReasonOracleSpam})}})
+	if !strings.Contains(string(body), `"user_message":"This message resembles a known phishing campaign targeting PayPal users"`) {
+		t.Errorf("expected the user message in the response, got %s", body)
+	}
+
+	// Nothing configured: no message
+	withConfig(t, map[string]string{"USER_MESSAGE_ORACLE_SPAM_URL": "", "USER_MESSAGE_ORACLE_SPAM": "", "USER_MESSAGE_ATTACHMENT": "", "USER_MESSAGE_DEFAULT": ""})
+	if got := userMessageFor(cases[0].res); got != "" {
+		t.Errorf("expected no message without configuration, got %q", got)
+	}
+}
+
+// TestSMTPResponse checks the SMTP reply suggested for each action and its templating
+func TestSMTPResponse(t *testing.T) {
+	withConfig(t, map[string]string{})
+	refreshLogicConfig()
+
+	spam := smtpResponseFor(AnalysisResult{Action: "spam", ReasonCode: ReasonLocalSpam})
+	if spam == nil || spam.Code != 550 || spam.EnhancedCode != "5.7.1" || spam.Message != "Message rejected as spam" || spam.Header != "" {
+		t.Errorf("unexpected default spam response: %+v", spam)
+	}
+	soft := smtpResponseFor(AnalysisResult{Action: "soft_spam"})
+	if soft == nil || soft.Code != 250 || soft.Header != defaultSMTPSoftSpamHeader {
+		t.Errorf("unexpected default soft_spam response: %+v", soft)
+	}
+	if allow := smtpResponseFor(AnalysisResult{Action: "allow"}); allow == nil || allow.Code != 250 || allow.Header != "" {
+		t.Errorf("unexpected default allow response: %+v", allow)
+	}
+	if got := smtpResponseFor(AnalysisResult{Action: "unknown"}); got != nil {
+		t.Errorf("expected no response for an unknown action, got %+v", got)
+	}
+
+	withConfig(t, map[string]string{
+		"SMTP_RESPONSE_SPAM":             "554 5.7.1 Rejected: {reason_code} ({brand})",
+		"SMTP_RESPONSE_SOFT_SPAM":        "451 4.7.1 Try again later",
+		"SMTP_RESPONSE_SOFT_SPAM_HEADER": "X-Mailuminati-Verdict: soft_spam",
+		"SMTP_RESPONSE_ALLOW":            "550 2.0.0 mismatched classes",
+	})
+	refreshLogicConfig()
+
+	res := AnalysisResult{Action: "spam", ReasonCode: ReasonOracleSpam, Brand: "PayPal"}
+	if got := smtpResponseFor(res); got.Code != 554 || got.Message != "Rejected: ORACLE_SPAM (PayPal)" {
+		t.Errorf("unexpected templated spam response: %+v", got)
+	}
+	res.Brand = ""
+	if got := smtpResponseFor(res); got.Code != 550 || got.Message != "Message rejected as spam" {
+		t.Errorf("expected the default when a placeholder has no value, got %+v", got)
+	}
+	res.Brand = "Pay\r\nPal"
+	if got := smtpResponseFor(res); got.Code != 550 {
+		t.Errorf("expected the default when a value breaks the reply, got %+v", got)
+	}
+	if got := smtpResponseFor(AnalysisResult{Action: "soft_spam"}); got.Code != 451 || got.EnhancedCode != "4.7.1" || got.Header != "X-Mailuminati-Verdict: soft_spam" {
+		t.Errorf("unexpected configured soft_spam response: %+v", got)
+	}
+	if got := smtpResponseFor(AnalysisResult{Action: "allow"}); got.Code != 250 || got.Message != "Message accepted" {
+		t.Errorf("expected an invalid template to fall back to its default, got %+v", got)
+	}
+
+	for tmpl, want := range map[string]bool{
+		"250":                   true,
+		"250 OK":                true,
+		"421-4.3.2 Busy":        true,
+		"250 2.0.0":             true,
+		"550 4.7.1 wrong class": false,
+		"150 bad code":          false,
+		"rejected":              false,
+	} {
+		if _, ok := parseSMTPResponse(tmpl); ok != want {
+			t.Errorf("parseSMTPResponse(%q) = %v, want %v", tmpl, ok, want)
+		}
+	}
+
+	body := analyzeResponseBody(scanOutcome{Result: AnalysisResult{Action: "spam", ReasonCode: ReasonLocalSpam, Brand: "PayPal"}})
+	var decoded struct {
+		SMTP SMTPResponse `json:"smtp_response"`
+	}
+	if err := json.Unmarshal(body, &decoded); err != nil || decoded.SMTP.Code != 554 {
+		t.Errorf("expected smtp_response in the verdict, got %s", body)
+	}
+}
+
+// TestHTMLStructureSignature checks the HTML skeleton extraction and that template reuse
+// matches despite different text
+func TestHTMLStructureSignature(t *testing.T) {
+	skeleton := htmlSkeleton(`<!-- campaign 42 --><div CLASS="b  a" style="color:red" data-x="1"><a href="https://x.example/t?id=1">Click</a><style>.a{}</style><br/></div>`)
+	want := "<div class=a b>\n<a>\n</a>\n<style>\n</style>\n<br>\n</div>\n"
+	if skeleton != want {
+		t.Errorf("unexpected skeleton:\n%q\nwant\n%q", skeleton, want)
+	}
+	if htmlSkeleton("no markup at all") != "" {
+		t.Error("plain text has no skeleton")
+	}
+
+	useMiniredis(t)
+	withConfig(t, map[string]string{"STRUCTURE_SIGNATURE": "true"})
+
+	template := func(title, offer, footer string) string {
+		var b strings.Builder
+		b.WriteString(`<html><body><table class="wrapper" width="600" cellpadding="0" cellspacing="0" border="0" align="center">`)
+		b.WriteString(`<tr><td class="header" align="center"><img src="https://cdn.example/logo.png" width="120" height="40"></td></tr>`)
+		fmt.Fprintf(&b, `<tr><td class="title" valign="top"><h1 class="headline">%s</h1></td></tr>`, title)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(&b, `<tr><td class="item" width="50%%"><p class="copy">%s</p></td><td class="cta" align="right"><a class="button" href="https://shop.example/%d">Go</a></td></tr>`, offer, i)
+		}
+		fmt.Fprintf(&b, `<tr><td class="footer" colspan="2"><span class="legal">%s</span></td></tr></table></body></html>`, footer)
+		return b.String()
+	}
+	message := func(id, html string) *enmime.Envelope {
+		raw := "From: promo@example.com\r\nMessage-ID: <" + id + "@x>\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" + html + "\r\n"
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return env
+	}
+	structureSig := func(outcome scanOutcome) string {
+		for _, ts := range outcome.Signatures {
+			if ts.Type == SigStructure {
+				return ts.Hash
+			}
+		}
+		return ""
+	}
+
+	first := scanEnvelope(context.Background(), message("a", template("Winter clearance starts today",
+		"Thermal jackets and wool scarves at half price for our loyal members", "You receive this because you subscribed to seasonal offers")))
+	sig := structureSig(first)
+	if sig == "" {
+		t.Fatalf("expected a structure signature, got %+v", first.Signatures)
+	}
+	learnSpamHash(sig, 1, SigStructure)
+
+	second := scanEnvelope(context.Background(), message("b", template("Crypto returns you cannot ignore",
+		"Our trading robot doubled the savings of retirees in under three weeks", "Reply STOP to no longer hear about guaranteed profits")))
+	if other := structureSig(second); other == "" {
+		t.Fatal("expected a structure signature for the second message")
+	} else if dist, _ := computeDistance(sig, other, false, 0); dist > getThresholdForType(SigStructure) {
+		t.Fatalf("identical templates should be within the structure threshold, distance %d", dist)
+	}
+	if second.Result.Action != "spam" || second.Result.MatchType != SigStructure.String() {
+		t.Errorf("expected a structure match, got %+v", second.Result)
+	}
+
+	// Off by default
+	withConfig(t, map[string]string{"STRUCTURE_SIGNATURE": "false"})
+	if sig := structureSig(scanEnvelope(context.Background(), message("c", template("a", "b", "c")))); sig != "" {
+		t.Error("no structure signature should be computed when disabled")
+	}
+}
+
+// TestAnalyzeConcurrencyLimit load-tests the MAX_CONCURRENT_ANALYZE ceiling, rejecting
+// and waiting
+func TestAnalyzeConcurrencyLimit(t *testing.T) {
+	var active, peak int64
+	handler := limitAnalyzeConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&active, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&active, -1)
+		w.WriteHeader(http.StatusOK)
+	})
+	burst := func(n int) (ok, rejected int64) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rr := httptest.NewRecorder()
+				handler(rr, httptest.NewRequest("POST", "/analyze", nil))
+				switch rr.Code {
+				case http.StatusOK:
+					atomic.AddInt64(&ok, 1)
+				case http.StatusServiceUnavailable:
+					atomic.AddInt64(&rejected, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		return ok, rejected
+	}
+
+	// Full: reject at once
+	withConfig(t, map[string]string{"MAX_CONCURRENT_ANALYZE": "3"})
+	before := testutil.ToFloat64(promAnalyzeRejected)
+	ok, rejected := burst(50)
+	if peak > 3 {
+		t.Errorf("concurrency ceiling exceeded: %d requests in flight", peak)
+	}
+	if rejected == 0 || ok+rejected != 50 {
+		t.Errorf("expected some 503s without a queue timeout, got %d ok / %d rejected", ok, rejected)
+	}
+	if got := testutil.ToFloat64(promAnalyzeRejected) - before; got != float64(rejected) {
+		t.Errorf("expected %d counted rejections, got %v", rejected, got)
+	}
+
+	// Full: wait for a slot
+	withConfig(t, map[string]string{"MAX_CONCURRENT_ANALYZE": "3", "ANALYZE_QUEUE_TIMEOUT": "10s"})
+	atomic.StoreInt64(&peak, 0)
+	if ok, rejected := burst(30); ok != 30 || rejected != 0 {
+		t.Errorf("queued requests should all complete, got %d ok / %d rejected", ok, rejected)
+	}
+	if peak > 3 {
+		t.Errorf("concurrency ceiling exceeded while queueing: %d requests in flight", peak)
+	}
+	if inFlight := testutil.ToFloat64(promAnalyzeInFlight); inFlight != 0 {
+		t.Errorf("expected no request in flight after the burst, got %v", inFlight)
+	}
+
+	// No limit
+	withConfig(t, map[string]string{"MAX_CONCURRENT_ANALYZE": "0"})
+	atomic.StoreInt64(&peak, 0)
+	if ok, _ := burst(10); ok != 10 || peak < 4 {
+		t.Errorf("without a limit every request should run concurrently, got %d ok, peak %d", ok, peak)
+	}
+}
+
+// TestLocalConflictPolicy checks the verdict when a signature matches learned hashes of
+// conflicting scores
+func TestLocalConflictPolicy(t *testing.T) {
+	trusted := func(c localCandidate) bool { return c.Score > 0 }
+	candidates := []localCandidate{
+		{Hash: "weak_spam", Distance: 30, Score: 1},
+		{Hash: "hammed", Distance: 10, Score: -4},
+		{Hash: "strong_spam", Distance: 50, Score: 2},
+	}
+	cases := []struct {
+		policy     string
+		want       string // "" = no spam verdict
+		overridden bool
+	}{
+		{LocalConflictAnySpam, "weak_spam", false},
+		{LocalConflictHighestScore, "strong_spam", false},
+		{LocalConflictNearest, "", true},
+		{LocalConflictNetScore, "", true},
+	}
+	for _, c := range cases {
+		withConfig(t, map[string]string{"LOCAL_CONFLICT_POLICY": c.policy})
+		match, ok, overridden := resolveLocalCandidates(candidates, trusted)
+		if got := map[bool]string{true: match.Hash}[ok]; got != c.want || overridden != c.overridden {
+			t.Errorf("%s: expected %q (overridden %t), got %q (overridden %t)", c.policy, c.want, c.overridden, got, overridden)
+		}
+	}
+	withConfig(t, map[string]string{"LOCAL_CONFLICT_POLICY": LocalConflictNetScore})
+	if match, ok, _ := resolveLocalCandidates([]localCandidate{{Hash: "a", Distance: 20, Score: 3}, {Hash: "b", Distance: 5, Score: -1}}, trusted); !ok || match.Hash != "a" {
+		t.Errorf("a positive net score should match the nearest spam candidate, got %+v %t", match, ok)
+	}
+
+	// End to end: a hammed near neighbor next to a weakly spammy one
+	useMiniredis(t)
+	refreshLogicConfig()
+	spamBody := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	hamBody := strings.Replace(spamBody, "now", "today", 1)
+	message := func(body string) *enmime.Envelope {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <c@x>\r\nSubject: hi\r\n\r\n" + body + "\r\n"))
+		return env
+	}
+	learn := func(body string, score int64) {
+		for _, ts := range scanEnvelope(context.Background(), message(body)).Signatures {
+			learnSpamHash(ts.Hash, 1, ts.Type)
+			rdb.Set(ctx, LocalScorePrefix+ts.Hash, score, 0)
+		}
+	}
+	learn(spamBody, 1)
+	learn(hamBody, -5)
+
+	analyze := func(policy string) AnalysisResult {
+		withConfig(t, map[string]string{"LOCAL_CONFLICT_POLICY": policy})
+		return scanEnvelope(context.Background(), message(hamBody)).Result
+	}
+	if res := analyze(LocalConflictAnySpam); res.Action != "spam" || res.Label != "local_spam" {
+		t.Errorf("any_spam: the spam candidate should match, got %+v", res)
+	}
+	for _, policy := range []string{LocalConflictNearest, LocalConflictNetScore} {
+		if res := analyze(policy); res.Action != "allow" {
+			t.Errorf("%s: the hammed neighbor should override the spam candidate, got %+v", policy, res)
+		}
+	}
+}
+
+// TestSkipRawForHTML checks that SKIP_RAW_FOR_HTML drops the raw signature of HTML mail only
+func TestSkipRawForHTML(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	text := strings.Repeat("Quarterly newsletter: product updates, upcoming webinars and community highlights for members. ", 4)
+	htmlMail := "From: news@example.com\r\nMessage-ID: <h@x>\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<html><body><div class=\"c\"><p>" + text + "</p></div></body></html>\r\n"
+	textMail := "From: news@example.com\r\nMessage-ID: <t@x>\r\n\r\n" + text + "\r\n"
+	hasRaw := func(raw string) bool {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		for _, ts := range scanEnvelope(context.Background(), env).Signatures {
+			if ts.Type == SigRaw || ts.CoversRaw {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !hasRaw(htmlMail) {
+		t.Fatal("HTML mail should get a raw signature by default")
+	}
+	withConfig(t, map[string]string{"SKIP_RAW_FOR_HTML": "true"})
+	if hasRaw(htmlMail) {
+		t.Error("raw signature should be skipped for HTML mail")
+	}
+	if !hasRaw(textMail) {
+		t.Error("plain text mail should keep its raw coverage")
+	}
+}
+
+// TestSIEMFormats checks the CEF and LEEF serialization of verdicts
+func TestSIEMFormats(t *testing.T) {
+	spam := scanOutcome{Result: AnalysisResult{Action: "spam", Label: "local_spam", ReasonCode: ReasonLocalSpam, MatchType: "url", Distance: 12, Confidence: 0.85}}
+	event := newSIEMEvent(spam, "Billing <billing@Pay-Pal.example>", "<abc=1@x>")
+
+	want := "CEF:0|Mailuminati|Guardian|" + EngineVersion + "|LOCAL_SPAM|Mail verdict spam|8|act=spam cs1Label=label cs1=local_spam cs2Label=matchType cs2=url cs3Label=fromDomain cs3=pay-pal.example cn1Label=distance cn1=12 cfp1Label=confidence cfp1=0.850 externalId=abc\\=1@x"
+	if got := formatCEF(event); got != want {
+		t.Errorf("unexpected CEF line:\n%s\nwant\n%s", got, want)
+	}
+	wantLEEF := "LEEF:1.0|Mailuminati|Guardian|" + EngineVersion + "|LOCAL_SPAM|sev=8\taction=spam\tlabel=local_spam\tmatchType=url\tfromDomain=pay-pal.example\tdistance=12\tconfidence=0.850\tmessageId=abc=1@x"
+	if got := formatLEEF(event); got != wantLEEF {
+		t.Errorf("unexpected LEEF line:\n%q\nwant\n%q", got, wantLEEF)
+	}
+
+	// Exact matches carry their distance 0; verdicts without a match have none
+	exact := newSIEMEvent(scanOutcome{Result: AnalysisResult{Action: "spam", Label: "local_spam", MatchType: "normalized"}}, "", "")
+	if !strings.Contains(formatCEF(exact), "cn1Label=distance cn1=0") || !strings.Contains(formatLEEF(exact), "\tdistance=0") {
+		t.Errorf("exact match should report distance 0: %s / %s", formatCEF(exact), formatLEEF(exact))
+	}
+	clean := newSIEMEvent(scanOutcome{Result: AnalysisResult{Action: "allow"}}, "", "")
+	if strings.Contains(formatCEF(clean), "distance") || strings.Contains(formatLEEF(clean), "distance") {
+		t.Errorf("verdict without a match should not report a distance: %s", formatCEF(clean))
+	}
+
+	// Escaping: pipes in header fields, backslashes and newlines in extensions
+	odd := siemEvent{Action: "soft_spam", Label: "a|b\\c\nd", ReasonCode: "X|Y"}
+	if got := formatCEF(odd); !strings.Contains(got, `|X\|Y|`) || !strings.Contains(got, `cs1=a|b\\c\nd`) || !strings.Contains(got, "|5|") {
+		t.Errorf("CEF escaping failed: %s", got)
+	}
+
+	for accept, want := range map[string]string{
+		"application/x-cef":                          SIEMFormatCEF,
+		"application/json, application/x-leef;q=0.9": SIEMFormatLEEF,
+		"application/json":                           "",
+		"":                                           "",
+	} {
+		if got := negotiateSIEMFormat(accept); got != want {
+			t.Errorf("Accept %q: expected %q, got %q", accept, want, got)
+		}
+	}
+
+	// Through /analyze: negotiated response and verdict log
+	useMiniredis(t)
+	withConfig(t, map[string]string{"VERDICT_LOG_FORMAT": "cef"})
+	var logged bytes.Buffer
+	siemLogger.SetOutput(&logged)
+	defer siemLogger.SetOutput(os.Stdout)
+
+	req := httptest.NewRequest("POST", "/analyze", strings.NewReader("From: a@example.com\r\nMessage-ID: <s@x>\r\nSubject: hello\r\n\r\nShort body.\r\n"))
+	req.Header.Set("Accept", "application/x-cef")
+	rr := httptest.NewRecorder()
+	analyzeHandler(rr, req)
+	if rr.Header().Get("Content-Type") != "application/x-cef" || !strings.HasPrefix(rr.Body.String(), "CEF:0|Mailuminati|Guardian|") || !strings.Contains(rr.Body.String(), "act=allow") {
+		t.Errorf("expected a CEF response, got %q %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if !strings.Contains(logged.String(), "cs3=example.com") || !strings.Contains(logged.String(), "externalId=s@x") {
+		t.Errorf("expected a CEF verdict log line, got %q", logged.String())
+	}
+}
+
+// TestAuditLogRotation checks the size and time rotation triggers, retention of rotated
+// files, and the configured fields and redaction of audit lines
+func TestAuditLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit", "verdicts.log")
+	clock := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	l := &auditLogger{
+		cfg: auditConfig{Path: path, MaxSize: 100, RotateInterval: 24 * time.Hour, Retention: 48 * time.Hour},
+		now: func() time.Time { return clock },
+	}
+	defer l.close()
+	rotated := func() []string {
+		names, _ := filepath.Glob(path + ".*")
+		return names
+	}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+
+	// Size: a line that would grow the file beyond MaxSize goes to a new file
+	l.write(line)
+	l.write(line)
+	if len(rotated()) != 0 {
+		t.Fatalf("80 bytes should not rotate a 100-byte log, got %v", rotated())
+	}
+	l.write(line)
+	if len(rotated()) != 1 || l.size != 40 {
+		t.Fatalf("exceeding the max size should rotate, got %v (size %d)", rotated(), l.size)
+	}
+	if info, _ := os.Stat(rotated()[0]); info.Size() != 80 {
+		t.Errorf("rotated file should hold the previous lines, got %d bytes", info.Size())
+	}
+
+	// A line larger than the limit still goes to a file of its own
+	l.size = 0
+	l.file.Truncate(0)
+	if l.write([]byte(strings.Repeat("y", 150) + "\n")); l.size != 151 {
+		t.Errorf("an oversized line should be written, size %d", l.size)
+	}
+	l.write(line)
+	if len(rotated()) != 2 {
+		t.Errorf("the line after an oversized one should rotate, got %v", rotated())
+	}
+
+	// Time: crossing a period boundary rotates even a small file
+	clock = clock.Add(13 * time.Hour)
+	l.write(line)
+	if len(rotated()) != 2 {
+		t.Fatalf("the same UTC day should not rotate, got %v", rotated())
+	}
+	clock = clock.Add(2 * time.Hour)
+	l.write(line)
+	if len(rotated()) != 3 {
+		t.Fatalf("a new UTC day should rotate, got %v", rotated())
+	}
+
+	// Retention: rotated files older than it are pruned at the next rotation
+	clock = clock.Add(72 * time.Hour)
+	l.write(line)
+	if got := rotated(); len(got) != 1 || !strings.HasSuffix(got[0], clock.Format(auditRotatedTimeFormat)) {
+		t.Errorf("rotated files past retention should be deleted, got %v", got)
+	}
+
+	// A restarted logger keeps rotating by the period of the file's last write
+	l.close()
+	old := clock.Add(-25 * time.Hour)
+	os.Chtimes(path, old, old)
+	restarted := &auditLogger{cfg: l.cfg, now: func() time.Time { return clock }}
+	defer restarted.close()
+	restarted.write(line)
+	if len(rotated()) != 2 {
+		t.Errorf("a file last written in an earlier period should rotate on restart, got %v", rotated())
+	}
+
+	// Fields and redaction
+	useMiniredis(t)
+	withConfig(t, map[string]string{"AUDIT_LOG_FIELDS": "action,reason_code,from_domain,message_id,bogus", "AUDIT_LOG_REDACT": "hash"})
+	cfg := loadAuditConfig()
+	if strings.Join(cfg.Fields, ",") != "action,reason_code,from_domain,message_id" {
+		t.Fatalf("unknown fields should be dropped, got %v", cfg.Fields)
+	}
+	outcome := scanOutcome{Result: AnalysisResult{Action: "spam", Label: "local_spam", ReasonCode: ReasonLocalSpam}, Fingerprint: "fp"}
+	record := auditRecord(cfg, outcome, "Alice <alice@example.com>", "<id@example.com>", clock)
+	if record["action"] != "spam" || record["reason_code"] != "LOCAL_SPAM" || record["fingerprint"] != nil {
+		t.Errorf("record should hold the configured fields only, got %v", record)
+	}
+	if d, _ := record["from_domain"].(string); d == "" || d == "example.com" {
+		t.Errorf("from_domain should be hashed, got %v", record["from_domain"])
+	}
+	cfg.Redact = AuditRedactOmit
+	if record := auditRecord(cfg, outcome, "alice@example.com", "<id@example.com>", clock); record["from_domain"] != nil || record["message_id"] != nil {
+		t.Errorf("personal fields should be omitted, got %v", record)
+	}
+
+	withConfig(t, map[string]string{"AUDIT_LOG_PATH": filepath.Join(dir, "live.log"), "AUDIT_LOG_FIELDS": "", "AUDIT_LOG_REDACT": ""})
+	refreshLogicConfig()
+	defer configureAuditLog(auditConfig{})
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <audit@x>\r\n\r\n" + strings.Repeat("Minutes of the weekly planning meeting, action items below. ", 6)))
+	auditVerdict(analyzeEnvelope(context.Background(), env), "a@example.com", "<audit@x>")
+	data, _ := os.ReadFile(filepath.Join(dir, "live.log"))
+	var written map[string]interface{}
+	if err := json.Unmarshal(data, &written); err != nil || written["action"] != "allow" || written["from_domain"] != "example.com" || written["fingerprint"] == nil {
+		t.Errorf("verdict should be appended with the default fields, got %s (%v)", data, err)
+	}
+}
+
+// TestLargeImageHashing checks the MAX_VISUAL_SIZE boundaries and perceptual hashing of
+// large images
+func TestLargeImageHashing(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+
+	// A smooth picture with pixel noise: same perceptual content, different bytes per seed
+	picture := func(seed int64) []byte {
+		rng := rand.New(rand.NewSource(seed))
+		img := image.NewRGBA(image.Rect(0, 0, 240, 200))
+		for y := 0; y < 200; y++ {
+			for x := 0; x < 240; x++ {
+				v := 128 + 90*math.Sin(float64(x)/19)*math.Cos(float64(y)/27) + float64(rng.Intn(30)-15)
+				img.Set(x, y, color.RGBA{uint8(v), uint8(v / 2), uint8(255 - v), 255})
+			}
+		}
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		return buf.Bytes()
+	}
+	first, second := picture(1), picture(2)
+	if len(first) <= MinVisualSize {
+		t.Fatalf("test picture too small: %d bytes", len(first))
+	}
+	message := func(content []byte) *enmime.Envelope {
+		raw := "From: a@example.com\r\nMessage-ID: <img@x>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nSee picture.\r\n" +
+			"--b\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"p.png\"\r\n\r\n" + base64.StdEncoding.EncodeToString(content) + "\r\n--b--\r\n"
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		return env
+	}
+	attachmentSig := func(content []byte) string {
+		for _, ts := range scanEnvelope(context.Background(), message(content)).Signatures {
+			if ts.Type == SigAttachment {
+				return ts.Hash
+			}
+		}
+		return ""
+	}
+
+	// Size boundaries: up to the cap TLSH, above it skipped
+	size := strconv.Itoa(len(first))
+	withConfig(t, map[string]string{"MAX_VISUAL_SIZE": size})
+	if sig := attachmentSig(first); !isTLSHSignature(sig) {
+		t.Errorf("an image at the cap should get a TLSH signature, got %q", sig)
+	}
+	withConfig(t, map[string]string{"MAX_VISUAL_SIZE": strconv.Itoa(len(first) - 1)})
+	before := testutil.ToFloat64(promLargeImagesSkipped)
+	if sig := attachmentSig(first); sig != "" {
+		t.Errorf("an image over the cap should be skipped, got %q", sig)
+	}
+	if testutil.ToFloat64(promLargeImagesSkipped) != before+1 {
+		t.Error("skipped images should be counted")
+	}
+	withConfig(t, map[string]string{"MAX_VISUAL_SIZE": "0"})
+	if visualHashMode(1<<30) != VisualHashTLSH {
+		t.Error("no cap by default")
+	}
+
+	// Perceptual hashing: re-encoded copies stay close and match
+	withConfig(t, map[string]string{"MAX_VISUAL_SIZE": "1024", "LARGE_IMAGE_PERCEPTUAL": "true"})
+	sig1, sig2 := attachmentSig(first), attachmentSig(second)
+	if !isPerceptualSignature(sig1) || !isPerceptualSignature(sig2) {
+		t.Fatalf("expected perceptual signatures, got %q / %q", sig1, sig2)
+	}
+	distances, _ := distancerForSignature(sig1).Distances(sig1, []string{sig2})
+	if d := distances[sig2]; d > getThresholdForType(SigAttachment) {
+		t.Errorf("copies of the same picture should be within the attachment threshold, distance %d", d)
+	}
+	learnSpamHash(sig1, 1, SigAttachment)
+	if res := scanEnvelope(context.Background(), message(second)).Result; res.Action != "spam" || res.MatchType != "attachment" {
+		t.Errorf("expected a perceptual attachment match, got %+v", res)
+	}
+	if _, err := perceptualHash([]byte("not an image at all")); err == nil {
+		t.Error("undecodable content should not get a perceptual hash")
+	}
+}
+
+// TestReportWhitelistedSender checks that spam reports on whitelisted senders are only
+// learned with an admin override
+func TestReportWhitelistedSender(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+
+	var oracleCalls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&oracleCalls, 1)
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	// Scanned before the sender was whitelisted
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: CEO <ceo@partner.example>\r\nMessage-ID: <wl@x>\r\nSubject: invoice\r\n\r\n" +
+		strings.Repeat("Please settle the attached invoice today, wire details have changed since last quarter. ", 4) + "\r\n"))
+	outcome := scanEnvelope(context.Background(), env)
+	if len(outcome.Hashes) == 0 {
+		t.Fatal("expected scanned hashes")
+	}
+	rdb.SAdd(ctx, "mi:whitelist:domain", "partner.example")
+
+	report := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/report", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		reportHandler(rr, req)
+		return rr
+	}
+	learned := func() bool { return rdb.Exists(ctx, LocalScorePrefix+outcome.Hashes[0]).Val() != 0 }
+
+	before := testutil.ToFloat64(promReportsSuppressed)
+	if rr := report(`{"message-id":"<wl@x>","report_type":"spam"}`, ""); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "whitelisted_sender") {
+		t.Errorf("expected a suppressed report, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := report(`{"message-id":"<wl@x>","report_type":"spam","override_whitelist":true}`, "wrong"); rr.Code != http.StatusForbidden {
+		t.Errorf("an override needs the admin token, got %d %s", rr.Code, rr.Body.String())
+	}
+	if learned() || atomic.LoadInt64(&oracleCalls) != 0 {
+		t.Error("suppressed reports must not be learned nor forwarded")
+	}
+	if got := testutil.ToFloat64(promReportsSuppressed) - before; got != 2 {
+		t.Errorf("expected 2 suppressed reports, got %v", got)
+	}
+
+	if rr := report(`{"message-id":"<wl@x>","report_type":"spam","override_whitelist":true}`, "s3cret"); rr.Code != http.StatusOK {
+		t.Errorf("an admin override should be learned, got %d %s", rr.Code, rr.Body.String())
+	}
+	if !learned() {
+		t.Error("the overridden report should be learned")
+	}
+
+	// Ham reports on whitelisted senders are not restricted
+	if rr := report(`{"message-id":"<wl@x>","report_type":"ham"}`, ""); rr.Code == http.StatusForbidden {
+		t.Errorf("ham reports should not be suppressed, got %d", rr.Code)
+	}
+}
+
+// TestMaxHashLifetime checks that a hash expires MAX_HASH_LIFETIME after it was first
+// learned, despite repeated refreshes
+func TestMaxHashLifetime(t *testing.T) {
+	mr := useMiniredis(t)
+	withConfig(t, map[string]string{"LOCAL_RETENTION_DAYS": "30", "MAX_HASH_LIFETIME": "240h"})
+
+	body := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <life@x>\r\nSubject: hi\r\n\r\n" + body + "\r\n"))
+		return scanEnvelope(context.Background(), env).Result
+	}
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	learnSpamHash(sig, 1, SigNormalized)
+	if ttl := mr.TTL(LocalScorePrefix + sig); ttl != 240*time.Hour {
+		t.Errorf("a new hash should live MAX_HASH_LIFETIME, got %v", ttl)
+	}
+
+	// Learned 9 days ago, reported and matched every day since
+	rdb.Set(ctx, LocalLearnedPrefix+sig, time.Now().Add(-9*24*time.Hour).Unix(), 0)
+	for i := 0; i < 3; i++ {
+		learnSpamHash(sig, 1, SigNormalized)
+		if res := analyze(); res.Action != "spam" {
+			t.Fatalf("the hash should still match within its lifetime, got %+v", res)
+		}
+	}
+	if ttl := mr.TTL(LocalScorePrefix + sig); ttl > 24*time.Hour || ttl <= 0 {
+		t.Errorf("refreshes should not extend past the lifetime, TTL %v", ttl)
+	}
+	mr.FastForward(25 * time.Hour)
+	if rdb.Exists(ctx, LocalScorePrefix+sig).Val() != 0 {
+		t.Error("the hash should have expired")
+	}
+	if res := analyze(); res.Action == "spam" {
+		t.Errorf("an expired hash should not match anymore, got %+v", res)
+	}
+
+	if got := capHashLifetime(time.Hour, time.Now().Add(-300*time.Hour).Unix(), time.Now()); got != time.Second {
+		t.Errorf("a hash past its lifetime should expire at once, got %v", got)
+	}
+	withConfig(t, map[string]string{"MAX_HASH_LIFETIME": "0"})
+	if got := capHashLifetime(720*time.Hour, time.Now().Add(-9000*time.Hour).Unix(), time.Now()); got != 720*time.Hour {
+		t.Errorf("no cap by default, got %v", got)
+	}
+}
+
+// TestTopDomains checks the bounded top-N spam domain tracker: eviction, window and endpoint
+func TestTopDomains(t *testing.T) {
+	now := time.Now()
+	tracker := newDomainTracker(3, time.Hour, now)
+	for domain, n := range map[string]int{"a.example": 5, "b.example": 3, "c.example": 1} {
+		for i := 0; i < n; i++ {
+			tracker.add(domain, now)
+		}
+	}
+
+	// Full: the least counted domain is evicted and the newcomer inherits its count
+	tracker.add("d.example", now)
+	top, _ := tracker.top(10, now)
+	if len(top) != 3 {
+		t.Fatalf("the tracker should stay bounded to 3 domains, got %+v", top)
+	}
+	want := []domainCount{{"a.example", 5, 0}, {"b.example", 3, 0}, {"d.example", 2, 1}}
+	for i := range want {
+		if top[i] != want[i] {
+			t.Errorf("rank %d: expected %+v, got %+v", i, want[i], top[i])
+		}
+	}
+	// A burst of a new domain climbs past established ones
+	for i := 0; i < 4; i++ {
+		tracker.add("e.example", now)
+	}
+	if top, _ := tracker.top(1, now); top[0].Domain != "e.example" || top[0].Count != 6 || top[0].Error != 2 {
+		t.Errorf("expected e.example on top with its error bound, got %+v", top)
+	}
+	// New window
+	if top, since := tracker.top(10, now.Add(time.Hour)); len(top) != 0 || !since.Equal(now.Add(time.Hour)) {
+		t.Errorf("a new window should start empty, got %+v since %v", top, since)
+	}
+
+	// Through analyze verdicts and the endpoint
+	useMiniredis(t)
+	withConfig(t, map[string]string{"TOP_DOMAINS_SIZE": "2"})
+	rdb.SAdd(ctx, "mi:blacklist:domain", "spam.example", "junk.example")
+	for _, from := range []string{"x@spam.example", "y@spam.example", "z@junk.example"} {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: " + from + "\r\nMessage-ID: <" + from + ">\r\nSubject: hi\r\n\r\nBuy now.\r\n"))
+		analyzeEnvelope(context.Background(), env)
+	}
+	rr := httptest.NewRecorder()
+	topDomainsHandler(rr, httptest.NewRequest("GET", "/stats/top-domains", nil))
+	var resp struct {
+		Domains []domainCount `json:"domains"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || len(resp.Domains) != 2 || resp.Domains[0] != (domainCount{"spam.example", 2, 0}) {
+		t.Errorf("unexpected top domains: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Sender domains are personal data: admin only
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret"})
+	rr = httptest.NewRecorder()
+	requireAdmin(topDomainsHandler)(rr, httptest.NewRequest("GET", "/stats/top-domains", nil))
+	if rr.Code != http.StatusUnauthorized || strings.Contains(rr.Body.String(), "spam.example") {
+		t.Errorf("unauthenticated top domains should be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	withConfig(t, map[string]string{"TOP_DOMAINS_SIZE": "0"})
+	rr = httptest.NewRecorder()
+	topDomainsHandler(rr, httptest.NewRequest("GET", "/stats/top-domains", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when disabled, got %d", rr.Code)
+	}
+}
+
+// TestOracleLocalOnlyTypes checks that signature types configured local-only never call the oracle
+func TestOracleLocalOnlyTypes(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ORACLE_LOCAL_ONLY_TYPES": "normalized, raw, subject"})
+
+	var mu sync.Mutex
+	asked := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		asked[req["email_body_hash"]] = true
+		mu.Unlock()
+		w.Write([]byte(`{"result": {"action": "allow"}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	body := strings.Repeat("Your parcel could not be delivered, confirm the shipping fee to reschedule it. ", 3) +
+		"https://parcel-tracking.example/confirm?ref=88231 https://parcel-payments.example/fee/pay?session=4471 https://parcel-help.example/support/contact"
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <lo@x>\r\nSubject: hi\r\n\r\n" + body + "\r\n"))
+	first := scanEnvelope(context.Background(), env)
+	types := map[SignatureType]string{}
+	for _, ts := range first.Signatures {
+		types[ts.Type] = ts.Hash
+		for _, band := range extractBands_6_3(ts.Hash) {
+			rdb.Set(ctx, FragKeyPrefix+band, "1", 0)
+		}
+	}
+	if types[SigNormalized] == "" || types[SigURL] == "" {
+		t.Fatalf("expected normalized and url signatures, got %+v", first.Signatures)
+	}
+
+	res := scanEnvelope(context.Background(), env).Result
+	if asked[types[SigNormalized]] {
+		t.Error("a local-only type should not call the oracle")
+	}
+	if !asked[types[SigURL]] {
+		t.Error("other types should still call the oracle")
+	}
+	if !res.ProximityMatch {
+		t.Errorf("local-only band matches are still proximity matches, got %+v", res)
+	}
+
+	// Default (the verdict caches are cleared so the oracle is asked again)
+	withConfig(t, map[string]string{"ORACLE_LOCAL_ONLY_TYPES": ""})
+	rdb.FlushDB(ctx)
+	for _, ts := range first.Signatures {
+		for _, band := range extractBands_6_3(ts.Hash) {
+			rdb.Set(ctx, FragKeyPrefix+band, "1", 0)
+		}
+	}
+	scanEnvelope(context.Background(), env)
+	if !asked[types[SigNormalized]] {
+		t.Error("every type should call the oracle by default")
+	}
+}
+
+func TestMessageBodyPool(t *testing.T) {
+	// The size cap is still enforced
+	big := bytes.Repeat([]byte("a"), MaxProcessSize+1000)
+	body, err := readMessageBody(bytes.NewReader(big), int64(len(big)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Len() != MaxProcessSize {
+		t.Errorf("expected the body to be cut at %d bytes, got %d", MaxProcessSize, body.Len())
+	}
+	releaseMessageBody(body)
+
+	// A parsed envelope does not keep references to the pooled buffer
+	msg := "From: a@example.com\r\nSubject: pooled\r\n\r\nFirst message body\r\n"
+	body, err = readMessageBody(strings.NewReader(msg), int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(body.Bytes(), bytes.Repeat([]byte("x"), body.Len()))
+	releaseMessageBody(body)
+	if strings.TrimSpace(env.Text) != "First message body" || env.GetHeader("Subject") != "pooled" {
+		t.Errorf("envelope changed with its buffer: %q / %q", env.Text, env.GetHeader("Subject"))
+	}
+}
+
+// BenchmarkReadMessageBody compares the former io.ReadAll read of /analyze bodies with the
+// pooled buffers (go test -bench ReadMessageBody -benchmem)
+func BenchmarkReadMessageBody(b *testing.B) {
+	attachment := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(attachment)
+	msg := []byte("From: a@example.com\r\nSubject: bench\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=B\r\n\r\n--B\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+		"--B\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(attachment) + "\r\n--B--\r\n")
+
+	b.Run("readall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := io.ReadAll(io.LimitReader(bytes.NewReader(msg), MaxProcessSize))
+			if err != nil || len(data) != len(msg) {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, err := readMessageBody(bytes.NewReader(msg), int64(len(msg)))
+			if err != nil || body.Len() != len(msg) {
+				b.Fatal(err)
+			}
+			releaseMessageBody(body)
+		}
+	})
+}
+
+func TestDisplayNameSpoof(t *testing.T) {
+	protected := parseProtectedDisplayNames([]string{"paypal=paypal.com|paypal.fr", "john smith=example.com", "amazon", "apple=apple.com"})
+	tests := []struct {
+		name  string
+		from  string
+		spoof bool
+	}{
+		{"Brand from its domain", "PayPal <service@paypal.com>", false},
+		{"Brand from a subdomain", "PayPal Support <service@mail.paypal.fr>", false},
+		{"Brand from another domain", "PayPal Support <x@random.ru>", true},
+		{"Quoted and punctuated", `"PAYPAL-Billing" <billing@random.ru>`, true},
+		{"Split brand", "Pay Pal <x@random.ru>", true},
+		{"Look-alike characters", "P\u0430y\u0440\u0430l <x@random.ru>", true},
+		{"Zero-width character", "Pay\u200bPal <x@random.ru>", true},
+		{"Digit look-alike", "PayPa1 <x@random.ru>", true},
+		{"Address as display name", `"service@paypal.com" <x@random.ru>`, true},
+		{"Encoded word", "=?UTF-8?B?UGF5UGFsIFNlcnZpY2U=?= <x@random.ru>", true},
+		{"Person", "John Smith <john.smith@gmail.example>", true},
+		{"Person from the company", "John Smith <john@example.com>", false},
+		{"Name without domains", "Amazon <ship@amazon.de>", false},
+		{"Name without domains, other domain", "Amazon Prime <ship@amaz0n-prime.example>", true},
+		{"Brand inside a word", "Pineapple Farm <news@farm.example>", false},
+		{"No display name", "x@random.ru", false},
+		{"Malformed header", "PayPal Service <x@random.ru", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := tt.from
+			if strings.HasPrefix(from, "=?") {
+				// As seen by the heuristics, after enmime decoded the header
+				env, err := enmime.ReadEnvelope(strings.NewReader("From: " + from + "\r\n\r\nHello\r\n"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				from = env.GetHeader("From")
+			}
+			sig, got := checkDisplayNameSpoof(from, protected)
+			if got != tt.spoof {
+				t.Fatalf("checkDisplayNameSpoof(%q) = %v (%s), want %v", from, got, sig.Detail, tt.spoof)
+			}
+			if got && sig.Label != "display_name_spoof" {
+				t.Errorf("unexpected label %q", sig.Label)
+			}
+		})
+	}
+
+	// Wired into the heuristics, off while the list is empty
+	raw := "From: PayPal Support <x@random.ru>\r\nSubject: Account\r\n\r\nPlease confirm."
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, map[string]string{"PROTECTED_DISPLAY_NAMES": ""})
+	if signals := evaluateHeuristics(env, messageFacts{}); len(signals) != 0 {
+		t.Errorf("no protected names should not fire, got %v", signals)
+	}
+	withConfig(t, map[string]string{"PROTECTED_DISPLAY_NAMES": "PayPal=paypal.com"})
+	signals := evaluateHeuristics(env, messageFacts{})
+	if len(signals) != 1 || signals[0].Label != "display_name_spoof" {
+		t.Fatalf("expected a display_name_spoof signal, got %v", signals)
+	}
+	res := AnalysisResult{Action: "allow"}
+	applyHeuristic(&res, signals[0])
+	if res.Action != "soft_spam" || reasonCodeFor(res) != ReasonDisplayNameSpoof {
+		t.Errorf("allow should become soft_spam/DISPLAY_NAME_SPOOF, got %+v", res)
+	}
+}
+
+// TestAdminReportDedup checks that report dedup keys can be listed and cleared, so a
+// message can be reported again
+func TestAdminReportDedup(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "s3cret", "REPORT_CONTENT_DEDUP_WINDOW": "24h"})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <dedup@x>\r\nSubject: hi\r\n\r\n" +
+		strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6) + "\r\n"))
+	outcome := scanEnvelope(context.Background(), env)
+	if outcome.Fingerprint == "" {
+		t.Fatal("expected a content fingerprint")
+	}
+	report := func() int {
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"<dedup@x>","report_type":"spam"}`)))
+		return rr.Code
+	}
+	if code := report(); code != http.StatusOK {
+		t.Fatalf("first report: got %d", code)
+	}
+	if code := report(); code != http.StatusConflict {
+		t.Fatalf("second report should be a duplicate, got %d", code)
+	}
+
+	admin := func(method, query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/report-dedup?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		requireAdmin(adminReportDedupHandler)(rr, req)
+		return rr
+	}
+	if rr := admin("DELETE", "message_id="+url.QueryEscape("<dedup@x>"), ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rr.Code)
+	}
+	if rr := admin("GET", "fingerprint=not-a-fingerprint", "s3cret"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid fingerprint, got %d", rr.Code)
+	}
+
+	// The content key is found through the stored scan of the Message-ID
+	rr := admin("GET", "message_id="+url.QueryEscape("<dedup@x>"), "s3cret")
+	var listed struct {
+		Fingerprint string             `json:"fingerprint"`
+		Keys        []reportDedupEntry `json:"keys"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", rr.Code, rr.Body.String())
+	}
+	if listed.Fingerprint != outcome.Fingerprint || len(listed.Keys) != 2 {
+		t.Fatalf("expected the Message-ID and content keys, got %+v", listed)
+	}
+	for _, k := range listed.Keys {
+		if k.TTL <= 0 {
+			t.Errorf("expected a TTL on %s, got %d", k.Key, k.TTL)
+		}
+	}
+
+	rr = admin("DELETE", "message_id="+url.QueryEscape("<dedup@x>"), "s3cret")
+	var cleared struct {
+		Cleared []string `json:"cleared"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &cleared)
+	if rr.Code != http.StatusOK || len(cleared.Cleared) != 2 {
+		t.Fatalf("expected 2 cleared keys, got %d %s", rr.Code, rr.Body.String())
+	}
+	if code := report(); code != http.StatusOK {
+		t.Errorf("the message should be reportable again, got %d", code)
+	}
+
+	// By fingerprint alone, only the content key
+	rdb.Set(ctx, contentReportKey(outcome.Fingerprint, "spam", nil), "<other@x>", time.Hour)
+	rr = admin("DELETE", "fingerprint="+outcome.Fingerprint, "s3cret")
+	json.Unmarshal(rr.Body.Bytes(), &cleared)
+	if len(cleared.Cleared) != 1 || !strings.HasPrefix(cleared.Cleared[0], ContentReportDedupPrefix) {
+		t.Errorf("expected the content key only, got %v", cleared.Cleared)
+	}
+}
+
+// TestTLSHLengthInclusion checks that TLSH_IGNORE_LENGTH_TYPES leaves the length
+// difference out of the distances of the listed types only
+func TestTLSHLengthInclusion(t *testing.T) {
+	useMiniredis(t)
+	text := "Your mailbox is almost full, confirm your account now to keep receiving messages. "
+	short, _ := computeLocalTLSH(normalizeEmailBody(strings.Repeat(text, 6), ""))
+	long, _ := computeLocalTLSH(normalizeEmailBody(strings.Repeat(text, 24), ""))
+
+	withLen, err1 := computeDistance(short, long, true, 0)
+	withoutLen, err2 := computeDistance(short, long, false, 0)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if withoutLen >= withLen {
+		t.Errorf("leaving the length out should shorten the distance, got %d with and %d without", withLen, withoutLen)
+	}
+	batch, _ := computeDistanceBatch(short, []string{long}, []string{long}, false)
+	if batch[long] != withoutLen {
+		t.Errorf("batch and single distances disagree: %d vs %d", batch[long], withoutLen)
+	}
+
+	withConfig(t, map[string]string{"TLSH_IGNORE_LENGTH_TYPES": "normalized, subject, bogus"})
+	if getLengthInclusionForType(SigNormalized) || getLengthInclusionForType(SigSubject) || !getLengthInclusionForType(SigAttachment) {
+		t.Error("only the listed types should leave the length out")
+	}
+	normalized, _ := distancerForType(short, SigNormalized).Distances(short, []string{long})
+	attachment, _ := distancerForType(short, SigAttachment).Distances(short, []string{long})
+	if normalized[long] != withoutLen || attachment[long] != withLen {
+		t.Errorf("expected %d (normalized) and %d (attachment), got %d and %d", withoutLen, withLen, normalized[long], attachment[long])
+	}
+	if distancerForType(urlSetSignature([]string{"https://a.example/x"}), SigNormalized).Name() != "jaccard" {
+		t.Error("other metrics should not be affected")
+	}
+
+	// A long copy of a short learned message matches once the length is left out
+	analyze := func() AnalysisResult {
+		env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <len@x>\r\nSubject: hi\r\n\r\n" + strings.Repeat(text, 24) + "\r\n"))
+		return scanEnvelope(context.Background(), env).Result
+	}
+	withConfig(t, map[string]string{"TLSH_IGNORE_LENGTH_TYPES": ""})
+	learnSpamHash(short, 1, SigNormalized)
+	if res := analyze(); res.Label == "local_spam" {
+		t.Errorf("the length difference should keep the long copy out of threshold, got %+v", res)
+	}
+	withConfig(t, map[string]string{"TLSH_IGNORE_LENGTH_TYPES": "normalized"})
+	if res := analyze(); res.Label != "local_spam" || res.MatchType != "normalized" || res.Distance != withoutLen {
+		t.Errorf("expected a local_spam match at distance %d, got %+v", withoutLen, res)
+	}
+}
+
+func TestDominantForwardedBlock(t *testing.T) {
+	original := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages.\n", 4)
+	quoted := "> " + strings.ReplaceAll(strings.TrimSpace(original), "\n", "\n> ")
+
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"Forward separator", "FYI\n\n---------- Forwarded message ---------\nFrom: x@random.ru\nDate: Mon\nSubject: hi\nTo: me@example.com\n\n" + original, true},
+		{"Quoted reply", "Is this legit?\n\nOn Mon, 1 Jan 2026, x@random.ru wrote:\n" + quoted + "\n\n-- \nBob", true},
+		{"Short quote", "Thanks!\n\n> see you tomorrow\n", false},
+		{"No quoting", original, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, ok := dominantForwardedBlock(tt.text, 100)
+			if ok != tt.want {
+				t.Fatalf("got %v (%q), want %v", ok, block, tt.want)
+			}
+			if ok && block != strings.TrimSpace(original) {
+				t.Errorf("expected the dequoted original, got %q", block)
+			}
+		})
+	}
+
+	html := `<div>FYI</div><blockquote class="gmail_quote"><p>Original</p><blockquote>older</blockquote></blockquote>`
+	if block, ok := forwardedHTMLBlock(html); !ok || block != `<p>Original</p><blockquote>older</blockquote>` {
+		t.Errorf("expected the outermost blockquote content, got %q", block)
+	}
+}
+
+// TestForwardedReportLearning checks that a spam report on a forwarded-with-comment copy
+// learns the signature of the original
+func TestForwardedReportLearning(t *testing.T) {
+	useMiniredis(t)
+	refreshLogicConfig()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	original := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages.\r\n", 6)
+	origEnv, _ := enmime.ReadEnvelope(strings.NewReader("From: IT Desk <it@random.ru>\r\nMessage-ID: <orig@x>\r\nSubject: mailbox\r\n\r\n" + original))
+	originalSig, _ := computeLocalTLSH(normalizeEmailBody(origEnv.Text, origEnv.HTML))
+	forward := "From: user@example.com\r\nMessage-ID: <%s>\r\nSubject: Fwd: mailbox\r\n\r\n" +
+		"FYI, I keep getting these, please block them.\r\n\r\n---------- Forwarded message ---------\r\n" +
+		"From: IT Desk <it@random.ru>\r\nDate: Mon, 1 Jan 2026 10:00:00 +0000\r\nSubject: mailbox\r\nTo: user@example.com\r\n\r\n" + original
+
+	learnedFrom := func(msgID string) map[string]bool {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(fmt.Sprintf(forward, msgID)))
+		scanEnvelope(context.Background(), env)
+		// Scan results are stored asynchronously
+		deadline := time.Now().Add(time.Second)
+		for rdb.Exists(ctx, "mi:msgid:"+messageIDHash("<"+msgID+">")).Val() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("scan result not stored")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		rr := httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest("POST", "/report", strings.NewReader(`{"message-id":"<`+msgID+`>","report_type":"spam"}`)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("report: %d %s", rr.Code, rr.Body.String())
+		}
+		learned := map[string]bool{}
+		for _, key := range rdb.Keys(ctx, LocalScorePrefix+"*").Val() {
+			learned[strings.TrimPrefix(key, LocalScorePrefix)] = true
+		}
+		return learned
+	}
+
+	// Disabled: the whole forward is learned, comment and headers included
+	if learnedFrom("fwd1@x")[originalSig] {
+		t.Fatal("without FORWARDED_BLOCK_MIN_SIZE the original signature should not be learned")
+	}
+
+	rdb.FlushDB(ctx)
+	withConfig(t, map[string]string{"FORWARDED_BLOCK_MIN_SIZE": "200"})
+	if !learnedFrom("fwd2@x")[originalSig] {
+		t.Fatal("the forwarded block should be learned as the original signature")
+	}
+	if res := scanEnvelope(context.Background(), origEnv).Result; res.Label != "local_spam" || res.Distance != 0 {
+		t.Errorf("the original should now match at distance 0, got %+v", res)
+	}
+}
+
+// TestMinLengthForType checks each signature type's MIN_LENGTH_<TYPE> gate
+func TestMinLengthForType(t *testing.T) {
+	useMiniredis(t)
+	rng := rand.New(rand.NewSource(7))
+	attachment := make([]byte, 2048)
+	rng.Read(attachment)
+	picture := make([]byte, 64*1024)
+	rng.Read(picture)
+
+	text := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6) +
+		"\r\nhttps://mailbox-quota.example/confirm?id=1 https://mailbox-help.example/support https://mailbox-quota.example/unsubscribe\r\n"
+	html := "<html><body><table width=\"600\"><tr><td class=\"header\"><img src=\"logo.png\"></td></tr>" +
+		strings.Repeat("<tr><td class=\"row\"><p>Your mailbox is almost full</p><a href=\"https://mailbox-quota.example/confirm\">Confirm</a></td></tr>", 4) +
+		"</table></body></html>"
+	build := func(subject string) *enmime.Envelope {
+		raw := "From: a@example.com\r\nMessage-ID: <minlen@x>\r\nSubject: " + subject + "\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"m\"\r\n\r\n--m\r\n" +
+			"Content-Type: multipart/alternative; boundary=\"a\"\r\n\r\n--a\r\nContent-Type: text/plain\r\n\r\n" + text +
+			"\r\n--a\r\nContent-Type: text/html\r\n\r\n" + html + "\r\n--a--\r\n" +
+			"--m\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"a.bin\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			base64.StdEncoding.EncodeToString(attachment) + "\r\n" +
+			"--m\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=\"p.png\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			base64.StdEncoding.EncodeToString(picture) + "\r\n--m--\r\n"
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env
+	}
+	counts := func(env *enmime.Envelope) map[SignatureType]int {
+		c := map[SignatureType]int{}
+		for _, ts := range scanEnvelope(context.Background(), env).Signatures {
+			c[ts.Type]++
+		}
+		return c
+	}
+	longSubject := build("Action required: your mailbox storage quota is exceeded")
+
+	base := map[string]string{"COMBINED_SIGNATURE": "true", "STRUCTURE_SIGNATURE": "true", "REDUNDANT_RAW_DISTANCE": "-1"}
+	withConfig(t, base)
+	all := counts(longSubject)
+	for _, st := range allSignatureTypes {
+		want := 1
+		if st == SigAttachment {
+			want = 2 // The binary attachment and the picture
+		}
+		if all[st] != want {
+			t.Fatalf("expected %d %s signature(s) with the default gates, got %v", want, st, all)
+		}
+	}
+
+	// Raising each gate drops that type only
+	for _, tt := range []struct {
+		key   string
+		typ   SignatureType
+		after int
+	}{
+		{"MIN_LENGTH_NORMALIZED", SigNormalized, 0},
+		{"MIN_LENGTH_RAW", SigRaw, 0},
+		{"MIN_LENGTH_URL", SigURL, 0},
+		{"MIN_LENGTH_SUBJECT", SigSubject, 0},
+		{"MIN_LENGTH_ATTACHMENT", SigAttachment, 1},
+		{"MIN_VISUAL_SIZE", SigAttachment, 1},
+		{"MIN_LENGTH_COMBINED", SigCombined, 0},
+		{"MIN_LENGTH_STRUCTURE", SigStructure, 0},
+	} {
+		t.Run(tt.key, func(t *testing.T) {
+			cfg := map[string]string{tt.key: "10000000"}
+			for k, v := range base {
+				cfg[k] = v
+			}
+			withConfig(t, cfg)
+			got := counts(longSubject)
+			if got[tt.typ] != tt.after {
+				t.Errorf("expected %d %s signature(s), got %v", tt.after, tt.typ, got)
+			}
+			for _, st := range allSignatureTypes {
+				if st != tt.typ && got[st] != all[st] {
+					t.Errorf("%s should not change %s signatures: %v", tt.key, st, got)
+				}
+			}
+		})
+	}
+
+	// Lowering a gate lets shorter content in
+	shortSubject := build("Quota exceeded now")
+	withConfig(t, base)
+	if counts(shortSubject)[SigSubject] != 0 {
+		t.Error("a short subject should get no signature by default")
+	}
+	withConfig(t, map[string]string{"MIN_LENGTH_SUBJECT": "10"})
+	if getMinLengthForType(SigSubject) != 10 || counts(shortSubject)[SigSubject] != 1 {
+		t.Error("MIN_LENGTH_SUBJECT should let a shorter subject get a signature")
+	}
+}
+
+// TestUserSignals checks that behavior signals demote the learned hashes of a message,
+// once per signal, never below zero
+func TestUserSignals(t *testing.T) {
+	useMiniredis(t)
+	withConfig(t, map[string]string{"SIGNAL_WEIGHT_REPLIED": "2", "SIGNAL_WEIGHT_MOVED_TO_INBOX": "5"})
+
+	body := strings.Repeat("Your mailbox is almost full, confirm your account now to keep receiving messages. ", 6)
+	sig, _ := computeLocalTLSH(normalizeEmailBody(body, ""))
+	learnSpamHash(sig, 3, SigNormalized)
+
+	env, _ := enmime.ReadEnvelope(strings.NewReader("From: a@example.com\r\nMessage-ID: <signal@x>\r\nSubject: hi\r\n\r\n" + body + "\r\n"))
+	scanEnvelope(context.Background(), env)
+	deadline := time.Now().Add(time.Second)
+	for rdb.Exists(ctx, "mi:msgid:"+messageIDHash("<signal@x>")).Val() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scan result not stored")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	send := func(msgID, signal string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		signalHandler(rr, httptest.NewRequest("POST", "/signal", strings.NewReader(`{"message-id":"`+msgID+`","signal":"`+signal+`"}`)))
+		return rr
+	}
+	score := func() int64 { s, _ := rdb.Get(ctx, LocalScorePrefix+sig).Int64(); return s }
+
+	before := testutil.ToFloat64(promUserSignals.WithLabelValues("replied"))
+	if rr := send("<signal@x>", "replied"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), sig) {
+		t.Fatalf("replied: %d %s", rr.Code, rr.Body.String())
+	}
+	if got := score(); got != 1 {
+		t.Errorf("replied (weight 2) should demote 3 to 1, got %d", got)
+	}
+	if ttl := rdb.TTL(ctx, SignalKeyPrefix+messageIDHash("<signal@x>")+":replied").Val(); ttl != ScanRetention {
+		t.Errorf("the signal dedup key should live as long as the stored scan, TTL %s", ttl)
+	}
+	if rr := send("<signal@x>", "replied"); rr.Code != http.StatusConflict || score() != 1 {
+		t.Errorf("a repeated signal should be a duplicate, got %d (score %d)", rr.Code, score())
+	}
+	if got := testutil.ToFloat64(promUserSignals.WithLabelValues("replied")) - before; got != 2 {
+		t.Errorf("expected 2 replied signals counted, got %v", got)
+	}
+
+	// Another signal applies, down to zero only
+	if rr := send("<signal@x>", "moved_to_inbox"); rr.Code != http.StatusOK || score() != 0 {
+		t.Errorf("moved_to_inbox should demote to 0, got %d (score %d)", rr.Code, score())
+	}
+	if history := loadReportHistory(sig, time.Now()); history.Reports != 3 {
+		t.Errorf("expected the learned report and 2 signals in the history, got %+v", history)
+	}
+
+	if rr := send("<signal@x>", "read"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "signal_disabled") {
+		t.Errorf("read has no weight by default, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("<signal@x>", "starred"); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown signals should be rejected, got %d", rr.Code)
+	}
+	if rr := send("<unknown@x>", "replied"); rr.Code != http.StatusNotFound {
+		t.Errorf("signals on unscanned messages should return 404, got %d", rr.Code)
+	}
+
+	// Signals un-learn spam: the endpoint is admin only
+	rr := httptest.NewRecorder()
+	withConfig(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	requireAdmin(signalHandler)(rr, httptest.NewRequest("POST", "/signal", strings.NewReader(`{"message-id":"<signal@x>","signal":"replied"}`)))
+	if rr.Code != http.StatusUnauthorized && rr.Code != http.StatusForbidden {
+		t.Errorf("unauthenticated signals should be refused, got %d", rr.Code)
+	}
+}
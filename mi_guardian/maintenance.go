@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Scheduled oracle maintenance windows ---
+
+// maintenanceWindow is a recurring period (UTC) during which the oracle is known to be down
+type maintenanceWindow struct {
+	Spec   string
+	AnyDay bool
+	Day    time.Weekday
+	Start  int // Minutes since midnight
+	End    int // Minutes since midnight; before Start when the window crosses midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseMaintenanceWindows parses "[day ]HH:MM-HH:MM" entries separated by commas,
+// e.g. "02:00-03:00, sun 23:30-01:00". Times are UTC.
+func parseMaintenanceWindows(spec string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		w := maintenanceWindow{Spec: entry, AnyDay: true}
+		fields := strings.Fields(entry)
+		if len(fields) == 2 {
+			day, ok := weekdays[fields[0]]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", fields[0])
+			}
+			w.AnyDay, w.Day = false, day
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid window %q", entry)
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q", entry)
+		}
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("empty window %q", entry)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// contains reports whether t falls inside the window
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	onDay := func(d time.Weekday) bool { return w.AnyDay || t.Weekday() == d }
+	if w.Start < w.End {
+		return onDay(w.Day) && minute >= w.Start && minute < w.End
+	}
+	// Crosses midnight: the tail belongs to the next day
+	return (onDay(w.Day) && minute >= w.Start) || (onDay((w.Day+1)%7) && minute < w.End)
+}
+
+// oracleInMaintenance reports whether now is inside a configured ORACLE_MAINTENANCE_WINDOWS window
+func oracleInMaintenance(now time.Time) bool {
+	windows, _ := maintenanceWindows.Load().([]maintenanceWindow)
+	for _, w := range windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipOracleCall reports (and counts) an oracle call suppressed by a maintenance window
+func skipOracleCall(call string) bool {
+	if !oracleInMaintenance(time.Now()) {
+		return false
+	}
+	promOracleSkipped.WithLabelValues(call).Inc()
+	return true
+}
+
+// configHandler exposes the operational configuration that affects verdicts
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	windows, _ := maintenanceWindows.Load().([]maintenanceWindow)
+	specs := make([]string, 0, len(windows))
+	for _, win := range windows {
+		specs = append(specs, win.Spec)
+	}
+	hamCfg := currentHamSampleConfig()
+	heuristicCfg := currentHeuristicConfig()
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"oracle_maintenance": map[string]interface{}{
+			"windows":  specs,
+			"timezone": "UTC",
+			"active":   oracleInMaintenance(time.Now()),
+		},
+		"subject": map[string]interface{}{
+			"signature_min_length": getMinLengthForType(SigSubject) + 1,
+			"empty_subject_check":  heuristicEnabled("empty_subject"),
+		},
+		"heuristics": map[string]interface{}{
+			"active":  heuristicCfg.activeHeuristics(),
+			"weights": heuristicCfg.weightPercents(),
+		},
+		"oracle_contribution": map[string]interface{}{
+			"ham_sampling": map[string]interface{}{
+				"enabled": hamCfg.Rate > 0,
+				"rate":    hamCfg.Rate,
+				"types":   hamCfg.typeNames(),
+			},
+		},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Operating mode (incident panic button) ---
+
+// OperatingModeKey holds the fleet-wide operating mode. Every node reads it from the
+// shared Redis on each analysis, so a change applies to the whole fleet at once.
+const OperatingModeKey = "mi_meta:mode"
+
+const (
+	ModeNormal   = "normal"    // Regular verdicts
+	ModeAllowAll = "allow_all" // Every message is allowed without scanning
+	ModeScanOnly = "scan_only" // Messages are scanned (and stored for /report) but never blocked
+)
+
+// validModes lists the modes accepted by /admin/mode
+var validModes = []string{ModeNormal, ModeAllowAll, ModeScanOnly}
+
+// currentMode returns the operating mode, falling back to normal when unset or unreadable
+func currentMode() string {
+	mode, err := rdb.Get(ctx, OperatingModeKey).Result()
+	if err != nil || !isValidMode(mode) {
+		mode = ModeNormal
+	}
+	for _, m := range validModes {
+		if m == mode {
+			promMode.WithLabelValues(m).Set(1)
+		} else {
+			promMode.WithLabelValues(m).Set(0)
+		}
+	}
+	return mode
+}
+
+func isValidMode(mode string) bool {
+	for _, m := range validModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// setMode stores a new operating mode; normal simply clears the override
+func setMode(mode string) error {
+	if mode == ModeNormal {
+		return rdb.Del(ctx, OperatingModeKey).Err()
+	}
+	return rdb.Set(ctx, OperatingModeKey, mode, 0).Err()
+}
+
+// applyScanOnly turns a verdict into an allow while keeping the match details for investigation
+func applyScanOnly(res *AnalysisResult, messageID string) {
+	if res.Action == "spam" || res.Action == "soft_spam" {
+		log.Printf("[Mailuminati] Scan-only mode: %s/%s not enforced | Message-ID: %s", res.Action, res.Label, messageID)
+	}
+	res.Action = "allow"
+	res.Label = ModeScanOnly
+	res.Confidence = 0
+}
+
+// adminModeHandler reads (GET) or changes (POST {"mode": "..."}) the operating mode
+func adminModeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var reqBody struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		mode := strings.ToLower(strings.TrimSpace(reqBody.Mode))
+		if !isValidMode(mode) {
+			http.Error(w, "Mode must be one of: "+strings.Join(validModes, ", "), http.StatusBadRequest)
+			return
+		}
+		previous := currentMode()
+		if err := setMode(mode); err != nil && err != redis.Nil {
+			http.Error(w, "Redis error", http.StatusInternalServerError)
+			return
+		}
+		if mode != previous {
+			log.Printf("[Mailuminati] Operating mode changed: %s -> %s (from %s)", previous, mode, r.RemoteAddr)
+			promModeChanges.WithLabelValues(mode).Inc()
+		}
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respBytes, _ := json.Marshal(map[string]string{"mode": currentMode()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
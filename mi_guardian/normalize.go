@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --- Body normalization pipeline ---
+
+// normalizeStep is one named transformation of the body, applied in NORMALIZE_STEPS order
+type normalizeStep struct {
+	Name  string
+	Rule  string // pattern=>replacement of a custom rule ("" for built-ins)
+	Apply func(string) string
+}
+
+// regexStep replaces every match of a pattern
+func regexStep(name, pattern, replacement string) normalizeStep {
+	re := regexp.MustCompile(pattern)
+	return normalizeStep{Name: name, Apply: func(body string) string {
+		return re.ReplaceAllString(body, replacement)
+	}}
+}
+
+// flagStep is a step enabled by its own setting: its place in the pipeline only matters
+// while enabled is on
+func flagStep(name string, enabled *atomic.Bool, apply func(string) string) normalizeStep {
+	return normalizeStep{Name: name, Apply: func(body string) string {
+		if !enabled.Load() {
+			return body
+		}
+		return apply(body)
+	}}
+}
+
+// builtinNormalizeSteps are the available steps, in the default (historical) order.
+// Changing the order or disabling steps changes the hashes: locally learned and
+// oracle signatures computed with another pipeline will match less reliably.
+var builtinNormalizeSteps = []normalizeStep{
+	flagStep("dequote", &dequoteForwards, func(body string) string { return dequoteHTML(dequoteText(body)) }),
+	flagStep("base64", &base64Decode, decodeBase64Evasion),
+	flagStep("emoji", &emojiNormalize, normalizeEmoji),
+	regexStep("img_src", `(?i)<img([^>]*?)src="[^"]*"([^>]*?)>`, `<img${1}src="imgurl"${2}>`),
+	regexStep("hex_ids", `[0-9a-fA-F]{8,}`, "****"),
+	regexStep("long_digits", `\d{6,}`, "****"),
+	regexStep("style_attrs", `(?i)\s*style\s*=\s*"[^"]*"`, ""),
+	regexStep("trackers", `(?i)([?&])(utm_[^=&]+|gclid|fbclid|mc_eid|mc_cid)=[^&\s"'>]+`, "$1"),
+	{Name: "lowercase", Apply: strings.ToLower},
+	regexStep("spaces", `[ \t]+`, " "),
+	regexStep("newlines", `\r?\n{2,}`, "\n\n"),
+}
+
+var reStepName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// parseCustomNormalizeRule parses a NORMALIZE_CUSTOM_RULES rule: name=pattern=>replacement
+func parseCustomNormalizeRule(rule string) (normalizeStep, error) {
+	name, rest, ok := strings.Cut(rule, "=")
+	arrow := strings.LastIndex(rest, "=>")
+	if !ok || arrow < 0 {
+		return normalizeStep{}, fmt.Errorf("expected name=pattern=>replacement")
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !reStepName.MatchString(name) || name == "none" {
+		return normalizeStep{}, fmt.Errorf("invalid step name %q", name)
+	}
+	pattern, replacement := rest[:arrow], rest[arrow+2:]
+	if pattern == "" {
+		return normalizeStep{}, fmt.Errorf("empty pattern")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return normalizeStep{}, err
+	}
+	step := regexStep(name, pattern, replacement)
+	step.Rule = pattern + "=>" + replacement
+	return step, nil
+}
+
+// loadCustomNormalizeSteps reads NORMALIZE_CUSTOM_RULES, ';'-separated rules. Invalid rules,
+// and rules reusing the name of another step, are ignored.
+func loadCustomNormalizeSteps() []normalizeStep {
+	taken := make(map[string]bool, len(builtinNormalizeSteps))
+	for _, s := range builtinNormalizeSteps {
+		taken[s.Name] = true
+	}
+	var steps []normalizeStep
+	for _, rule := range strings.Split(getEnv("NORMALIZE_CUSTOM_RULES", ""), ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		step, err := parseCustomNormalizeRule(rule)
+		if err == nil && taken[step.Name] {
+			err = fmt.Errorf("step %q already exists", step.Name)
+		}
+		if err != nil {
+			log.Printf("[Mailuminati] Invalid NORMALIZE_CUSTOM_RULES rule %q, ignored: %v", rule, err)
+			continue
+		}
+		taken[step.Name] = true
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// parseNormalizeSteps resolves an ordered list of step names among the available steps.
+// "none" disables every step.
+func parseNormalizeSteps(names []string, available []normalizeStep) ([]normalizeStep, bool) {
+	if len(names) == 1 && names[0] == "none" {
+		return []normalizeStep{}, true
+	}
+	byName := make(map[string]normalizeStep, len(available))
+	for _, s := range available {
+		byName[s.Name] = s
+	}
+	steps := make([]normalizeStep, 0, len(names))
+	for _, name := range names {
+		s, ok := byName[name]
+		if !ok {
+			return nil, false
+		}
+		delete(byName, name) // Each step runs at most once
+		steps = append(steps, s)
+	}
+	return steps, true
+}
+
+// loadNormalizeSteps reads NORMALIZE_STEPS, falling back to the default order (the built-ins,
+// then the custom rules) when unset or invalid
+func loadNormalizeSteps() []normalizeStep {
+	available := append(append([]normalizeStep{}, builtinNormalizeSteps...), loadCustomNormalizeSteps()...)
+	names := getEnvList("NORMALIZE_STEPS")
+	if len(names) == 0 {
+		return available
+	}
+	steps, ok := parseNormalizeSteps(names, available)
+	if !ok {
+		log.Printf("[Mailuminati] Invalid NORMALIZE_STEPS %q, using default order", getEnv("NORMALIZE_STEPS", ""))
+		return available
+	}
+	return steps
+}
+
+// currentNormalizeSteps returns the configured pipeline
+func currentNormalizeSteps() []normalizeStep {
+	if steps, ok := normalizeSteps.Load().([]normalizeStep); ok {
+		return steps
+	}
+	return builtinNormalizeSteps
+}
+
+// --- Base64 evasion ---
+
+// reBase64Run matches, anywhere in the body, either a block of at least 3 consecutive lines
+// made only of base64 characters (a wrapped blob, whatever its line width) or a long run
+// within a line, optionally padded. A block's last line may be short.
+var reBase64Run = regexp.MustCompile(`(?m)(?:^[A-Za-z0-9+/]{16,}\r?\n){2,}^[A-Za-z0-9+/]+={0,2}\r?$|[A-Za-z0-9+/]{40,}={0,2}`)
+
+// decodeBase64Runs replaces base64 blobs embedded in visible text with their decoded
+// content, so the hash sees the payload spammers hide from text matching. Only runs
+// decoding to printable UTF-8 text are replaced, up to maxDecoded bytes in total.
+func decodeBase64Runs(body string, minRun, maxDecoded int) string {
+	budget := maxDecoded
+	return reBase64Run.ReplaceAllStringFunc(body, func(run string) string {
+		if len(run) < minRun || budget <= 0 {
+			return run
+		}
+		blob := strings.NewReplacer("\r", "", "\n", "").Replace(run)
+		decoded, err := base64.StdEncoding.DecodeString(blob)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(blob, "="))
+		}
+		if err != nil || len(decoded) > budget || !isPrintableText(decoded) {
+			return run
+		}
+		budget -= len(decoded)
+		return string(decoded)
+	})
+}
+
+// isPrintableText reports whether b is UTF-8 text made (almost) only of printable characters
+func isPrintableText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	total, printable := 0, 0
+	for _, r := range string(b) {
+		total++
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			printable++
+		}
+	}
+	return total > 0 && printable*100 >= total*95
+}
+
+// decodeBase64Evasion applies decodeBase64Runs with the BASE64_* settings
+func decodeBase64Evasion(body string) string {
+	return decodeBase64Runs(body, int(atomic.LoadInt64(&base64MinRun)), int(atomic.LoadInt64(&base64MaxDecoded)))
+}
+
+// --- Emoji and symbol runs ---
+
+const emojiPlaceholder = "[emoji]"
+
+// isEmojiRune reports whether r is an emoji, a pictographic symbol or one of the modifiers
+// emoji sequences are built from. Math symbols (Sm) are left alone: they include the markup
+// characters "<", ">" and "=".
+func isEmojiRune(r rune) bool {
+	switch {
+	case unicode.Is(unicode.So, r):
+		return true
+	case r == 0x20E3: // Combining keycap
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F: // Variation selectors
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // Skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // Tag sequences (subdivision flags)
+		return true
+	}
+	return false
+}
+
+// normalizeEmoji replaces every run of emoji/symbols with one placeholder, so swapping or
+// repeating emoji doesn't change the hash while their position still does
+func normalizeEmoji(s string) string {
+	var b strings.Builder
+	inRun := false
+	for _, r := range s {
+		// The zero-width joiner only extends a run: some scripts use it between letters
+		if isEmojiRune(r) || (inRun && r == 0x200D) {
+			if !inRun {
+				b.WriteString(emojiPlaceholder)
+				inRun = true
+			}
+			continue
+		}
+		inRun = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// subjectHashContent is the content hashed for the subject signature: the normalized subject,
+// repeated to meet the TLSH minimum length requirement
+func subjectHashContent(subject string) string {
+	return strings.Repeat(normalizeSubject(subject)+" ", 5)
+}
+
+// normalizeSubject prepares the subject for the subject and combined signatures
+func normalizeSubject(subject string) string {
+	subject = strings.ToLower(strings.TrimSpace(subject))
+	if emojiNormalize.Load() {
+		subject = normalizeEmoji(subject)
+	}
+	return subject
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- Malformed oracle responses ---
+
+// An oracle answer that cannot be decoded, or carries an action Guardian doesn't know,
+// used to be read as allow without a trace. It is now counted by reason, retried
+// ORACLE_MALFORMED_RETRIES times (within the request deadline), then settled by
+// ORACLE_MALFORMED_ACTION:
+//   - allow (default): as if the oracle had not confirmed the match
+//   - soft_spam: the band match stands as a soft verdict (label oracle_malformed)
+//   - last_known: the last valid oracle verdict for the signature, kept
+//     ORACLE_LAST_KNOWN_TTL after it was received (allow without one)
+
+const (
+	OracleLastKnownPrefix = "mi:oracle_last:" // Last valid oracle verdict per signature (ORACLE_MALFORMED_ACTION=last_known)
+
+	MalformedActionAllow     = "allow"
+	MalformedActionSoftSpam  = "soft_spam"
+	MalformedActionLastKnown = "last_known"
+
+	maxOracleResponseSize = 1024 * 1024
+)
+
+// knownOracleActions lists the actions an oracle verdict may carry ("" = no verdict, allow)
+var knownOracleActions = map[string]bool{"": true, "allow": true, "soft_spam": true, "spam": true}
+
+// queryOracle asks the oracle for the verdict of sig. A response that is not a usable
+// verdict is reported by its malformed reason (decode, action); err is for requests that
+// got no response at all, or an error status (an overloaded or failing oracle, which
+// retries would only load more).
+func queryOracle(reqCtx context.Context, sig string) (res AnalysisResult, malformed string, err error) {
+	payload, _ := json.Marshal(map[string]string{
+		"node_id":         nodeID,
+		"email_body_hash": sig,
+	})
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, oracleURL+"/analyze", bytes.NewBuffer(payload))
+	if err != nil {
+		return res, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceContext(reqCtx, req)
+
+	client := &http.Client{Timeout: 4 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxOracleResponseSize))
+		return res, "", fmt.Errorf("oracle returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Result AnalysisResult `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOracleResponseSize)).Decode(&body); err != nil {
+		return res, "decode", nil
+	}
+	if !knownOracleActions[body.Result.Action] {
+		return res, "action", nil
+	}
+	return body.Result, "", nil
+}
+
+// getOracleMalformedAction returns ORACLE_MALFORMED_ACTION: allow, soft_spam or last_known
+func getOracleMalformedAction() string {
+	if action, ok := oracleMalformedAction.Load().(string); ok && action != "" {
+		return action
+	}
+	return MalformedActionAllow
+}
+
+// loadOracleMalformedAction reads ORACLE_MALFORMED_ACTION
+func loadOracleMalformedAction() {
+	switch action := strings.ToLower(getEnv("ORACLE_MALFORMED_ACTION", MalformedActionAllow)); action {
+	case MalformedActionAllow, MalformedActionSoftSpam, MalformedActionLastKnown:
+		oracleMalformedAction.Store(action)
+	default:
+		log.Printf("[Mailuminati] Invalid ORACLE_MALFORMED_ACTION %q, using %s", action, MalformedActionAllow)
+		oracleMalformedAction.Store(MalformedActionAllow)
+	}
+}
+
+// rememberOracleVerdict keeps a valid oracle verdict as the signature's last known one,
+// when ORACLE_MALFORMED_ACTION=last_known may need it
+func rememberOracleVerdict(sig string, res AnalysisResult) {
+	if getOracleMalformedAction() != MalformedActionLastKnown {
+		return
+	}
+	data, _ := json.Marshal(res)
+	rdb.Set(ctx, OracleLastKnownPrefix+sig, data, time.Duration(atomic.LoadInt64(&oracleLastKnownTTL)))
+}
+
+// malformedOracleVerdict is the verdict of a signature whose oracle answers were all malformed
+func malformedOracleVerdict(sig string) AnalysisResult {
+	switch getOracleMalformedAction() {
+	case MalformedActionSoftSpam:
+		return AnalysisResult{Action: "soft_spam", Label: "oracle_malformed", ProximityMatch: true, Confidence: heuristicSoftConfidence}
+	case MalformedActionLastKnown:
+		if res, ok := cachedOracleVerdict(OracleLastKnownPrefix + sig); ok {
+			log.Printf("[Mailuminati] Using last known oracle verdict (%s) for signature: %s", res.Action, sig)
+			return res
+		}
+	}
+	return AnalysisResult{Action: "allow", ProximityMatch: true}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Oracle cache warm start ---
+
+// The oc_f: proximity cache only holds the oracle spam verdicts of the last
+// oracleSpamCacheDuration, and starts empty: after a restart (or a Redis flush), every
+// variant of an ongoing campaign costs an oracle call until the cache has refilled. With
+// ORACLE_CACHE_WARM_START, the node asks the oracle for a snapshot of its recent spam
+// signatures (POST /snapshot) on startup and caches them as if it had queried them itself.
+
+// snapshotEntry is a recent spam signature of an oracle snapshot
+type snapshotEntry struct {
+	Hash   string `json:"hash"`
+	Type   string `json:"type,omitempty"`
+	Label  string `json:"label,omitempty"`
+	Brand  string `json:"brand,omitempty"`
+	SeenAt int64  `json:"seen_at,omitempty"` // Unix time the oracle last confirmed it (0: now)
+}
+
+// snapshotResponse is the body of an oracle /snapshot answer
+type snapshotResponse struct {
+	Signatures []snapshotEntry `json:"signatures"`
+}
+
+// fetchOracleSnapshot asks the oracle for at most limit recent spam signatures
+func fetchOracleSnapshot(limit int64) (snapshotResponse, error) {
+	var snapshot snapshotResponse
+	payload, _ := json.Marshal(map[string]interface{}{
+		"node_id": nodeID,
+		"version": EngineVersion,
+		"limit":   limit,
+		"max_age": int64(oracleSpamCacheDuration / time.Second),
+	})
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(oracleURL+"/snapshot", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return snapshot, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return snapshot, fmt.Errorf("oracle returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+// applyOracleSnapshot caches the snapshot entries as oracle spam verdicts, for what remains
+// of their cache lifetime. Entries already expired, or not a valid signature, are skipped.
+// It returns the number of signatures cached.
+func applyOracleSnapshot(snapshot snapshotResponse, now time.Time) int {
+	type pending struct {
+		entry  snapshotEntry
+		seenAt int64
+		ttl    time.Duration
+		exists *redis.IntCmd
+	}
+	var candidates []pending
+	pipe := rdb.Pipeline()
+	for _, e := range snapshot.Signatures {
+		if len(signatureBands(e.Hash)) == 0 {
+			continue
+		}
+		if _, urlSet := parseURLSetSignature(e.Hash); !urlSet && !isPerceptualSignature(e.Hash) && !isValidTLSH(e.Hash) {
+			continue
+		}
+		seenAt := now.Unix()
+		if e.SeenAt > 0 && e.SeenAt < seenAt {
+			seenAt = e.SeenAt
+		}
+		ttl := oracleSpamCacheDuration - now.Sub(time.Unix(seenAt, 0))
+		if ttl < time.Second {
+			continue
+		}
+		candidates = append(candidates, pending{entry: e, seenAt: seenAt, ttl: ttl, exists: pipe.Exists(ctx, "mi:oracle_cache:"+e.Hash)})
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0
+	}
+
+	cached := 0
+	version := currentVerdictSchemaVersion()
+	for _, c := range candidates {
+		if c.exists.Val() > 0 {
+			continue // Queried since: the live verdict is fresher
+		}
+		e := c.entry
+		res := AnalysisResult{Action: "spam", Label: e.Label, Brand: e.Brand, MatchType: e.Type, CachedAt: c.seenAt, SchemaVersion: version}
+		cacheOracleSpam(e.Hash, res, c.ttl)
+		cached++
+	}
+	return cached
+}
+
+// warmOracleCache fills the oracle proximity cache from an oracle snapshot, when
+// ORACLE_CACHE_WARM_START is on
+func warmOracleCache() {
+	if !oracleCacheWarmStart.Load() || skipOracleCall("snapshot") {
+		return
+	}
+	start := time.Now()
+	snapshot, err := fetchOracleSnapshot(atomic.LoadInt64(&oracleCacheWarmStartLimit))
+	if err != nil {
+		log.Printf("[Mailuminati] Oracle cache warm start failed: %v", err)
+		return
+	}
+	n := applyOracleSnapshot(snapshot, time.Now())
+	promOracleCacheWarmed.Add(float64(n))
+	log.Printf("[Mailuminati] Oracle cache warmed from snapshot: %d of %d signatures in %s", n, len(snapshot.Signatures), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Per-request threshold overrides (admin only) ---
+
+// ThresholdOverrideHeader carries per-request thresholds, e.g. "normalized=60, url=40, soft_delta=10"
+const ThresholdOverrideHeader = "X-Mailuminati-Thresholds"
+
+// thresholdOverrides replaces configured thresholds for a single analyze request
+type thresholdOverrides struct {
+	PerType   map[SignatureType]int
+	SoftDelta int // -1 = keep the profile's
+}
+
+type thresholdOverridesKey struct{}
+
+// parseThresholdOverrides parses "type=distance" pairs; soft_delta sets the soft spam delta
+func parseThresholdOverrides(header string) (thresholdOverrides, error) {
+	o := thresholdOverrides{PerType: map[SignatureType]int{}, SoftDelta: -1}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return o, fmt.Errorf("invalid override %q", pair)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		dist, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || dist < 0 || dist > 300 {
+			return o, fmt.Errorf("invalid distance for %s: %q", name, value)
+		}
+		if name == "soft_delta" {
+			o.SoftDelta = dist
+			continue
+		}
+		sigType := parseSignatureType(name)
+		if sigType == SigUnknown {
+			return o, fmt.Errorf("unknown signature type %q", name)
+		}
+		o.PerType[sigType] = dist
+	}
+	return o, nil
+}
+
+// withRequestOverrides attaches the threshold overrides of an admin-authenticated request
+// to its context. Overrides sent without a valid admin token are ignored.
+func withRequestOverrides(reqCtx context.Context, r *http.Request) (context.Context, error) {
+	header := r.Header.Get(ThresholdOverrideHeader)
+	if header == "" {
+		return reqCtx, nil
+	}
+	if !isAdminRequest(r) {
+		log.Printf("[Mailuminati] Ignoring %s from unauthenticated caller %s", ThresholdOverrideHeader, r.RemoteAddr)
+		return reqCtx, nil
+	}
+	o, err := parseThresholdOverrides(header)
+	if err != nil {
+		return reqCtx, err
+	}
+	return context.WithValue(reqCtx, thresholdOverridesKey{}, o), nil
+}
+
+// applyThresholdOverrides returns the profile adjusted by the request's overrides, if any
+func applyThresholdOverrides(reqCtx context.Context, p thresholdProfile) thresholdProfile {
+	o, ok := reqCtx.Value(thresholdOverridesKey{}).(thresholdOverrides)
+	if !ok {
+		return p
+	}
+	p.Name += "+override"
+	p.Overrides = o.PerType
+	if o.SoftDelta >= 0 {
+		p.SoftDelta = o.SoftDelta
+		p.SourceSoftDelta = nil // The request's delta applies to every source
+	}
+	return p
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Redis Streams consumer (QUEUE_MODE) ---
+
+// Input entries carry the raw RFC822 message in a "message" field and an optional caller
+// "id". Each verdict is written to the output stream with the caller id (or the input
+// entry id), the Message-ID header and the /analyze response as "verdict".
+
+// queueStreams returns the configured input stream, output stream and consumer group
+func queueStreams() (input, output, group string) {
+	return getEnv("QUEUE_INPUT_STREAM", "mi:queue:in"), getEnv("QUEUE_OUTPUT_STREAM", "mi:queue:out"), getEnv("QUEUE_GROUP", "guardian")
+}
+
+// ensureQueueGroup creates the consumer group (and the input stream) if needed
+func ensureQueueGroup() error {
+	input, _, group := queueStreams()
+	err := rdb.XGroupCreateMkStream(ctx, input, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// queueWorker consumes the input stream until the process exits. Nodes share the work
+// through the consumer group; entries a node left pending (crash, restart) are
+// processed again first, as the consumer name is the stable node id.
+func queueWorker() {
+	if err := ensureQueueGroup(); err != nil {
+		log.Printf("[Mailuminati] Queue mode disabled, cannot create consumer group: %v", err)
+		return
+	}
+	input, output, _ := queueStreams()
+	log.Printf("[Mailuminati] Queue mode: consuming %s, verdicts to %s", input, output)
+
+	for {
+		if n, err := processQueueBatch(true, -1); err != nil || n == 0 {
+			break
+		}
+	}
+	for {
+		if _, err := processQueueBatch(false, 5*time.Second); err != nil {
+			log.Printf("[Mailuminati] Queue read failed: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// processQueueBatch reads up to QUEUE_BATCH_SIZE entries (new ones, or this consumer's
+// pending ones) and writes their verdicts. block < 0 returns at once when idle.
+func processQueueBatch(pending bool, block time.Duration) (int, error) {
+	input, _, group := queueStreams()
+	start := ">"
+	if pending {
+		start = "0"
+	}
+	streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: nodeID,
+		Streams:  []string{input, start},
+		Count:    atomic.LoadInt64(&queueBatchSize),
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			if err := processQueueEntry(msg); err != nil {
+				return processed, err
+			}
+			processed++
+		}
+	}
+	return processed, nil
+}
+
+// processQueueEntry analyzes one input entry, writes its verdict and acknowledges it
+func processQueueEntry(msg redis.XMessage) error {
+	input, output, group := queueStreams()
+	id, _ := msg.Values["id"].(string)
+	if id == "" {
+		id = msg.ID
+	}
+	raw, _ := msg.Values["message"].(string)
+
+	values := map[string]interface{}{"id": id}
+	env, err := parseEnvelope([]byte(raw))
+	if raw == "" || err != nil {
+		values["error"] = "Invalid MIME"
+	} else {
+		atomic.AddInt64(&scanCount, 1)
+		promScanned.Inc()
+		outcome := analyzeEnvelope(context.Background(), env)
+		logVerdictSIEM(newSIEMEvent(outcome, env.GetHeader("From"), env.GetHeader("Message-ID")))
+		auditVerdict(outcome, env.GetHeader("From"), env.GetHeader("Message-ID"))
+		values["message_id"] = env.GetHeader("Message-ID")
+		values["action"] = outcome.Result.Action
+		if !responseIncludeHashes.Load() {
+			outcome = outcome.withoutHashes()
+		}
+		values["verdict"] = string(analyzeResponseBody(outcome))
+	}
+
+	if err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: output,
+		MaxLen: atomic.LoadInt64(&queueOutputMaxLen),
+		Approx: true,
+		Values: values,
+	}).Err(); err != nil {
+		return err // Left pending, retried after a restart
+	}
+	return rdb.XAck(ctx, input, group, msg.ID).Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+// --- Verdict reason codes ---
+
+// ReasonCode is a stable, machine-readable reason for a verdict. Unlike the label,
+// which is free text and may come from the oracle, codes never change meaning.
+type ReasonCode string
+
+const (
+	ReasonClean            ReasonCode = "CLEAN"                 // No match, no heuristic
+	ReasonWhitelisted      ReasonCode = "WHITELISTED"           // Sender on the whitelist
+	ReasonBlacklisted      ReasonCode = "BLACKLISTED"           // Sender on the blacklist
+	ReasonSpamTrap         ReasonCode = "SPAM_TRAP"             // Delivered to a spam-trap recipient
+	ReasonLocalSpam        ReasonCode = "LOCAL_SPAM"            // Proximity match on local learning
+	ReasonLocalExact       ReasonCode = "LOCAL_EXACT"           // Exact match on a learned X1 signature
+	ReasonLocalSoft        ReasonCode = "LOCAL_SOFT"            // Near match on local learning
+	ReasonLocalUnconfirmed ReasonCode = "LOCAL_UNCONFIRMED"     // Local match not yet reported by LEARNING_MIN_SOURCES sources
+	ReasonOracleSpam       ReasonCode = "ORACLE_SPAM"           // Oracle confirmed spam (live or cached verdict)
+	ReasonOracleSoft       ReasonCode = "ORACLE_SOFT"           // Oracle returned soft_spam
+	ReasonOracleMalformed  ReasonCode = "ORACLE_MALFORMED"      // Oracle answers unusable (ORACLE_MALFORMED_ACTION)
+	ReasonOracleCacheMatch ReasonCode = "ORACLE_CACHE_MATCH"    // Proximity match on recent oracle spam
+	ReasonOracleCacheSoft  ReasonCode = "ORACLE_CACHE_SOFT"     // Near match on recent oracle spam
+	ReasonOraclePartial    ReasonCode = "ORACLE_PARTIAL"        // Oracle bands matched without confirmation
+	ReasonMissingHeaders   ReasonCode = "MISSING_HEADERS"       // Required header absent
+	ReasonMassCampaign     ReasonCode = "MASS_CAMPAIGN"         // Same content seen in a burst
+	ReasonReplyToMismatch  ReasonCode = "REPLYTO_MISMATCH"      // Reply-To domain differs from From
+	ReasonMsgIDMismatch    ReasonCode = "MSGID_DOMAIN_MISMATCH" // Message-ID domain invalid or unrelated to From
+	ReasonNewSender        ReasonCode = "NEW_SENDER"            // From domain first seen recently
+	ReasonEmptySubject     ReasonCode = "EMPTY_SUBJECT"         // Subject missing or blank
+	ReasonDisplayNameSpoof ReasonCode = "DISPLAY_NAME_SPOOF"    // Display name claims a protected name
+	ReasonAltPartMismatch  ReasonCode = "ALTPART_MISMATCH"      // Text and HTML alternatives diverge
+	ReasonDateAnomaly      ReasonCode = "DATE_ANOMALY"          // Date header missing, unparsable or out of range
+	ReasonSoftEscalated    ReasonCode = "SOFT_SPAM_ESCALATED"   // Same content got soft_spam too many times
+	ReasonScore            ReasonCode = "SPAMMINESS_SCORE"      // Verdict raised by the spamminess score (SCORE_ACTION)
+	ReasonBadAttachment    ReasonCode = "KNOWN_BAD_ATTACHMENT"  // Attachment SHA-256 in the known-bad sets
+	ReasonDangerousFile    ReasonCode = "DANGEROUS_ATTACHMENT"  // Attachment with a dangerous extension
+	ReasonUnhashableBody   ReasonCode = "UNHASHABLE_BODY"       // Normalized body could not be hashed
+	ReasonModeAllowAll     ReasonCode = "MODE_ALLOW_ALL"        // Operating mode allow_all: not scanned
+	ReasonModeScanOnly     ReasonCode = "MODE_SCAN_ONLY"        // Operating mode scan_only: verdict not enforced
+)
+
+// labelReasonCodes maps the labels Guardian sets itself to their reason code
+var labelReasonCodes = map[string]ReasonCode{
+	"whitelisted":           ReasonWhitelisted,
+	"blacklisted":           ReasonBlacklisted,
+	"spam_trap":             ReasonSpamTrap,
+	"local_spam":            ReasonLocalSpam,
+	"local_exact":           ReasonLocalExact,
+	"local_soft":            ReasonLocalSoft,
+	"local_unconfirmed":     ReasonLocalUnconfirmed,
+	"oracle_cache_match":    ReasonOracleCacheMatch,
+	"oracle_cache_soft":     ReasonOracleCacheSoft,
+	"oracle_partial":        ReasonOraclePartial,
+	"oracle_soft":           ReasonOracleSoft,
+	"oracle_malformed":      ReasonOracleMalformed,
+	"missing_headers":       ReasonMissingHeaders,
+	"mass_campaign":         ReasonMassCampaign,
+	"replyto_mismatch":      ReasonReplyToMismatch,
+	"msgid_domain_mismatch": ReasonMsgIDMismatch,
+	"new_sender":            ReasonNewSender,
+	"empty_subject":         ReasonEmptySubject,
+	"display_name_spoof":    ReasonDisplayNameSpoof,
+	"altpart_mismatch":      ReasonAltPartMismatch,
+	"date_anomaly":          ReasonDateAnomaly,
+	"soft_spam_escalated":   ReasonSoftEscalated,
+	"spamminess_score":      ReasonScore,
+	"known_bad_attachment":  ReasonBadAttachment,
+	"dangerous_attachment":  ReasonDangerousFile,
+	"unhashable_body":       ReasonUnhashableBody,
+	ModeAllowAll:            ReasonModeAllowAll,
+	ModeScanOnly:            ReasonModeScanOnly,
+}
+
+// reasonCodeFor returns the reason code of a verdict. Labels Guardian doesn't own
+// come from the oracle, so they are classified by action.
+func reasonCodeFor(res AnalysisResult) ReasonCode {
+	if code, ok := labelReasonCodes[res.Label]; ok {
+		return code
+	}
+	switch res.Action {
+	case "spam":
+		return ReasonOracleSpam
+	case "soft_spam":
+		return ReasonOracleSoft
+	default:
+		return ReasonClean
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Recency-weighted local scores ---
+
+// Every report on a learned hash is logged in a sorted set (member "<unixnano>:<weight>",
+// scored by unix time). With REPORT_HALF_LIFE set, a report's weight halves every
+// half-life, and a hash only blocks while its weighted score stays at or above
+// REPORT_MIN_WEIGHTED_SCORE (percent of one score point): stale learning fades out
+// without waiting for retention.
+
+const maxTrackedReports = 100 // Newest reports kept per hash
+
+// recordReport logs a signed report weight for hash, kept as long as the hash itself
+func recordReport(pipe redis.Pipeliner, hash string, weight int64, retention time.Duration) {
+	now := time.Now()
+	key := LocalReportsPrefix + hash
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.Unix()), Member: strconv.FormatInt(now.UnixNano(), 10) + ":" + strconv.FormatInt(weight, 10)})
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxTrackedReports-1)
+	pipe.Expire(ctx, key, retention)
+}
+
+// reportHistory is the report log of a learned hash
+type reportHistory struct {
+	Reports    int64   // Logged reports
+	LastReport int64   // Unix time of the newest report (0 if none)
+	Weighted   float64 // Sum of the report weights, decayed by REPORT_HALF_LIFE
+}
+
+// loadReportHistory reads the report log of hash and computes its weighted score at now
+func loadReportHistory(hash string, now time.Time) reportHistory {
+	entries, _ := rdb.ZRangeWithScores(ctx, LocalReportsPrefix+hash, 0, -1).Result()
+	halfLife := time.Duration(atomic.LoadInt64(&reportHalfLife))
+
+	var h reportHistory
+	for _, z := range entries {
+		member, _ := z.Member.(string)
+		_, w, ok := strings.Cut(member, ":")
+		if !ok {
+			continue
+		}
+		weight, err := strconv.ParseInt(w, 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(int64(z.Score), 0)
+		factor := 1.0
+		if age := now.Sub(at); halfLife > 0 && age > 0 {
+			factor = math.Pow(0.5, float64(age)/float64(halfLife))
+		}
+		h.Reports++
+		h.Weighted += float64(weight) * factor
+		if at.Unix() > h.LastReport {
+			h.LastReport = at.Unix()
+		}
+	}
+	return h
+}
+
+// weightedLocalScore returns the recency-weighted score of hash. Hashes learned before
+// reports were logged have no history and keep their raw score.
+func weightedLocalScore(hash string, rawScore int64) float64 {
+	h := loadReportHistory(hash, time.Now())
+	if h.Reports == 0 {
+		return float64(rawScore)
+	}
+	return h.Weighted
+}
+
+// localScoreTrusted reports whether a learned hash may drive a verdict: its raw score must be
+// positive and, with REPORT_HALF_LIFE set, its weighted score must not have decayed below
+// REPORT_MIN_WEIGHTED_SCORE
+func localScoreTrusted(hash string, rawScore int64) bool {
+	if rawScore <= 0 {
+		return false
+	}
+	if atomic.LoadInt64(&reportHalfLife) <= 0 {
+		return true
+	}
+	return weightedLocalScore(hash, rawScore) >= float64(atomic.LoadInt64(&reportMinWeightedScore))/100
+}
+
+// learningInspectHandler shows what Guardian knows about a learned hash (GET /learning/inspect?hash=...)
+func learningInspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := strings.TrimSpace(r.URL.Query().Get("hash"))
+	if hash == "" {
+		http.Error(w, "hash parameter required", http.StatusBadRequest)
+		return
+	}
+
+	score, err := rdb.Get(ctx, LocalScorePrefix+hash).Int64()
+	if err == redis.Nil {
+		http.Error(w, "Unknown hash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	sigType, _ := rdb.Get(ctx, LocalTypePrefix+hash).Result()
+	history := loadReportHistory(hash, time.Now())
+	weighted := float64(score)
+	if history.Reports > 0 {
+		weighted = history.Weighted
+	}
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"hash":           hash,
+		"type":           sigType,
+		"score":          score,
+		"weighted_score": math.Round(weighted*1000) / 1000,
+		"trusted":        localScoreTrusted(hash, score),
+		"reports":        history.Reports,
+		"last_report":    history.LastReport,
+		"learned_at":     localLearnedAt(hash),
+		"campaign_id":    localCampaignID(hash),
+		"sources":        localSourceCount(hash),
+		"confirmed":      localHashConfirmed(hash),
+		"half_life":      time.Duration(atomic.LoadInt64(&reportHalfLife)).String(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Report dedup keys ---
+
+const (
+	ReportDedupPrefix        = "mi:rpt:"    // Per Message-ID and report type, 24h
+	ContentReportDedupPrefix = "mi:rpt_fp:" // Per content fingerprint, report type and scope (REPORT_CONTENT_DEDUP_WINDOW)
+)
+
+var reFingerprint = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// reportDedupEntry is a dedup key and its remaining lifetime in seconds (-1: no expiry)
+type reportDedupEntry struct {
+	Key string `json:"key"`
+	TTL int64  `json:"ttl"`
+}
+
+// messageIDHash is the SHA-1 of a Message-ID, as used in the mi:msgid: and mi:rpt: keys
+func messageIDHash(messageID string) string {
+	sum := sha1.Sum([]byte(messageID))
+	return hex.EncodeToString(sum[:])
+}
+
+// reportDedupKeys lists the dedup keys of a Message-ID and/or a content fingerprint.
+// Without a fingerprint, the one of the Message-ID's stored scan is used.
+func reportDedupKeys(messageID, fingerprint string) ([]reportDedupEntry, string, error) {
+	var patterns []string
+	if messageID != "" {
+		msgHash := messageIDHash(messageID)
+		patterns = append(patterns, ReportDedupPrefix+msgHash+":*")
+		if fingerprint == "" {
+			if val, err := rdb.Get(ctx, "mi:msgid:"+msgHash).Result(); err == nil {
+				var scanData ScanResult
+				if json.Unmarshal([]byte(val), &scanData) == nil {
+					fingerprint = scanData.Fingerprint
+				}
+			} else if err != redis.Nil {
+				return nil, "", err
+			}
+		}
+	}
+	if fingerprint != "" {
+		patterns = append(patterns, ContentReportDedupPrefix+fingerprint+":*")
+	}
+
+	entries := []reportDedupEntry{}
+	for _, pattern := range patterns {
+		iter := rdb.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			entry := reportDedupEntry{Key: iter.Val(), TTL: -1}
+			if ttl, err := rdb.TTL(ctx, entry.Key).Result(); err == nil && ttl > 0 {
+				entry.TTL = int64(ttl / time.Second)
+			}
+			entries = append(entries, entry)
+		}
+		if err := iter.Err(); err != nil {
+			return nil, "", err
+		}
+	}
+	return entries, fingerprint, nil
+}
+
+// adminReportDedupHandler lists (GET) or clears (DELETE) the report dedup keys of a
+// Message-ID (?message_id=) or content fingerprint (?fingerprint=), so a message can be
+// reported again on purpose
+func adminReportDedupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "GET or DELETE required", http.StatusMethodNotAllowed)
+		return
+	}
+	messageID := r.URL.Query().Get("message_id")
+	fingerprint := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("fingerprint")))
+	if messageID == "" && fingerprint == "" {
+		http.Error(w, "message_id or fingerprint required", http.StatusBadRequest)
+		return
+	}
+	if fingerprint != "" && !reFingerprint.MatchString(fingerprint) {
+		http.Error(w, "Invalid fingerprint", http.StatusBadRequest)
+		return
+	}
+
+	entries, fingerprint, err := reportDedupKeys(messageID, fingerprint)
+	if err != nil {
+		http.Error(w, "Redis error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"message_id": messageID, "fingerprint": fingerprint}
+	if r.Method == http.MethodGet {
+		resp["keys"] = entries
+	} else {
+		cleared := []string{}
+		for _, e := range entries {
+			if n, err := rdb.Del(ctx, e.Key).Result(); err != nil {
+				http.Error(w, "Redis error", http.StatusInternalServerError)
+				return
+			} else if n > 0 {
+				cleared = append(cleared, e.Key)
+			}
+		}
+		log.Printf("[Mailuminati] Report dedup cleared (Message-ID: %q, fingerprint: %q): %d keys", messageID, fingerprint, len(cleared))
+		resp["status"] = "ok"
+		resp["cleared"] = cleared
+	}
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
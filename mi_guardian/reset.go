@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// --- Throttled oracle band reset ---
+
+// resetInProgress is set while a RESET_DB job runs; syncs wait for it to finish
+var resetInProgress atomic.Bool
+
+// startReset launches the RESET_DB job in the background unless one is already running
+func startReset() bool {
+	if !resetInProgress.CompareAndSwap(false, true) {
+		return false
+	}
+	go func() {
+		defer resetInProgress.Store(false)
+		if err := runReset(); err != nil {
+			log.Printf("[Mailuminati] Oracle band reset failed: %v", err)
+		}
+	}()
+	return true
+}
+
+// runReset unlinks the oracle bands in small batches with a pause between them, so a
+// large reset never monopolizes Redis while analyze requests are being served.
+// The sync sequence is only rewound once every band is gone.
+func runReset() error {
+	batch := atomic.LoadInt64(&resetBatchSize)
+	delay := time.Duration(atomic.LoadInt64(&resetBatchDelay))
+	start := time.Now()
+	var deleted int64
+	promResetInProgress.Set(1)
+	promResetDeleted.Set(0)
+	defer promResetInProgress.Set(0)
+
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, FragKeyPrefix+"*", batch).Result()
+		if err != nil {
+			return err
+		}
+		// COUNT is only a hint: re-chunk whatever SCAN returned
+		for len(keys) > 0 {
+			n := int(batch)
+			if n > len(keys) {
+				n = len(keys)
+			}
+			if err := rdb.Unlink(ctx, keys[:n]...).Err(); err != nil {
+				return err
+			}
+			keys = keys[n:]
+			deleted += int64(n)
+			promResetDeleted.Set(float64(deleted))
+			time.Sleep(delay)
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	log.Printf("[Mailuminati] Oracle band reset complete: %d keys in %s", deleted, time.Since(start).Round(time.Millisecond))
+	return rdb.Set(ctx, MetaVer, 0, 0).Err()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Spamminess score ---
+
+// With SPAMMINESS_SCORE on, every verdict carries a 0-100 score aggregating what was found
+// about the message:
+//
+//	score = 100 × (1 − (1 − wm·m) × Π(1 − wh)) × (1 − wr·r)
+//
+//   - m, the strongest match: the best signature verdict, or a rule verdict (blacklist,
+//     known-bad attachment...); a spam counts its confidence, a soft_spam half of it
+//   - wm = SCORE_WEIGHT_MATCH
+//   - wh, each spam heuristic signal: SCORE_WEIGHT_<LABEL>, or SCORE_WEIGHT_HEURISTIC
+//   - r, the sender domain reputation: its ham reports within AUTO_WHITELIST_WINDOW relative
+//     to AUTO_WHITELIST_HAM_REPORTS (counted with AUTO_WHITELIST only)
+//   - wr = SCORE_WEIGHT_REPUTATION
+//
+// Weights are percents. Every bad signal can only raise the score. With SCORE_ACTION on,
+// the action is derived from the score (SCORE_SPAM_THRESHOLD, SCORE_SOFT_THRESHOLD).
+
+// scoredHeuristics are the heuristic labels that may have their own SCORE_WEIGHT_<LABEL>
+var scoredHeuristics = []string{
+	"missing_headers", "mass_campaign", "replyto_mismatch", "new_sender", "empty_subject",
+	"display_name_spoof", "altpart_mismatch", "date_anomaly", "dangerous_attachment",
+	"unhashable_body", "list_unsubscribe_missing", "msgid_domain_mismatch",
+}
+
+// hamSignals are heuristic signals speaking for the message; they are not scored
+var hamSignals = map[string]bool{"list_unsubscribe": true}
+
+// scoreConfig holds the parsed SCORE_* settings (weights and thresholds in [0, 1])
+type scoreConfig struct {
+	Enabled          bool
+	Action           bool
+	MatchWeight      float64
+	HeuristicWeight  float64
+	LabelWeights     map[string]float64
+	ReputationWeight float64
+	SpamThreshold    float64
+	SoftThreshold    float64
+}
+
+// loadScoreConfig reads SPAMMINESS_SCORE, SCORE_ACTION, SCORE_WEIGHT_* and SCORE_*_THRESHOLD
+func loadScoreConfig() scoreConfig {
+	percent := func(k string, def int64) float64 {
+		return math.Max(0, math.Min(100, float64(getEnvInt64(k, def)))) / 100
+	}
+	cfg := scoreConfig{
+		Enabled:          getEnvBool("SPAMMINESS_SCORE", false),
+		Action:           getEnvBool("SCORE_ACTION", false),
+		MatchWeight:      percent("SCORE_WEIGHT_MATCH", 100),
+		HeuristicWeight:  percent("SCORE_WEIGHT_HEURISTIC", 20),
+		LabelWeights:     make(map[string]float64),
+		ReputationWeight: percent("SCORE_WEIGHT_REPUTATION", 50),
+		SpamThreshold:    percent("SCORE_SPAM_THRESHOLD", 80),
+		SoftThreshold:    percent("SCORE_SOFT_THRESHOLD", 40),
+	}
+	for _, label := range scoredHeuristics {
+		if getEnv("SCORE_WEIGHT_"+strings.ToUpper(label), "") != "" {
+			cfg.LabelWeights[label] = percent("SCORE_WEIGHT_"+strings.ToUpper(label), 0)
+		}
+	}
+	if cfg.Action && !cfg.Enabled {
+		log.Printf("[Mailuminati] SCORE_ACTION needs SPAMMINESS_SCORE, ignored")
+		cfg.Action = false
+	}
+	return cfg
+}
+
+// currentScoreConfig returns the active score settings
+func currentScoreConfig() scoreConfig {
+	cfg, _ := scoreSettings.Load().(scoreConfig)
+	return cfg
+}
+
+// verdictStrength is what a verdict brings to the score: a spam its confidence, a soft_spam half of it
+func verdictStrength(res AnalysisResult) float64 {
+	switch res.Action {
+	case "spam":
+		return effectiveConfidence(res)
+	case "soft_spam":
+		return effectiveConfidence(res) / 2
+	}
+	return 0
+}
+
+// matchStrength returns the strongest match of a message. A soft_spam raised by a heuristic
+// is left to the heuristic weights.
+func matchStrength(outcome scanOutcome) float64 {
+	var m float64
+	for _, v := range outcome.TypeVerdicts {
+		m = math.Max(m, verdictStrength(v.Result))
+	}
+	res := outcome.Result
+	if res.Action == "soft_spam" {
+		for _, h := range outcome.Heuristics {
+			if h.Label == res.Label {
+				return m
+			}
+		}
+	}
+	return math.Max(m, verdictStrength(res))
+}
+
+// senderReputation returns the share of AUTO_WHITELIST_HAM_REPORTS the sender domain received
+func senderReputation(domain string) float64 {
+	needed := atomic.LoadInt64(&autoWhitelistHamReports)
+	if domain == "" || needed <= 0 {
+		return 0
+	}
+	count, _ := rdb.Get(ctx, HamCountPrefix+domain).Int64()
+	return math.Min(1, float64(count)/float64(needed))
+}
+
+// spamminessScore aggregates the match, the heuristic signals and the sender reputation
+func spamminessScore(cfg scoreConfig, match float64, heuristics []heuristicSignal, reputation float64) int {
+	clean := 1 - cfg.MatchWeight*match
+	for _, h := range heuristics {
+		if hamSignals[h.Label] {
+			continue
+		}
+		w, ok := cfg.LabelWeights[h.Label]
+		if !ok {
+			w = cfg.HeuristicWeight
+		}
+		clean *= 1 - w
+	}
+	score := (1 - clean) * (1 - cfg.ReputationWeight*reputation)
+	return int(math.Round(math.Max(0, math.Min(1, score)) * 100))
+}
+
+// applySpamminessScore scores the verdict and, with SCORE_ACTION, derives its action from the
+// score. Whitelisted senders and spam-trap deliveries score 0 and keep their action.
+func applySpamminessScore(outcome *scanOutcome, fromDomain, messageID string) {
+	cfg := currentScoreConfig()
+	if !cfg.Enabled {
+		return
+	}
+	res := &outcome.Result
+	score := 0
+	if !outcome.Whitelisted && res.Label != "spam_trap" {
+		score = spamminessScore(cfg, matchStrength(*outcome), outcome.Heuristics, senderReputation(fromDomain))
+	}
+	res.Score = &score
+	if !cfg.Action || outcome.Whitelisted || res.Label == "spam_trap" {
+		return
+	}
+
+	action := "allow"
+	switch s := float64(score) / 100; {
+	case s >= cfg.SpamThreshold:
+		action = "spam"
+	case s >= cfg.SoftThreshold:
+		action = "soft_spam"
+	}
+	if action == res.Action {
+		return
+	}
+	log.Printf("[Mailuminati] Verdict %s changed to %s by score %d | Message-ID: %s", res.Action, action, score, messageID)
+	switch {
+	case action == "allow":
+		res.Label = ""
+		res.Confidence = 0
+	case res.Action == "allow":
+		res.Label = "spamminess_score"
+		res.Confidence = float64(score) / 100
+	case action == "soft_spam":
+		if soft, ok := softLabels[res.Label]; ok {
+			res.Label = soft
+		}
+	default:
+		for spam, soft := range softLabels {
+			if res.Label == soft {
+				res.Label = spam
+			}
+		}
+	}
+	res.Action = action
+}
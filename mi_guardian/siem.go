@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- SIEM output (CEF / LEEF) ---
+
+// Verdicts can be emitted as CEF or LEEF lines for SIEM ingestion, without a
+// transformation layer:
+//   - per request, with "Accept: application/x-cef" or "Accept: application/x-leef" on /analyze
+//   - as a verdict log, one line per analyzed message on stdout (VERDICT_LOG_FORMAT)
+
+const (
+	SIEMFormatCEF  = "cef"
+	SIEMFormatLEEF = "leef"
+)
+
+// siemLogger writes verdict log lines as-is, without the log timestamp prefix
+var siemLogger = log.New(os.Stdout, "", 0)
+
+// siemEvent holds the fields shared by both formats
+type siemEvent struct {
+	Action     string
+	Label      string
+	ReasonCode ReasonCode
+	MatchType  string
+	Distance   int
+	Confidence float64
+	FromDomain string
+	MessageID  string
+}
+
+func newSIEMEvent(outcome scanOutcome, fromHeader, messageID string) siemEvent {
+	res := outcome.Result
+	return siemEvent{
+		Action:     res.Action,
+		Label:      res.Label,
+		ReasonCode: res.ReasonCode,
+		MatchType:  res.MatchType,
+		Distance:   res.Distance,
+		Confidence: res.Confidence,
+		FromDomain: extractDomain(fromHeader),
+		MessageID:  strings.Trim(strings.TrimSpace(messageID), "<>"),
+	}
+}
+
+// severity maps the action to the 0-10 scale of both formats
+func (e siemEvent) severity() int {
+	switch e.Action {
+	case "spam":
+		return 8
+	case "soft_spam":
+		return 5
+	default:
+		return 1
+	}
+}
+
+func (e siemEvent) eventID() string {
+	if e.ReasonCode == "" {
+		return string(reasonCodeFor(AnalysisResult{Action: e.Action, Label: e.Label}))
+	}
+	return string(e.ReasonCode)
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	leefValueEscaper    = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+// formatCEF serializes a verdict as an ArcSight CEF line:
+// CEF:0|Mailuminati|Guardian|<version>|<reason code>|<name>|<severity>|<extension>
+func formatCEF(e siemEvent) string {
+	ext := []string{"act=" + cefExtensionEscaper.Replace(e.Action)}
+	if e.Label != "" {
+		ext = append(ext, "cs1Label=label", "cs1="+cefExtensionEscaper.Replace(e.Label))
+	}
+	if e.MatchType != "" {
+		ext = append(ext, "cs2Label=matchType", "cs2="+cefExtensionEscaper.Replace(e.MatchType))
+	}
+	if e.FromDomain != "" {
+		ext = append(ext, "cs3Label=fromDomain", "cs3="+cefExtensionEscaper.Replace(e.FromDomain))
+	}
+	if e.MatchType != "" { // Exact matches have distance 0
+		ext = append(ext, "cn1Label=distance", "cn1="+strconv.Itoa(e.Distance))
+	}
+	if e.Confidence > 0 {
+		ext = append(ext, "cfp1Label=confidence", "cfp1="+strconv.FormatFloat(e.Confidence, 'f', 3, 64))
+	}
+	if e.MessageID != "" {
+		ext = append(ext, "externalId="+cefExtensionEscaper.Replace(e.MessageID))
+	}
+	return fmt.Sprintf("CEF:0|Mailuminati|Guardian|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(EngineVersion), cefHeaderEscaper.Replace(e.eventID()),
+		cefHeaderEscaper.Replace("Mail verdict "+e.Action), e.severity(), strings.Join(ext, " "))
+}
+
+// formatLEEF serializes a verdict as an IBM QRadar LEEF 1.0 line (tab-separated attributes)
+func formatLEEF(e siemEvent) string {
+	attrs := []string{"sev=" + strconv.Itoa(e.severity()), "action=" + leefValueEscaper.Replace(e.Action)}
+	if e.Label != "" {
+		attrs = append(attrs, "label="+leefValueEscaper.Replace(e.Label))
+	}
+	if e.MatchType != "" {
+		attrs = append(attrs, "matchType="+leefValueEscaper.Replace(e.MatchType))
+	}
+	if e.FromDomain != "" {
+		attrs = append(attrs, "fromDomain="+leefValueEscaper.Replace(e.FromDomain))
+	}
+	if e.MatchType != "" {
+		attrs = append(attrs, "distance="+strconv.Itoa(e.Distance))
+	}
+	if e.Confidence > 0 {
+		attrs = append(attrs, "confidence="+strconv.FormatFloat(e.Confidence, 'f', 3, 64))
+	}
+	if e.MessageID != "" {
+		attrs = append(attrs, "messageId="+leefValueEscaper.Replace(e.MessageID))
+	}
+	return fmt.Sprintf("LEEF:1.0|Mailuminati|Guardian|%s|%s|%s",
+		cefHeaderEscaper.Replace(EngineVersion), cefHeaderEscaper.Replace(e.eventID()), strings.Join(attrs, "\t"))
+}
+
+// formatSIEM serializes a verdict in the given format ("" if unknown)
+func formatSIEM(format string, e siemEvent) string {
+	switch format {
+	case SIEMFormatCEF:
+		return formatCEF(e)
+	case SIEMFormatLEEF:
+		return formatLEEF(e)
+	}
+	return ""
+}
+
+// negotiateSIEMFormat returns the SIEM format requested by an Accept header, or ""
+func negotiateSIEMFormat(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/x-cef":
+			return SIEMFormatCEF
+		case "application/x-leef":
+			return SIEMFormatLEEF
+		}
+	}
+	return ""
+}
+
+// logVerdictSIEM writes the verdict log line, when VERDICT_LOG_FORMAT is set
+func logVerdictSIEM(e siemEvent) {
+	format, _ := verdictLogFormat.Load().(string)
+	if line := formatSIEM(format, e); line != "" {
+		siemLogger.Println(line)
+	}
+}
+
+// writeSIEMResponse answers /analyze with a single CEF or LEEF line
+func writeSIEMResponse(w http.ResponseWriter, format string, e siemEvent) {
+	w.Header().Set("Content-Type", "application/x-"+format)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(formatSIEM(format, e) + "\n"))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- User behavior signals ---
+
+// A mail client can tell Guardian what the user did with a delivered message: replied
+// to it, read it, moved it back to the inbox. Each is ham evidence of its own strength:
+// POST /signal demotes the spam score of the learned hashes matching the message by the
+// signal's weight (SIGNAL_WEIGHT_<SIGNAL>, 0 = ignored). Unlike a ham report, a signal
+// never drives a score below zero, nor counts toward the sender auto-whitelist.
+
+const (
+	SignalReplied      = "replied"
+	SignalRead         = "read"
+	SignalMovedToInbox = "moved_to_inbox"
+
+	SignalKeyPrefix = "mi:sig:" // Per Message-ID and signal, kept for ScanRetention like the stored scan
+)
+
+// signalWeightDefaults lists the known signals and their default weight
+var signalWeightDefaults = map[string]int64{
+	SignalReplied:      2,
+	SignalRead:         0, // Reading a message says little about it
+	SignalMovedToInbox: 1,
+}
+
+// loadSignalWeights reads SIGNAL_WEIGHT_REPLIED, SIGNAL_WEIGHT_READ and SIGNAL_WEIGHT_MOVED_TO_INBOX
+func loadSignalWeights() map[string]int64 {
+	weights := make(map[string]int64, len(signalWeightDefaults))
+	for signal, def := range signalWeightDefaults {
+		if w := getEnvInt64("SIGNAL_WEIGHT_"+strings.ToUpper(signal), def); w > 0 {
+			weights[signal] = w
+		} else {
+			weights[signal] = 0
+		}
+	}
+	return weights
+}
+
+// getSignalWeight returns the ham weight of a signal, and whether the signal is known
+func getSignalWeight(signal string) (int64, bool) {
+	weights, _ := signalWeights.Load().(map[string]int64)
+	w, ok := weights[signal]
+	return w, ok
+}
+
+// demoteScoreScript lowers a score by at most ARGV[1], down to zero, and returns the
+// amount removed: read and decrement in one step, so concurrent reports aren't lost
+var demoteScoreScript = redis.NewScript(`
+local score = tonumber(redis.call("GET", KEYS[1]) or "0") or 0
+if score <= 0 then
+	return 0
+end
+local demotion = math.min(tonumber(ARGV[1]), score)
+redis.call("DECRBY", KEYS[1], demotion)
+return demotion
+`)
+
+// demoteLearnedHash lowers the spam score of a learned hash by at most weight, down to zero.
+// It returns the score removed.
+func demoteLearnedHash(targetHash string, weight int64) int64 {
+	demotion, err := demoteScoreScript.Run(ctx, rdb, []string{LocalScorePrefix + targetHash}, weight).Int64()
+	if err != nil || demotion <= 0 {
+		return 0
+	}
+
+	retention := learnedRetention(targetHash)
+	pipe := rdb.Pipeline()
+	recordReport(pipe, targetHash, -demotion, retention)
+	pipe.Exec(ctx)
+	return demotion
+}
+
+// learnFromSignal applies a ham signal to the learned hashes matching the scanned signatures.
+// It returns the demoted hashes.
+func learnFromSignal(sigs []TypedSignature, weight int64) []string {
+	demoted := []string{}
+	for _, ts := range sigs {
+		targetHash, known := matchLearnedHash(ts)
+		if !known && isTLSHSignature(ts.Hash) {
+			continue
+		}
+		if n := demoteLearnedHash(targetHash, weight); n > 0 {
+			log.Printf("[Mailuminati] Ham signal for hash: %s (-%d)", targetHash, n)
+			demoted = append(demoted, targetHash)
+		}
+	}
+	return demoted
+}
+
+// signalHandler records a user behavior signal on a scanned message (POST /signal)
+func signalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		MessageID string `json:"message-id"`
+		Signal    string `json:"signal"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.MessageID == "" {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	signal := strings.ToLower(strings.TrimSpace(reqBody.Signal))
+	weight, ok := getSignalWeight(signal)
+	if !ok {
+		http.Error(w, "Unknown signal: "+reqBody.Signal, http.StatusBadRequest)
+		return
+	}
+	promUserSignals.WithLabelValues(signal).Inc()
+	if weight == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ignored","reason":"signal_disabled"}`))
+		return
+	}
+
+	msgHash := messageIDHash(reqBody.MessageID)
+	val, err := rdb.Get(ctx, "mi:msgid:"+msgHash).Result()
+	if err == redis.Nil {
+		http.Error(w, "No scan data found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Redis error", http.StatusInternalServerError)
+		return
+	}
+	var scanData ScanResult
+	json.Unmarshal([]byte(val), &scanData)
+	if scanData.SchemaVersion != "" && scanData.SchemaVersion != currentVerdictSchemaVersion() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(`{"status":"stale","reason":"verdict_schema_changed"}`))
+		return
+	}
+
+	// One signal of each kind per message
+	dedupKey := SignalKeyPrefix + msgHash + ":" + signal
+	if added, err := rdb.SetNX(ctx, dedupKey, "1", ScanRetention).Result(); err != nil {
+		http.Error(w, "Redis error", http.StatusInternalServerError)
+		return
+	} else if !added {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"status":"duplicate","message":"Signal already recorded"}`))
+		return
+	}
+
+	demoted := learnFromSignal(scanData.typedHashes(), weight)
+	log.Printf("[Mailuminati] Signal %s for Message-ID: %s (%d learned hashes demoted)", signal, reqBody.MessageID, len(demoted))
+	respBytes, _ := json.Marshal(map[string]interface{}{"status": "ok", "signal": signal, "weight": weight, "demoted": demoted})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --- SMTP reply suggestion ---
+
+// MTAs calling Guardian at SMTP time need to turn the verdict into a reply. Rather than
+// have every integration hardcode its own mapping, each verdict carries an smtp_response
+// built from a per-action template (SMTP_RESPONSE_SPAM, SMTP_RESPONSE_SOFT_SPAM,
+// SMTP_RESPONSE_ALLOW): a reply code, an optional enhanced status code and a text, e.g.
+// "550 5.7.1 Message rejected as spam". The text accepts the USER_MESSAGE_ placeholders.
+// soft_spam verdicts also suggest a header to add (SMTP_RESPONSE_SOFT_SPAM_HEADER).
+
+// smtpResponseDefaults lists the default template of each action
+var smtpResponseDefaults = map[string]string{
+	"spam":      "550 5.7.1 Message rejected as spam",
+	"soft_spam": "250 2.0.0 Message accepted, flagged as possible spam",
+	"allow":     "250 2.0.0 Message accepted",
+}
+
+const defaultSMTPSoftSpamHeader = "X-Spam-Flag: YES"
+
+var reSMTPResponse = regexp.MustCompile(`^([245][0-9][0-9])(?:[ -]([245]\.[0-9]{1,3}\.[0-9]{1,3}))?(?:\s+(.*))?$`)
+
+// SMTPResponse is the SMTP reply suggested for a verdict
+type SMTPResponse struct {
+	Code         int    `json:"code"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+	Message      string `json:"message"`
+	Header       string `json:"header,omitempty"` // Header to add before delivery (soft_spam)
+}
+
+// smtpResponseConfig holds the parsed SMTP_RESPONSE_* settings
+type smtpResponseConfig struct {
+	Templates      map[string]string // By action, validated
+	SoftSpamHeader string
+}
+
+// parseSMTPResponse splits a template into reply code, enhanced status code and text.
+// The enhanced code, when present, must be of the reply code's class.
+func parseSMTPResponse(tmpl string) (SMTPResponse, bool) {
+	m := reSMTPResponse.FindStringSubmatch(strings.TrimSpace(tmpl))
+	if m == nil {
+		return SMTPResponse{}, false
+	}
+	if m[2] != "" && m[2][0] != m[1][0] {
+		return SMTPResponse{}, false
+	}
+	code, _ := strconv.Atoi(m[1])
+	return SMTPResponse{Code: code, EnhancedCode: m[2], Message: strings.TrimSpace(m[3])}, true
+}
+
+// loadSMTPResponses reads SMTP_RESPONSE_<ACTION> and SMTP_RESPONSE_SOFT_SPAM_HEADER.
+// Invalid templates fall back to their default.
+func loadSMTPResponses() smtpResponseConfig {
+	cfg := smtpResponseConfig{Templates: make(map[string]string, len(smtpResponseDefaults))}
+	for action, def := range smtpResponseDefaults {
+		key := "SMTP_RESPONSE_" + strings.ToUpper(action)
+		tmpl := strings.TrimSpace(getEnv(key, def))
+		if _, ok := parseSMTPResponse(tmpl); !ok {
+			log.Printf("[Mailuminati] Invalid %s %q, using %q", key, tmpl, def)
+			tmpl = def
+		}
+		cfg.Templates[action] = tmpl
+	}
+	cfg.SoftSpamHeader = strings.TrimSpace(getEnv("SMTP_RESPONSE_SOFT_SPAM_HEADER", defaultSMTPSoftSpamHeader))
+	if cfg.SoftSpamHeader != "" && !strings.Contains(cfg.SoftSpamHeader, ":") {
+		log.Printf("[Mailuminati] Invalid SMTP_RESPONSE_SOFT_SPAM_HEADER %q, using %q", cfg.SoftSpamHeader, defaultSMTPSoftSpamHeader)
+		cfg.SoftSpamHeader = defaultSMTPSoftSpamHeader
+	}
+	return cfg
+}
+
+// smtpResponseFor returns the SMTP reply suggested for a verdict. A template using a
+// placeholder the verdict has no value for falls back to the action's default.
+func smtpResponseFor(res AnalysisResult) *SMTPResponse {
+	cfg, _ := smtpResponses.Load().(smtpResponseConfig)
+	tmpl, ok := cfg.Templates[res.Action]
+	if !ok {
+		if tmpl, ok = smtpResponseDefaults[res.Action]; !ok {
+			return nil
+		}
+	}
+
+	values := map[string]string{
+		"brand":       res.Brand,
+		"label":       res.Label,
+		"reason_code": string(res.ReasonCode),
+		"match_type":  res.MatchType,
+		"action":      res.Action,
+	}
+	rendered, ok := renderUserMessage(tmpl, values)
+	if !ok {
+		rendered = smtpResponseDefaults[res.Action]
+	}
+	resp, ok := parseSMTPResponse(rendered)
+	if !ok {
+		// A placeholder value broke the template (e.g. a brand with a line break)
+		resp, _ = parseSMTPResponse(smtpResponseDefaults[res.Action])
+	}
+	if res.Action == "soft_spam" {
+		resp.Header = cfg.SoftSpamHeader
+	}
+	return &resp
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- soft_spam trend tracking ---
+
+const (
+	SoftSpamKeyPrefix = "mi:softspam:"      // Hash per content fingerprint: count, first_seen, last_seen, label, match_type
+	SoftSpamTrendKey  = "mi:softspam:trend" // Sorted set: fingerprint -> last soft_spam verdict (unix time)
+)
+
+// contentFingerprint identifies message content independently of its Message-ID
+func contentFingerprint(normalizedBody string) string {
+	sum := sha1.Sum([]byte(normalizedBody))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordSoftSpam counts a soft_spam verdict for a content fingerprint, so a campaign's
+// volume can be watched rising before it is confirmed. It returns the count. The
+// fingerprint only shows in the trends with SOFT_SPAM_TRACKING on: escalation counts
+// alone are not tracking data.
+func recordSoftSpam(fingerprint string, res AnalysisResult) int64 {
+	ttl := time.Duration(atomic.LoadInt64(&softSpamTrackingTTL))
+	now := time.Now().Unix()
+	key := SoftSpamKeyPrefix + fingerprint
+
+	pipe := rdb.Pipeline()
+	count := pipe.HIncrBy(ctx, key, "count", 1)
+	pipe.HSetNX(ctx, key, "first_seen", now)
+	pipe.HSet(ctx, key, "last_seen", now, "label", res.Label, "match_type", res.MatchType)
+	pipe.Expire(ctx, key, ttl)
+	if softSpamTracking.Load() {
+		// Fingerprints not seen within the window leave the index with their entry
+		pipe.ZAdd(ctx, SoftSpamTrendKey, &redis.Z{Score: float64(now), Member: fingerprint})
+		pipe.ZRemRangeByScore(ctx, SoftSpamTrendKey, "-inf", "("+strconv.FormatInt(now-int64(ttl/time.Second), 10))
+		pipe.Expire(ctx, SoftSpamTrendKey, ttl)
+	}
+	pipe.Exec(ctx)
+	return count.Val()
+}
+
+// softSpamTrend is one tracked fingerprint as returned by /learning/softspam
+type softSpamTrend struct {
+	Fingerprint string `json:"fingerprint"`
+	Count       int64  `json:"count"`
+	FirstSeen   int64  `json:"first_seen"`
+	LastSeen    int64  `json:"last_seen"`
+	Label       string `json:"label,omitempty"`
+	MatchType   string `json:"match_type,omitempty"`
+}
+
+// topSoftSpamTrends returns the most frequent soft_spam fingerprints still within the tracking window
+func topSoftSpamTrends(limit int64) ([]softSpamTrend, error) {
+	since := time.Now().Add(-time.Duration(atomic.LoadInt64(&softSpamTrackingTTL))).Unix()
+	fingerprints, err := rdb.ZRangeByScore(ctx, SoftSpamTrendKey, &redis.ZRangeBy{Min: strconv.FormatInt(since, 10), Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := rdb.Pipeline()
+	entries := make([]*redis.StringStringMapCmd, len(fingerprints))
+	for i, fp := range fingerprints {
+		entries[i] = pipe.HGetAll(ctx, SoftSpamKeyPrefix+fp)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	trends := []softSpamTrend{}
+	for i, fp := range fingerprints {
+		fields := entries[i].Val()
+		if len(fields) == 0 {
+			continue // Entry expired
+		}
+		trend := softSpamTrend{Fingerprint: fp, Label: fields["label"], MatchType: fields["match_type"]}
+		trend.Count, _ = strconv.ParseInt(fields["count"], 10, 64)
+		trend.FirstSeen, _ = strconv.ParseInt(fields["first_seen"], 10, 64)
+		trend.LastSeen, _ = strconv.ParseInt(fields["last_seen"], 10, 64)
+		trends = append(trends, trend)
+	}
+	sort.SliceStable(trends, func(i, j int) bool { return trends[i].Count > trends[j].Count })
+	if int64(len(trends)) > limit {
+		trends = trends[:limit]
+	}
+	return trends, nil
+}
+
+// softSpamTrendsHandler lists the top soft_spam fingerprints (GET /learning/softspam?limit=N)
+func softSpamTrendsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := int64(20)
+	if l, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	trends, err := topSoftSpamTrends(limit)
+	if err != nil {
+		http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"enabled":  softSpamTracking.Load(),
+		"window":   time.Duration(atomic.LoadInt64(&softSpamTrackingTTL)).String(),
+		"trending": trends,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// --- Per-source soft_spam settings ---
+
+// Local soft matches come from fuzzy proximity to what this node learned; oracle cache
+// soft matches from proximity to spam the oracle confirmed. SOFT_SPAM_DELTA_<SOURCE> sets
+// how far beyond the spam threshold each source still gives soft_spam, and
+// SOFT_SPAM_ESCALATE_<SOURCE> after how many soft_spam verdicts on the same content (within
+// SOFT_SPAM_TRACKING_TTL) the verdict becomes spam.
+
+const (
+	SoftSourceLocal       = "local"
+	SoftSourceOracleCache = "oracle_cache"
+)
+
+// softSpamSources maps the soft labels to their verdict source
+var softSpamSources = map[string]string{
+	"local_soft":        SoftSourceLocal,
+	"oracle_cache_soft": SoftSourceOracleCache,
+}
+
+// sourceSoftDeltas returns the soft deltas set per verdict source
+func sourceSoftDeltas() map[string]int {
+	deltas := make(map[string]int)
+	if d := atomic.LoadInt64(&softSpamDeltaLocal); d >= 0 {
+		deltas[SoftSourceLocal] = int(d)
+	}
+	if d := atomic.LoadInt64(&softSpamDeltaOracleCache); d >= 0 {
+		deltas[SoftSourceOracleCache] = int(d)
+	}
+	return deltas
+}
+
+// softSpamEscalationFor returns after how many soft_spam verdicts on the same content a
+// soft verdict with this label becomes spam (0 = never)
+func softSpamEscalationFor(label string) int64 {
+	switch softSpamSources[label] {
+	case SoftSourceLocal:
+		return atomic.LoadInt64(&softSpamEscalateLocal)
+	case SoftSourceOracleCache:
+		return atomic.LoadInt64(&softSpamEscalateOracleCache)
+	}
+	return 0
+}
+
+// escalateSoftSpam counts a soft_spam verdict for its content and turns it into spam
+// (label soft_spam_escalated) once the content reached after soft_spam verdicts. The
+// confidence is raised to SPAM_MIN_CONFIDENCE, so the escalation isn't demoted back. A dry
+// run reads the count as if this verdict had been counted.
+func escalateSoftSpam(res *AnalysisResult, fingerprint string, after int64, dryRun bool) (heuristicSignal, bool) {
+	var count int64
+	if dryRun {
+		count, _ = rdb.HGet(ctx, SoftSpamKeyPrefix+fingerprint, "count").Int64()
+		count++
+	} else {
+		count = recordSoftSpam(fingerprint, *res)
+	}
+	if count < after {
+		return heuristicSignal{}, false
+	}
+	sig := heuristicSignal{Label: "soft_spam_escalated", Detail: fmt.Sprintf("%s: %d soft_spam verdicts within %s", res.Label, count,
+		time.Duration(atomic.LoadInt64(&softSpamTrackingTTL)))}
+	res.Action = "spam"
+	res.Label = sig.Label
+	res.Confidence = math.Max(res.Confidence, float64(atomic.LoadInt64(&spamMinConfidence))/100)
+	return sig, true
+}
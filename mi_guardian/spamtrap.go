@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Spam-trap recipients ---
+
+// recipientHeaders are checked, in order, for the addresses a message was delivered to
+var recipientHeaders = []string{"Delivered-To", "X-Original-To", "To", "Cc"}
+
+// messageRecipients returns the lowercased recipient addresses found in the message headers
+func messageRecipients(env *enmime.Envelope) []string {
+	var rcpts []string
+	for _, h := range recipientHeaders {
+		value := env.GetHeader(h)
+		if value == "" {
+			continue
+		}
+		if list, err := mail.ParseAddressList(value); err == nil {
+			for _, addr := range list {
+				rcpts = append(rcpts, strings.ToLower(addr.Address))
+			}
+			continue
+		}
+		for _, part := range strings.Split(value, ",") {
+			part = strings.Trim(strings.TrimSpace(part), "<>")
+			if strings.Contains(part, "@") {
+				rcpts = append(rcpts, strings.ToLower(part))
+			}
+		}
+	}
+	return rcpts
+}
+
+// spamTrapRecipient returns the first SPAM_TRAP_RECIPIENTS address the message was sent to
+func spamTrapRecipient(env *enmime.Envelope) (string, bool) {
+	traps, _ := spamTrapRecipients.Load().([]string)
+	if len(traps) == 0 {
+		return "", false
+	}
+	for _, rcpt := range messageRecipients(env) {
+		for _, trap := range traps {
+			if rcpt == trap {
+				return trap, true
+			}
+		}
+	}
+	return "", false
+}
+
+// learnTrapHit learns every signature of a spam-trap delivery as if it had been reported as spam
+func learnTrapHit(trap string, signatures []TypedSignature) {
+	if len(signatures) == 0 {
+		return
+	}
+	learnFromReport(signatures, "spam", ReportSourceSystem)
+	promTrapAutoLearned.Inc()
+	log.Printf("[Mailuminati] Auto-learned %d signatures from spam trap %s", len(signatures), trap)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// --- HTML structure signature ---
+
+// Campaigns vary their visible text but keep the same HTML template (table layout,
+// class names). The optional structure signature (STRUCTURE_SIGNATURE) hashes the tag
+// skeleton of the HTML part: tag names and a few layout attributes, one tag per line,
+// without any text, links or inline styles.
+
+// skeletonAttributes are the attributes kept in the skeleton. Links, image sources,
+// alt texts and styles are left out: they vary per recipient or carry text.
+var skeletonAttributes = map[string]bool{
+	"class": true, "id": true, "role": true, "type": true,
+	"align": true, "valign": true, "width": true, "height": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "colspan": true, "rowspan": true,
+}
+
+var (
+	reHTMLComment  = regexp.MustCompile(`(?s)<!--.*?-->`)
+	reHTMLRawText  = regexp.MustCompile(`(?is)<(style|script)\b([^>]*)>.*?</(style|script)\s*>`)
+	reSkeletonTag  = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)\b((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+	reSkeletonAttr = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// htmlSkeleton returns the tag-and-attribute skeleton of an HTML document, e.g.
+// "<table class=main width=600>\n<tr>\n<td align=center>\n</td>\n</tr>\n</table>".
+// Kept attributes are sorted by name and lowercased; class lists are sorted too.
+func htmlSkeleton(htmlBody string) string {
+	htmlBody = reHTMLComment.ReplaceAllString(htmlBody, "")
+	htmlBody = reHTMLRawText.ReplaceAllString(htmlBody, "<$1$2></$1>")
+
+	var b strings.Builder
+	for _, m := range reSkeletonTag.FindAllStringSubmatch(htmlBody, -1) {
+		closing, name, attrs := m[1], strings.ToLower(m[2]), m[3]
+		b.WriteString("<" + closing + name)
+		if closing == "" {
+			var kept []string
+			for _, a := range reSkeletonAttr.FindAllStringSubmatch(attrs, -1) {
+				attr := strings.ToLower(a[1])
+				if !skeletonAttributes[attr] {
+					continue
+				}
+				value := strings.ToLower(strings.Trim(a[2], `"'`))
+				fields := strings.Fields(value)
+				if attr == "class" {
+					sort.Strings(fields)
+				}
+				kept = append(kept, attr+"="+strings.Join(fields, " "))
+			}
+			sort.Strings(kept)
+			for _, a := range kept {
+				b.WriteString(" " + a)
+			}
+		}
+		b.WriteString(">\n")
+	}
+	return b.String()
+}
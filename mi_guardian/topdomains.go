@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Top spam sender domains ---
+
+// Sender domains are too many for a Prometheus label. With TOP_DOMAINS_SIZE set, the
+// sender domains of spam verdicts are counted in memory instead, per TOP_DOMAINS_WINDOW,
+// and the top ones are served by /stats/top-domains. The tracker is bounded (Space-Saving
+// algorithm): it keeps topDomainsSlack times N counters, and a new domain arriving when
+// they are all taken replaces the least counted one, inheriting its count as error bound.
+
+const topDomainsSlack = 10
+
+// domainCount is a tracked domain; Count overestimates the true count by at most Error
+type domainCount struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+	Error  int64  `json:"max_error"`
+}
+
+// domainTracker is a bounded top-N counter over a tumbling window
+type domainTracker struct {
+	mu          sync.Mutex
+	capacity    int
+	window      time.Duration
+	windowStart time.Time
+	counts      map[string]*domainCount
+}
+
+func newDomainTracker(capacity int, window time.Duration, now time.Time) *domainTracker {
+	return &domainTracker{capacity: capacity, window: window, windowStart: now, counts: make(map[string]*domainCount)}
+}
+
+// rotate starts a new window when the current one is over
+func (t *domainTracker) rotate(now time.Time) {
+	if t.window > 0 && now.Sub(t.windowStart) >= t.window {
+		t.counts = make(map[string]*domainCount)
+		t.windowStart = now
+	}
+}
+
+// add counts one spam verdict for domain
+func (t *domainTracker) add(domain string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+
+	if c, ok := t.counts[domain]; ok {
+		c.Count++
+		return
+	}
+	if len(t.counts) < t.capacity {
+		t.counts[domain] = &domainCount{Domain: domain, Count: 1}
+		return
+	}
+	// Full: the least counted domain makes room (ties: alphabetical, to stay deterministic)
+	var victim *domainCount
+	for _, c := range t.counts {
+		if victim == nil || c.Count < victim.Count || (c.Count == victim.Count && c.Domain < victim.Domain) {
+			victim = c
+		}
+	}
+	delete(t.counts, victim.Domain)
+	t.counts[domain] = &domainCount{Domain: domain, Count: victim.Count + 1, Error: victim.Count}
+}
+
+// top returns the n most counted domains of the current window
+func (t *domainTracker) top(n int, now time.Time) ([]domainCount, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+
+	list := make([]domainCount, 0, len(t.counts))
+	for _, c := range t.counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Domain < list[j].Domain
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list, t.windowStart
+}
+
+var (
+	topDomainsMutex   sync.Mutex
+	topDomainsTracker *domainTracker // nil = disabled
+)
+
+// configureTopDomains applies TOP_DOMAINS_SIZE and TOP_DOMAINS_WINDOW. Counts are kept
+// across reloads unless the settings change.
+func configureTopDomains(size int64, window time.Duration) {
+	topDomainsMutex.Lock()
+	defer topDomainsMutex.Unlock()
+	atomic.StoreInt64(&topDomainsSize, size)
+	if size <= 0 {
+		topDomainsTracker = nil
+		return
+	}
+	capacity := int(size) * topDomainsSlack
+	if topDomainsTracker == nil || topDomainsTracker.capacity != capacity || topDomainsTracker.window != window {
+		topDomainsTracker = newDomainTracker(capacity, window, time.Now())
+	}
+}
+
+func currentTopDomainsTracker() *domainTracker {
+	topDomainsMutex.Lock()
+	defer topDomainsMutex.Unlock()
+	return topDomainsTracker
+}
+
+// recordSpamDomain counts the sender domain of a spam verdict, when tracking is enabled
+func recordSpamDomain(domain string) {
+	if domain == "" {
+		return
+	}
+	if t := currentTopDomainsTracker(); t != nil {
+		t.add(domain, time.Now())
+	}
+}
+
+// topDomainsHandler lists the top spam sender domains (GET /stats/top-domains?limit=N)
+func topDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	t := currentTopDomainsTracker()
+	if t == nil {
+		http.Error(w, "Top domains tracking disabled (TOP_DOMAINS_SIZE=0)", http.StatusNotFound)
+		return
+	}
+
+	limit := int(atomic.LoadInt64(&topDomainsSize))
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	domains, since := t.top(limit, time.Now())
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"window":       t.window.String(),
+		"window_start": since.Unix(),
+		"domains":      domains,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
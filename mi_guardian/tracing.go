@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- OpenTelemetry tracing ---
+
+// tracer creates Guardian's spans. Until initTracing installs a provider it is the
+// global no-op tracer, so instrumented code costs nothing when OTEL_ENABLED is off.
+var tracer = otel.Tracer("mailuminati-guardian")
+
+// initTracing installs an OTLP/HTTP trace exporter when OTEL_ENABLED is set. The exporter
+// is configured by the standard OTEL_EXPORTER_OTLP_* variables (endpoint, headers, ...)
+// and flushes spans in batches. It returns the installed provider, nil when disabled.
+func initTracing() (*sdktrace.TracerProvider, error) {
+	if !getEnvBool("OTEL_ENABLED", false) {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(
+		resource.NewSchemaless(
+			attribute.String("service.name", "mailuminati-guardian"),
+			attribute.String("service.version", EngineVersion),
+		),
+		resource.Environment(), // OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES win
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Println("[Mailuminati] OpenTelemetry tracing enabled")
+	return provider, nil
+}
+
+// shutdownTracingOnSignal flushes the spans still batched by provider when Guardian is
+// stopped (SIGTERM, SIGINT), then exits
+func shutdownTracingOnSignal(provider *sdktrace.TracerProvider) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[Mailuminati] Tracing shutdown failed: %v", err)
+		}
+		os.Exit(0)
+	}()
+}
+
+// startRequestSpan starts the server span of an HTTP request, continuing the caller's trace
+func startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	reqCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(reqCtx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// injectTraceContext propagates the current trace into an outgoing request's headers
+func injectTraceContext(reqCtx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(reqCtx, propagation.HeaderCarrier(req.Header))
+}
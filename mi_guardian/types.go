@@ -4,13 +4,18 @@ package main
 type SignatureType int
 
 const (
-	SigNormalized  SignatureType = iota // Normalized body - highest confidence
-	SigRaw                              // Raw body - medium confidence
-	SigURL                              // URL-based - high confidence for phishing
-	SigSubject                          // Subject-based - medium confidence
-	SigAttachment                       // Attachment - lower confidence
+	SigNormalized SignatureType = iota // Normalized body - highest confidence
+	SigRaw                             // Raw body - medium confidence
+	SigURL                             // URL-based - high confidence for phishing
+	SigSubject                         // Subject-based - medium confidence
+	SigAttachment                      // Attachment - lower confidence
+	SigCombined                        // Subject + body hashed together (optional)
+	SigStructure                       // HTML tag skeleton, no text (optional)
 )
 
+// SigUnknown marks a signature whose type wasn't recorded (scan data from older versions)
+const SigUnknown SignatureType = -1
+
 func (s SignatureType) String() string {
 	switch s {
 	case SigNormalized:
@@ -23,24 +28,90 @@ func (s SignatureType) String() string {
 		return "subject"
 	case SigAttachment:
 		return "attachment"
+	case SigCombined:
+		return "combined"
+	case SigStructure:
+		return "structure"
 	default:
 		return "unknown"
 	}
 }
 
+// allSignatureTypes lists every signature type, in hashing order
+var allSignatureTypes = []SignatureType{SigNormalized, SigRaw, SigURL, SigSubject, SigAttachment, SigCombined, SigStructure}
+
+// parseSignatureType is the inverse of SignatureType.String
+func parseSignatureType(name string) SignatureType {
+	for _, st := range allSignatureTypes {
+		if st.String() == name {
+			return st
+		}
+	}
+	return SigUnknown
+}
+
 // TypedSignature holds a signature with its type for threshold selection
 type TypedSignature struct {
-	Hash string
-	Type SignatureType
+	Hash      string
+	Type      SignatureType
+	CoversRaw bool // Normalized signature also standing for a redundant raw one
 }
 
 type AnalysisResult struct {
-	Action         string  `json:"action"`
-	Label          string  `json:"label,omitempty"`
-	ProximityMatch bool    `json:"proximity_match"`
-	Distance       int     `json:"distance,omitempty"`
-	Confidence     float64 `json:"confidence,omitempty"`
-	MatchType      string  `json:"match_type,omitempty"`
+	Action              string               `json:"action"`
+	Label               string               `json:"label,omitempty"`
+	ProximityMatch      bool                 `json:"proximity_match"`
+	Distance            int                  `json:"distance,omitempty"`
+	Confidence          float64              `json:"confidence,omitempty"`
+	Score               *int                 `json:"score,omitempty"` // Spamminess score, 0-100 (SPAMMINESS_SCORE)
+	MatchType           string               `json:"match_type,omitempty"`
+	Brand               string               `json:"brand,omitempty"`        // Targeted brand, when the oracle reports one
+	UserMessage         string               `json:"user_message,omitempty"` // End-user explanation (USER_MESSAGE_*)
+	LearnedAt           int64                `json:"learned_at,omitempty"`   // Local learning: first report of the matched hash
+	CampaignID          string               `json:"campaign_id,omitempty"`  // Local learning: campaign of the matched hash (compaction)
+	CachedAt            int64                `json:"cached_at,omitempty"`    // Oracle cache: when the verdict was cached
+	ReasonCode          ReasonCode           `json:"reason_code,omitempty"`
+	NearMiss            *NearMiss            `json:"near_miss,omitempty"`              // Closest learned hash that did not match (non-spam verdicts)
+	ConfidenceBreakdown *ConfidenceBreakdown `json:"confidence_breakdown,omitempty"`   // Sub-signals behind Confidence
+	SchemaVersion       string               `json:"verdict_schema_version,omitempty"` // Config the verdict was computed under
+}
+
+// NearMiss is the closest local candidate of a signature that stayed over its spam threshold
+type NearMiss struct {
+	Hash      string `json:"hash,omitempty"` // Omitted when RESPONSE_INCLUDE_HASHES is off
+	Distance  int    `json:"distance"`
+	Threshold int    `json:"threshold"`
+	MatchType string `json:"match_type"`
+}
+
+// scanOutcome is the complete result of analyzeEnvelope for one message
+type scanOutcome struct {
+	Result          AnalysisResult
+	Whitelisted     bool
+	WhitelistReason string
+	BlacklistReason string
+	Profile         thresholdProfile
+	Fingerprint     string // contentFingerprint of the normalized body
+	Signatures      []TypedSignature
+	Hashes          []string
+	Heuristics      []heuristicSignal
+	NearMisses      map[string]NearMiss // Signature hash -> its closest non-matching local candidate
+	AltPartDistance *int                // Text vs HTML alternative distance (ALTPART_MISMATCH_CHECK)
+	Date            *messageDate        // Date header check (DATE_ANOMALY_CHECK)
+	TypeVerdicts    []typeVerdict       // Verdict of each signature type looked up, in signature order
+	Failed          map[string]int      // Signatures that could not be computed, by type (nil if not scanned)
+}
+
+// withoutHashes returns the outcome with its signatures left out of the response
+// (RESPONSE_INCLUDE_HASHES=false): the computed hashes and the near miss's learned hash
+func (o scanOutcome) withoutHashes() scanOutcome {
+	o.Hashes = nil
+	if o.Result.NearMiss != nil {
+		nm := *o.Result.NearMiss
+		nm.Hash = ""
+		o.Result.NearMiss = &nm
+	}
+	return o
 }
 
 type SyncResponse struct {
@@ -55,6 +126,52 @@ type SyncOp struct {
 }
 
 type ScanResult struct {
-	Hashes    []string `json:"hashes"`
-	Timestamp int64    `json:"timestamp"`
+	Hashes     []string          `json:"hashes"`
+	Types      map[string]string `json:"types,omitempty"` // Signature type per hash
+	Timestamp  int64             `json:"timestamp"`
+	FromDomain string            `json:"from_domain,omitempty"`
+	FromEmail  string            `json:"from_email,omitempty"` // Sender address, for the whitelist check on report
+	// contentFingerprint of the normalized body, for bodies long enough to identify the content
+	Fingerprint   string `json:"fingerprint,omitempty"`
+	SchemaVersion string `json:"verdict_schema_version,omitempty"` // Config the hashes were computed under
+	// Normalized signature of the dominant forwarded block, learned in place of the whole-message one (FORWARDED_BLOCK_MIN_SIZE)
+	Forwarded string `json:"forwarded,omitempty"`
+}
+
+// senderWhitelisted checks the sender of a stored scan against the current whitelist
+func (s ScanResult) senderWhitelisted() (bool, string) {
+	from := s.FromEmail
+	if from == "" && s.FromDomain != "" {
+		from = "@" + s.FromDomain // Scans stored before the address was recorded
+	}
+	if from == "" {
+		return false, ""
+	}
+	return isWhitelisted(from)
+}
+
+// typedHashes returns the scanned hashes with their recorded type (SigUnknown if missing)
+func (s ScanResult) typedHashes() []TypedSignature {
+	sigs := make([]TypedSignature, 0, len(s.Hashes))
+	for _, h := range s.Hashes {
+		sigs = append(sigs, TypedSignature{Hash: h, Type: parseSignatureType(s.Types[h])})
+	}
+	return sigs
+}
+
+// inScope keeps only the hashes whose stored type is one of types. Hashes without
+// type information (scan results stored before types were recorded) are dropped.
+func (s ScanResult) inScope(types []SignatureType) ScanResult {
+	scoped := s
+	scoped.Hashes = nil
+	for _, h := range s.Hashes {
+		hashType := parseSignatureType(s.Types[h])
+		for _, t := range types {
+			if hashType == t {
+				scoped.Hashes = append(scoped.Hashes, h)
+				break
+			}
+		}
+	}
+	return scoped
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+)
+
+// --- End-user messages ---
+
+// spam and soft_spam verdicts can carry a user_message for the mail system to show its
+// users. Messages are configured per reason code and/or match type:
+//   - USER_MESSAGE_<REASON_CODE>_<MATCH_TYPE>, e.g. USER_MESSAGE_ORACLE_SPAM_URL
+//   - USER_MESSAGE_<REASON_CODE>, e.g. USER_MESSAGE_LOCAL_SOFT
+//   - USER_MESSAGE_<MATCH_TYPE>, e.g. USER_MESSAGE_ATTACHMENT
+//   - USER_MESSAGE_DEFAULT
+//
+// The most specific one applies. Templates may use {brand}, {label}, {reason_code},
+// {match_type} and {action}; a template using a placeholder the verdict has no value
+// for (typically {brand}) is skipped for the next, less specific one.
+
+var userMessagePlaceholders = []string{"brand", "label", "reason_code", "match_type", "action"}
+
+// userMessageReasonCodes lists the reason codes a message can be configured for
+func userMessageReasonCodes() []ReasonCode {
+	codes := []ReasonCode{ReasonOracleSpam, ReasonOracleSoft}
+	for _, code := range labelReasonCodes {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// loadUserMessages reads the configured templates, keyed by their USER_MESSAGE_ suffix
+func loadUserMessages() map[string]string {
+	keys := []string{"DEFAULT"}
+	for _, t := range allSignatureTypes {
+		keys = append(keys, strings.ToUpper(t.String()))
+	}
+	for _, code := range userMessageReasonCodes() {
+		keys = append(keys, string(code))
+		for _, t := range allSignatureTypes {
+			keys = append(keys, string(code)+"_"+strings.ToUpper(t.String()))
+		}
+	}
+
+	messages := make(map[string]string)
+	for _, key := range keys {
+		if tmpl := strings.TrimSpace(getEnv("USER_MESSAGE_"+key, "")); tmpl != "" {
+			messages[key] = tmpl
+		}
+	}
+	return messages
+}
+
+// renderUserMessage fills the placeholders of tmpl. It fails when a placeholder used by
+// the template has no value.
+func renderUserMessage(tmpl string, values map[string]string) (string, bool) {
+	var pairs []string
+	for _, name := range userMessagePlaceholders {
+		token := "{" + name + "}"
+		if !strings.Contains(tmpl, token) {
+			continue
+		}
+		if values[name] == "" {
+			return "", false
+		}
+		pairs = append(pairs, token, values[name])
+	}
+	if len(pairs) == 0 {
+		return tmpl, true
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl), true
+}
+
+// userMessageFor returns the end-user message of a verdict, or "" when none applies
+func userMessageFor(res AnalysisResult) string {
+	if res.Action != "spam" && res.Action != "soft_spam" {
+		return ""
+	}
+	messages, _ := userMessages.Load().(map[string]string)
+	if len(messages) == 0 {
+		return ""
+	}
+
+	code := string(res.ReasonCode)
+	matchType := strings.ToUpper(res.MatchType)
+	var candidates []string
+	if matchType != "" {
+		candidates = append(candidates, code+"_"+matchType)
+	}
+	candidates = append(candidates, code)
+	if matchType != "" {
+		candidates = append(candidates, matchType)
+	}
+	candidates = append(candidates, "DEFAULT")
+
+	values := map[string]string{
+		"brand":       res.Brand,
+		"label":       res.Label,
+		"reason_code": code,
+		"match_type":  res.MatchType,
+		"action":      res.Action,
+	}
+	for _, key := range candidates {
+		if tmpl, ok := messages[key]; ok {
+			if msg, ok := renderUserMessage(tmpl, values); ok {
+				return msg
+			}
+		}
+	}
+	return ""
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func loadConfigFile(path string) error {
@@ -78,3 +80,54 @@ func getEnv(k, f string) string {
 	}
 	return f
 }
+
+// getEnvInt64 reads an integer setting, falling back to f when unset or invalid
+func getEnvInt64(k string, f int64) int64 {
+	if v, err := strconv.ParseInt(getEnv(k, ""), 10, 64); err == nil {
+		return v
+	}
+	return f
+}
+
+// getEnvBool reads a boolean setting (1/true/yes/on), falling back to f when unset or invalid
+func getEnvBool(k string, f bool) bool {
+	switch strings.ToLower(getEnv(k, "")) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	}
+	return f
+}
+
+// getEnvDuration reads a Go duration setting ("500ms", "2s", "1h"), falling back to f when unset or invalid
+func getEnvDuration(k string, f time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getEnv(k, "")); err == nil && d >= 0 {
+		return d
+	}
+	return f
+}
+
+// getEnvList reads a comma-separated setting as a lowercased list, skipping empty entries
+func getEnvList(k string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(k, ""), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvSignatureTypes reads a comma-separated list of signature type names as a set
+func getEnvSignatureTypes(k string) map[SignatureType]bool {
+	types := make(map[SignatureType]bool)
+	for _, name := range getEnvList(k) {
+		if sigType := parseSignatureType(name); sigType != SigUnknown {
+			types[sigType] = true
+		} else {
+			log.Printf("[Mailuminati] Ignoring unknown signature type %q in %s", name, k)
+		}
+	}
+	return types
+}
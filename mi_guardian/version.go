@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Verdict schema version ---
+
+// The verdict schema version identifies the engine version and the configuration that
+// shapes the signatures themselves (normalization, signature types, TLSH options). It is
+// stamped into cached oracle verdicts and stored scan results: entries written under
+// another version are ignored, as their signatures may no longer be what the current
+// config computes. The version is derived from the config itself, so it changes whenever
+// that config does. Tuning that only changes how signatures are judged (thresholds,
+// quorums, soft deltas, minimum lengths, verdict combiner) is left out, so that it can be
+// adjusted without invalidating stored scans, nor the cache entries of nodes tuned otherwise.
+
+// verdictSchemaInputs lists what the version is computed from
+func verdictSchemaInputs() string {
+	ignoreLength := []string{}
+	for _, t := range allSignatureTypes {
+		if !getLengthInclusionForType(t) {
+			ignoreLength = append(ignoreLength, t.String())
+		}
+	}
+	steps := currentNormalizeSteps()
+	names := make([]string, 0, len(steps))
+	for _, s := range steps {
+		if s.Rule != "" {
+			names = append(names, s.Name+"="+s.Rule)
+		} else {
+			names = append(names, s.Name)
+		}
+	}
+	return strings.Join([]string{
+		"engine=" + EngineVersion,
+		"normalize=" + strings.Join(names, ","),
+		fmt.Sprintf("dequote=%t base64=%t/%d/%d emoji=%t charset_sniff=%t", dequoteForwards.Load(), base64Decode.Load(),
+			atomic.LoadInt64(&base64MinRun), atomic.LoadInt64(&base64MaxDecoded), emojiNormalize.Load(), charsetSniffing.Load()),
+		fmt.Sprintf("combined=%t structure=%t skip_raw_html=%t large_image_perceptual=%t", combinedSignature.Load(),
+			structureSignature.Load(), skipRawForHTML.Load(), largeImagePerceptual.Load()),
+		"tlsh_ignore_length=" + strings.Join(ignoreLength, ","),
+	}, ";")
+}
+
+// computeVerdictSchemaVersion hashes the inputs into a short, deterministic version
+func computeVerdictSchemaVersion() string {
+	sum := sha256.Sum256([]byte(verdictSchemaInputs()))
+	return hex.EncodeToString(sum[:6])
+}
+
+// currentVerdictSchemaVersion returns the version computed at the last config (re)load
+func currentVerdictSchemaVersion() string {
+	if v, ok := verdictSchemaVersion.Load().(string); ok {
+		return v
+	}
+	return computeVerdictSchemaVersion()
+}
+
+// cachedOracleVerdict reads a cached oracle verdict (exact or fingerprint cache). Entries
+// stamped with another schema version, or none, are reported as missing. They are left to
+// expire rather than deleted: nodes sharing the Redis may run another config.
+func cachedOracleVerdict(key string) (AnalysisResult, bool) {
+	var res AnalysisResult
+	cached, err := rdb.Get(ctx, key).Result()
+	if err != nil || json.Unmarshal([]byte(cached), &res) != nil {
+		return res, false
+	}
+	if res.SchemaVersion != currentVerdictSchemaVersion() {
+		return AnalysisResult{}, false
+	}
+	return res, true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Registered decoders for perceptual hashing
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Large image attachments ---
+
+// Images over MIN_VISUAL_SIZE are hashed with TLSH like any attachment, but a huge photo
+// or animated GIF gives a noisy TLSH that rarely matches and costs time. Images over
+// MAX_VISUAL_SIZE (0 = no cap) are skipped, or, with LARGE_IMAGE_PERCEPTUAL, hashed
+// with a perceptual hash of their (first frame) pixels instead: a re-encoded or
+// slightly edited copy of the same picture keeps a close perceptual hash.
+
+// PerceptualPrefix marks perceptual image signatures (64-bit difference hash, hex)
+const PerceptualPrefix = "P1:"
+
+// maxPerceptualPixels bounds the decoded size, against decompression bombs
+const maxPerceptualPixels = 50_000_000
+
+const (
+	VisualHashTLSH       = "tlsh"
+	VisualHashPerceptual = "perceptual"
+	VisualSkip           = "skip"
+)
+
+// visualHashMode decides how an image attachment of the given size is hashed
+func visualHashMode(size int) string {
+	maxSize := atomic.LoadInt64(&maxVisualSize)
+	if maxSize <= 0 || int64(size) <= maxSize {
+		return VisualHashTLSH
+	}
+	if largeImagePerceptual.Load() {
+		return VisualHashPerceptual
+	}
+	return VisualSkip
+}
+
+// perceptualHash computes a 64-bit difference hash (dHash) of an image: the picture is
+// scaled down to 9x8 grey levels, and each bit tells whether a pixel is brighter than
+// its right neighbor
+func perceptualHash(content []byte) (string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxPerceptualPixels {
+		return "", fmt.Errorf("image too large to decode (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	// Average grey level of each cell of a 9x8 grid
+	const w, h = 9, 8
+	b := img.Bounds()
+	var grey [h][w]float64
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var sum float64
+			var n int
+			// Sample at most 16x16 points per cell, enough for a 64-bit hash
+			stepY, stepX := max(1, (y1-y0)/16), max(1, (x1-x0)/16)
+			for py := y0; py < max(y1, y0+1); py += stepY {
+				for px := x0; px < max(x1, x0+1); px += stepX {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			grey[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grey[y][x] > grey[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return PerceptualPrefix + fmt.Sprintf("%016X", hash), nil
+}
+
+func parsePerceptualSignature(sig string) (uint64, bool) {
+	if !strings.HasPrefix(sig, PerceptualPrefix) {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(sig, PerceptualPrefix), 16, 64)
+	return v, err == nil
+}
+
+// isPerceptualSignature reports whether sig is a perceptual image signature
+func isPerceptualSignature(sig string) bool {
+	_, ok := parsePerceptualSignature(sig)
+	return ok
+}
+
+// perceptualDistancer compares perceptual signatures by Hamming distance, scaled from
+// 0-64 bits to the 0-300 TLSH range so the attachment threshold keeps its meaning
+// (45 = about 10 differing bits)
+type perceptualDistancer struct{}
+
+func (perceptualDistancer) Name() string { return "hamming" }
+
+func (perceptualDistancer) Distances(ref string, candidates []string) (map[string]int, error) {
+	refHash, ok := parsePerceptualSignature(ref)
+	if !ok {
+		return nil, errors.New("not a perceptual signature")
+	}
+	results := make(map[string]int)
+	for _, c := range candidates {
+		hash, ok := parsePerceptualSignature(c)
+		if !ok {
+			continue // Skip signatures of another metric
+		}
+		results[c] = int(math.Round(float64(bits.OnesCount64(refHash^hash)) * 300 / 64))
+	}
+	return results, nil
+}
+
+// perceptualBands splits a perceptual hash into 4 bands of 16 bits: two hashes at most
+// 3 bits apart always share a band, so one matching band is enough as a quorum
+func perceptualBands(hash uint64) []string {
+	bands := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		chunk := []byte{byte(hash >> (56 - 16*i)), byte(hash >> (48 - 16*i))}
+		bands = append(bands, "p:"+strconv.Itoa(i)+":"+strings.ToUpper(hex.EncodeToString(chunk)))
+	}
+	return bands
+}
@@ -18,6 +18,12 @@ func syncWorker() {
 }
 
 func doSync() {
+	if resetInProgress.Load() {
+		return // Resume from sequence 0 once the reset is done
+	}
+	if skipOracleCall("sync") {
+		return // Catch up after the maintenance window
+	}
 	currentSeq, _ := rdb.Get(ctx, MetaVer).Int()
 	payload, _ := json.Marshal(map[string]interface{}{
 		"node_id":     nodeID,
@@ -41,6 +47,11 @@ func doSync() {
 		return
 	}
 
+	applySyncResponse(syncData)
+}
+
+// applySyncResponse applies an oracle sync payload (delta or reset) to the local band index
+func applySyncResponse(syncData SyncResponse) error {
 	if syncData.Action == "UPDATE_DELTA" {
 		pipe := rdb.Pipeline()
 		for _, op := range syncData.Ops {
@@ -52,15 +63,15 @@ func doSync() {
 				}
 			}
 		}
-		pipe.Exec(ctx)
-		rdb.Set(ctx, MetaVer, syncData.NewSeq, 0)
-	} else if syncData.Action == "RESET_DB" {
-		iter := rdb.Scan(ctx, 0, FragKeyPrefix+"*", 0).Iterator()
-		for iter.Next(ctx) {
-			rdb.Del(ctx, iter.Val())
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
 		}
-		rdb.Set(ctx, MetaVer, 0, 0)
+		return rdb.Set(ctx, MetaVer, syncData.NewSeq, 0).Err()
+	} else if syncData.Action == "RESET_DB" {
+		// Throttled background job; its progress is exposed as metrics
+		startReset()
 	}
+	return nil
 }
 
 // Statistics reporting worker